@@ -1,21 +1,32 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	_ "github.com/lib/pq"
 
+	"proj1/internal/pkg/auth"
+	"proj1/internal/pkg/certs"
+	"proj1/internal/pkg/consensus"
+	"proj1/internal/pkg/replication"
+	"proj1/internal/pkg/resp"
+	"proj1/internal/pkg/ring"
 	"proj1/internal/pkg/saving"
 	"proj1/internal/pkg/server"
 	"proj1/internal/pkg/storage"
+	"proj1/internal/pkg/tracing"
 )
 
 const (
@@ -23,6 +34,52 @@ const (
 	envpath     = "STORAGE_FILE_PATH"
 	envpostgres = "POSTGRES"
 	envport     = "BASIC_SERVER_PORT"
+	envreplica  = "REPLICA_OF"
+	envbacklog  = "REPLICATION_BACKLOG"
+	envraft     = "RAFT_ADDR"
+	envnodeurl  = "RAFT_NODE_URL"
+	envraftdir  = "RAFT_DIR"
+	envboot     = "RAFT_BOOTSTRAP"
+	envjoin     = "RAFT_JOIN"
+	envring     = "RING_NODES"
+	envringurl  = "RING_NODE_URL"
+	envvnodes   = "RING_VNODES"
+	envredirect = "RING_REDIRECT"
+	envpubsub   = "PUBSUB_BUFFER"
+	envorigins  = "WS_ALLOWED_ORIGINS"
+	envwal      = "STORAGE_WAL_PATH"
+	envfsync    = "WAL_FSYNC"
+	envresp     = "RESP_SERVER_PORT"
+	envpersist  = "PERSISTENCE"
+	envbolt     = "BOLT_PATH"
+	envkeep     = "VERSIONS_KEEP"
+	envinterval = "SNAPSHOT_INTERVAL"
+	envflush    = "KEYS_FLUSH_INTERVAL"
+	envauth     = "AUTH_FILE"
+	envreload   = "AUTH_RELOAD_INTERVAL"
+	envnodekey  = "AUTH_NODE_KEY"
+	envcert     = "TLS_CERT_FILE"
+	envkey      = "TLS_KEY_FILE"
+	envclientca = "TLS_CLIENT_CA_FILE"
+	envclient   = "TLS_CLIENT_AUTH"
+	envca       = "TLS_CA_FILE"
+	envmaxmem   = "MAXMEMORY"
+	envmaxkeys  = "MAXKEYS"
+	envevict    = "MAXMEMORY_POLICY"
+	envsnapshot = "SNAPSHOT_FORMAT"
+	envcompress = "SNAPSHOT_COMPRESSION"
+	envtraces   = "OTEL_TRACES_EXPORTER"
+	envotlp     = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	envservice  = "OTEL_SERVICE_NAME"
+	envsampler  = "OTEL_TRACES_SAMPLER_ARG"
+
+	walCompactSize = 64 << 20
+)
+
+// Former names of envkeep and envinterval, still read when those are not set.
+const (
+	envpgkeep     = "POSTGRES_VERSIONS_KEEP"
+	envpginterval = "POSTGRES_VERSION_INTERVAL"
 )
 
 func main() {
@@ -36,26 +93,326 @@ func main() {
 		log.Fatal(err)
 	}
 
-	storageDB, err := saving.NewStorageDB(os.Getenv(envpostgres))
+	traceCfg := tracing.Config{Exporter: os.Getenv(envtraces), Endpoint: os.Getenv(envotlp), ServiceName: os.Getenv(envservice)}
+	if ratio := os.Getenv(envsampler); ratio != "" {
+		traceCfg.SampleRatio, err = strconv.ParseFloat(ratio, 64)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", envsampler, err)
+		}
+	}
+	shutdownTracing, err := tracing.Setup(traceCfg)
+	if err != nil {
+		log.Fatalf("Tracing error: %v", err)
+	}
+
+	retention := saving.DefaultRetention
+	if keep, name := getenv(envkeep, envpgkeep); keep != "" {
+		retention, err = strconv.Atoi(keep)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", name, err)
+		}
+	}
+
+	saveInterval := 10 * time.Minute
+	if interval, name := getenv(envinterval, envpginterval); interval != "" {
+		saveInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", name, err)
+		}
+	}
+
+	backend, err := saving.ParseBackend(os.Getenv(envpersist))
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", envpersist, err)
+	}
+
+	persist := saving.PersisterConfig{Backend: backend, Path: filePath, URL: os.Getenv(envpostgres), Retention: retention}
+	if backend == saving.BackendBolt {
+		if persist.Path = os.Getenv(envbolt); persist.Path == "" {
+			persist.Path = filePath + ".bolt"
+		}
+	}
+
+	persister, err := saving.OpenPersister(persist)
+	if err != nil {
+		log.Fatalf("Persistence error: %v", err)
+	}
+
+	defer persister.Close()
+	stor2.SetPersister(persister)
+
+	flushInterval := time.Second
+	if backend == saving.BackendPostgresKeys {
+		keyStore, err := saving.NewPGKeyStore(persist.URL)
+		if err != nil {
+			log.Fatalf("Persistence error: %v", err)
+		}
+
+		defer keyStore.Close()
+		stor2.SetKeyStore(keyStore)
+		if interval := os.Getenv(envflush); interval != "" {
+			flushInterval, err = time.ParseDuration(interval)
+			if err != nil {
+				log.Fatalf("Invalid %s: %v", envflush, err)
+			}
+		}
+	}
+
+	// With raft the log and its snapshots are the source of truth, the
+	// contents are rebuilt from them.
+	raftAddr := os.Getenv(envraft)
+	if raftAddr == "" {
+		openLocal(&stor2, filePath, backend == saving.BackendPostgresKeys)
+	}
+
+	evictPolicy, err := storage.ParseEvictionPolicy(os.Getenv(envevict))
 	if err != nil {
-		log.Fatalf("Ошибка подключения к базе данных: %v", err)
+		log.Fatalf("Invalid %s: %v", envevict, err)
+	}
+
+	eviction := storage.EvictionConfig{Policy: evictPolicy}
+	if maxmem := os.Getenv(envmaxmem); maxmem != "" {
+		eviction.MaxMemory, err = strconv.ParseInt(maxmem, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", envmaxmem, err)
+		}
+	}
+
+	if maxkeys := os.Getenv(envmaxkeys); maxkeys != "" {
+		eviction.MaxKeys, err = strconv.Atoi(maxkeys)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", envmaxkeys, err)
+		}
+	}
+
+	stor2.SetEviction(eviction)
+
+	// Snapshots stay JSON unless binary is asked for, so that older versions
+	// can still read them. PostgreSQL keeps versions as JSONB.
+	snapshotFormat := os.Getenv(envsnapshot)
+	if snapshotFormat == "" {
+		snapshotFormat = string(storage.SnapshotJSON)
+	}
+
+	snapshot := storage.SnapshotConfig{}
+	if snapshot.Format, err = storage.ParseSnapshotFormat(snapshotFormat); err != nil {
+		log.Fatalf("Invalid %s: %v", envsnapshot, err)
+	}
+
+	if backend == saving.BackendPostgres && snapshot.Format != storage.SnapshotJSON {
+		log.Fatalf("%s must be json with the postgres backend", envsnapshot)
+	}
+
+	if snapshot.Compression, err = saving.ParseCompression(os.Getenv(envcompress)); err != nil {
+		log.Fatalf("Invalid %s: %v", envcompress, err)
+	}
+
+	stor2.SetSnapshotConfig(snapshot)
+
+	serverPort, ok := os.LookupEnv(envport)
+	if !ok {
+		serverPort = "8090"
+	}
+
+	var node *consensus.Node
+	if raftAddr != "" {
+		if eviction.MaxKeys > 0 || eviction.MaxMemory > 0 {
+			log.Printf("%s and %s are ignored with raft", envmaxmem, envmaxkeys)
+		}
+
+		nodeURL := os.Getenv(envnodeurl)
+		if nodeURL == "" {
+			nodeURL = "http://localhost:" + serverPort
+		}
+
+		raftDir := os.Getenv(envraftdir)
+		if raftDir == "" {
+			raftDir = filePath + ".raft"
+		}
+
+		node, err = consensus.NewNode(consensus.Config{
+			ID:        nodeURL,
+			Addr:      raftAddr,
+			Dir:       raftDir,
+			Bootstrap: os.Getenv(envboot) == "true",
+		}, &stor2)
+		if err != nil {
+			log.Fatalf("Raft error: %v", err)
+		}
 	}
 
-	defer storageDB.Db.Close()
 	var wg sync.WaitGroup
 	closeChan := make(chan struct{})
-	wg.Add(1)
+	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		stor2.PeriodicClean(closeChan, 10*time.Minute, filePath)
+		stor2.PeriodicClean(closeChan, saveInterval)
 	}()
-	serverPort, ok := os.LookupEnv(envport)
+	go func() {
+		defer wg.Done()
+		stor2.PeriodicCompact(closeChan, time.Minute, walCompactSize)
+	}()
+	if backend == saving.BackendPostgresKeys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stor2.PeriodicFlushKeys(closeChan, flushInterval)
+		}()
+	}
+	respPort, ok := os.LookupEnv(envresp)
 	if !ok {
-		serverPort = "8090"
+		respPort = "6379"
 	}
 
-	stor2.LoadFromFile(filePath)
 	srv := server.New(":"+serverPort, &stor2)
+	srv.SetVersionStore(persister)
+	if db, ok := persister.(*saving.StorageDB); ok {
+		srv.Metrics().CounterFunc("postgres_version_save_failures_total", "Number of versions that could not be saved to PostgreSQL.", func() float64 {
+			return float64(db.Failures())
+		})
+	}
+	if n := os.Getenv(envpubsub); n != "" {
+		srv.PubSub().Buffer, err = strconv.Atoi(n)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", envpubsub, err)
+		}
+	}
+	if origins := os.Getenv(envorigins); origins != "" {
+		srv.SetAllowedOrigins(strings.Split(origins, ","))
+	}
+	respSrv := resp.New(":"+respPort, &stor2)
+
+	if authFile := os.Getenv(envauth); authFile != "" {
+		acl, err := auth.Load(authFile)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", envauth, err)
+		}
+
+		reload := 5 * time.Second
+		if interval := os.Getenv(envreload); interval != "" {
+			reload, err = time.ParseDuration(interval)
+			if err != nil {
+				log.Fatalf("Invalid %s: %v", envreload, err)
+			}
+		}
+
+		srv.SetACL(acl)
+		respSrv.SetACL(acl)
+		go acl.Watch(closeChan, reload)
+	}
+
+	// Followers, raft and ring nodes call each other through peer.
+	var peer http.RoundTripper = http.DefaultTransport
+	if certFile := os.Getenv(envcert); certFile != "" {
+		clientAuth, err := certs.ParseClientAuth(os.Getenv(envclient))
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", envclient, err)
+		}
+
+		reloader, err := certs.NewReloader(certs.Config{
+			CertFile:     certFile,
+			KeyFile:      os.Getenv(envkey),
+			ClientCAFile: os.Getenv(envclientca),
+			ClientAuth:   clientAuth,
+			CAFile:       cmp.Or(os.Getenv(envca), os.Getenv(envclientca)),
+		})
+		if err != nil {
+			log.Fatalf("TLS error: %v", err)
+		}
+
+		srv.SetTLS(reloader)
+		go reloader.Watch(closeChan, 10*time.Second)
+
+		// Other nodes may require a client certificate as well.
+		peer = reloader.Transport()
+	}
+
+	if key := os.Getenv(envnodekey); key != "" {
+		peer = &auth.Transport{Base: peer, Key: key}
+		srv.SetNodeKey(key)
+	}
+	peer = &tracing.Transport{Base: peer}
+	srv.SetPeerTransport(peer)
+
+	replicaCtx, stopReplica := context.WithCancel(context.Background())
+	defer stopReplica()
+	if node != nil {
+		node.Client.Transport = peer
+		srv.SetConsensus(node)
+		respSrv.SetReadOnly(!node.IsLeader())
+		go func() {
+			for {
+				select {
+				case isLeader := <-node.LeaderCh():
+					respSrv.SetReadOnly(!isLeader)
+				case <-replicaCtx.Done():
+					return
+				}
+			}
+		}()
+
+		if peer := os.Getenv(envjoin); peer != "" {
+			go func() {
+				if err := node.JoinCluster(replicaCtx, peer); err != nil {
+					log.Printf("Raft join error: %v", err)
+				}
+			}()
+		}
+	}
+
+	if nodes := os.Getenv(envring); nodes != "" {
+		if node != nil || os.Getenv(envreplica) != "" {
+			log.Fatalf("%s can not be used with %s or %s", envring, envraft, envreplica)
+		}
+
+		self := os.Getenv(envringurl)
+		if self == "" {
+			self = "http://localhost:" + serverPort
+		}
+
+		vnodes := ring.DefaultVNodes
+		if n := os.Getenv(envvnodes); n != "" {
+			vnodes, err = strconv.Atoi(n)
+			if err != nil {
+				log.Fatalf("Invalid %s: %v", envvnodes, err)
+			}
+		}
+
+		cluster, err := ring.NewCluster(self, strings.Split(nodes, ","), vnodes, &stor2)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", envring, err)
+		}
+
+		cluster.Client.Transport = peer
+		srv.SetRing(cluster, os.Getenv(envredirect) == "true")
+		go cluster.Run(replicaCtx)
+	}
+
+	if leader := os.Getenv(envreplica); leader != "" {
+		if node != nil {
+			log.Fatalf("%s can not be used with %s", envreplica, envraft)
+		}
+
+		follower, err := replication.NewFollower(leader, &stor2)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", envreplica, err)
+		}
+
+		follower.Client.Transport = peer
+		srv.SetReplicaOf(follower)
+		respSrv.SetReadOnly(true)
+		go follower.Run(replicaCtx)
+	} else {
+		backlog := storage.DefaultBacklog
+		if n := os.Getenv(envbacklog); n != "" {
+			backlog, err = strconv.Atoi(n)
+			if err != nil {
+				log.Fatalf("Invalid %s: %v", envbacklog, err)
+			}
+		}
+
+		stor2.EnableReplication(backlog)
+	}
 
 	go func() {
 		if err := srv.Start(); err != nil && err != http.ErrServerClosed {
@@ -63,20 +420,93 @@ func main() {
 		}
 	}()
 
+	go func() {
+		if err := respSrv.Start(); err != nil {
+			log.Fatalf("RESP server error: %s\n", err)
+		}
+	}()
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
 	<-quit
+	stopReplica()
 	close(closeChan)
 	wg.Wait()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	if err = respSrv.Shutdown(ctx); err != nil {
+		log.Printf("RESP shutdown error: %s\n", err)
+	}
+
 	err = srv.Shutdown(ctx)
 	if err != nil {
 		log.Fatalf("Shutdown error: %s\n", err)
 	}
 
+	if node != nil {
+		if err = node.Shutdown(); err != nil {
+			log.Printf("Raft shutdown error: %s\n", err)
+		}
+	}
+
+	// Flushed keys are dropped from the wal, so flush before closing it.
+	if backend == saving.BackendPostgresKeys {
+		if _, err = stor2.FlushKeys(); err != nil {
+			log.Printf("Keys flush error: %s\n", err)
+		}
+	}
+
+	if err = stor2.CloseWAL(); err != nil {
+		log.Printf("WAL close error: %s\n", err)
+	}
+
+	if err = shutdownTracing(ctx); err != nil {
+		log.Printf("Tracing shutdown error: %s\n", err)
+	}
+
 	fmt.Println("Server exited")
 
 }
+
+// openLocal loads the contents saved by this process and opens the wal.
+// With a key store the wal only holds the changes since the last flush.
+func openLocal(stor2 *storage.SliceStorage, filePath string, keys bool) {
+	if keys {
+		if err := stor2.LoadKeys(); err != nil {
+			log.Fatalf("Load error: %v", err)
+		}
+	} else if err := stor2.Load(); err != nil && !errors.Is(err, saving.ErrNoVersion) {
+		log.Printf("Load error: %v", err)
+	}
+
+	walPath := os.Getenv(envwal)
+	if walPath == "" {
+		walPath = filePath + ".wal"
+	}
+
+	policy, err := saving.ParseSyncPolicy(os.Getenv(envfsync))
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", envfsync, err)
+	}
+
+	if err = stor2.OpenWAL(walPath, policy); err != nil {
+		log.Fatalf("WAL open error: %v", err)
+	}
+}
+
+// getenv returns the variable name, or the deprecated one it replaced, with
+// the name the value was read from.
+func getenv(name, deprecated string) (string, string) {
+	if v := os.Getenv(name); v != "" {
+		return v, name
+	}
+
+	v := os.Getenv(deprecated)
+	if v != "" {
+		log.Printf("%s is deprecated, use %s", deprecated, name)
+		return v, deprecated
+	}
+	return "", name
+}
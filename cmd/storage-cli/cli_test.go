@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"proj1/internal/pkg/server"
+	"proj1/internal/pkg/storage"
+	"proj1/pkg/client"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestCLI(t *testing.T) (*cli, *bytes.Buffer) {
+	gin.SetMode(gin.TestMode)
+	st, _ := storage.NewSliceStorage("slice_storage.json")
+	ts := httptest.NewServer(server.New("", &st).Handler())
+	t.Cleanup(ts.Close)
+
+	c, err := client.New(ts.URL, client.WithRetries(0))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	out := &bytes.Buffer{}
+	return &cli{client: c, out: out, format: formatText}, out
+}
+
+func TestSplitArgs(t *testing.T) {
+	cases := map[string][]string{
+		`set k v`:                 {"set", "k", "v"},
+		`  set  "a b"  'c "d"' `:  {"set", "a b", `c "d"`},
+		`hset m f\ 1 ""`:          {"hset", "m", "f 1", ""},
+		`tx '{"ops": []}'`:        {"tx", `{"ops": []}`},
+		`publish ch "say \"hi\""`: {"publish", "ch", `say "hi"`},
+	}
+	for line, want := range cases {
+		if got, err := splitArgs(line); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %q %v", line, got, err)
+		}
+	}
+
+	if _, err := splitArgs(`get "k`); err == nil {
+		t.Error("unterminated quote accepted")
+	}
+}
+
+func TestCommands(t *testing.T) {
+	c, out := newTestCLI(t)
+	ctx := context.Background()
+
+	run := func(line string) string {
+		t.Helper()
+		out.Reset()
+		args, _ := splitArgs(line)
+		if err := c.exec(ctx, args); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		return out.String()
+	}
+
+	if got := run(`set greeting "hello world"`); got != "OK\n" {
+		t.Errorf("set: %q", got)
+	}
+	if got := run("get greeting"); got != "hello world\n" {
+		t.Errorf("get: %q", got)
+	}
+	run("set n 41")
+	if got := run("incr n"); got != "42\n" {
+		t.Errorf("incr: %q", got)
+	}
+	run("rpush list a b c")
+	if got := run("lpop list 2"); got != "1) a\n2) b\n" {
+		t.Errorf("lpop: %q", got)
+	}
+	run("zadd board 1 a 5 b")
+	if got := run("zrangebyscore board -inf +inf"); !strings.Contains(got, `{"member":"b","score":5}`) {
+		t.Errorf("zrangebyscore: %q", got)
+	}
+
+	run("output table")
+	got := run("zrange board")
+	if lines := strings.Split(strings.TrimSpace(got), "\n"); len(lines) != 3 ||
+		strings.Fields(lines[0])[0] != "MEMBER" || strings.Fields(lines[2])[0] != "b" {
+		t.Errorf("table: %q", got)
+	}
+
+	run("output json")
+	if got := run("hset m f v"); got != "1\n" {
+		t.Errorf("hset json: %q", got)
+	}
+	if got := run("hget m f"); got != "{\n  \"value\": \"v\"\n}\n" {
+		t.Errorf("hget json: %q", got)
+	}
+
+	for line, want := range map[string]string{
+		"get":          "wrong number of arguments",
+		"nosuchthing":  "unknown command",
+		"hset m f":     "wrong number of arguments",
+		"get missing":  "404",
+		"output yaml":  "unknown output format",
+		"raw GET path": "path must start with /",
+	} {
+		args, _ := splitArgs(line)
+		if err := c.exec(ctx, args); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: %v", line, err)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	c, out := newTestCLI(t)
+	errOut := &bytes.Buffer{}
+
+	script := `# fill a queue
+rpush jobs one two
+get missing
+
+lget jobs -1
+quit
+get never
+`
+	if failed := c.script(strings.NewReader(script), errOut); failed != 1 {
+		t.Errorf("%d failures: %s", failed, errOut)
+	}
+	if out.String() != "OK\ntwo\n" {
+		t.Errorf("output: %q", out.String())
+	}
+	if !strings.HasPrefix(errOut.String(), "(error) line 3: ") {
+		t.Errorf("error output: %q", errOut.String())
+	}
+}
+
+func TestComplete(t *testing.T) {
+	if got := complete("zrang"); !reflect.DeepEqual(got, []string{"zrange", "zrangebyscore"}) {
+		t.Errorf("command: %v", got)
+	}
+	if got := complete("output t"); !reflect.DeepEqual(got, []string{"output text", "output table"}) {
+		t.Errorf("output: %v", got)
+	}
+	if got := complete("help xg"); !reflect.DeepEqual(got, []string{"help xgroup", "help xgroups"}) {
+		t.Errorf("help: %v", got)
+	}
+	if got := complete("get k"); got != nil {
+		t.Errorf("arguments: %v", got)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// request is a call of the API built from the arguments of a command.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   any
+}
+
+// command maps a command line onto a route of the server. Commands are
+// named after the last element of their route, e.g. lpush for
+// /slice/lpush/:key.
+type command struct {
+	name  string
+	args  string
+	help  string
+	min   int
+	max   int // -1 for any number
+	build func(args []string) (request, error)
+}
+
+var errUsage = errors.New("wrong number of arguments")
+
+func escape(segments []string) string {
+	var b strings.Builder
+	for _, s := range segments {
+		b.WriteByte('/')
+		b.WriteString(url.PathEscape(s))
+	}
+
+	return b.String()
+}
+
+// segments passes every argument as a path parameter of route.
+func segments(method, route string) func([]string) (request, error) {
+	return func(args []string) (request, error) {
+		return request{method: method, path: route + escape(args)}, nil
+	}
+}
+
+// list passes the first n arguments as path parameters and the others as
+// a JSON array.
+func list(route string, n int) func([]string) (request, error) {
+	return func(args []string) (request, error) {
+		return request{method: http.MethodPost, path: route + escape(args[:n]), body: args[n:]}, nil
+	}
+}
+
+// keys passes the first n arguments as path parameters and the others as
+// key query parameters.
+func keys(method, route string, n int) func([]string) (request, error) {
+	return func(args []string) (request, error) {
+		return request{method: method, path: route + escape(args[:n]), query: url.Values{"key": args[n:]}}, nil
+	}
+}
+
+// optional passes the first n arguments as path parameters and the others
+// as the query parameters named by params, as far as they are given.
+func optional(method, route string, n int, params ...string) func([]string) (request, error) {
+	return func(args []string) (request, error) {
+		query := url.Values{}
+		for i, v := range args[n:] {
+			query.Set(params[i], v)
+		}
+		return request{method: method, path: route + escape(args[:n]), query: query}, nil
+	}
+}
+
+// blocking takes the keys and a trailing timeout in seconds.
+func blocking(route string) func([]string) (request, error) {
+	return func(args []string) (request, error) {
+		last := len(args) - 1
+		if _, err := strconv.ParseFloat(args[last], 64); err != nil {
+			return request{}, errors.New("timeout must be a number of seconds")
+		}
+		return request{method: http.MethodGet, path: route + escape(args[:1]),
+			query: url.Values{"key": args[1:last], "timeout": {args[last]}}}, nil
+	}
+}
+
+// scalarValue quotes strings, which the server tells from integers by the
+// quotes.
+func scalarValue(v string) string {
+	if _, err := strconv.Atoi(v); err == nil {
+		return v
+	}
+
+	return `"` + v + `"`
+}
+
+func pairs(args []string) (map[string]string, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, errors.New("fields and values must come in pairs")
+	}
+
+	res := make(map[string]string, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		res[args[i]] = args[i+1]
+	}
+	return res, nil
+}
+
+var commands = []command{
+	{name: "set", args: "key value [ttl-seconds]", help: "Set a scalar; integers are stored as numbers.", min: 2, max: 3,
+		build: func(args []string) (request, error) {
+			req := request{method: http.MethodPost, path: "/scalar/set" + escape([]string{args[0], scalarValue(args[1])})}
+			if len(args) == 3 {
+				req.query = url.Values{"exp": {args[2]}}
+			}
+			return req, nil
+		}},
+	{name: "get", args: "key", help: "Get a scalar.", min: 1, max: 1, build: segments(http.MethodGet, "/scalar/get")},
+	{name: "incr", args: "key", help: "Increment an integer by one.", min: 1, max: 1, build: segments(http.MethodPost, "/scalar/incr")},
+	{name: "decr", args: "key", help: "Decrement an integer by one.", min: 1, max: 1, build: segments(http.MethodPost, "/scalar/decr")},
+	{name: "incrby", args: "key delta", help: "Add to an integer.", min: 2, max: 2, build: segments(http.MethodPost, "/scalar/incrby")},
+	{name: "incrbyfloat", args: "key delta", help: "Add to a float.", min: 2, max: 2, build: segments(http.MethodPost, "/scalar/incrbyfloat")},
+
+	{name: "hset", args: "key field value [field value ...]", help: "Replace a map.", min: 3, max: -1,
+		build: func(args []string) (request, error) {
+			fields, err := pairs(args[1:])
+			if err != nil {
+				return request{}, err
+			}
+			return request{method: http.MethodPost, path: "/map/hset" + escape(args[:1]), body: []map[string]string{fields}}, nil
+		}},
+	{name: "hget", args: "key field", help: "Get a field of a map.", min: 2, max: 2, build: segments(http.MethodGet, "/map/hget")},
+	{name: "hincrby", args: "key field delta", help: "Add to an integer field.", min: 3, max: 3, build: segments(http.MethodPost, "/map/hincrby")},
+	{name: "hincrbyfloat", args: "key field delta", help: "Add to a float field.", min: 3, max: 3, build: segments(http.MethodPost, "/map/hincrbyfloat")},
+
+	{name: "lpush", args: "key elem [elem ...]", help: "Prepend to a list.", min: 2, max: -1, build: list("/slice/lpush", 1)},
+	{name: "rpush", args: "key elem [elem ...]", help: "Append to a list.", min: 2, max: -1, build: list("/slice/rpush", 1)},
+	{name: "raddtoset", args: "key elem [elem ...]", help: "Append elements the list does not contain yet.", min: 2, max: -1, build: list("/slice/raddtoset", 1)},
+	{name: "lset", args: "key index elem", help: "Replace a list element.", min: 3, max: 3, build: segments(http.MethodPost, "/slice/slice/lset")},
+	{name: "lget", args: "key index", help: "Get a list element; negative indexes count from the tail.", min: 2, max: 2, build: segments(http.MethodGet, "/slice/slice/lget")},
+	{name: "lpop", args: "key count | key start end", help: "Pop from the head of a list.", min: 2, max: 3, build: optional(http.MethodGet, "/slice/lpop", 1, "start", "end")},
+	{name: "rpop", args: "key count | key start end", help: "Pop from the tail of a list.", min: 2, max: 3, build: optional(http.MethodGet, "/slice/rpop", 1, "start", "end")},
+	{name: "blpop", args: "key [key ...] timeout", help: "Pop from the head of the first non-empty list, waiting up to timeout seconds (0 forever).", min: 2, max: -1, build: blocking("/slice/blpop")},
+	{name: "brpop", args: "key [key ...] timeout", help: "Pop from the tail of the first non-empty list, waiting up to timeout seconds (0 forever).", min: 2, max: -1, build: blocking("/slice/brpop")},
+	{name: "lmove", args: "src dst [from [to]]", help: "Move an element between lists; from and to are left or right.", min: 2, max: 4, build: optional(http.MethodPost, "/slice/lmove", 2, "from", "to")},
+	{name: "blmove", args: "src dst from to timeout", help: "Like lmove, waiting up to timeout seconds for an element.", min: 5, max: 5, build: optional(http.MethodPost, "/slice/blmove", 2, "from", "to", "timeout")},
+
+	{name: "sadd", args: "key member [member ...]", help: "Add members to a set.", min: 2, max: -1, build: list("/set/sadd", 1)},
+	{name: "srem", args: "key member [member ...]", help: "Remove members from a set.", min: 2, max: -1, build: list("/set/srem", 1)},
+	{name: "spop", args: "key [count]", help: "Remove and return random members.", min: 1, max: 2, build: optional(http.MethodPost, "/set/spop", 1, "count")},
+	{name: "srandmember", args: "key [count]", help: "Return random members.", min: 1, max: 2, build: optional(http.MethodGet, "/set/srandmember", 1, "count")},
+	{name: "sismember", args: "key member", help: "Check whether a set contains a member.", min: 2, max: 2, build: segments(http.MethodGet, "/set/sismember")},
+	{name: "scard", args: "key", help: "Count the members of a set.", min: 1, max: 1, build: segments(http.MethodGet, "/set/scard")},
+	{name: "smembers", args: "key", help: "List the members of a set.", min: 1, max: 1, build: segments(http.MethodGet, "/set/smembers")},
+	{name: "sinter", args: "key [key ...]", help: "Intersect sets.", min: 1, max: -1, build: keys(http.MethodGet, "/set/sinter", 0)},
+	{name: "sunion", args: "key [key ...]", help: "Unite sets.", min: 1, max: -1, build: keys(http.MethodGet, "/set/sunion", 0)},
+	{name: "sdiff", args: "key [key ...]", help: "Subtract the other sets from the first.", min: 1, max: -1, build: keys(http.MethodGet, "/set/sdiff", 0)},
+	{name: "sinterstore", args: "dest key [key ...]", help: "Store the intersection of sets.", min: 2, max: -1, build: keys(http.MethodPost, "/set/sinterstore", 1)},
+	{name: "sunionstore", args: "dest key [key ...]", help: "Store the union of sets.", min: 2, max: -1, build: keys(http.MethodPost, "/set/sunionstore", 1)},
+	{name: "sdiffstore", args: "dest key [key ...]", help: "Store the difference of sets.", min: 2, max: -1, build: keys(http.MethodPost, "/set/sdiffstore", 1)},
+
+	{name: "zadd", args: "key score member [score member ...]", help: "Add members to a sorted set.", min: 3, max: -1,
+		build: func(args []string) (request, error) {
+			if len(args)%2 != 1 {
+				return request{}, errors.New("scores and members must come in pairs")
+			}
+			var members []map[string]any
+			for i := 1; i < len(args); i += 2 {
+				score, err := strconv.ParseFloat(args[i], 64)
+				if err != nil {
+					return request{}, fmt.Errorf("invalid score %q", args[i])
+				}
+				members = append(members, map[string]any{"member": args[i+1], "score": score})
+			}
+			return request{method: http.MethodPost, path: "/zset/zadd" + escape(args[:1]), body: members}, nil
+		}},
+	{name: "zincrby", args: "key member delta", help: "Add to the score of a member.", min: 3, max: 3, build: segments(http.MethodPost, "/zset/zincrby")},
+	{name: "zrem", args: "key member [member ...]", help: "Remove members from a sorted set.", min: 2, max: -1, build: list("/zset/zrem", 1)},
+	{name: "zremrangebyscore", args: "key min max", help: "Remove members by score; bounds take -inf, +inf and a leading (.", min: 3, max: 3, build: optional(http.MethodPost, "/zset/zremrangebyscore", 1, "min", "max")},
+	{name: "zscore", args: "key member", help: "Get the score of a member.", min: 2, max: 2, build: segments(http.MethodGet, "/zset/zscore")},
+	{name: "zcard", args: "key", help: "Count the members of a sorted set.", min: 1, max: 1, build: segments(http.MethodGet, "/zset/zcard")},
+	{name: "zrank", args: "key member", help: "Get the rank of a member, lowest score first.", min: 2, max: 2, build: segments(http.MethodGet, "/zset/zrank")},
+	{name: "zrevrank", args: "key member", help: "Get the rank of a member, highest score first.", min: 2, max: 2, build: segments(http.MethodGet, "/zset/zrevrank")},
+	{name: "zrange", args: "key [start [stop]]", help: "List members by rank.", min: 1, max: 3, build: optional(http.MethodGet, "/zset/zrange", 1, "start", "stop")},
+	{name: "zrangebyscore", args: "key [min [max [offset [count]]]]", help: "List members by score.", min: 1, max: 5, build: optional(http.MethodGet, "/zset/zrangebyscore", 1, "min", "max", "offset", "count")},
+
+	{name: "xadd", args: "key id field value [field value ...]", help: "Append an entry to a stream; id * generates one.", min: 4, max: -1,
+		build: func(args []string) (request, error) {
+			fields, err := pairs(args[2:])
+			if err != nil {
+				return request{}, err
+			}
+			return request{method: http.MethodPost, path: "/stream/xadd" + escape(args[:1]), query: url.Values{"id": {args[1]}}, body: fields}, nil
+		}},
+	{name: "xlen", args: "key", help: "Count the entries of a stream.", min: 1, max: 1, build: segments(http.MethodGet, "/stream/xlen")},
+	{name: "xrange", args: "key [start [end [count]]]", help: "List entries by id; - and + are the smallest and greatest id.", min: 1, max: 4, build: optional(http.MethodGet, "/stream/xrange", 1, "start", "end", "count")},
+	{name: "xrevrange", args: "key [end [start [count]]]", help: "List entries by id, newest first.", min: 1, max: 4, build: optional(http.MethodGet, "/stream/xrevrange", 1, "end", "start", "count")},
+	{name: "xtrim", args: "key maxlen|minid|maxage value", help: "Remove the oldest entries of a stream.", min: 3, max: 3,
+		build: func(args []string) (request, error) {
+			switch args[1] {
+			case "maxlen", "minid", "maxage":
+			default:
+				return request{}, errors.New("trim by maxlen, minid or maxage")
+			}
+			return request{method: http.MethodPost, path: "/stream/xtrim" + escape(args[:1]), query: url.Values{args[1]: {args[2]}}}, nil
+		}},
+	{name: "xgroup", args: "key group [start]", help: "Create a consumer group, and the stream if needed; start is $ (default), 0 or an id.", min: 2, max: 3,
+		build: func(args []string) (request, error) {
+			query := url.Values{"mkstream": {"true"}}
+			if len(args) == 3 {
+				query.Set("start", args[2])
+			}
+			return request{method: http.MethodPost, path: "/stream/xgroup" + escape(args[:2]), query: query}, nil
+		}},
+	{name: "xgroups", args: "key", help: "List the consumer groups of a stream.", min: 1, max: 1, build: segments(http.MethodGet, "/stream/xgroups")},
+	{name: "xreadgroup", args: "key group consumer [count]", help: "Deliver new entries to a consumer.", min: 3, max: 4, build: optional(http.MethodPost, "/stream/xreadgroup", 3, "count")},
+	{name: "xack", args: "key group id [id ...]", help: "Acknowledge delivered entries.", min: 3, max: -1, build: list("/stream/xack", 2)},
+	{name: "xautoclaim", args: "key group consumer min-idle-ms [count]", help: "Take over entries pending for at least min-idle-ms.", min: 4, max: 5, build: optional(http.MethodPost, "/stream/xautoclaim", 3, "min_idle", "count")},
+	{name: "xpending", args: "key group [consumer]", help: "List pending entries.", min: 2, max: 3, build: optional(http.MethodGet, "/stream/xpending", 2, "consumer")},
+
+	{name: "expire", args: "key seconds", help: "Make a key expire.", min: 2, max: 2, build: segments(http.MethodPost, "/any/expire")},
+	{name: "keys", args: "pattern", help: "List keys matching a regular expression.", min: 1, max: 1, build: segments(http.MethodGet, "/keys")},
+	{name: "watch", args: "key [key ...]", help: "Get the versions of keys for a transaction.", min: 1, max: -1, build: keys(http.MethodGet, "/tx/watch", 0)},
+	{name: "tx", args: "json", help: `Run a transaction, e.g. tx '{"ops": [{"op": "incrby", "key": "n", "args": ["1"]}]}'.`, min: 1, max: 1,
+		build: func(args []string) (request, error) {
+			if !json.Valid([]byte(args[0])) {
+				return request{}, errors.New("transaction is not valid json")
+			}
+			return request{method: http.MethodPost, path: "/tx", body: json.RawMessage(args[0])}, nil
+		}},
+	{name: "publish", args: "channel data", help: "Publish a message on a channel.", min: 2, max: 2,
+		build: func(args []string) (request, error) {
+			return request{method: http.MethodPost, path: "/pubsub/publish" + escape(args[:1]), body: map[string]string{"data": args[1]}}, nil
+		}},
+
+	{name: "health", help: "Check that the server is up.", build: segments(http.MethodGet, "/health")},
+	{name: "versions", help: "List saved versions.", build: segments(http.MethodGet, "/admin/versions")},
+	{name: "save-version", help: "Save a version of the storage.", build: segments(http.MethodPost, "/admin/versions")},
+	{name: "restore", args: "version", help: "Restore a saved version.", min: 1, max: 1, build: segments(http.MethodPost, "/admin/restore")},
+	{name: "eviction", help: "Show memory usage and eviction statistics.", build: segments(http.MethodGet, "/admin/eviction")},
+	{name: "bgsave", help: "Save the storage file in the background.", build: segments(http.MethodPost, "/admin/bgsave")},
+	{name: "snapshot", help: "Show statistics of the storage file saves.", build: segments(http.MethodGet, "/admin/snapshot")},
+	{name: "replication", help: "Show the replication status.", build: segments(http.MethodGet, "/replication/status")},
+	{name: "cluster", help: "Show the raft cluster status.", build: segments(http.MethodGet, "/cluster/status")},
+	{name: "ring", help: "Show the sharded cluster topology.", build: segments(http.MethodGet, "/ring")},
+	{name: "raw", args: "method path [json]", help: "Call any route, e.g. raw GET /zset/zrange/board?rev=true.", min: 2, max: 3,
+		build: func(args []string) (request, error) {
+			u, err := url.Parse(args[1])
+			if err != nil || !strings.HasPrefix(u.Path, "/") {
+				return request{}, errors.New("path must start with /")
+			}
+			req := request{method: strings.ToUpper(args[0]), path: u.EscapedPath(), query: u.Query()}
+			if len(args) == 3 {
+				if !json.Valid([]byte(args[2])) {
+					return request{}, errors.New("body is not valid json")
+				}
+				req.body = json.RawMessage(args[2])
+			}
+			return req, nil
+		}},
+}
+
+var byName = func() map[string]*command {
+	res := make(map[string]*command, len(commands))
+	for i := range commands {
+		res[commands[i].name] = &commands[i]
+	}
+	return res
+}()
+
+// Commands of the cli itself rather than of the server.
+var local = []string{"help", "output", "quit", "exit"}
+
+func commandNames() []string {
+	res := slices.Clone(local)
+	for _, c := range commands {
+		res = append(res, c.name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (c *command) usage() string {
+	if c.args == "" {
+		return c.name
+	}
+
+	return c.name + " " + c.args
+}
+
+func (c *command) request(args []string) (request, error) {
+	if len(args) < c.min || c.max >= 0 && len(args) > c.max {
+		return request{}, fmt.Errorf("%w, usage: %s", errUsage, c.usage())
+	}
+
+	return c.build(args)
+}
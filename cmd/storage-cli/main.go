@@ -0,0 +1,377 @@
+// Command storage-cli calls the storage server from the shell: one command
+// from its arguments, a script from a file or stdin, or an interactive
+// session with history and completion.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterh/liner"
+
+	"proj1/pkg/client"
+)
+
+const (
+	defaultAddr = "http://localhost:8090"
+	envaddr     = "STORAGE_ADDR"
+	envkey      = "STORAGE_API_KEY"
+	historyFile = ".storage_cli_history"
+)
+
+var errQuit = errors.New("quit")
+
+type cli struct {
+	client  *client.Client
+	out     io.Writer
+	format  format
+	timeout time.Duration
+}
+
+func main() {
+	addr := os.Getenv(envaddr)
+	if addr == "" {
+		addr = defaultAddr
+	}
+
+	home, _ := os.UserHomeDir()
+	flag.StringVar(&addr, "addr", addr, "server url, also taken from "+envaddr)
+	apiKey := flag.String("api-key", os.Getenv(envkey), "api key of the server, also taken from "+envkey)
+	output := flag.String("o", string(formatText), "output format: text, json or table")
+	file := flag.String("f", "", "read commands from a file, - for stdin")
+	history := flag.String("history", filepath.Join(home, historyFile), "history file of interactive sessions, empty to disable")
+	timeout := flag.Duration("timeout", 0, "timeout of every request, 0 for none")
+	caFile := flag.String("cacert", "", "PEM file of the CAs to verify an https server with")
+	certFile := flag.String("cert", "", "PEM file of a client certificate")
+	keyFile := flag.String("key", "", "PEM file of the key of -cert")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command [args...]]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Without a command, commands are read from -f, stdin or an interactive prompt.")
+		fmt.Fprintln(flag.CommandLine.Output(), "Run \"help\" for the list of commands.")
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	f, err := parseFormat(*output)
+	if err != nil {
+		fatal(err)
+	}
+
+	opts := []client.Option{client.WithAPIKey(*apiKey)}
+	if *caFile != "" || *certFile != "" {
+		conf, err := tlsConfig(*caFile, *certFile, *keyFile)
+		if err != nil {
+			fatal(err)
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = conf
+		opts = append(opts, client.WithHTTPClient(&http.Client{Transport: transport}))
+	}
+
+	c, err := client.New(addr, opts...)
+	if err != nil {
+		fatal(err)
+	}
+
+	cl := &cli{client: c, out: os.Stdout, format: f, timeout: *timeout}
+	switch {
+	case flag.NArg() > 0:
+		if err = cl.exec(context.Background(), flag.Args()); err != nil && err != errQuit {
+			fatal(err)
+		}
+	case *file != "" && *file != "-":
+		in, err := os.Open(*file)
+		if err != nil {
+			fatal(err)
+		}
+		defer in.Close()
+		if cl.script(in, os.Stderr) > 0 {
+			os.Exit(1)
+		}
+	case *file == "-" || !interactive():
+		if cl.script(os.Stdin, os.Stderr) > 0 {
+			os.Exit(1)
+		}
+	default:
+		cl.repl(addr, *history)
+	}
+}
+
+func tlsConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	conf := &tls.Config{}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", caFile)
+		}
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return conf, nil
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "(error)", err)
+	os.Exit(1)
+}
+
+func interactive() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// exec runs a command given as its words.
+func (c *cli) exec(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	name, args := strings.ToLower(args[0]), args[1:]
+	switch name {
+	case "quit", "exit":
+		return errQuit
+	case "help":
+		return c.help(args)
+	case "output":
+		if len(args) != 1 {
+			_, err := fmt.Fprintln(c.out, c.format)
+			return err
+		}
+		f, err := parseFormat(args[0])
+		if err == nil {
+			c.format = f
+		}
+		return err
+	}
+
+	cmd, ok := byName[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q, see help", name)
+	}
+
+	req, err := cmd.request(args)
+	if err != nil {
+		return err
+	}
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var res any
+	if err = c.client.Do(ctx, req.method, req.path, req.query, req.body, &res); err != nil {
+		return err
+	}
+
+	return write(c.out, c.format, res)
+}
+
+func (c *cli) help(args []string) error {
+	if len(args) > 0 {
+		cmd, ok := byName[strings.ToLower(args[0])]
+		if !ok {
+			return fmt.Errorf("unknown command %q", args[0])
+		}
+		_, err := fmt.Fprintf(c.out, "%s\n  %s\n", cmd.usage(), cmd.help)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "%s\t%s\n", cmd.usage(), cmd.help)
+	}
+	fmt.Fprintln(tw, "output [text|json|table]\tShow or change the output format.")
+	fmt.Fprintln(tw, "help [command]\tShow this list or the usage of a command.")
+	fmt.Fprintln(tw, "quit\tLeave the session.")
+	return tw.Flush()
+}
+
+// script runs a command per line of r; empty lines and lines starting with
+// # are skipped. Errors are reported to errOut and counted.
+func (c *cli) script(r io.Reader, errOut io.Writer) int {
+	var failed int
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		args, err := splitArgs(line)
+		if err == nil {
+			err = c.exec(context.Background(), args)
+		}
+		if err == errQuit {
+			break
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintf(errOut, "(error) line %d: %v\n", n, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		failed++
+		fmt.Fprintln(errOut, "(error)", err)
+	}
+	return failed
+}
+
+func (c *cli) repl(addr, historyPath string) {
+	line := liner.NewLiner()
+	defer line.Close()
+
+	line.SetCtrlCAborts(true)
+	line.SetTabCompletionStyle(liner.TabPrints)
+	line.SetCompleter(complete)
+	if historyPath != "" {
+		if f, err := os.Open(historyPath); err == nil {
+			line.ReadHistory(f)
+			f.Close()
+		}
+		defer func() {
+			if f, err := os.Create(historyPath); err == nil {
+				line.WriteHistory(f)
+				f.Close()
+			}
+		}()
+	}
+
+	prompt := strings.TrimPrefix(strings.TrimPrefix(addr, "http://"), "https://") + "> "
+	for {
+		input, err := line.Prompt(prompt)
+		if err != nil {
+			// Ctrl-C, Ctrl-D or a closed terminal.
+			if err != liner.ErrPromptAborted {
+				fmt.Println()
+			}
+			return
+		}
+
+		input = strings.TrimSpace(input)
+		if input == "" {
+			continue
+		}
+		line.AppendHistory(input)
+
+		args, err := splitArgs(input)
+		if err == nil {
+			// Ctrl-C stops waiting for a response, e.g. of a blocking pop.
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			err = c.exec(ctx, args)
+			stop()
+		}
+		if err == errQuit {
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "(error)", err)
+		}
+	}
+}
+
+// complete completes command names, and the argument of help and output.
+func complete(line string) []string {
+	var res []string
+	name, rest, found := strings.Cut(line, " ")
+	if !found {
+		for _, cmd := range commandNames() {
+			if strings.HasPrefix(cmd, strings.ToLower(name)) {
+				res = append(res, cmd)
+			}
+		}
+		return res
+	}
+
+	var options []string
+	switch strings.ToLower(name) {
+	case "help":
+		options = commandNames()
+	case "output":
+		options = []string{string(formatText), string(formatJSON), string(formatTable)}
+	default:
+		return nil
+	}
+
+	rest = strings.TrimLeft(rest, " ")
+	for _, opt := range options {
+		if strings.HasPrefix(opt, rest) {
+			res = append(res, name+" "+opt)
+		}
+	}
+	return res
+}
+
+// splitArgs splits a line into words like a shell: quotes group words and
+// a backslash escapes the next character outside single quotes.
+func splitArgs(line string) ([]string, error) {
+	var res []string
+	var word strings.Builder
+	var quote rune
+	inWord, escaped := false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				res = append(res, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		res = append(res, word.String())
+	}
+	return res, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+type format string
+
+const (
+	formatText  format = "text"
+	formatJSON  format = "json"
+	formatTable format = "table"
+)
+
+func parseFormat(f string) (format, error) {
+	switch format(f) {
+	case formatText, formatJSON, formatTable:
+		return format(f), nil
+	}
+
+	return "", fmt.Errorf("unknown output format %q, use text, json or table", f)
+}
+
+// unwrap drops the {"result": ...} and {"value": ...} envelopes of the
+// server for text and tables.
+func unwrap(v any) any {
+	if m, ok := v.(map[string]any); ok && len(m) == 1 {
+		for _, name := range []string{"result", "value"} {
+			if inner, ok := m[name]; ok {
+				return inner
+			}
+		}
+	}
+
+	return v
+}
+
+// write prints a decoded response; nil is a response without a body.
+func write(w io.Writer, f format, v any) error {
+	switch f {
+	case formatJSON:
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case formatTable:
+		return writeTable(w, unwrap(v))
+	}
+
+	return writeText(w, unwrap(v))
+}
+
+// scalar formats strings without quotes and anything else as compact JSON.
+func scalar(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func sortedKeys(m map[string]any) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// writeText prints like redis-cli: numbered lines for arrays and one
+// "field: value" line per field for objects.
+func writeText(w io.Writer, v any) error {
+	var err error
+	switch v := v.(type) {
+	case nil:
+		_, err = fmt.Fprintln(w, "OK")
+	case []any:
+		if len(v) == 0 {
+			_, err = fmt.Fprintln(w, "(empty)")
+		}
+		for i, x := range v {
+			if _, err = fmt.Fprintf(w, "%d) %s\n", i+1, scalar(x)); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		for _, k := range sortedKeys(v) {
+			if _, err = fmt.Fprintf(w, "%s: %s\n", k, scalar(v[k])); err != nil {
+				return err
+			}
+		}
+	default:
+		_, err = fmt.Fprintln(w, scalar(v))
+	}
+
+	return err
+}
+
+// writeTable prints arrays of objects with a column per field, other
+// arrays with a column of values and objects with a row per field.
+func writeTable(w io.Writer, v any) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	row := func(cells ...string) {
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+
+	switch v := v.(type) {
+	case nil:
+		row("OK")
+	case []any:
+		columns := map[string]any{}
+		objects := len(v) > 0
+		for _, x := range v {
+			m, ok := x.(map[string]any)
+			if !ok {
+				objects = false
+				break
+			}
+			for k := range m {
+				columns[k] = nil
+			}
+		}
+
+		if !objects {
+			row("#", "VALUE")
+			for i, x := range v {
+				row(fmt.Sprint(i+1), scalar(x))
+			}
+			break
+		}
+
+		names := sortedKeys(columns)
+		header := make([]string, len(names))
+		for i, name := range names {
+			header[i] = strings.ToUpper(name)
+		}
+		row(header...)
+		for _, x := range v {
+			m := x.(map[string]any)
+			cells := make([]string, len(names))
+			for i, name := range names {
+				if cell, ok := m[name]; ok {
+					cells[i] = scalar(cell)
+				}
+			}
+			row(cells...)
+		}
+	case map[string]any:
+		row("FIELD", "VALUE")
+		for _, k := range sortedKeys(v) {
+			row(k, scalar(v[k]))
+		}
+	default:
+		row(scalar(v))
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,434 @@
+// Package auth checks who sends a request to the API and what it may do:
+// API keys, HMAC signatures or client certificates identify the sender,
+// grants of read, write or admin per route group and key prefix or pattern
+// decide what it may access.
+package auth
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type Permission int
+
+const (
+	None Permission = iota
+	Read
+	Write
+	// Admin also allows writes and reads.
+	Admin
+)
+
+func ParsePermission(s string) (Permission, error) {
+	switch s {
+	case "read":
+		return Read, nil
+	case "write":
+		return Write, nil
+	case "admin":
+		return Admin, nil
+	}
+
+	return None, fmt.Errorf("unknown permission %q, use read, write or admin", s)
+}
+
+func (p Permission) String() string {
+	switch p {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case Admin:
+		return "admin"
+	}
+
+	return "none"
+}
+
+var (
+	ErrNoCredentials = errors.New("credentials required")
+	ErrInvalidKey    = errors.New("invalid api key")
+	ErrBadSignature  = errors.New("invalid signature")
+	ErrUnknownCert   = errors.New("client certificate is not mapped to an identity")
+)
+
+const HeaderAPIKey = "X-API-Key"
+
+// Grant gives Permission on the keys of the route groups, e.g. "scalar" for
+// /scalar/...; no groups or "*" means every group. Prefix and Pattern
+// (path.Match syntax) restrict the keys, both must match when both are set.
+type Grant struct {
+	Groups     []string `json:"groups,omitempty"`
+	Prefix     string   `json:"prefix,omitempty"`
+	Pattern    string   `json:"pattern,omitempty"`
+	Permission string   `json:"permission"`
+}
+
+// Key is a client of the API. It authenticates with Key as a bearer token,
+// by signing requests with Secret, or with a verified client certificate
+// whose common name or whole subject, e.g. "CN=app,O=Acme", is Subject.
+type Key struct {
+	ID      string  `json:"id"`
+	Key     string  `json:"key,omitempty"`
+	Secret  string  `json:"secret,omitempty"`
+	Subject string  `json:"subject,omitempty"`
+	Grants  []Grant `json:"grants"`
+}
+
+type Config struct {
+	Keys []Key `json:"keys"`
+}
+
+type grant struct {
+	groups  []string
+	prefix  string
+	pattern string
+	perm    Permission
+}
+
+func (g grant) hasGroup(group string) bool {
+	return len(g.groups) == 0 || slices.Contains(g.groups, "*") || slices.Contains(g.groups, group)
+}
+
+func (g grant) hasKey(key string) bool {
+	if !strings.HasPrefix(key, g.prefix) {
+		return false
+	}
+	if g.pattern == "" {
+		return true
+	}
+
+	ok, _ := path.Match(g.pattern, key)
+	return ok
+}
+
+func (g grant) allKeys() bool {
+	return g.prefix == "" && g.pattern == ""
+}
+
+// Identity is an authenticated client.
+type Identity struct {
+	ID      string
+	key     string
+	secret  string
+	subject string
+	grants  []grant
+}
+
+// Allowed tells whether the identity may access keys of group with perm.
+// Grants restricted to some keys only count when the keys of a request are
+// known, so without keys an unrestricted grant is needed.
+func (id *Identity) Allowed(group string, perm Permission, keys ...string) bool {
+	for _, g := range id.grants {
+		if g.perm < perm || !g.hasGroup(group) {
+			continue
+		}
+
+		ok := len(keys) > 0 || g.allKeys()
+		for _, key := range keys {
+			ok = ok && g.hasKey(key)
+		}
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reaches tells whether the identity may access any key of group with perm,
+// e.g. to list the ones it may see.
+func (id *Identity) Reaches(group string, perm Permission) bool {
+	return slices.ContainsFunc(id.grants, func(g grant) bool {
+		return g.perm >= perm && g.hasGroup(group)
+	})
+}
+
+func compile(cfg Config) (map[string]*Identity, error) {
+	res := make(map[string]*Identity, len(cfg.Keys))
+	keys := make(map[string]bool, len(cfg.Keys))
+	subjects := make(map[string]bool, len(cfg.Keys))
+	for i, k := range cfg.Keys {
+		if k.ID == "" {
+			return nil, fmt.Errorf("key %d has no id", i)
+		}
+		if res[k.ID] != nil {
+			return nil, fmt.Errorf("duplicate id %q", k.ID)
+		}
+		if k.Key == "" && k.Secret == "" && k.Subject == "" {
+			return nil, fmt.Errorf("%s: key, secret or subject is required", k.ID)
+		}
+		if k.Key != "" && keys[k.Key] {
+			return nil, fmt.Errorf("%s: key is used twice", k.ID)
+		}
+		if k.Subject != "" && subjects[k.Subject] {
+			return nil, fmt.Errorf("%s: subject is used twice", k.ID)
+		}
+		keys[k.Key], subjects[k.Subject] = true, true
+
+		id := &Identity{ID: k.ID, key: k.Key, secret: k.Secret, subject: k.Subject}
+		for _, g := range k.Grants {
+			perm, err := ParsePermission(g.Permission)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k.ID, err)
+			}
+			if _, err = path.Match(g.Pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: pattern %q: %w", k.ID, g.Pattern, err)
+			}
+
+			id.grants = append(id.grants, grant{groups: g.Groups, prefix: g.Prefix, pattern: g.Pattern, perm: perm})
+		}
+		res[k.ID] = id
+	}
+
+	return res, nil
+}
+
+// auditSize is the number of recent denials kept for Stats.
+const auditSize = 100
+
+type Denial struct {
+	Time   int64  `json:"time"`
+	ID     string `json:"id,omitempty"`
+	Remote string `json:"remote"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	Reason string `json:"reason"`
+}
+
+type Stats struct {
+	Keys     int      `json:"keys"`
+	LoadedAt int64    `json:"loaded_at"`
+	Denials  uint64   `json:"denials"`
+	Recent   []Denial `json:"recent"`
+}
+
+// ACL holds the keys of a config file. Reload and Watch replace them while
+// requests are checked; a broken file keeps the previous keys.
+type ACL struct {
+	path   string
+	logger *zap.Logger
+
+	mu       sync.RWMutex
+	ids      map[string]*Identity
+	modTime  time.Time
+	loadedAt time.Time
+
+	denials atomic.Uint64
+	auditMu sync.Mutex
+	recent  []Denial
+}
+
+func Load(file string) (*ACL, error) {
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &ACL{path: file, logger: logger.Named("audit")}
+	if err = a.Reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Reload reads the config file again.
+func (a *ACL) Reload() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+
+	var cfg Config
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+
+	ids, err := compile(cfg)
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+
+	a.mu.Lock()
+	a.ids, a.modTime, a.loadedAt = ids, info.ModTime(), time.Now()
+	a.mu.Unlock()
+	a.logger.Info("Access control loaded", zap.String("file", a.path), zap.Int("keys", len(ids)))
+	return nil
+}
+
+// Watch reloads the config file whenever it changes until done is closed.
+func (a *ACL) Watch(done <-chan struct{}, interval time.Duration) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+
+		info, err := os.Stat(a.path)
+		if err != nil {
+			a.logger.Error("Failed to check access control file", zap.Error(err))
+			continue
+		}
+
+		a.mu.RLock()
+		changed := !info.ModTime().Equal(a.modTime)
+		a.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err = a.Reload(); err != nil {
+			a.logger.Error("Failed to reload access control, keeping the previous one", zap.Error(err))
+			// Do not try the same broken file again.
+			a.mu.Lock()
+			a.modTime = info.ModTime()
+			a.mu.Unlock()
+		}
+	}
+}
+
+// Authenticate returns the identity r was sent by: an API key in an
+// "Authorization: Bearer" or X-API-Key header, an HMAC signature, see Sign,
+// or else a verified client certificate. The body of a signed request is
+// read and put back.
+func (a *ACL) Authenticate(r *http.Request) (*Identity, error) {
+	a.mu.RLock()
+	ids := a.ids
+	a.mu.RUnlock()
+
+	if id := r.Header.Get(HeaderKeyID); id != "" {
+		return verify(r, ids[id])
+	}
+
+	key := r.Header.Get(HeaderAPIKey)
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		key = bearer
+	}
+	if key == "" {
+		return certIdentity(ids, r.TLS)
+	}
+
+	return keyIdentity(ids, key)
+}
+
+// AuthenticateKey returns the identity of an API key, for protocols other
+// than HTTP.
+func (a *ACL) AuthenticateKey(key string) (*Identity, error) {
+	a.mu.RLock()
+	ids := a.ids
+	a.mu.RUnlock()
+
+	return keyIdentity(ids, key)
+}
+
+func keyIdentity(ids map[string]*Identity, key string) (*Identity, error) {
+	for _, id := range ids {
+		if id.key != "" && subtle.ConstantTimeCompare([]byte(id.key), []byte(key)) == 1 {
+			return id, nil
+		}
+	}
+
+	return nil, ErrInvalidKey
+}
+
+func verify(r *http.Request, id *Identity) (*Identity, error) {
+	if id == nil || id.secret == "" {
+		return nil, ErrBadSignature
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil || time.Since(time.Unix(ts, 0)).Abs() > MaxSkew {
+		return nil, ErrBadSignature
+	}
+
+	var body []byte
+	if r.Body != nil {
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	want := Signature(id.secret, r.Method, r.URL.RequestURI(), ts, body)
+	if !hmacEqual(want, r.Header.Get(HeaderSignature)) {
+		return nil, ErrBadSignature
+	}
+
+	return id, nil
+}
+
+// certIdentity maps the subject of a client certificate to an identity.
+// Only certificates verified against the client CAs count.
+func certIdentity(ids map[string]*Identity, state *tls.ConnectionState) (*Identity, error) {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	subject := state.VerifiedChains[0][0].Subject
+	for _, id := range ids {
+		if id.subject != "" && (id.subject == subject.CommonName || id.subject == subject.String()) {
+			return id, nil
+		}
+	}
+
+	return nil, ErrUnknownCert
+}
+
+// Deny records a refused request and writes it to the audit log.
+func (a *ACL) Deny(d Denial) {
+	a.denials.Add(1)
+	a.logger.Warn("Access denied",
+		zap.String("id", d.ID),
+		zap.String("remote", d.Remote),
+		zap.String("method", d.Method),
+		zap.String("path", d.Path),
+		zap.Int("status", d.Status),
+		zap.String("reason", d.Reason))
+
+	a.auditMu.Lock()
+	defer a.auditMu.Unlock()
+	if len(a.recent) == auditSize {
+		a.recent = a.recent[1:]
+	}
+	a.recent = append(a.recent, d)
+}
+
+func (a *ACL) Stats() Stats {
+	a.mu.RLock()
+	res := Stats{Keys: len(a.ids), LoadedAt: a.loadedAt.UnixMilli(), Denials: a.denials.Load()}
+	a.mu.RUnlock()
+
+	a.auditMu.Lock()
+	res.Recent = slices.Clone(a.recent)
+	a.auditMu.Unlock()
+	if res.Recent == nil {
+		res.Recent = []Denial{}
+	}
+
+	return res
+}
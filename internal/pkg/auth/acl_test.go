@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testConfig = Config{Keys: []Key{
+	{ID: "app", Key: "app-key", Grants: []Grant{
+		{Groups: []string{"scalar", "map"}, Prefix: "user:", Permission: "write"},
+		{Groups: []string{"keys"}, Pattern: "user:*", Permission: "read"},
+	}},
+	{ID: "ops", Key: "ops-key", Secret: "ops-secret", Grants: []Grant{{Permission: "admin"}}},
+	{ID: "signer", Secret: "signer-secret", Grants: []Grant{{Groups: []string{"*"}, Permission: "read"}}},
+}}
+
+func writeConfig(t *testing.T, file string, cfg Config) {
+	t.Helper()
+	data, _ := json.Marshal(cfg)
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadTest(t *testing.T) (*ACL, string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "acl.json")
+	writeConfig(t, file, testConfig)
+	acl, err := Load(file)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	return acl, file
+}
+
+func TestAllowed(t *testing.T) {
+	acl, _ := loadTest(t)
+	app, ops := acl.ids["app"], acl.ids["ops"]
+	cases := []struct {
+		id    *Identity
+		group string
+		perm  Permission
+		keys  []string
+		want  bool
+	}{
+		{app, "scalar", Read, []string{"user:1"}, true},
+		{app, "map", Write, []string{"user:1"}, true},
+		{app, "scalar", Write, []string{"user:1", "order:1"}, false},
+		{app, "scalar", Admin, []string{"user:1"}, false},
+		{app, "slice", Read, []string{"user:1"}, false},
+		{app, "scalar", Read, nil, false},
+		{app, "keys", Read, []string{"user:1"}, true},
+		{app, "keys", Read, []string{"user:1/x"}, false},
+		{ops, "admin", Admin, nil, true},
+		{ops, "slice", Write, []string{"anything"}, true},
+	}
+	for _, c := range cases {
+		if got := c.id.Allowed(c.group, c.perm, c.keys...); got != c.want {
+			t.Errorf("%s %s %s %v: %v", c.id.ID, c.perm, c.group, c.keys, got)
+		}
+	}
+
+	if !app.Reaches("keys", Read) || app.Reaches("admin", Read) {
+		t.Error("reaches")
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "acl.json")
+	for name, cfg := range map[string]Config{
+		"no id":          {Keys: []Key{{Key: "k"}}},
+		"duplicate id":   {Keys: []Key{{ID: "a", Key: "k1"}, {ID: "a", Key: "k2"}}},
+		"duplicate key":  {Keys: []Key{{ID: "a", Key: "k"}, {ID: "b", Key: "k"}}},
+		"no credentials": {Keys: []Key{{ID: "a"}}},
+		"permission":     {Keys: []Key{{ID: "a", Key: "k", Grants: []Grant{{Permission: "all"}}}}},
+		"pattern":        {Keys: []Key{{ID: "a", Key: "k", Grants: []Grant{{Pattern: "[", Permission: "read"}}}}},
+	} {
+		writeConfig(t, file, cfg)
+		if _, err := Load(file); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	acl, _ := loadTest(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/scalar/get/user:1", nil)
+	if _, err := acl.Authenticate(req); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("no credentials: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer app-key")
+	if id, err := acl.Authenticate(req); err != nil || id.ID != "app" {
+		t.Errorf("bearer: %v %v", id, err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/scalar/get/user:1", nil)
+	req.Header.Set(HeaderAPIKey, "wrong")
+	if _, err := acl.Authenticate(req); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("wrong key: %v", err)
+	}
+
+	body := `{"ops":[]}`
+	signed := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/tx?x=1", strings.NewReader(body))
+		Sign(req, "signer", "signer-secret", []byte(body))
+		return req
+	}
+
+	req = signed()
+	if id, err := acl.Authenticate(req); err != nil || id.ID != "signer" {
+		t.Fatalf("signed: %v %v", id, err)
+	}
+	if data, _ := io.ReadAll(req.Body); string(data) != body {
+		t.Errorf("body after verification: %q", data)
+	}
+
+	req = signed()
+	req.URL.RawQuery = "x=2"
+	if _, err := acl.Authenticate(req); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("changed query: %v", err)
+	}
+
+	req = signed()
+	req.Body = io.NopCloser(strings.NewReader(`{"ops":[1]}`))
+	if _, err := acl.Authenticate(req); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("changed body: %v", err)
+	}
+
+	req = signed()
+	old := time.Now().Add(-2 * MaxSkew).Unix()
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(old, 10))
+	req.Header.Set(HeaderSignature, Signature("signer-secret", req.Method, req.URL.RequestURI(), old, []byte(body)))
+	if _, err := acl.Authenticate(req); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("old timestamp: %v", err)
+	}
+
+	req = signed()
+	req.Header.Set(HeaderKeyID, "app")
+	if _, err := acl.Authenticate(req); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("key without secret: %v", err)
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "acl.json")
+	writeConfig(t, file, Config{Keys: []Key{
+		{ID: "svc", Subject: "svc", Grants: []Grant{{Permission: "read"}}},
+		{ID: "ops", Subject: "CN=ops,O=Acme", Grants: []Grant{{Permission: "admin"}}},
+	}})
+	acl, err := Load(file)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	withCert := func(subject pkix.Name, verified bool) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		cert := &x509.Certificate{Subject: subject}
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		if verified {
+			req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+		}
+		return req
+	}
+
+	if id, err := acl.Authenticate(withCert(pkix.Name{CommonName: "svc", Organization: []string{"Other"}}, true)); err != nil || id.ID != "svc" {
+		t.Errorf("common name: %v %v", id, err)
+	}
+	if id, err := acl.Authenticate(withCert(pkix.Name{CommonName: "ops", Organization: []string{"Acme"}}, true)); err != nil || id.ID != "ops" {
+		t.Errorf("subject: %v %v", id, err)
+	}
+	if _, err := acl.Authenticate(withCert(pkix.Name{CommonName: "ops", Organization: []string{"Evil"}}, true)); !errors.Is(err, ErrUnknownCert) {
+		t.Errorf("other subject: %v", err)
+	}
+	if _, err := acl.Authenticate(withCert(pkix.Name{CommonName: "svc"}, false)); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("unverified certificate: %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	acl, file := loadTest(t)
+	done := make(chan struct{})
+	defer close(done)
+	go acl.Watch(done, 5*time.Millisecond)
+
+	waitKeys := func(n int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); acl.Stats().Keys != n; {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d keys, want %d", acl.Stats().Keys, n)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// Modification times may be coarse, so make the change visible.
+	writeConfig(t, file, Config{Keys: testConfig.Keys[:1]})
+	later := time.Now().Add(time.Second)
+	os.Chtimes(file, later, later)
+	waitKeys(1)
+
+	os.WriteFile(file, []byte("{broken"), 0o600)
+	later = later.Add(time.Second)
+	os.Chtimes(file, later, later)
+	time.Sleep(50 * time.Millisecond)
+	waitKeys(1)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(HeaderAPIKey, "ops-key")
+	if _, err := acl.Authenticate(req); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("removed key: %v", err)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Authorization"))
+	}))
+	defer ts.Close()
+
+	c := &http.Client{Transport: &Transport{Base: http.DefaultTransport, Key: "node-key"}}
+	c.Get(ts.URL)
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	req.Header.Set("Authorization", "Bearer client-key")
+	c.Do(req)
+
+	if len(got) != 2 || got[0] != "Bearer node-key" || got[1] != "Bearer client-key" {
+		t.Errorf("authorization: %q", got)
+	}
+}
+
+func TestDenials(t *testing.T) {
+	acl, _ := loadTest(t)
+	for i := 0; i < auditSize+5; i++ {
+		acl.Deny(Denial{Path: "/p" + strconv.Itoa(i), Status: http.StatusForbidden})
+	}
+
+	stats := acl.Stats()
+	if stats.Denials != auditSize+5 || len(stats.Recent) != auditSize || stats.Recent[0].Path != "/p5" {
+		t.Errorf("stats: %d denials, %d recent", stats.Denials, len(stats.Recent))
+	}
+}
@@ -0,0 +1,271 @@
+// Package certs serves TLS with certificates that are read again when their
+// files change, optionally verifying client certificates, and calls other
+// servers with them.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type ClientAuth string
+
+const (
+	ClientAuthNone ClientAuth = "none"
+	// ClientAuthVerify verifies client certificates that are sent, but
+	// lets clients without one in.
+	ClientAuthVerify  ClientAuth = "verify"
+	ClientAuthRequire ClientAuth = "require"
+)
+
+func ParseClientAuth(s string) (ClientAuth, error) {
+	switch ClientAuth(s) {
+	case ClientAuthNone, ClientAuthVerify, ClientAuthRequire:
+		return ClientAuth(s), nil
+	case "":
+		return ClientAuthNone, nil
+	}
+
+	return "", fmt.Errorf("unknown client auth %q, use none, verify or require", s)
+}
+
+func (c ClientAuth) tlsType() tls.ClientAuthType {
+	switch c {
+	case ClientAuthVerify:
+		return tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert
+	}
+
+	return tls.NoClientCert
+}
+
+// Config names the PEM files of the server certificate and its key, of
+// the CAs client certificates are verified with, and of the CAs the
+// certificates of other servers are verified with, the system roots if
+// CAFile is empty.
+type Config struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	ClientAuth   ClientAuth
+	CAFile       string
+}
+
+// Reloader keeps the certificates of a Config. Reload and Watch replace
+// them for new connections; files that can not be loaded keep the previous
+// ones.
+type Reloader struct {
+	cfg    Config
+	logger *zap.Logger
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	conf      *tls.Config
+	transport *http.Transport
+	modTimes  []time.Time
+}
+
+func NewReloader(cfg Config) (*Reloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("certificate and key files are required")
+	}
+	if cfg.ClientAuth == "" {
+		cfg.ClientAuth = ClientAuthNone
+	}
+	if cfg.ClientAuth != ClientAuthNone && cfg.ClientCAFile == "" {
+		return nil, errors.New("client certificates need a client CA file")
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reloader{cfg: cfg, logger: logger}
+	if err = r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+	if r.cfg.CAFile != "" {
+		files = append(files, r.cfg.CAFile)
+	}
+
+	return files
+}
+
+func (r *Reloader) modTimesNow() ([]time.Time, error) {
+	var res []time.Time
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, info.ModTime())
+	}
+
+	return res, nil
+}
+
+// Reload reads the files again.
+func (r *Reloader) Reload() error {
+	modTimes, err := r.modTimesNow()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	conf := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   r.cfg.ClientAuth.tlsType(),
+	}
+	if r.cfg.ClientCAFile != "" {
+		if conf.ClientCAs, err = loadPool(r.cfg.ClientCAFile); err != nil {
+			return err
+		}
+	}
+
+	transport := newTransport()
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetClientCertificate: r.GetClientCertificate}
+	if r.cfg.CAFile != "" {
+		if transport.TLSClientConfig.RootCAs, err = loadPool(r.cfg.CAFile); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	old := r.transport
+	r.cert, r.conf, r.transport, r.modTimes = &cert, conf, transport, modTimes
+	r.mu.Unlock()
+	if old != nil {
+		// Requests in flight finish on their connections.
+		old.CloseIdleConnections()
+	}
+
+	var expires time.Time
+	if cert.Leaf != nil {
+		expires = cert.Leaf.NotAfter
+	}
+	r.logger.Info("Certificates loaded", zap.String("cert", r.cfg.CertFile), zap.Time("expires", expires))
+	return nil
+}
+
+// Watch reloads the certificates whenever one of the files changes until
+// done is closed.
+func (r *Reloader) Watch(done <-chan struct{}, interval time.Duration) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+
+		modTimes, err := r.modTimesNow()
+		if err != nil {
+			r.logger.Error("Failed to check certificates", zap.Error(err))
+			continue
+		}
+
+		r.mu.RLock()
+		changed := false
+		for i, t := range modTimes {
+			changed = changed || !t.Equal(r.modTimes[i])
+		}
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err = r.Reload(); err != nil {
+			// A certificate and its key are rarely replaced at once; the
+			// next check tries again.
+			r.logger.Error("Failed to reload certificates, keeping the previous ones", zap.Error(err))
+		}
+	}
+}
+
+// TLSConfig returns the configuration of a server, which picks up the
+// certificates of the latest reload with every handshake.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.conf, nil
+		},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.cert, nil
+		},
+	}
+}
+
+// GetClientCertificate presents the server certificate to other servers,
+// e.g. those of the same cluster requiring client certificates.
+func (r *Reloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Transport calls other servers, verifying them against the CAs of the
+// latest reload and presenting the server certificate to them.
+func (r *Reloader) Transport() http.RoundTripper {
+	return roundTripper(func(req *http.Request) (*http.Response, error) {
+		r.mu.RLock()
+		transport := r.transport
+		r.mu.RUnlock()
+		return transport.RoundTrip(req)
+	})
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func newTransport() *http.Transport {
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		return t.Clone()
+	}
+
+	return &http.Transport{Proxy: http.ProxyFromEnvironment}
+}
+
+func loadPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", file)
+	}
+	return pool, nil
+}
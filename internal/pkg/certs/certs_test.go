@@ -0,0 +1,245 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCert makes a certificate signed by parent, or a self-signed CA for a
+// nil parent.
+func newCert(t *testing.T, name string, serial int64, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile == "" {
+		return
+	}
+
+	der, _ := x509.MarshalECPrivateKey(c.key)
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// serve starts an HTTPS server with the certificates of r.
+func serve(t *testing.T, r *Reloader) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{
+		TLSConfig: r.TLSConfig(),
+		Handler:   http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + ln.Addr().String()
+}
+
+// get returns the serial number of the server certificate.
+func get(url string, roots *x509.CertPool, client *tls.Certificate) (int64, error) {
+	conf := &tls.Config{RootCAs: roots}
+	if client != nil {
+		// Sent even if the server does not list its CA as acceptable.
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return client, nil
+		}
+	}
+
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: conf, DisableKeepAlives: true}}
+	resp, err := c.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.TLS.PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	ca := newCert(t, "ca", 1, nil)
+	newCert(t, "server", 10, ca).write(t, certFile, keyFile)
+
+	if _, err := NewReloader(Config{CertFile: certFile}); err == nil {
+		t.Error("missing key accepted")
+	}
+	if _, err := NewReloader(Config{CertFile: certFile, KeyFile: keyFile, ClientAuth: ClientAuthRequire}); err == nil {
+		t.Error("client auth without a CA accepted")
+	}
+
+	r, err := NewReloader(Config{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go r.Watch(done, 5*time.Millisecond)
+	url := serve(t, r)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	if serial, err := get(url, roots, nil); err != nil || serial != 10 {
+		t.Fatalf("first certificate: %d %v", serial, err)
+	}
+	if _, err := get(url, x509.NewCertPool(), nil); err == nil {
+		t.Error("untrusted certificate accepted")
+	}
+
+	// A renewed certificate is picked up by new connections.
+	newCert(t, "server", 11, ca).write(t, certFile, keyFile)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		serial, err := get(url, roots, nil)
+		if err == nil && serial == 11 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("renewed certificate not served: %d %v", serial, err)
+		}
+	}
+
+	// A broken file keeps the previous certificate.
+	os.WriteFile(keyFile, []byte("broken"), 0o600)
+	if err = r.Reload(); err == nil {
+		t.Error("broken key loaded")
+	}
+	if serial, err := get(url, roots, nil); err != nil || serial != 11 {
+		t.Errorf("after a broken reload: %d %v", serial, err)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.pem")
+	ca := newCert(t, "ca", 1, nil)
+	ca.write(t, caFile, "")
+	newCert(t, "server", 10, ca).write(t, certFile, keyFile)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := newCert(t, "app", 20, ca).tlsCert()
+	stranger := newCert(t, "app", 21, newCert(t, "other ca", 2, nil)).tlsCert()
+
+	for _, c := range []struct {
+		auth    ClientAuth
+		client  *tls.Certificate
+		allowed bool
+	}{
+		{ClientAuthRequire, &client, true},
+		{ClientAuthRequire, nil, false},
+		{ClientAuthRequire, &stranger, false},
+		{ClientAuthVerify, nil, true},
+		{ClientAuthVerify, &client, true},
+		{ClientAuthVerify, &stranger, false},
+	} {
+		r, err := NewReloader(Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: c.auth})
+		if err != nil {
+			t.Fatalf("new: %v", err)
+		}
+
+		_, err = get(serve(t, r), roots, c.client)
+		if (err == nil) != c.allowed {
+			t.Errorf("%s with client %v: %v", c.auth, c.client != nil, err)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name string) string { return filepath.Join(dir, name) }
+	ca := newCert(t, "ca", 1, nil)
+	ca.write(t, file("ca.pem"), "")
+	newCert(t, "a", 10, ca).write(t, file("a.pem"), file("a.key"))
+	newCert(t, "b", 11, ca).write(t, file("b.pem"), file("b.key"))
+
+	a, err := NewReloader(Config{CertFile: file("a.pem"), KeyFile: file("a.key"), CAFile: file("ca.pem")})
+	if err != nil {
+		t.Fatalf("new a: %v", err)
+	}
+	b, err := NewReloader(Config{CertFile: file("b.pem"), KeyFile: file("b.key"), ClientCAFile: file("ca.pem"), ClientAuth: ClientAuthRequire})
+	if err != nil {
+		t.Fatalf("new b: %v", err)
+	}
+
+	// a trusts the private CA and presents its certificate to b.
+	client := &http.Client{Transport: a.Transport()}
+	url := serve(t, b)
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("call b: %v", err)
+	}
+	resp.Body.Close()
+
+	// Once reloaded, the CA file is what counts.
+	newCert(t, "other ca", 2, nil).write(t, file("ca.pem"), "")
+	if err := a.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if _, err := client.Get(url); err == nil {
+		t.Error("b verified against a replaced CA")
+	}
+}
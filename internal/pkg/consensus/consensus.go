@@ -0,0 +1,440 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"proj1/internal/pkg/storage"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrNotLeader   = errors.New("this node is not the raft leader")
+	ErrUnavailable = errors.New("raft is not available")
+)
+
+const (
+	JoinPath = "/cluster/join"
+
+	DefaultTimeout  = 10 * time.Second
+	retainSnapshots = 2
+	maxPool         = 3
+)
+
+// Config describes a node. Nodes are identified by the URL of their HTTP
+// API, so that every node can forward writes to the leader.
+type Config struct {
+	ID string
+	// Addr is the host:port raft traffic is bound to and advertised on.
+	Addr string
+	// Dir keeps the raft log and snapshots; empty keeps them in memory.
+	Dir string
+	// Bootstrap starts a new single node cluster unless there is state in
+	// Dir already.
+	Bootstrap bool
+
+	// Transport replaces the tcp transport on Addr, e.g. with an in-memory
+	// one for tests.
+	Transport raft.Transport
+	// Raft overrides the default raft configuration; LocalID is always set
+	// from ID.
+	Raft *raft.Config
+}
+
+// Node runs raft with a SliceStorage as the replicated state machine: every
+// mutation of the storage becomes a log entry that is applied on all nodes
+// once a quorum has it.
+type Node struct {
+	id      string
+	addr    string
+	raft    *raft.Raft
+	storage *storage.SliceStorage
+	logger  *zap.Logger
+	closers []io.Closer
+	Timeout time.Duration
+	// Client calls the peer JoinCluster is given.
+	Client *http.Client
+
+	// Proposals hold mu for reading; ProposeIf holds it exclusively so that
+	// the record it builds reflects everything proposed before.
+	mu sync.RWMutex
+}
+
+type Member struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+}
+
+type Status struct {
+	ID           string   `json:"id"`
+	State        string   `json:"state"`
+	Leader       string   `json:"leader"`
+	Term         uint64   `json:"term"`
+	AppliedIndex uint64   `json:"applied_index"`
+	Members      []Member `json:"members"`
+}
+
+func NewNode(cfg Config, st *storage.SliceStorage) (*Node, error) {
+	if cfg.ID == "" {
+		return nil, errors.New("node id is required")
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{id: cfg.ID, storage: st, logger: logger, Timeout: DefaultTimeout, Client: &http.Client{}}
+	raftLogger := hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.Warn, Output: os.Stderr})
+
+	rc := raft.DefaultConfig()
+	if cfg.Raft != nil {
+		rc = cfg.Raft
+	}
+	rc.LocalID = raft.ServerID(cfg.ID)
+	if rc.Logger == nil {
+		rc.Logger = raftLogger
+	}
+
+	var logs raft.LogStore
+	var stable raft.StableStore
+	var snaps raft.SnapshotStore
+	if cfg.Dir == "" {
+		mem := raft.NewInmemStore()
+		logs, stable, snaps = mem, mem, raft.NewInmemSnapshotStore()
+	} else {
+		if err = os.MkdirAll(cfg.Dir, 0o755); err != nil {
+			return nil, err
+		}
+
+		bolt, err := raftboltdb.NewBoltStore(filepath.Join(cfg.Dir, "raft.db"))
+		if err != nil {
+			return nil, fmt.Errorf("raft log: %w", err)
+		}
+		n.closers = append(n.closers, bolt)
+
+		snaps, err = raft.NewFileSnapshotStoreWithLogger(cfg.Dir, retainSnapshots, raftLogger)
+		if err != nil {
+			n.close()
+			return nil, fmt.Errorf("raft snapshots: %w", err)
+		}
+		logs, stable = bolt, bolt
+	}
+
+	transport := cfg.Transport
+	if transport == nil {
+		addr, err := net.ResolveTCPAddr("tcp", cfg.Addr)
+		if err != nil {
+			n.close()
+			return nil, fmt.Errorf("raft address: %w", err)
+		}
+
+		tcp, err := raft.NewTCPTransportWithLogger(cfg.Addr, addr, maxPool, DefaultTimeout, raftLogger)
+		if err != nil {
+			n.close()
+			return nil, fmt.Errorf("raft transport: %w", err)
+		}
+		n.closers = append(n.closers, tcp)
+		transport = tcp
+	}
+
+	// Mutations must go through the log from the first entry on.
+	st.SetProposer(n)
+
+	n.raft, err = raft.NewRaft(rc, &fsm{storage: st}, logs, stable, snaps, transport)
+	if err != nil {
+		n.close()
+		return nil, err
+	}
+
+	if cfg.Bootstrap {
+		exists, err := raft.HasExistingState(logs, stable, snaps)
+		if err != nil {
+			n.Shutdown()
+			return nil, err
+		}
+
+		if !exists {
+			boot := raft.Configuration{Servers: []raft.Server{{ID: rc.LocalID, Address: transport.LocalAddr()}}}
+			if err = n.raft.BootstrapCluster(boot).Error(); err != nil {
+				n.Shutdown()
+				return nil, fmt.Errorf("bootstrap: %w", err)
+			}
+		}
+	}
+
+	n.addr = string(transport.LocalAddr())
+	n.logger.Info("raft node started", zap.String("id", cfg.ID), zap.String("addr", n.addr))
+	return n, nil
+}
+
+func (n *Node) close() {
+	for _, c := range n.closers {
+		c.Close()
+	}
+}
+
+// Shutdown hands leadership over, if this node has it, and stops raft.
+func (n *Node) Shutdown() error {
+	if n.IsLeader() {
+		if err := n.raft.LeadershipTransfer().Error(); err != nil {
+			n.logger.Info("Leadership not transferred", zap.Error(err))
+		}
+	}
+
+	err := n.raft.Shutdown().Error()
+	n.close()
+	return err
+}
+
+func (n *Node) ID() string {
+	return n.id
+}
+
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// Leader returns the id, i.e. the HTTP URL, of the current leader; empty if
+// there is none at the moment.
+func (n *Node) Leader() string {
+	_, id := n.raft.LeaderWithID()
+	return string(id)
+}
+
+// LeaderCh delivers true when this node becomes the leader and false when it
+// loses leadership. It has to have a single reader.
+func (n *Node) LeaderCh() <-chan bool {
+	return n.raft.LeaderCh()
+}
+
+func (n *Node) Status() Status {
+	status := Status{
+		ID:           n.id,
+		State:        n.raft.State().String(),
+		Leader:       n.Leader(),
+		AppliedIndex: n.raft.AppliedIndex(),
+	}
+	status.Term, _ = strconv.ParseUint(n.raft.Stats()["term"], 10, 64)
+
+	if f := n.raft.GetConfiguration(); f.Error() == nil {
+		for _, srv := range f.Configuration().Servers {
+			status.Members = append(status.Members, Member{
+				ID:       string(srv.ID),
+				Address:  string(srv.Address),
+				Suffrage: srv.Suffrage.String(),
+			})
+		}
+	}
+
+	return status
+}
+
+// Join adds a voting node; it is called on the leader.
+func (n *Node) Join(id, addr string) error {
+	f := n.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return n.raftError(err)
+	}
+
+	for _, srv := range f.Configuration().Servers {
+		if srv.ID == raft.ServerID(id) && srv.Address == raft.ServerAddress(addr) {
+			return nil
+		}
+
+		// A node that comes back with another address or id replaces
+		// its old entry.
+		if srv.ID == raft.ServerID(id) || srv.Address == raft.ServerAddress(addr) {
+			if err := n.raft.RemoveServer(srv.ID, 0, n.Timeout).Error(); err != nil {
+				return n.raftError(err)
+			}
+		}
+	}
+
+	if err := n.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, n.Timeout).Error(); err != nil {
+		return n.raftError(err)
+	}
+
+	n.logger.Info("node joined", zap.String("id", id), zap.String("addr", addr))
+	return nil
+}
+
+type JoinRequest struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// JoinCluster asks the cluster peer belongs to, through any of its nodes, to
+// add this node. It retries until ctx is done, since the cluster may have no
+// leader at the moment.
+func (n *Node) JoinCluster(ctx context.Context, peer string) error {
+	body, err := json.Marshal(JoinRequest{ID: n.id, Addr: n.addr})
+	if err != nil {
+		return err
+	}
+
+	backoff := 100 * time.Millisecond
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+JoinPath, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := n.Client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				n.logger.Info("joined cluster", zap.String("peer", peer))
+				return nil
+			}
+			err = fmt.Errorf("peer responded with %s", resp.Status)
+		}
+
+		n.logger.Info("Failed to join cluster", zap.String("peer", peer), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 5*time.Second)
+	}
+}
+
+// Leave removes a node from the cluster; it is called on the leader.
+func (n *Node) Leave(id string) error {
+	if err := n.raft.RemoveServer(raft.ServerID(id), 0, n.Timeout).Error(); err != nil {
+		return n.raftError(err)
+	}
+
+	n.logger.Info("node removed", zap.String("id", id))
+	return nil
+}
+
+// Snapshot compacts the log into a snapshot of the storage.
+func (n *Node) Snapshot() error {
+	return n.raft.Snapshot().Error()
+}
+
+func (n *Node) Propose(rec storage.Record) (any, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return n.apply(rec)
+}
+
+func (n *Node) ProposeIf(build func() (storage.Record, error)) (any, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.IsLeader() {
+		return nil, ErrNotLeader
+	}
+
+	if err := n.raft.Barrier(n.Timeout).Error(); err != nil {
+		return nil, n.raftError(err)
+	}
+
+	rec, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	return n.apply(rec)
+}
+
+func (n *Node) apply(rec storage.Record) (any, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	f := n.raft.Apply(data, n.Timeout)
+	if err := f.Error(); err != nil {
+		return nil, n.raftError(err)
+	}
+
+	res := f.Response().(result)
+	return res.value, res.err
+}
+
+func (n *Node) raftError(err error) error {
+	switch {
+	case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrLeadershipLost),
+		errors.Is(err, raft.ErrLeadershipTransferInProgress):
+		return fmt.Errorf("%w: %w", ErrNotLeader, err)
+	case errors.Is(err, raft.ErrRaftShutdown), errors.Is(err, raft.ErrEnqueueTimeout):
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+
+	return err
+}
+
+type result struct {
+	value any
+	err   error
+}
+
+// fsm applies committed entries to the storage. Snapshots are the JSON the
+// storage is saved as.
+type fsm struct {
+	storage *storage.SliceStorage
+}
+
+func (f *fsm) Apply(l *raft.Log) any {
+	var rec storage.Record
+	if err := json.Unmarshal(l.Data, &rec); err != nil {
+		return result{err: err}
+	}
+
+	res, err := f.storage.ApplyReplicated(rec)
+	return result{value: res, err: err}
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	data, err := f.storage.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot(data), nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+
+	return f.storage.LoadReplica(data)
+}
+
+type snapshot []byte
+
+func (s snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (s snapshot) Release() {}
@@ -0,0 +1,288 @@
+package consensus_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"proj1/internal/pkg/consensus"
+	"proj1/internal/pkg/server"
+	"proj1/internal/pkg/storage"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testNode struct {
+	url       string
+	storage   *storage.SliceStorage
+	node      *consensus.Node
+	transport *raft.InmemTransport
+	http      *httptest.Server
+}
+
+func fastConfig() *raft.Config {
+	c := raft.DefaultConfig()
+	c.HeartbeatTimeout = 100 * time.Millisecond
+	c.ElectionTimeout = 100 * time.Millisecond
+	c.LeaderLeaseTimeout = 50 * time.Millisecond
+	c.CommitTimeout = 5 * time.Millisecond
+	// Nodes that join after a snapshot have to be sent the snapshot.
+	c.TrailingLogs = 0
+	c.Logger = hclog.NewNullLogger()
+	return c
+}
+
+// cluster runs nodes in process, connected through in-memory transports
+// and serving the HTTP API on loopback.
+type cluster struct {
+	t     *testing.T
+	nodes []*testNode
+}
+
+func (c *cluster) start(bootstrap bool) *testNode {
+	t := c.t
+	st, err := storage.NewSliceStorage(filepath.Join(t.TempDir(), "storage.json"))
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	n := &testNode{url: "http://" + ln.Addr().String(), storage: &st}
+	_, n.transport = raft.NewInmemTransport("")
+	for _, other := range c.nodes {
+		n.transport.Connect(other.transport.LocalAddr(), other.transport)
+		other.transport.Connect(n.transport.LocalAddr(), n.transport)
+	}
+
+	n.node, err = consensus.NewNode(consensus.Config{
+		ID:        n.url,
+		Bootstrap: bootstrap,
+		Transport: n.transport,
+		Raft:      fastConfig(),
+	}, &st)
+	require.NoError(t, err)
+
+	srv := server.New(ln.Addr().String(), &st)
+	srv.SetConsensus(n.node)
+	n.http = &httptest.Server{Listener: ln, Config: &http.Server{Handler: srv.Handler()}}
+	n.http.Start()
+
+	c.nodes = append(c.nodes, n)
+	t.Cleanup(func() {
+		n.stop()
+	})
+	return n
+}
+
+func (n *testNode) stop() {
+	if n.node != nil {
+		n.node.Shutdown()
+		n.http.Close()
+		n.node = nil
+	}
+}
+
+func (c *cluster) leader() *testNode {
+	c.t.Helper()
+	var leader *testNode
+	require.Eventually(c.t, func() bool {
+		for _, n := range c.nodes {
+			if n.node != nil && n.node.IsLeader() {
+				leader = n
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+func (c *cluster) follower() *testNode {
+	leader := c.leader()
+	for _, n := range c.nodes {
+		if n != leader && n.node != nil {
+			return n
+		}
+	}
+
+	c.t.Fatal("no follower")
+	return nil
+}
+
+// converged waits until every running node has key set to want.
+func (c *cluster) converged(key, want string) {
+	c.t.Helper()
+	assert.Eventually(c.t, func() bool {
+		for _, n := range c.nodes {
+			if n.node == nil {
+				continue
+			}
+			if val, ok := n.storage.Get(key); !ok || val != want {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func do(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(data)
+}
+
+func newCluster(t *testing.T, size int) *cluster {
+	gin.SetMode(gin.TestMode)
+	c := &cluster{t: t}
+	first := c.start(true)
+	c.leader()
+
+	for i := 1; i < size; i++ {
+		n := c.start(false)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		require.NoError(t, n.node.JoinCluster(ctx, first.url))
+		cancel()
+	}
+
+	return c
+}
+
+func TestClusterReplicatesWrites(t *testing.T) {
+	c := newCluster(t, 3)
+	leader, follower := c.leader(), c.follower()
+	assert.Len(t, leader.node.Status().Members, 3)
+
+	// Writes sent to a follower are forwarded to the leader.
+	code, _ := do(t, http.MethodPost, follower.url+"/scalar/set/a/1", "")
+	assert.Equal(t, http.StatusOK, code)
+	c.converged("a", "1")
+
+	res, err := leader.storage.IncrBy("a", 4)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), res)
+	c.converged("a", "5")
+
+	_, err = follower.storage.IncrBy("a", 1)
+	assert.True(t, errors.Is(err, consensus.ErrNotLeader))
+
+	require.NoError(t, leader.storage.RPush("list", []string{"x", "y", "z"}))
+	assert.Equal(t, []string{"z"}, leader.storage.RPop("list", 1))
+	assert.Eventually(t, func() bool {
+		val, err := follower.storage.LGet("list", -1)
+		return err == nil && val == "y"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	elem, ok, err := leader.storage.LMove("list", "moved", storage.Left, storage.Right)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "x", elem)
+	assert.Eventually(t, func() bool {
+		val, err := follower.storage.LGet("moved", 0)
+		return err == nil && val == "x" && follower.storage.LLen("list") == 1
+	}, 10*time.Second, 10*time.Millisecond)
+
+	members, err := leader.storage.SPop("set", 1)
+	require.NoError(t, err)
+	assert.Empty(t, members)
+}
+
+func TestClusterSPop(t *testing.T) {
+	c := newCluster(t, 3)
+	leader, follower := c.leader(), c.follower()
+
+	_, err := leader.storage.SAdd("set", []string{"a", "b", "c"})
+	require.NoError(t, err)
+	members, err := leader.storage.SPop("set", 1)
+	require.NoError(t, err)
+	require.Len(t, members, 1)
+
+	// The popped member is removed on every node.
+	for _, n := range []*testNode{leader, follower} {
+		assert.Eventually(t, func() bool {
+			card, err := n.storage.SCard("set")
+			ok, _ := n.storage.SIsMember("set", members[0])
+			return err == nil && card == 2 && !ok
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestClusterTransactions(t *testing.T) {
+	c := newCluster(t, 3)
+	follower := c.follower()
+
+	code, body := do(t, http.MethodGet, follower.url+"/tx/watch?key=n", "")
+	require.Equal(t, http.StatusOK, code)
+	var versions map[string]uint64
+	require.NoError(t, json.Unmarshal([]byte(body), &versions))
+
+	watch, _ := json.Marshal(versions)
+	tx := `{"watch":` + string(watch) + `,"ops":[{"op":"incrby","key":"n","args":["2"]},{"op":"expire","key":"n","args":["100"]},{"op":"get","key":"n"}]}`
+	code, body = do(t, http.MethodPost, follower.url+"/tx", tx)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"result":[{"result":2},{"result":1},{"result":"2"}]}`, body)
+	c.converged("n", "2")
+
+	code, _ = do(t, http.MethodPost, follower.url+"/tx", tx)
+	assert.Equal(t, http.StatusConflict, code)
+}
+
+func TestClusterSnapshotAndFailover(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.leader()
+
+	require.NoError(t, leader.storage.Set("a", "1"))
+	_, err := leader.storage.ZAdd("z", []storage.ZMember{{Member: "m", Score: 2}})
+	require.NoError(t, err)
+	c.converged("a", "1")
+
+	// With the log compacted a new node can only catch up from the snapshot.
+	require.NoError(t, leader.node.Snapshot())
+	late := c.start(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, late.node.JoinCluster(ctx, leader.url))
+	c.converged("a", "1")
+	assert.Eventually(t, func() bool {
+		score, ok, err := late.storage.ZScore("z", "m")
+		return err == nil && ok && score == 2
+	}, 10*time.Second, 10*time.Millisecond)
+
+	leader.stop()
+	next := c.leader()
+	assert.NotEqual(t, leader.url, next.url)
+
+	code, _ := do(t, http.MethodPost, c.follower().url+"/scalar/set/b/2", "")
+	assert.Equal(t, http.StatusOK, code)
+	c.converged("b", "2")
+
+	code, _ = do(t, http.MethodDelete, c.follower().url+"/cluster/nodes?id="+url.QueryEscape(leader.url), "")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, body := do(t, http.MethodGet, next.url+"/cluster/status", "")
+	assert.Equal(t, http.StatusOK, code)
+	var status consensus.Status
+	require.NoError(t, json.Unmarshal([]byte(body), &status))
+	assert.Equal(t, next.url, status.Leader)
+	assert.Len(t, status.Members, 3)
+}
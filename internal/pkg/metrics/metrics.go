@@ -0,0 +1,319 @@
+// Package metrics keeps counters and histograms and writes them in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are upper bounds in seconds suited to request latencies.
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Histogram counts observations per bucket without locking.
+type Histogram struct {
+	bounds []float64
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	sum    atomic.Uint64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	bounds := slices.Clone(buckets)
+	slices.Sort(bounds)
+	return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string, labels []string) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		writeSample(w, name+"_bucket", append(labels, "le", formatFloat(bound)), float64(cumulative))
+	}
+	count := h.count.Load()
+	writeSample(w, name+"_bucket", append(labels, "le", "+Inf"), float64(count))
+	writeSample(w, name+"_sum", labels, math.Float64frombits(h.sum.Load()))
+	writeSample(w, name+"_count", labels, float64(count))
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	n atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.n.Add(1)
+}
+
+func (c *Counter) Load() uint64 {
+	return c.n.Load()
+}
+
+// vec keeps a metric per combination of label values.
+type vec[T any] struct {
+	labels []string
+	create func() *T
+	mu     sync.RWMutex
+	values map[string]*T
+}
+
+func (v *vec[T]) with(values ...string) *T {
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	m := v.values[key]
+	v.mu.RUnlock()
+	if m != nil {
+		return m
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if m = v.values[key]; m == nil {
+		m = v.create()
+		v.values[key] = m
+	}
+	return m
+}
+
+// each calls fn with the label pairs of every metric, in a stable order.
+func (v *vec[T]) each(fn func(labels []string, m *T)) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	values := make([]*T, len(keys))
+	for i, key := range keys {
+		values[i] = v.values[key]
+	}
+	v.mu.RUnlock()
+
+	for i, key := range keys {
+		var labels []string
+		for j, value := range strings.Split(key, "\xff") {
+			labels = append(labels, v.labels[j], value)
+		}
+		fn(labels, values[i])
+	}
+}
+
+type CounterVec struct {
+	vec[Counter]
+}
+
+// With returns the counter of the label values, in the order the labels
+// were given to NewCounterVec.
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.with(values...)
+}
+
+type HistogramVec struct {
+	vec[Histogram]
+}
+
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.with(values...)
+}
+
+type family struct {
+	name  string
+	help  string
+	typ   string
+	write func(w *bufio.Writer)
+}
+
+// Registry is the set of metrics written by WriteTo, in the order they were
+// registered. Metrics registered again under the same name are written
+// within the first one, e.g. histograms kept elsewhere with other labels.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(name, help, typ string, write func(w *bufio.Writer)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, f := range r.families {
+		if f.name == name {
+			r.families[i].write = func(w *bufio.Writer) {
+				f.write(w)
+				write(w)
+			}
+			return
+		}
+	}
+	r.families = append(r.families, family{name: name, help: help, typ: typ, write: write})
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec[Counter]{labels: labels, create: func() *Counter { return &Counter{} }, values: make(map[string]*Counter)}}
+	r.register(name, help, "counter", func(w *bufio.Writer) {
+		c.each(func(labels []string, m *Counter) {
+			writeSample(w, name, labels, float64(m.Load()))
+		})
+	})
+	return c
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{vec[Histogram]{labels: labels, create: func() *Histogram { return NewHistogram(buckets) }, values: make(map[string]*Histogram)}}
+	r.register(name, help, "histogram", func(w *bufio.Writer) {
+		h.each(func(labels []string, m *Histogram) {
+			m.write(w, name, labels)
+		})
+	})
+	return h
+}
+
+// Histogram registers a histogram kept elsewhere, with fixed labels given
+// as name, value pairs.
+func (r *Registry) Histogram(name, help string, h *Histogram, labels ...string) {
+	r.register(name, help, "histogram", func(w *bufio.Writer) {
+		h.write(w, name, labels)
+	})
+}
+
+// CounterFunc registers a counter whose value fn returns when the metrics
+// are written.
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.register(name, help, "counter", func(w *bufio.Writer) {
+		writeSample(w, name, nil, fn())
+	})
+}
+
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(name, help, "gauge", func(w *bufio.Writer) {
+		writeSample(w, name, nil, fn())
+	})
+}
+
+// GaugeVecFunc registers gauges with one label, whose values by label value
+// fn returns when the metrics are written.
+func (r *Registry) GaugeVecFunc(name, help, label string, fn func() map[string]float64) {
+	r.register(name, help, "gauge", func(w *bufio.Writer) {
+		values := fn()
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		for _, key := range keys {
+			writeSample(w, name, []string{label, key}, values[key])
+		}
+	})
+}
+
+func (r *Registry) WriteTo(out io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := slices.Clone(r.families)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: out}
+	w := bufio.NewWriter(cw)
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, escape(f.help, false))
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+		f.write(w)
+	}
+
+	err := w.Flush()
+	return cw.n, err
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		r.WriteTo(w)
+	})
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeSample writes a line of the metric with labels as name, value pairs.
+func writeSample(w *bufio.Writer, name string, labels []string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(labels[i])
+			w.WriteString(`="`)
+			w.WriteString(escape(labels[i+1], true))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escape escapes backslashes and newlines, and in label values quotes.
+func escape(s string, quotes bool) string {
+	r := strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	if quotes {
+		r = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	}
+
+	return r.Replace(s)
+}
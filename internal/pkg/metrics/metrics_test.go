@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	reg := NewRegistry()
+	requests := reg.NewCounterVec("requests_total", "Requests.", "route")
+	latency := reg.NewHistogramVec("latency_seconds", "Latency.", []float64{1, 0.1}, "route")
+	reg.GaugeVecFunc("keys", "Keys per kind.", "kind", func() map[string]float64 {
+		return map[string]float64{"S": 2, "D": 1}
+	})
+	reg.Histogram("wait_seconds", "Wait.", NewHistogram([]float64{1}), "mode", "read")
+	reg.Histogram("wait_seconds", "Wait.", NewHistogram([]float64{1}), "mode", "write")
+
+	requests.With(`/a"b`).Inc()
+	requests.With("/c").Inc()
+	requests.With("/c").Inc()
+	for _, v := range []float64{0.05, 0.5, 5} {
+		latency.With("/c").Observe(v)
+	}
+
+	var out strings.Builder
+	if _, err := reg.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{route="/a\"b"} 1
+requests_total{route="/c"} 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/c",le="0.1"} 1
+latency_seconds_bucket{route="/c",le="1"} 2
+latency_seconds_bucket{route="/c",le="+Inf"} 3
+latency_seconds_sum{route="/c"} 5.55
+latency_seconds_count{route="/c"} 3
+# HELP keys Keys per kind.
+# TYPE keys gauge
+keys{kind="D"} 1
+keys{kind="S"} 2
+# HELP wait_seconds Wait.
+# TYPE wait_seconds histogram
+wait_seconds_bucket{mode="read",le="1"} 0
+wait_seconds_bucket{mode="read",le="+Inf"} 0
+wait_seconds_sum{mode="read"} 0
+wait_seconds_count{mode="read"} 0
+wait_seconds_bucket{mode="write",le="1"} 0
+wait_seconds_bucket{mode="write",le="+Inf"} 0
+wait_seconds_sum{mode="write"} 0
+wait_seconds_count{mode="write"} 0
+`
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	w := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); ct != contentType || w.Body.String() != want {
+		t.Errorf("handler: %q %q", ct, w.Body.String())
+	}
+}
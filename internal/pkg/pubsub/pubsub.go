@@ -0,0 +1,251 @@
+package pubsub
+
+import (
+	"errors"
+	"path"
+	"proj1/internal/pkg/storage"
+	"sync"
+)
+
+const DefaultBuffer = 256
+
+const (
+	TypeKeyspace = "keyspace"
+	TypeMessage  = "message"
+)
+
+var (
+	ErrSlowConsumer = errors.New("subscriber is too slow")
+	ErrClosed       = errors.New("pubsub is closed")
+)
+
+// Message is either a keyspace event or a message published to a channel.
+// Pattern is the subscription it matched.
+type Message struct {
+	Type    string         `json:"type"`
+	Pattern string         `json:"pattern"`
+	Channel string         `json:"channel,omitempty"`
+	Data    string         `json:"data,omitempty"`
+	Event   *storage.Event `json:"event,omitempty"`
+}
+
+// Hub delivers keyspace events and published messages to subscribers. Every
+// subscriber has a bounded buffer; a subscriber whose buffer is full is
+// disconnected rather than slowing down writers.
+type Hub struct {
+	// Buffer is the number of messages a new subscriber may fall behind.
+	Buffer int
+
+	mu     sync.RWMutex
+	subs   map[*Subscriber]struct{}
+	closed bool
+}
+
+func NewHub() *Hub {
+	return &Hub{Buffer: DefaultBuffer, subs: make(map[*Subscriber]struct{})}
+}
+
+// Subscriber receives the messages matching its patterns. Patterns use the
+// syntax of path.Match; a key or channel without wildcards matches exactly.
+type Subscriber struct {
+	hub  *Hub
+	c    chan Message
+	done chan struct{}
+
+	mu       sync.RWMutex
+	keys     map[string]struct{}
+	channels map[string]struct{}
+	err      error
+}
+
+func validPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.New("bad pattern " + p)
+		}
+	}
+
+	return nil
+}
+
+// Subscribe adds a subscriber to events of keys and to channels matching the
+// given patterns.
+func (h *Hub) Subscribe(keys, channels []string) (*Subscriber, error) {
+	sub := &Subscriber{
+		hub:      h,
+		done:     make(chan struct{}),
+		keys:     make(map[string]struct{}),
+		channels: make(map[string]struct{}),
+	}
+	if err := sub.Subscribe(keys, channels); err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, ErrClosed
+	}
+
+	sub.c = make(chan Message, max(h.Buffer, 1))
+	h.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+// Notify delivers a keyspace event; it is the notifier of the storage.
+func (h *Hub) Notify(e storage.Event) {
+	h.deliver(func(sub *Subscriber) (Message, bool) {
+		p, ok := sub.match(sub.keys, e.Key)
+		return Message{Type: TypeKeyspace, Pattern: p, Event: &e}, ok
+	})
+}
+
+// Publish sends data to the subscribers of channel and returns how many
+// received it.
+func (h *Hub) Publish(channel, data string) int {
+	return h.deliver(func(sub *Subscriber) (Message, bool) {
+		p, ok := sub.match(sub.channels, channel)
+		return Message{Type: TypeMessage, Pattern: p, Channel: channel, Data: data}, ok
+	})
+}
+
+func (h *Hub) deliver(msg func(sub *Subscriber) (Message, bool)) int {
+	h.mu.RLock()
+	var n int
+	var slow []*Subscriber
+	for sub := range h.subs {
+		m, ok := msg(sub)
+		if !ok {
+			continue
+		}
+
+		select {
+		case sub.c <- m:
+			n++
+		default:
+			slow = append(slow, sub)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, sub := range slow {
+		sub.close(ErrSlowConsumer)
+	}
+	return n
+}
+
+// Close disconnects every subscriber; later subscriptions fail.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	h.closed = true
+	subs := make([]*Subscriber, 0, len(h.subs))
+	for sub := range h.subs {
+		subs = append(subs, sub)
+	}
+	h.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.close(ErrClosed)
+	}
+}
+
+// C delivers the messages. It is never closed; Done is closed instead when
+// the subscriber is disconnected.
+func (sub *Subscriber) C() <-chan Message {
+	return sub.c
+}
+
+func (sub *Subscriber) Done() <-chan struct{} {
+	return sub.done
+}
+
+// Err tells why the subscriber was disconnected.
+func (sub *Subscriber) Err() error {
+	sub.mu.RLock()
+	defer sub.mu.RUnlock()
+
+	return sub.err
+}
+
+func (sub *Subscriber) Subscribe(keys, channels []string) error {
+	if err := validPatterns(keys); err != nil {
+		return err
+	}
+	if err := validPatterns(channels); err != nil {
+		return err
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	for _, k := range keys {
+		sub.keys[k] = struct{}{}
+	}
+	for _, c := range channels {
+		sub.channels[c] = struct{}{}
+	}
+	return nil
+}
+
+func (sub *Subscriber) Unsubscribe(keys, channels []string) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	for _, k := range keys {
+		delete(sub.keys, k)
+	}
+	for _, c := range channels {
+		delete(sub.channels, c)
+	}
+}
+
+// Subscriptions returns the key and channel patterns.
+func (sub *Subscriber) Subscriptions() (keys, channels []string) {
+	sub.mu.RLock()
+	defer sub.mu.RUnlock()
+
+	keys, channels = []string{}, []string{}
+	for k := range sub.keys {
+		keys = append(keys, k)
+	}
+	for c := range sub.channels {
+		channels = append(channels, c)
+	}
+	return keys, channels
+}
+
+func (sub *Subscriber) match(patterns map[string]struct{}, name string) (string, bool) {
+	sub.mu.RLock()
+	defer sub.mu.RUnlock()
+
+	if _, ok := patterns[name]; ok {
+		return name, true
+	}
+
+	for p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+func (sub *Subscriber) Close() {
+	sub.close(ErrClosed)
+}
+
+func (sub *Subscriber) close(err error) {
+	sub.hub.mu.Lock()
+	_, ok := sub.hub.subs[sub]
+	delete(sub.hub.subs, sub)
+	sub.hub.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	sub.mu.Lock()
+	sub.err = err
+	sub.mu.Unlock()
+	close(sub.done)
+}
@@ -0,0 +1,231 @@
+package pubsub_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"proj1/internal/pkg/auth"
+	"proj1/internal/pkg/pubsub"
+	"proj1/internal/pkg/server"
+	"proj1/internal/pkg/storage"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func receive(t *testing.T, sub *pubsub.Subscriber) pubsub.Message {
+	t.Helper()
+	select {
+	case msg := <-sub.C():
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message")
+		return pubsub.Message{}
+	}
+}
+
+func TestHubMatching(t *testing.T) {
+	hub := pubsub.NewHub()
+	sub, err := hub.Subscribe([]string{"user:*", "exact"}, []string{"news"})
+	require.NoError(t, err)
+	defer sub.Close()
+
+	hub.Notify(storage.Event{Key: "other", Op: "set"})
+	hub.Notify(storage.Event{Key: "user:1", Op: "set", Kind: storage.KindInt})
+	msg := receive(t, sub)
+	assert.Equal(t, pubsub.TypeKeyspace, msg.Type)
+	assert.Equal(t, "user:*", msg.Pattern)
+	assert.Equal(t, storage.Event{Key: "user:1", Op: "set", Kind: storage.KindInt}, *msg.Event)
+
+	assert.Equal(t, 1, hub.Publish("news", "hello"))
+	assert.Equal(t, 0, hub.Publish("sports", "hello"))
+	msg = receive(t, sub)
+	assert.Equal(t, pubsub.Message{Type: pubsub.TypeMessage, Pattern: "news", Channel: "news", Data: "hello"}, msg)
+
+	sub.Unsubscribe(nil, []string{"news"})
+	assert.Equal(t, 0, hub.Publish("news", "again"))
+
+	_, err = hub.Subscribe([]string{"[broken"}, nil)
+	assert.Error(t, err)
+}
+
+func TestHubSlowConsumer(t *testing.T) {
+	hub := pubsub.NewHub()
+	hub.Buffer = 2
+	slow, err := hub.Subscribe(nil, []string{"c"})
+	require.NoError(t, err)
+	fast, err := hub.Subscribe(nil, []string{"c"})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		hub.Publish("c", "x")
+		if i < 2 {
+			receive(t, fast)
+		}
+	}
+
+	<-slow.Done()
+	assert.ErrorIs(t, slow.Err(), pubsub.ErrSlowConsumer)
+	assert.Equal(t, 1, hub.Publish("c", "y"))
+
+	hub.Close()
+	<-fast.Done()
+	assert.ErrorIs(t, fast.Err(), pubsub.ErrClosed)
+	_, err = hub.Subscribe(nil, nil)
+	assert.ErrorIs(t, err, pubsub.ErrClosed)
+}
+
+func newServer(t *testing.T) (*storage.SliceStorage, *server.Server, *httptest.Server) {
+	gin.SetMode(gin.TestMode)
+	st, err := storage.NewSliceStorage(filepath.Join(t.TempDir(), "storage.json"))
+	require.NoError(t, err)
+
+	srv := server.New("", &st)
+	hs := httptest.NewServer(srv.Handler())
+	t.Cleanup(hs.Close)
+	return &st, srv, hs
+}
+
+func TestWebSocket(t *testing.T) {
+	st, srv, hs := newServer(t)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(hs.URL, "http")+"/pubsub/ws?key=a*", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	require.NoError(t, conn.WriteJSON(map[string]any{"action": "subscribe", "channels": []string{"chat"}}))
+	var reply map[string]any
+	require.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "subscriptions", reply["type"])
+	assert.Equal(t, []any{"chat"}, reply["channels"])
+
+	require.NoError(t, st.Set("abc", "1"))
+	st.Expire("abc", -1)
+	assert.True(t, st.CheckIfExpired("abc"))
+
+	var msg pubsub.Message
+	for _, op := range []string{"set", "expireat", storage.ReasonExpired} {
+		require.NoError(t, conn.ReadJSON(&msg))
+		assert.Equal(t, "abc", msg.Event.Key)
+		assert.Equal(t, op, msg.Event.Op)
+	}
+
+	require.NoError(t, conn.WriteJSON(map[string]any{"action": "publish", "channel": "chat", "data": "hi"}))
+	var published bool
+	for i := 0; i < 2; i++ {
+		var raw map[string]any
+		require.NoError(t, conn.ReadJSON(&raw))
+		switch raw["type"] {
+		case "published":
+			published = true
+			assert.Equal(t, float64(1), raw["receivers"])
+		case pubsub.TypeMessage:
+			assert.Equal(t, "hi", raw["data"])
+		}
+	}
+	assert.True(t, published)
+
+	// A subscriber that does not read is disconnected.
+	srv.PubSub().Buffer = 1
+	slow, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(hs.URL, "http")+"/pubsub/ws?channel=flood", nil)
+	require.NoError(t, err)
+	defer slow.Close()
+	assert.Eventually(t, func() bool {
+		srv.PubSub().Publish("flood", strings.Repeat("x", 1<<10))
+		return srv.PubSub().Publish("flood", "") == 0
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestWebSocketACL(t *testing.T) {
+	acl := filepath.Join(t.TempDir(), "acl.json")
+	os.WriteFile(acl, []byte(`{"keys": [
+		{"id": "app", "key": "app-key", "grants": [
+			{"groups": ["pubsub"], "prefix": "user:", "permission": "write"}
+		]}
+	]}`), 0o600)
+	a, err := auth.Load(acl)
+	require.NoError(t, err)
+	_, srv, hs := newServer(t)
+	srv.SetACL(a)
+
+	url := "ws" + strings.TrimPrefix(hs.URL, "http") + "/pubsub/ws?key="
+	header := http.Header{"Authorization": {"Bearer app-key"}}
+	_, resp, err := websocket.DefaultDialer.Dial(url+"order:*", header)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Pages of other origins may not use credentials the browser sends.
+	_, resp, err = websocket.DefaultDialer.Dial(url+"user:*", http.Header{"Authorization": {"Bearer app-key"}, "Origin": {"https://evil.example"}})
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"user:*", header)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var reply map[string]any
+	for _, cmd := range []map[string]any{
+		{"action": "subscribe", "keys": []string{"order:*"}},
+		{"action": "subscribe", "channels": []string{"news"}},
+		{"action": "publish", "channel": "news", "data": "hi"},
+	} {
+		require.NoError(t, conn.WriteJSON(cmd))
+		require.NoError(t, conn.ReadJSON(&reply))
+		assert.Equal(t, "error", reply["type"], cmd)
+	}
+
+	require.NoError(t, conn.WriteJSON(map[string]any{"action": "subscribe", "channels": []string{"user:news"}}))
+	require.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "subscriptions", reply["type"])
+	assert.Equal(t, []any{"user:*"}, reply["keys"])
+	assert.Equal(t, uint64(4), a.Stats().Denials)
+
+	srv.SetAllowedOrigins([]string{"https://app.example"})
+	other, _, err := websocket.DefaultDialer.Dial(url+"user:*", http.Header{"Authorization": {"Bearer app-key"}, "Origin": {"https://app.example"}})
+	require.NoError(t, err)
+	other.Close()
+}
+
+func TestSSE(t *testing.T) {
+	st, _, hs := newServer(t)
+	resp, err := http.Get(hs.URL + "/pubsub/sse?key=k&channel=news")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	_, err = st.HSet("k", []map[string]string{{"f": "v"}})
+	require.NoError(t, err)
+	pub, err := http.Post(hs.URL+"/pubsub/publish/news", "application/json", strings.NewReader(`{"data":"hello"}`))
+	require.NoError(t, err)
+	pub.Body.Close()
+	assert.Equal(t, http.StatusOK, pub.StatusCode)
+
+	rd := bufio.NewReader(resp.Body)
+	var events []string
+	var messages []pubsub.Message
+	for len(messages) < 2 {
+		line, err := rd.ReadString('\n')
+		require.NoError(t, err)
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			events = append(events, strings.TrimSpace(strings.TrimPrefix(line, "event:")))
+		case strings.HasPrefix(line, "data:"):
+			var msg pubsub.Message
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &msg))
+			messages = append(messages, msg)
+		}
+	}
+
+	assert.Equal(t, []string{pubsub.TypeKeyspace, pubsub.TypeMessage}, events)
+	assert.Equal(t, storage.Event{Key: "k", Op: "hset", Kind: storage.KindMapStr}, *messages[0].Event)
+	assert.Equal(t, "hello", messages[1].Data)
+}
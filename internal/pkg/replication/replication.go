@@ -0,0 +1,323 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"proj1/internal/pkg/storage"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	StreamPath = "/replication/stream"
+
+	headerID     = "X-Replication-Id"
+	headerOffset = "X-Replication-Offset"
+	headerMode   = "X-Replication-Mode"
+
+	modeFull    = "full"
+	modePartial = "partial"
+
+	DefaultHeartbeat = time.Second
+)
+
+// The stream is newline delimited JSON: a full resync starts with the
+// snapshot on the first line, every other line is a storage.Entry, and empty
+// lines are heartbeats.
+
+type Leader struct {
+	storage   *storage.SliceStorage
+	logger    *zap.Logger
+	Heartbeat time.Duration
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func NewLeader(st *storage.SliceStorage) *Leader {
+	logger, err := zap.NewProduction()
+	if err != nil {
+		logger = zap.NewNop()
+	}
+
+	return &Leader{storage: st, logger: logger, Heartbeat: DefaultHeartbeat, done: make(chan struct{})}
+}
+
+// Close ends all streams, so that the http server can shut down.
+func (l *Leader) Close() {
+	l.closeOnce.Do(func() { close(l.done) })
+}
+
+func (l *Leader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	offset, _ := strconv.ParseUint(r.URL.Query().Get("offset"), 10, 64)
+	sub, err := l.storage.Subscribe(r.URL.Query().Get("id"), offset)
+	if errors.Is(err, storage.ErrReplicationDisabled) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		l.logger.Error("Failed to subscribe follower", zap.Error(err))
+		http.Error(w, "failed to start replication", http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+
+	mode := modePartial
+	if sub.Snapshot != nil {
+		mode = modeFull
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set(headerID, sub.ID)
+	w.Header().Set(headerOffset, strconv.FormatUint(sub.Offset, 10))
+	w.Header().Set(headerMode, mode)
+	w.WriteHeader(http.StatusOK)
+	l.logger.Info("follower connected", zap.String("remote", r.RemoteAddr), zap.String("mode", mode),
+		zap.Uint64("offset", sub.Offset))
+
+	bw := bufio.NewWriter(w)
+	flush := func() error {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		http.NewResponseController(w).Flush()
+		return nil
+	}
+
+	if sub.Snapshot != nil {
+		bw.Write(sub.Snapshot)
+		bw.WriteByte('\n')
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-l.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	enc := json.NewEncoder(bw)
+	for {
+		if err := flush(); err != nil {
+			return
+		}
+
+		next, stop := context.WithTimeout(ctx, l.Heartbeat)
+		e, err := sub.Next(next)
+		stop()
+		switch {
+		case err == nil:
+			if err = enc.Encode(e); err != nil {
+				return
+			}
+		case errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+			bw.WriteByte('\n')
+		default:
+			l.logger.Info("follower stream ended", zap.String("remote", r.RemoteAddr), zap.Error(err))
+			return
+		}
+	}
+}
+
+type Status struct {
+	Role      string `json:"role"`
+	Leader    string `json:"leader,omitempty"`
+	ID        string `json:"id"`
+	Offset    uint64 `json:"offset"`
+	Connected bool   `json:"connected"`
+}
+
+// Follower keeps a storage in sync with a leader, reconnecting after errors
+// and continuing from its offset while the leader still has it.
+type Follower struct {
+	leader  string
+	storage *storage.SliceStorage
+	logger  *zap.Logger
+
+	// Client calls the leader.
+	Client *http.Client
+	// Timeout is how long the stream may stay silent, heartbeats included,
+	// before the connection is considered dead.
+	Timeout    time.Duration
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mu        sync.Mutex
+	id        string
+	offset    uint64
+	connected bool
+}
+
+func NewFollower(leader string, st *storage.SliceStorage) (*Follower, error) {
+	if _, err := url.ParseRequestURI(leader); err != nil {
+		return nil, fmt.Errorf("leader address: %w", err)
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Follower{
+		leader:     leader,
+		storage:    st,
+		logger:     logger,
+		Client:     &http.Client{},
+		Timeout:    5 * DefaultHeartbeat,
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: 5 * time.Second,
+	}, nil
+}
+
+func (f *Follower) Leader() string {
+	return f.leader
+}
+
+func (f *Follower) Status() Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return Status{Role: "follower", Leader: f.leader, ID: f.id, Offset: f.offset, Connected: f.connected}
+}
+
+// Run replicates until ctx is canceled.
+func (f *Follower) Run(ctx context.Context) {
+	backoff := f.MinBackoff
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := f.sync(ctx)
+		f.setConnected(false)
+		if ctx.Err() != nil {
+			return
+		}
+
+		f.logger.Info("replication interrupted", zap.String("leader", f.leader), zap.Error(err))
+		if time.Since(start) > f.MaxBackoff {
+			backoff = f.MinBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, f.MaxBackoff)
+	}
+}
+
+func (f *Follower) setConnected(connected bool) {
+	f.mu.Lock()
+	f.connected = connected
+	f.mu.Unlock()
+}
+
+// sync runs one connection to the leader.
+func (f *Follower) sync(ctx context.Context) error {
+	f.mu.Lock()
+	id, offset := f.id, f.offset
+	f.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	query := url.Values{"id": {id}, "offset": {strconv.FormatUint(offset, 10)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+StreamPath+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader responded with %s", resp.Status)
+	}
+
+	// Any read, heartbeats included, keeps the connection alive.
+	watchdog := time.AfterFunc(f.Timeout, cancel)
+	defer watchdog.Stop()
+
+	rd := bufio.NewReader(resp.Body)
+	readLine := func() ([]byte, error) {
+		line, err := rd.ReadBytes('\n')
+		watchdog.Reset(f.Timeout)
+		return bytes.TrimSpace(line), err
+	}
+
+	id = resp.Header.Get(headerID)
+	offset, err = strconv.ParseUint(resp.Header.Get(headerOffset), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad offset from leader: %w", err)
+	}
+
+	if resp.Header.Get(headerMode) == modeFull {
+		snapshot, err := readLine()
+		if err != nil {
+			return err
+		}
+
+		if err = f.storage.LoadReplica(snapshot); err != nil {
+			return fmt.Errorf("load snapshot: %w", err)
+		}
+	}
+
+	f.mu.Lock()
+	f.id, f.offset, f.connected = id, offset, true
+	f.mu.Unlock()
+	f.logger.Info("replicating", zap.String("leader", f.leader), zap.String("mode", resp.Header.Get(headerMode)),
+		zap.Uint64("offset", offset))
+
+	for {
+		line, err := readLine()
+		if err != nil {
+			return err
+		}
+
+		if len(line) == 0 {
+			continue
+		}
+
+		var e storage.Entry
+		if err = json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+
+		if e.Offset != offset {
+			f.reset()
+			return fmt.Errorf("expected offset %d, got %d", offset, e.Offset)
+		}
+
+		if _, err = f.storage.ApplyReplicated(e.Record); err != nil {
+			// The copy can not be trusted anymore, so start over.
+			f.reset()
+			return fmt.Errorf("apply %s: %w", e.Record.Op, err)
+		}
+
+		offset++
+		f.mu.Lock()
+		f.offset = offset
+		f.mu.Unlock()
+	}
+}
+
+// reset makes the next connection ask for a full snapshot.
+func (f *Follower) reset() {
+	f.mu.Lock()
+	f.id = ""
+	f.mu.Unlock()
+}
@@ -0,0 +1,96 @@
+package replication
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"proj1/internal/pkg/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStorage(t *testing.T) *storage.SliceStorage {
+	st, err := storage.NewSliceStorage(filepath.Join(t.TempDir(), "storage.json"))
+	require.NoError(t, err)
+	return &st
+}
+
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	assert.Eventually(t, cond, 5*time.Second, 10*time.Millisecond)
+}
+
+func hasValue(st *storage.SliceStorage, key, want string) func() bool {
+	return func() bool {
+		val, ok := st.Get(key)
+		return ok && val == want
+	}
+}
+
+func TestReplication(t *testing.T) {
+	leaderStor := newStorage(t)
+	leaderStor.EnableReplication(100)
+	leaderStor.Set("before", "1")
+
+	leader := NewLeader(leaderStor)
+	leader.Heartbeat = 20 * time.Millisecond
+	srv := httptest.NewServer(leader)
+	defer srv.Close()
+
+	followerStor := newStorage(t)
+	follower, err := NewFollower(srv.URL, followerStor)
+	require.NoError(t, err)
+	follower.MinBackoff = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go follower.Run(ctx)
+
+	// Full sync first, then the live stream.
+	eventually(t, hasValue(followerStor, "before", "1"))
+	leaderStor.Set("after", "2")
+	err = leaderStor.RPush("list", []string{"a", "b"})
+	require.NoError(t, err)
+	eventually(t, hasValue(followerStor, "after", "2"))
+	eventually(t, func() bool {
+		val, err := followerStor.LGet("list", 1)
+		return err == nil && val == "b"
+	})
+
+	id, offset := leaderStor.ReplicationOffset()
+	eventually(t, func() bool { return follower.Status().Offset == offset })
+	status := follower.Status()
+	assert.Equal(t, id, status.ID)
+	assert.True(t, status.Connected)
+
+	// Dropping the connection must not need a new snapshot: the follower
+	// continues from its offset.
+	srv.CloseClientConnections()
+	leaderStor.Set("missed", "3")
+	eventually(t, hasValue(followerStor, "missed", "3"))
+	assert.Equal(t, id, follower.Status().ID)
+
+	// A restore on the leader starts a new stream.
+	data, err := leaderStor.Snapshot()
+	require.NoError(t, err)
+	require.NoError(t, leaderStor.Restore(data))
+	leaderStor.Set("restored", "4")
+	eventually(t, hasValue(followerStor, "restored", "4"))
+	newID, _ := leaderStor.ReplicationOffset()
+	assert.NotEqual(t, id, newID)
+	eventually(t, func() bool { return follower.Status().ID == newID })
+}
+
+func TestReplicationDisabled(t *testing.T) {
+	srv := httptest.NewServer(NewLeader(newStorage(t)))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + StreamPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
@@ -0,0 +1,111 @@
+package resp
+
+import (
+	"net/http"
+	"proj1/internal/pkg/auth"
+	"strings"
+	"time"
+)
+
+// commandGroups are the route groups of the HTTP API whose grants cover the
+// commands; the first argument of a command is its key. Commands without a
+// group, like PING, only need a valid key.
+var commandGroups = map[string]string{
+	"set": "scalar", "get": "scalar", "incr": "scalar", "decr": "scalar",
+	"incrby": "scalar", "decrby": "scalar", "incrbyfloat": "scalar",
+	"hset": "map", "hget": "map", "hincrby": "map", "hincrbyfloat": "map",
+	"lpush": "slice", "rpush": "slice", "lpop": "slice", "rpop": "slice", "lset": "slice", "lindex": "slice",
+	"expire": "any",
+	"keys":   "keys",
+}
+
+// client is the state of a connection. The key is checked again by every
+// command, so that keys removed from the access control stop working.
+type client struct {
+	remote string
+	key    string
+}
+
+// SetACL makes every command but AUTH and QUIT require an API key of acl,
+// given with AUTH or HELLO, and the grant the matching HTTP route needs.
+func (r *Server) SetACL(acl *auth.ACL) {
+	r.acl = acl
+}
+
+// cmdAuth handles AUTH [username] password; the password is an API key and
+// the username is ignored.
+func (r *Server) cmdAuth(w *writer, c *client, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		w.writeError("ERR wrong number of arguments for 'auth' command")
+		return
+	}
+
+	if r.acl == nil {
+		w.writeError("ERR AUTH called without any password configured")
+		return
+	}
+
+	if r.login(w, c, args[len(args)-1]) {
+		w.writeSimple("OK")
+	}
+}
+
+func (r *Server) login(w *writer, c *client, key string) bool {
+	if _, err := r.acl.AuthenticateKey(key); err != nil {
+		r.deny(c, "auth", http.StatusUnauthorized, err.Error())
+		w.writeError("WRONGPASS invalid username-password pair or user is disabled.")
+		return false
+	}
+
+	c.key = key
+	return true
+}
+
+// authorize checks that the client may run the command, answering it if
+// not. HELLO may authenticate with its AUTH option.
+func (r *Server) authorize(w *writer, c *client, name string, args []string) bool {
+	if name == "hello" && len(args) >= 5 && strings.EqualFold(args[2], "auth") && !r.login(w, c, args[4]) {
+		return false
+	}
+
+	id, err := r.acl.AuthenticateKey(c.key)
+	if c.key == "" || err != nil {
+		r.deny(c, name, http.StatusUnauthorized, auth.ErrNoCredentials.Error())
+		w.writeError("NOAUTH Authentication required.")
+		return false
+	}
+
+	group, ok := commandGroups[name]
+	if !ok {
+		return true
+	}
+
+	perm := auth.Read
+	if writeCommands[name] {
+		perm = auth.Write
+	}
+	// KEYS can not be filtered by grants, so it needs one on all keys.
+	var keys []string
+	if name != "keys" {
+		keys = args[1:2]
+	}
+	if !id.Allowed(group, perm, keys...) {
+		reason := perm.String() + " access to " + group + " denied"
+		r.deny(c, name, http.StatusForbidden, reason)
+		w.writeError("NOPERM " + reason)
+		return false
+	}
+
+	return true
+}
+
+func (r *Server) deny(c *client, name string, status int, reason string) {
+	r.acl.Deny(auth.Denial{
+		Time:   time.Now().UnixMilli(),
+		Remote: c.remote,
+		Method: "RESP",
+		Path:   strings.ToUpper(name),
+		Status: status,
+		Reason: reason,
+	})
+}
@@ -0,0 +1,193 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxBulkLen  = 512 << 20
+	maxArgs     = 1 << 20
+	maxInlineLn = 64 << 10
+)
+
+var errProtocol = errors.New("protocol error")
+
+type reader struct {
+	r *bufio.Reader
+}
+
+func newReader(r io.Reader) *reader {
+	return &reader{r: bufio.NewReader(r)}
+}
+
+func (r *reader) buffered() int {
+	return r.r.Buffered()
+}
+
+// readLine reads up to the next newline, failing as soon as the line
+// exceeds maxInlineLn rather than buffering it whole.
+func (r *reader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxInlineLn {
+			return "", errProtocol
+		}
+
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return "", err
+		}
+	}
+
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// readCommand reads either a RESP array of bulk strings or an inline command.
+func (r *reader) readCommand() ([]string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, nil
+	}
+
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, errProtocol
+	}
+
+	args := make([]string, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		arg, err := r.readBulk()
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+func (r *reader) readBulk() (string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return "", err
+	}
+
+	if len(line) == 0 || line[0] != '$' {
+		return "", errProtocol
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxBulkLen {
+		return "", errProtocol
+	}
+
+	buf := make([]byte, n+2)
+	if _, err = io.ReadFull(r.r, buf); err != nil {
+		return "", err
+	}
+
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return "", errProtocol
+	}
+
+	return string(buf[:n]), nil
+}
+
+type writer struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func newWriter(w io.Writer) *writer {
+	return &writer{w: bufio.NewWriter(w), proto: 2}
+}
+
+func (w *writer) flush() error {
+	return w.w.Flush()
+}
+
+func (w *writer) writeHeader(prefix byte, n int) {
+	w.w.WriteByte(prefix)
+	w.w.WriteString(strconv.Itoa(n))
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) writeSimple(s string) {
+	w.w.WriteByte('+')
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) writeError(s string) {
+	w.w.WriteByte('-')
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) writeInt(n int64) {
+	w.w.WriteByte(':')
+	w.w.WriteString(strconv.FormatInt(n, 10))
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) writeBulk(s string) {
+	w.writeHeader('$', len(s))
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) writeNull() {
+	if w.proto == 3 {
+		w.w.WriteString("_\r\n")
+		return
+	}
+
+	w.w.WriteString("$-1\r\n")
+}
+
+func (w *writer) writeNullArray() {
+	if w.proto == 3 {
+		w.w.WriteString("_\r\n")
+		return
+	}
+
+	w.w.WriteString("*-1\r\n")
+}
+
+func (w *writer) writeArray(n int) {
+	w.writeHeader('*', n)
+}
+
+func (w *writer) writeBulkArray(vals []string) {
+	w.writeArray(len(vals))
+	for _, v := range vals {
+		w.writeBulk(v)
+	}
+}
+
+// writeMap writes a RESP3 map header, or a flat array of 2*n elements for RESP2.
+func (w *writer) writeMap(n int) {
+	if w.proto == 3 {
+		w.writeHeader('%', n)
+		return
+	}
+
+	w.writeHeader('*', 2*n)
+}
@@ -0,0 +1,712 @@
+package resp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"proj1/internal/pkg/auth"
+	"proj1/internal/pkg/storage"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const wrongType = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+type Server struct {
+	host     string
+	storage  *storage.SliceStorage
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	closing  bool
+	wg       sync.WaitGroup
+	commands map[string]command
+	readOnly atomic.Bool
+	acl      *auth.ACL
+}
+
+type command struct {
+	arity   int
+	handler func(w *writer, args []string)
+}
+
+func New(host string, st *storage.SliceStorage) *Server {
+	s := &Server{
+		host:    host,
+		storage: st,
+		conns:   make(map[net.Conn]struct{}),
+	}
+	s.registerCommands()
+	return s
+}
+
+// arity follows the redis convention: positive is an exact number of
+// arguments including the command name, negative is a minimum.
+func (r *Server) registerCommands() {
+	r.commands = map[string]command{
+		"ping":         {-1, r.cmdPing},
+		"echo":         {2, r.cmdEcho},
+		"hello":        {-1, r.cmdHello},
+		"select":       {2, r.cmdSelect},
+		"client":       {-2, r.cmdOK},
+		"command":      {-1, r.cmdCommand},
+		"set":          {-3, r.cmdSet},
+		"get":          {2, r.cmdGet},
+		"incr":         {2, r.cmdIncr(1)},
+		"decr":         {2, r.cmdIncr(-1)},
+		"incrby":       {3, r.cmdIncrBy(1)},
+		"decrby":       {3, r.cmdIncrBy(-1)},
+		"incrbyfloat":  {3, r.cmdIncrByFloat},
+		"hincrby":      {4, r.cmdHIncrBy},
+		"hincrbyfloat": {4, r.cmdHIncrByFloat},
+		"hset":         {-4, r.cmdHSet},
+		"hget":         {3, r.cmdHGet},
+		"lpush":        {-3, r.cmdLPush},
+		"rpush":        {-3, r.cmdRPush},
+		"lpop":         {-2, r.cmdLPop},
+		"rpop":         {-2, r.cmdRPop},
+		"lset":         {4, r.cmdLSet},
+		"lindex":       {3, r.cmdLIndex},
+		"expire":       {3, r.cmdExpire},
+		"keys":         {2, r.cmdKeys},
+	}
+}
+
+// writeCommands are refused on a read-only replica.
+var writeCommands = map[string]bool{
+	"set": true, "incr": true, "decr": true, "incrby": true, "decrby": true, "incrbyfloat": true,
+	"hincrby": true, "hincrbyfloat": true, "hset": true, "lpush": true, "rpush": true,
+	"lpop": true, "rpop": true, "lset": true, "expire": true,
+}
+
+// SetReadOnly makes the server refuse writes, like a redis replica does.
+func (r *Server) SetReadOnly(readOnly bool) {
+	r.readOnly.Store(readOnly)
+}
+
+func (r *Server) Start() error {
+	fmt.Println("Starting RESP server at", r.host)
+	ln, err := net.Listen("tcp", r.host)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	return r.Serve(ln)
+}
+
+func (r *Server) Serve(ln net.Listener) error {
+	r.mu.Lock()
+	if r.closing {
+		r.mu.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	r.listener = ln
+	r.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			r.mu.Lock()
+			closing := r.closing
+			r.mu.Unlock()
+			if closing {
+				return nil
+			}
+
+			return fmt.Errorf("accept: %w", err)
+		}
+
+		r.mu.Lock()
+		if r.closing {
+			r.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		r.conns[conn] = struct{}{}
+		r.wg.Add(1)
+		r.mu.Unlock()
+
+		go r.serveConn(conn)
+	}
+}
+
+func (r *Server) Shutdown(ctx context.Context) error {
+	fmt.Println("Shutting down RESP server...")
+
+	r.mu.Lock()
+	r.closing = true
+	if r.listener != nil {
+		r.listener.Close()
+	}
+	// Wake up connections blocked in read; a command that is being executed
+	// still gets its reply written before the connection goes away.
+	for conn := range r.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		r.mu.Lock()
+		for conn := range r.conns {
+			conn.Close()
+		}
+		r.mu.Unlock()
+		return fmt.Errorf("RESP server forced to shutdown: %w", ctx.Err())
+	}
+}
+
+func (r *Server) serveConn(conn net.Conn) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.conns, conn)
+		r.mu.Unlock()
+		conn.Close()
+		r.wg.Done()
+	}()
+
+	rd := newReader(conn)
+	wr := newWriter(conn)
+	c := &client{remote: conn.RemoteAddr().String()}
+	for {
+		args, err := rd.readCommand()
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				wr.writeError("ERR Protocol error")
+				wr.flush()
+			}
+			return
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := strings.EqualFold(args[0], "quit")
+		if quit {
+			wr.writeSimple("OK")
+		} else {
+			r.exec(wr, c, args)
+		}
+
+		// Replies to pipelined commands are flushed together once the
+		// client has nothing more buffered for us.
+		if quit || rd.buffered() == 0 {
+			if err = wr.flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+func (r *Server) exec(w *writer, c *client, args []string) {
+	name := strings.ToLower(args[0])
+	if name == "auth" {
+		r.cmdAuth(w, c, args[1:])
+		return
+	}
+
+	cmd, ok := r.commands[name]
+	if !ok {
+		w.writeError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		w.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+
+	if r.acl != nil && !r.authorize(w, c, name, args) {
+		return
+	}
+
+	if writeCommands[name] && r.readOnly.Load() {
+		w.writeError("READONLY You can't write against a read only replica.")
+		return
+	}
+
+	cmd.handler(w, args[1:])
+}
+
+func (r *Server) cmdOK(w *writer, args []string) {
+	w.writeSimple("OK")
+}
+
+func (r *Server) cmdPing(w *writer, args []string) {
+	if len(args) > 0 {
+		w.writeBulk(args[0])
+		return
+	}
+
+	w.writeSimple("PONG")
+}
+
+func (r *Server) cmdEcho(w *writer, args []string) {
+	w.writeBulk(args[0])
+}
+
+func (r *Server) cmdSelect(w *writer, args []string) {
+	if args[0] != "0" {
+		w.writeError("ERR DB index is out of range")
+		return
+	}
+
+	w.writeSimple("OK")
+}
+
+func (r *Server) cmdCommand(w *writer, args []string) {
+	w.writeArray(0)
+}
+
+func (r *Server) cmdHello(w *writer, args []string) {
+	if len(args) > 0 {
+		proto, err := strconv.Atoi(args[0])
+		if err != nil || (proto != 2 && proto != 3) {
+			w.writeError("NOPROTO unsupported protocol version")
+			return
+		}
+
+		w.proto = proto
+	}
+
+	w.writeMap(6)
+	w.writeBulk("server")
+	w.writeBulk("storage_go")
+	w.writeBulk("version")
+	w.writeBulk("7.0.0")
+	w.writeBulk("proto")
+	w.writeInt(int64(w.proto))
+	w.writeBulk("mode")
+	w.writeBulk("standalone")
+	w.writeBulk("role")
+	w.writeBulk("master")
+	w.writeBulk("modules")
+	w.writeArray(0)
+}
+
+func isScalar(kind string) bool {
+	return kind == string(storage.KindString) || kind == string(storage.KindInt)
+}
+
+func isSlice(kind string) bool {
+	return kind == string(storage.KindSliceStr) || kind == string(storage.KindSliceInt)
+}
+
+func (r *Server) cmdSet(w *writer, args []string) {
+	key := args[0]
+	var ttl int64 = -1
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToLower(args[i])
+		if (opt != "ex" && opt != "px") || i+1 >= len(args) {
+			w.writeError("ERR syntax error")
+			return
+		}
+
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n <= 0 {
+			w.writeError("ERR invalid expire time in 'set' command")
+			return
+		}
+
+		ttl = n
+		if opt == "px" {
+			ttl = (n + 999) / 1000
+		}
+		i++
+	}
+
+	if err := r.storage.SetScalar(key, args[1]); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	if ttl > 0 {
+		r.storage.Expire(key, ttl)
+	}
+
+	w.writeSimple("OK")
+}
+
+func (r *Server) cmdGet(w *writer, args []string) {
+	key := args[0]
+	if r.storage.CheckIfExpired(key) {
+		w.writeNull()
+		return
+	}
+
+	kind := r.storage.GetKind(key)
+	if kind == "" {
+		w.writeNull()
+		return
+	}
+
+	if !isScalar(kind) {
+		w.writeError(wrongType)
+		return
+	}
+
+	v, ok := r.storage.Get(key)
+	if !ok {
+		w.writeNull()
+		return
+	}
+
+	w.writeBulk(v)
+}
+
+func (r *Server) cmdIncr(sign int64) func(w *writer, args []string) {
+	return func(w *writer, args []string) {
+		r.incrBy(w, args[0], sign)
+	}
+}
+
+func (r *Server) cmdIncrBy(sign int64) func(w *writer, args []string) {
+	return func(w *writer, args []string) {
+		delta, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			w.writeError("ERR value is not an integer or out of range")
+			return
+		}
+
+		r.incrBy(w, args[0], sign*delta)
+	}
+}
+
+func (r *Server) incrBy(w *writer, key string, delta int64) {
+	r.storage.CheckIfExpired(key)
+	res, err := r.storage.IncrBy(key, delta)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	w.writeInt(res)
+}
+
+func (r *Server) cmdIncrByFloat(w *writer, args []string) {
+	delta, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		w.writeError("ERR value is not a valid float")
+		return
+	}
+
+	r.storage.CheckIfExpired(args[0])
+	res, err := r.storage.IncrByFloat(args[0], delta)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	w.writeBulk(strconv.FormatFloat(res, 'f', -1, 64))
+}
+
+func (r *Server) cmdHIncrBy(w *writer, args []string) {
+	delta, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		w.writeError("ERR value is not an integer or out of range")
+		return
+	}
+
+	r.storage.CheckIfExpired(args[0])
+	res, err := r.storage.HIncrBy(args[0], args[1], delta)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	w.writeInt(res)
+}
+
+func (r *Server) cmdHIncrByFloat(w *writer, args []string) {
+	delta, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		w.writeError("ERR value is not a valid float")
+		return
+	}
+
+	r.storage.CheckIfExpired(args[0])
+	res, err := r.storage.HIncrByFloat(args[0], args[1], delta)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	w.writeBulk(strconv.FormatFloat(res, 'f', -1, 64))
+}
+
+func writeStorageError(w *writer, err error) {
+	if errors.Is(err, storage.ErrWrongKind) {
+		w.writeError(wrongType)
+		return
+	}
+
+	if errors.Is(err, storage.ErrOOM) {
+		w.writeError("OOM " + err.Error())
+		return
+	}
+
+	w.writeError("ERR " + err.Error())
+}
+
+func (r *Server) cmdHSet(w *writer, args []string) {
+	key := args[0]
+	if len(args)%2 != 1 {
+		w.writeError("ERR wrong number of arguments for 'hset' command")
+		return
+	}
+
+	r.storage.CheckIfExpired(key)
+	fields := make(map[string]string)
+	for i := 1; i < len(args); i += 2 {
+		fields[args[i]] = args[i+1]
+	}
+
+	c, err := r.storage.HSet(key, []map[string]string{fields})
+	if errors.Is(err, storage.ErrOOM) {
+		writeStorageError(w, err)
+		return
+	}
+	if err != nil {
+		w.writeError(wrongType)
+		return
+	}
+
+	w.writeInt(int64(c))
+}
+
+func (r *Server) cmdHGet(w *writer, args []string) {
+	key := args[0]
+	if r.storage.CheckIfExpired(key) {
+		w.writeNull()
+		return
+	}
+
+	res, err := r.storage.HGet(key, args[1])
+	if err != nil {
+		w.writeError(wrongType)
+		return
+	}
+
+	if res == nil {
+		w.writeNull()
+		return
+	}
+
+	w.writeBulk(*res)
+}
+
+func (r *Server) push(w *writer, args []string, push func(string, []string) error) {
+	key := args[0]
+	r.storage.CheckIfExpired(key)
+	if kind := r.storage.GetKind(key); kind != "" && !isSlice(kind) {
+		w.writeError(wrongType)
+		return
+	}
+
+	if err := push(key, args[1:]); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	w.writeInt(int64(r.storage.LLen(key)))
+}
+
+func (r *Server) cmdLPush(w *writer, args []string) {
+	r.push(w, args, r.storage.LPush)
+}
+
+func (r *Server) cmdRPush(w *writer, args []string) {
+	r.push(w, args, r.storage.RPush)
+}
+
+func (r *Server) pop(w *writer, args []string, pop func(string, ...int) []string) {
+	key := args[0]
+	if len(args) > 2 {
+		w.writeError("ERR syntax error")
+		return
+	}
+
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			w.writeError("ERR value is out of range, must be positive")
+			return
+		}
+		count = n
+	}
+
+	if r.storage.CheckIfExpired(key) || r.storage.GetKind(key) == "" {
+		if len(args) == 2 {
+			w.writeNullArray()
+		} else {
+			w.writeNull()
+		}
+		return
+	}
+
+	if !isSlice(r.storage.GetKind(key)) {
+		w.writeError(wrongType)
+		return
+	}
+
+	res := pop(key, count)
+	if len(args) == 2 {
+		w.writeBulkArray(res)
+		return
+	}
+
+	if len(res) == 0 {
+		w.writeNull()
+		return
+	}
+
+	w.writeBulk(res[0])
+}
+
+func (r *Server) cmdLPop(w *writer, args []string) {
+	r.pop(w, args, r.storage.LPop)
+}
+
+func (r *Server) cmdRPop(w *writer, args []string) {
+	r.pop(w, args, r.storage.RPop)
+}
+
+func (r *Server) cmdLSet(w *writer, args []string) {
+	key := args[0]
+	index, err := strconv.Atoi(args[1])
+	if err != nil {
+		w.writeError("ERR value is not an integer or out of range")
+		return
+	}
+
+	if r.storage.CheckIfExpired(key) || r.storage.GetKind(key) == "" {
+		w.writeError("ERR no such key")
+		return
+	}
+
+	if !isSlice(r.storage.GetKind(key)) {
+		w.writeError(wrongType)
+		return
+	}
+
+	if _, err = r.storage.LSet(key, index, args[2]); errors.Is(err, storage.ErrOOM) {
+		writeStorageError(w, err)
+		return
+	} else if err != nil {
+		w.writeError("ERR index out of range")
+		return
+	}
+
+	w.writeSimple("OK")
+}
+
+func (r *Server) cmdLIndex(w *writer, args []string) {
+	key := args[0]
+	index, err := strconv.Atoi(args[1])
+	if err != nil {
+		w.writeError("ERR value is not an integer or out of range")
+		return
+	}
+
+	if r.storage.CheckIfExpired(key) {
+		w.writeNull()
+		return
+	}
+
+	if kind := r.storage.GetKind(key); kind != "" && !isSlice(kind) {
+		w.writeError(wrongType)
+		return
+	}
+
+	res, err := r.storage.LGet(key, index)
+	if err != nil {
+		w.writeNull()
+		return
+	}
+
+	w.writeBulk(res)
+}
+
+func (r *Server) cmdExpire(w *writer, args []string) {
+	seconds, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		w.writeError("ERR value is not an integer or out of range")
+		return
+	}
+
+	if r.storage.CheckIfExpired(args[0]) {
+		w.writeInt(0)
+		return
+	}
+
+	w.writeInt(int64(r.storage.Expire(args[0], seconds)))
+}
+
+func (r *Server) cmdKeys(w *writer, args []string) {
+	res, err := r.storage.RegExKeys(globToRegexp(args[0]))
+	if err != nil {
+		w.writeError("ERR invalid pattern")
+		return
+	}
+
+	w.writeBulkArray(res)
+}
+
+// globToRegexp translates a redis glob pattern (*, ?, [...], \x) into an
+// anchored regular expression understood by SliceStorage.RegExKeys.
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteByte('^')
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			b.WriteString("(?s:.*)")
+		case '?':
+			b.WriteString("(?s:.)")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			} else {
+				b.WriteString(`\\`)
+			}
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+
+			class := pattern[i+1 : i+1+end]
+			b.WriteByte('[')
+			if strings.HasPrefix(class, "^") {
+				b.WriteByte('^')
+				class = class[1:]
+			}
+			b.WriteString(strings.ReplaceAll(class, `\`, `\\`))
+			b.WriteByte(']')
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteByte('$')
+	return b.String()
+}
@@ -0,0 +1,190 @@
+package resp
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"proj1/internal/pkg/auth"
+	"proj1/internal/pkg/storage"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestServer(t *testing.T) (*Server, net.Conn) {
+	return setupAuthServer(t, nil)
+}
+
+func setupAuthServer(t *testing.T, acl *auth.ACL) (*Server, net.Conn) {
+	stor, err := storage.NewSliceStorage("slice_storage.json")
+	require.NoError(t, err)
+
+	srv := New("127.0.0.1:0", &stor)
+	if acl != nil {
+		srv.SetACL(acl)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Shutdown(context.Background())
+	})
+	return srv, conn
+}
+
+func encode(args ...string) string {
+	w := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, a := range args {
+		w += "$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n"
+	}
+	return w
+}
+
+func roundTrip(t *testing.T, conn net.Conn, req, expected string) {
+	t.Helper()
+	_, err := conn.Write([]byte(req))
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, len(expected))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(buf))
+}
+
+func TestScalarCommands(t *testing.T) {
+	_, conn := setupTestServer(t)
+
+	roundTrip(t, conn, encode("SET", "name", "alice"), "+OK\r\n")
+	roundTrip(t, conn, encode("GET", "name"), "$5\r\nalice\r\n")
+	roundTrip(t, conn, encode("SET", "n", "42", "EX", "100"), "+OK\r\n")
+	roundTrip(t, conn, encode("GET", "n"), "$2\r\n42\r\n")
+	roundTrip(t, conn, encode("GET", "missing"), "$-1\r\n")
+	roundTrip(t, conn, encode("EXPIRE", "name", "100"), ":1\r\n")
+	roundTrip(t, conn, encode("KEYS", "na*"), "*1\r\n$4\r\nname\r\n")
+	roundTrip(t, conn, encode("INCRBY", "n", "8"), ":50\r\n")
+	roundTrip(t, conn, encode("INCR", "name"), "-ERR value is not an integer or out of range\r\n")
+	roundTrip(t, conn, encode("SET", "name"), "-ERR wrong number of arguments for 'set' command\r\n")
+
+	// Values are stored as sent, quotes included.
+	roundTrip(t, conn, encode("SET", "quoted", `"a"`), "+OK\r\n")
+	roundTrip(t, conn, encode("GET", "quoted"), "$3\r\n\"a\"\r\n")
+	roundTrip(t, conn, encode("SET", "quoted", `x"`), "+OK\r\n")
+	roundTrip(t, conn, encode("GET", "quoted"), "$2\r\nx\"\r\n")
+}
+
+func TestListAndMapCommands(t *testing.T) {
+	_, conn := setupTestServer(t)
+
+	roundTrip(t, conn, encode("RPUSH", "list", "a", "b", "c"), ":3\r\n")
+	roundTrip(t, conn, encode("LPUSH", "list", "z"), ":4\r\n")
+	roundTrip(t, conn, encode("LINDEX", "list", "-1"), "$1\r\nc\r\n")
+	roundTrip(t, conn, encode("LSET", "list", "1", "x"), "+OK\r\n")
+	roundTrip(t, conn, encode("LPOP", "list"), "$1\r\nz\r\n")
+	roundTrip(t, conn, encode("RPOP", "list", "2"), "*2\r\n$1\r\nc\r\n$1\r\nb\r\n")
+	roundTrip(t, conn, encode("GET", "list"), "-"+wrongType+"\r\n")
+	roundTrip(t, conn, encode("RPUSH", "nums", "1", "2"), ":2\r\n")
+	roundTrip(t, conn, encode("RPUSH", "nums", "x"), "-"+wrongType+"\r\n")
+	roundTrip(t, conn, encode("LINDEX", "nums", "-1"), "$1\r\n2\r\n")
+
+	roundTrip(t, conn, encode("HSET", "user", "name", "bob"), ":1\r\n")
+	roundTrip(t, conn, encode("HGET", "user", "name"), "$3\r\nbob\r\n")
+	roundTrip(t, conn, encode("HGET", "user", "age"), "$-1\r\n")
+}
+
+func TestPipeliningAndResp3(t *testing.T) {
+	_, conn := setupTestServer(t)
+
+	req := encode("HELLO", "3") + encode("SET", "k", "v") + encode("GET", "k") + encode("GET", "nope") + "PING\r\n"
+	expected := "%6\r\n$6\r\nserver\r\n$10\r\nstorage_go\r\n$7\r\nversion\r\n$5\r\n7.0.0\r\n" +
+		"$5\r\nproto\r\n:3\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n" +
+		"$7\r\nmodules\r\n*0\r\n" +
+		"+OK\r\n$1\r\nv\r\n_\r\n+PONG\r\n"
+	roundTrip(t, conn, req, expected)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	srv, conn := setupTestServer(t)
+	roundTrip(t, conn, encode("PING"), "+PONG\r\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	assert.Equal(t, `^h(?s:.)llo$`, globToRegexp("h?llo"))
+	assert.Equal(t, `^h[ae]llo(?s:.*)$`, globToRegexp("h[ae]llo*"))
+	assert.Equal(t, `^h\*llo$`, globToRegexp(`h\*llo`))
+	assert.Equal(t, `^a\.b$`, globToRegexp("a.b"))
+}
+
+func TestReadOnlyReplica(t *testing.T) {
+	srv, conn := setupTestServer(t)
+	srv.storage.Set("n", "42")
+	srv.SetReadOnly(true)
+
+	roundTrip(t, conn, encode("SET", "name", "bob"), "-READONLY You can't write against a read only replica.\r\n")
+	roundTrip(t, conn, encode("LPOP", "list"), "-READONLY You can't write against a read only replica.\r\n")
+	roundTrip(t, conn, encode("GET", "n"), "$2\r\n42\r\n")
+}
+
+func TestAuth(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "acl.json")
+	os.WriteFile(file, []byte(`{"keys": [
+		{"id": "app", "key": "app-key", "grants": [
+			{"groups": ["scalar"], "prefix": "user:", "permission": "write"},
+			{"groups": ["slice"], "permission": "read"}
+		]}
+	]}`), 0o600)
+	acl, err := auth.Load(file)
+	require.NoError(t, err)
+	_, conn := setupAuthServer(t, acl)
+
+	roundTrip(t, conn, encode("GET", "user:1"), "-NOAUTH Authentication required.\r\n")
+	roundTrip(t, conn, encode("AUTH", "wrong"), "-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+	roundTrip(t, conn, encode("AUTH", "default", "app-key"), "+OK\r\n")
+
+	roundTrip(t, conn, encode("SET", "user:1", "bob"), "+OK\r\n")
+	roundTrip(t, conn, encode("GET", "user:1"), "$3\r\nbob\r\n")
+	roundTrip(t, conn, encode("GET", "order:1"), "-NOPERM read access to scalar denied\r\n")
+	roundTrip(t, conn, encode("LINDEX", "list", "0"), "$-1\r\n")
+	roundTrip(t, conn, encode("LPOP", "list"), "-NOPERM write access to slice denied\r\n")
+	roundTrip(t, conn, encode("KEYS", "*"), "-NOPERM read access to keys denied\r\n")
+	roundTrip(t, conn, encode("PING"), "+PONG\r\n")
+	assert.Equal(t, uint64(5), acl.Stats().Denials)
+
+	_, conn = setupAuthServer(t, acl)
+	roundTrip(t, conn, encode("HELLO", "2", "AUTH", "default", "app-key")+encode("GET", "user:1"),
+		"*12\r\n$6\r\nserver\r\n$10\r\nstorage_go\r\n$7\r\nversion\r\n$5\r\n7.0.0\r\n"+
+			"$5\r\nproto\r\n:2\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n"+
+			"$7\r\nmodules\r\n*0\r\n$-1\r\n")
+}
+
+// endless is a client that never ends its line.
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	return len(p), nil
+}
+
+func TestLongLine(t *testing.T) {
+	_, err := newReader(endless{}).readLine()
+	assert.ErrorIs(t, err, errProtocol)
+}
@@ -0,0 +1,335 @@
+package ring
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"proj1/internal/pkg/storage"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	TopologyPath = "/ring"
+	ImportPath   = "/ring/import"
+
+	DefaultBatchSize = 100
+	defaultTimeout   = 10 * time.Second
+	retryInterval    = time.Second
+)
+
+var ErrUnknownNode = errors.New("node is not in the ring")
+
+// Topology is what the nodes agree on: a topology replaces the current one
+// only if its epoch is higher. Membership changes are meant to be made one
+// at a time.
+type Topology struct {
+	Epoch  uint64   `json:"epoch"`
+	VNodes int      `json:"vnodes"`
+	Nodes  []string `json:"nodes"`
+}
+
+type Status struct {
+	Self      string   `json:"self"`
+	Topology  Topology `json:"topology"`
+	Migrating bool     `json:"migrating"`
+	Moved     uint64   `json:"moved"`
+}
+
+// ImportRequest carries keys exported by the node that owned them before.
+type ImportRequest struct {
+	Keys map[string]json.RawMessage `json:"keys"`
+}
+
+type ImportResponse struct {
+	Imported int `json:"imported"`
+}
+
+// Cluster keeps the topology of a sharded cluster on one node and moves the
+// keys the node does not own anymore to their owners in the background.
+// Nodes are identified by the URL of their HTTP API.
+type Cluster struct {
+	self    string
+	storage *storage.SliceStorage
+	logger  *zap.Logger
+
+	// Client calls the other nodes.
+	Client    *http.Client
+	BatchSize int
+
+	mu       sync.RWMutex
+	topology Topology
+	ring     *Ring
+
+	kick      chan struct{}
+	migrating atomic.Bool
+	moved     atomic.Uint64
+}
+
+// NewCluster creates the node self of a cluster of nodes; self does not
+// have to be one of them, e.g. when it is yet to be added.
+func NewCluster(self string, nodes []string, vnodes int, st *storage.SliceStorage) (*Cluster, error) {
+	if _, err := url.ParseRequestURI(self); err != nil {
+		return nil, fmt.Errorf("node address: %w", err)
+	}
+
+	for _, node := range nodes {
+		if _, err := url.ParseRequestURI(node); err != nil {
+			return nil, fmt.Errorf("node address: %w", err)
+		}
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return nil, err
+	}
+
+	r := New(vnodes, nodes...)
+	c := &Cluster{
+		self:      self,
+		storage:   st,
+		logger:    logger,
+		Client:    &http.Client{Timeout: defaultTimeout},
+		BatchSize: DefaultBatchSize,
+		topology:  Topology{VNodes: r.VNodes(), Nodes: r.Nodes()},
+		ring:      r,
+		kick:      make(chan struct{}, 1),
+	}
+	// Keys loaded from a file may belong to other nodes by now.
+	c.kick <- struct{}{}
+	return c, nil
+}
+
+func (c *Cluster) Self() string {
+	return c.self
+}
+
+// Owner returns the node key belongs to.
+func (c *Cluster) Owner(key string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.ring.Owner(key)
+}
+
+func (c *Cluster) Topology() Topology {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	t := c.topology
+	t.Nodes = slices.Clone(t.Nodes)
+	return t
+}
+
+func (c *Cluster) Status() Status {
+	return Status{Self: c.self, Topology: c.Topology(), Migrating: c.migrating.Load(), Moved: c.moved.Load()}
+}
+
+// SetTopology replaces the topology if t is newer and reports whether it
+// did. Keys are moved to their new owners in the background.
+func (c *Cluster) SetTopology(t Topology) bool {
+	c.mu.Lock()
+	if t.Epoch <= c.topology.Epoch {
+		c.mu.Unlock()
+		return false
+	}
+
+	c.ring = New(t.VNodes, t.Nodes...)
+	c.topology = Topology{Epoch: t.Epoch, VNodes: c.ring.VNodes(), Nodes: c.ring.Nodes()}
+	c.mu.Unlock()
+
+	c.logger.Info("ring topology changed", zap.Uint64("epoch", t.Epoch), zap.Strings("nodes", t.Nodes))
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// AddNode adds node to the ring and sends the new topology to every node.
+func (c *Cluster) AddNode(ctx context.Context, node string) error {
+	if _, err := url.ParseRequestURI(node); err != nil {
+		return fmt.Errorf("node address: %w", err)
+	}
+
+	old := c.Topology()
+	if slices.Contains(old.Nodes, node) {
+		return nil
+	}
+
+	return c.change(ctx, old, append(slices.Clone(old.Nodes), node))
+}
+
+// RemoveNode takes node out of the ring; it hands its keys over to the
+// others before it may be stopped.
+func (c *Cluster) RemoveNode(ctx context.Context, node string) error {
+	old := c.Topology()
+	if !slices.Contains(old.Nodes, node) {
+		return ErrUnknownNode
+	}
+
+	return c.change(ctx, old, slices.DeleteFunc(slices.Clone(old.Nodes), func(n string) bool {
+		return n == node
+	}))
+}
+
+// change sends the new topology to the nodes of both the old and the new
+// one, so that a removed node learns it has to hand over its keys.
+func (c *Cluster) change(ctx context.Context, old Topology, nodes []string) error {
+	t := Topology{Epoch: old.Epoch + 1, VNodes: old.VNodes, Nodes: nodes}
+	c.SetTopology(t)
+
+	body, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, node := range slices.Compact(slices.Sorted(slices.Values(slices.Concat(old.Nodes, nodes)))) {
+		if node == c.self {
+			continue
+		}
+
+		if err = c.post(ctx, http.MethodPut, node+TopologyPath, body, nil); err != nil {
+			c.logger.Error("Failed to send topology", zap.String("node", node), zap.Error(err))
+			errs = append(errs, fmt.Errorf("%s: %w", node, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Cluster) post(ctx context.Context, method, target string, body []byte, res any) error {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("node responded with %s", resp.Status)
+	}
+
+	if res == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+// Import stores keys handed over by their previous owner.
+func (c *Cluster) Import(keys map[string]json.RawMessage) (int, error) {
+	var imported int
+	for key, data := range keys {
+		ok, err := c.storage.Import(key, data)
+		if err != nil {
+			return imported, fmt.Errorf("import %s: %w", key, err)
+		}
+		if ok {
+			imported++
+		}
+	}
+
+	return imported, nil
+}
+
+// Run moves keys to their owners whenever the topology changes, and retries
+// until all of them are moved. It returns when ctx is canceled.
+func (c *Cluster) Run(ctx context.Context) {
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.kick:
+		case <-retry:
+		}
+
+		retry = nil
+		if err := c.migrate(ctx); err != nil && ctx.Err() == nil {
+			c.logger.Error("Failed to move keys", zap.Error(err))
+			retry = time.After(retryInterval)
+		}
+	}
+}
+
+func (c *Cluster) migrate(ctx context.Context) error {
+	c.migrating.Store(true)
+	defer c.migrating.Store(false)
+
+	c.mu.RLock()
+	r := c.ring
+	c.mu.RUnlock()
+
+	moving := make(map[string][]string)
+	for _, key := range c.storage.Keys() {
+		if owner := r.Owner(key); owner != "" && owner != c.self {
+			moving[owner] = append(moving[owner], key)
+		}
+	}
+
+	var errs []error
+	for owner, keys := range moving {
+		for batch := range slices.Chunk(keys, max(c.BatchSize, 1)) {
+			if err := c.handOver(ctx, owner, batch); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", owner, err))
+				break
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// handOver sends keys to owner and drops the ones that did not change in
+// the meantime; the others are sent again on the next run.
+func (c *Cluster) handOver(ctx context.Context, owner string, keys []string) error {
+	req := ImportRequest{Keys: make(map[string]json.RawMessage, len(keys))}
+	versions := make(map[string]uint64, len(keys))
+	for _, key := range keys {
+		if data, version, ok := c.storage.Export(key); ok {
+			req.Keys[key], versions[key] = data, version
+		}
+	}
+
+	if len(req.Keys) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	var res ImportResponse
+	if err = c.post(ctx, http.MethodPost, owner+ImportPath, body, &res); err != nil {
+		return err
+	}
+
+	var dropped uint64
+	for key, version := range versions {
+		if c.storage.DropIfUnchanged(key, version) {
+			dropped++
+		}
+	}
+
+	c.moved.Add(dropped)
+	c.logger.Info("keys handed over", zap.String("owner", owner), zap.Uint64("keys", dropped))
+	if dropped < uint64(len(versions)) {
+		return fmt.Errorf("%d keys changed while being handed over", uint64(len(versions))-dropped)
+	}
+	return nil
+}
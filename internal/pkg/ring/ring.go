@@ -0,0 +1,97 @@
+package ring
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+const DefaultVNodes = 128
+
+// Ring maps keys to nodes with consistent hashing. Every node is placed on
+// the ring vnodes times, so that keys spread evenly and adding or removing a
+// node only moves the keys of its share. A Ring is not modified after it was
+// created, so it can be used concurrently.
+type Ring struct {
+	vnodes int
+	nodes  []string
+	hashes []uint64
+	owners map[uint64]string
+}
+
+func New(vnodes int, nodes ...string) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVNodes
+	}
+
+	r := &Ring{vnodes: vnodes, owners: make(map[uint64]string, vnodes*len(nodes))}
+	for _, node := range nodes {
+		if node == "" || slices.Contains(r.nodes, node) {
+			continue
+		}
+		r.nodes = append(r.nodes, node)
+
+		for i := 0; i < vnodes; i++ {
+			h := hash(node + "#" + strconv.Itoa(i))
+			// Collisions go to the smaller node, whatever the order of nodes.
+			if owner, ok := r.owners[h]; ok && owner < node {
+				continue
+			}
+			r.owners[h] = node
+		}
+	}
+	sort.Strings(r.nodes)
+
+	r.hashes = make([]uint64, 0, len(r.owners))
+	for h := range r.owners {
+		r.hashes = append(r.hashes, h)
+	}
+	slices.Sort(r.hashes)
+	return r
+}
+
+// hash is FNV-1a with the finalizer of splitmix64, since FNV alone spreads
+// strings that only differ at the end poorly.
+func hash(s string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	h := f.Sum64()
+
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// Owner returns the node key belongs to, the first one clockwise from the
+// hash of key; empty if the ring has no nodes.
+func (r *Ring) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	h := hash(key)
+	i, _ := slices.BinarySearch(r.hashes, h)
+	if i == len(r.hashes) {
+		i = 0
+	}
+
+	return r.owners[r.hashes[i]]
+}
+
+// Nodes returns the nodes in sorted order.
+func (r *Ring) Nodes() []string {
+	return slices.Clone(r.nodes)
+}
+
+func (r *Ring) VNodes() int {
+	return r.vnodes
+}
+
+func (r *Ring) Has(node string) bool {
+	_, ok := slices.BinarySearch(r.nodes, node)
+	return ok
+}
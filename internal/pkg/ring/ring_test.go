@@ -0,0 +1,245 @@
+package ring_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"proj1/internal/pkg/ring"
+	"proj1/internal/pkg/server"
+	"proj1/internal/pkg/storage"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRingDistribution(t *testing.T) {
+	nodes := []string{"http://a:1", "http://b:1", "http://c:1"}
+	r := ring.New(ring.DefaultVNodes, nodes...)
+	assert.Equal(t, r.Nodes(), ring.New(ring.DefaultVNodes, "http://c:1", "http://a:1", "http://b:1").Nodes())
+	assert.Empty(t, ring.New(0).Owner("key"))
+
+	const keys = 30000
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		counts[r.Owner("key"+strconv.Itoa(i))]++
+	}
+	for _, node := range nodes {
+		assert.InDelta(t, keys/3, counts[node], keys/3*0.2, node)
+	}
+
+	// Only keys taken over by the new node move.
+	grown := ring.New(ring.DefaultVNodes, append(nodes, "http://d:1")...)
+	var moved int
+	for i := 0; i < keys; i++ {
+		key := "key" + strconv.Itoa(i)
+		if before, after := r.Owner(key), grown.Owner(key); before != after {
+			assert.Equal(t, "http://d:1", after)
+			moved++
+		}
+	}
+	assert.InDelta(t, keys/4, moved, keys/4*0.2)
+}
+
+type testNode struct {
+	url     string
+	storage *storage.SliceStorage
+	cluster *ring.Cluster
+}
+
+func startNode(t *testing.T, nodes []string, ln net.Listener, redirect bool) *testNode {
+	st, err := storage.NewSliceStorage(filepath.Join(t.TempDir(), "storage.json"))
+	require.NoError(t, err)
+
+	n := &testNode{url: "http://" + ln.Addr().String(), storage: &st}
+	n.cluster, err = ring.NewCluster(n.url, nodes, 0, &st)
+	require.NoError(t, err)
+
+	srv := server.New(ln.Addr().String(), &st)
+	srv.SetRing(n.cluster, redirect)
+	hs := &httptest.Server{Listener: ln, Config: &http.Server{Handler: srv.Handler()}}
+	hs.Start()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go n.cluster.Run(ctx)
+	t.Cleanup(func() {
+		cancel()
+		hs.Close()
+	})
+	return n
+}
+
+func startCluster(t *testing.T, size int, redirect bool) []*testNode {
+	gin.SetMode(gin.TestMode)
+	listeners := make([]net.Listener, size)
+	urls := make([]string, size)
+	for i := range listeners {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners[i], urls[i] = ln, "http://"+ln.Addr().String()
+	}
+
+	nodes := make([]*testNode, size)
+	for i, ln := range listeners {
+		nodes[i] = startNode(t, urls, ln, redirect)
+	}
+	return nodes
+}
+
+func do(t *testing.T, method, target, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, target, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+// placed waits until every key is stored on its owner and nowhere else.
+func placed(t *testing.T, nodes []*testNode, keys []string) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		for _, key := range keys {
+			for _, n := range nodes {
+				_, ok := n.storage.Get(key)
+				if ok != (n.cluster.Owner(key) == n.url) {
+					return false
+				}
+			}
+		}
+		return true
+	}, 10*time.Second, 20*time.Millisecond)
+}
+
+func TestClusterRoutesAndMigrates(t *testing.T) {
+	nodes := startCluster(t, 3, false)
+
+	var keys []string
+	for i := 0; i < 60; i++ {
+		key := "key" + strconv.Itoa(i)
+		keys = append(keys, key)
+		resp := do(t, http.MethodPost, nodes[0].url+"/scalar/set/"+key+"/"+strconv.Itoa(i), "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	placed(t, nodes, keys)
+
+	// Reads are proxied as well.
+	for _, n := range nodes {
+		resp := do(t, http.MethodGet, n.url+"/scalar/get/key7", "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	added := startNode(t, nodes[0].cluster.Topology().Nodes, ln, false)
+	resp := do(t, http.MethodPost, nodes[1].url+"/ring/nodes", `{"url":"`+added.url+`"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	nodes = append(nodes, added)
+	for _, n := range nodes {
+		assert.Equal(t, uint64(1), n.cluster.Topology().Epoch)
+	}
+	placed(t, nodes, keys)
+	assert.NotZero(t, nodes[0].cluster.Status().Moved+nodes[1].cluster.Status().Moved+nodes[2].cluster.Status().Moved)
+
+	removed := nodes[0]
+	resp = do(t, http.MethodDelete, nodes[2].url+"/ring/nodes?url="+url.QueryEscape(removed.url), "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Eventually(t, func() bool {
+		return len(removed.storage.Keys()) == 0
+	}, 10*time.Second, 20*time.Millisecond)
+	placed(t, nodes[1:], keys)
+
+	for i, key := range keys {
+		val, ok := nodes[1].storage.Get(key)
+		if nodes[1].cluster.Owner(key) == nodes[1].url {
+			assert.True(t, ok)
+			assert.Equal(t, strconv.Itoa(i), val)
+		}
+	}
+
+	resp = do(t, http.MethodDelete, nodes[2].url+"/ring/nodes?url="+url.QueryEscape(removed.url), "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestClusterRedirects(t *testing.T) {
+	nodes := startCluster(t, 2, true)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	var key string
+	for i := 0; key == ""; i++ {
+		if k := "key" + strconv.Itoa(i); nodes[0].cluster.Owner(k) == nodes[1].url {
+			key = k
+		}
+	}
+
+	resp, err := client.Post(nodes[0].url+"/scalar/set/"+key+"/1", "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, nodes[1].url+"/scalar/set/"+key+"/1", resp.Header.Get("Location"))
+
+	// The default client follows the redirect to the owner.
+	resp = do(t, http.MethodPost, nodes[0].url+"/scalar/set/"+key+"/1", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, ok := nodes[1].storage.Get(key)
+	assert.True(t, ok)
+}
+
+func TestClusterRoutesAllKeys(t *testing.T) {
+	nodes := startCluster(t, 2, false)
+
+	// ownedBy returns keys the node owns.
+	ownedBy := func(n *testNode, count int) []string {
+		var keys []string
+		for i := 0; len(keys) < count; i++ {
+			if k := "key" + strconv.Itoa(i); n.cluster.Owner(k) == n.url {
+				keys = append(keys, k)
+			}
+		}
+		return keys
+	}
+	remote, local := ownedBy(nodes[1], 2), ownedBy(nodes[0], 1)
+
+	resp := do(t, http.MethodPost, nodes[0].url+"/set/sadd/"+remote[0], `["a"]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	ok, err := nodes[1].storage.SIsMember(remote[0], "a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	resp = do(t, http.MethodPost, nodes[0].url+"/any/expire/"+remote[0]+"/100", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	tx := `{"ops": [{"op": "set", "key": "` + remote[0] + `", "args": ["1"]}, {"op": "set", "key": "` + remote[1] + `", "args": ["2"]}]}`
+	resp = do(t, http.MethodPost, nodes[0].url+"/tx", tx)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, ok = nodes[1].storage.Get(remote[1])
+	assert.True(t, ok)
+
+	tx = `{"ops": [{"op": "set", "key": "` + remote[0] + `", "args": ["1"]}, {"op": "set", "key": "` + local[0] + `", "args": ["2"]}]}`
+	resp = do(t, http.MethodPost, nodes[0].url+"/tx", tx)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Clients can not pass for a node to write keys elsewhere.
+	req, err := http.NewRequest(http.MethodPost, nodes[0].url+"/scalar/set/"+remote[1]+"/3", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Storage-Forwarded", nodes[1].url)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode)
+	_, ok = nodes[0].storage.Get(remote[1])
+	assert.False(t, ok)
+}
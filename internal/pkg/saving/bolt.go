@@ -0,0 +1,139 @@
+package saving
+
+import (
+	"encoding/binary"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("versions")
+
+// BoltPersister keeps versions in a bbolt file, keyed by the version as a
+// big endian uint64; a value is the unix timestamp followed by the data.
+type BoltPersister struct {
+	db        *bolt.DB
+	Retention int
+}
+
+func NewBoltPersister(path string, retention int) (*BoltPersister, error) {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+
+	db, err := bolt.Open(path, rights, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltPersister{db: db, Retention: retention}, nil
+}
+
+func boltKey(version int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(version))
+}
+
+func (b *BoltPersister) SaveVersion(data []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		value := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix()))
+		if err = bucket.Put(boltKey(int64(seq)), append(value, data...)); err != nil {
+			return err
+		}
+
+		// Drop the oldest versions beyond the retention.
+		var old [][]byte
+		n := 0
+		c := bucket.Cursor()
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			if n++; n > b.Retention {
+				old = append(old, append([]byte{}, k...))
+			}
+		}
+
+		for _, k := range old {
+			if err = bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (b *BoltPersister) ListVersions() ([]Version, error) {
+	res := []Version{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			res = append(res, Version{
+				Version:   int64(binary.BigEndian.Uint64(k)),
+				Timestamp: int64(binary.BigEndian.Uint64(v)),
+				Size:      int64(len(v) - 8),
+			})
+		}
+		return nil
+	})
+
+	return res, err
+}
+
+// load copies the data of the version at key, or of the latest one for a
+// nil key, out of the transaction.
+func (b *BoltPersister) load(key []byte) ([]byte, error) {
+	var res []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		var v []byte
+		if key == nil {
+			_, v = bucket.Cursor().Last()
+		} else {
+			v = bucket.Get(key)
+		}
+		if v == nil {
+			return ErrNoVersion
+		}
+
+		res = append([]byte{}, v[8:]...)
+		return nil
+	})
+
+	return res, err
+}
+
+func (b *BoltPersister) LatestVersion() ([]byte, error) {
+	return b.load(nil)
+}
+
+func (b *BoltPersister) LoadVersion(version int64) ([]byte, error) {
+	return b.load(boltKey(version))
+}
+
+func (b *BoltPersister) DeleteVersion(version int64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if bucket.Get(boltKey(version)) == nil {
+			return ErrNoVersion
+		}
+
+		return bucket.Delete(boltKey(version))
+	})
+}
+
+func (b *BoltPersister) Close() error {
+	return b.db.Close()
+}
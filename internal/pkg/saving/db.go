@@ -2,7 +2,9 @@ package saving
 
 import (
 	"database/sql"
+	"errors"
 	"log"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,19 +18,42 @@ const (
 	queryDeleteOld = `DELETE FROM core
 		WHERE version NOT IN (
 			SELECT version FROM core
-			ORDER BY timestamp DESC
-			LIMIT 5
+			ORDER BY timestamp DESC, version DESC
+			LIMIT $1
 		)`
 	querySave = `INSERT INTO core (timestamp, payload) VALUES ($1, $2)`
 
+	queryList = `SELECT version, timestamp, octet_length(payload::text) FROM core
+		ORDER BY timestamp DESC, version DESC`
+	queryLoad   = `SELECT payload FROM core WHERE version = $1`
+	queryLatest = `SELECT payload FROM core ORDER BY timestamp DESC, version DESC LIMIT 1`
+
+	queryDelete = `DELETE FROM core WHERE version = $1`
+
 	queryVacuum = `VACUUM core`
 )
 
+const DefaultRetention = 5
+
+var ErrNoVersion = errors.New("no such version")
+
 type StorageDB struct {
-	Db *sql.DB
+	Db        *sql.DB
+	Retention int
+	failures  atomic.Uint64
+}
+
+type Version struct {
+	Version   int64 `json:"version"`
+	Timestamp int64 `json:"timestamp"`
+	Size      int64 `json:"size"`
 }
 
-func NewStorageDB(url string) (*StorageDB, error) {
+func NewStorageDB(url string, retention int) (*StorageDB, error) {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+
 	db, err := sql.Open("postgres", url)
 	if err != nil {
 		return nil, err
@@ -39,10 +64,19 @@ func NewStorageDB(url string) (*StorageDB, error) {
 		return nil, err
 	}
 
-	return &StorageDB{Db: db}, nil
+	return &StorageDB{Db: db, Retention: retention}, nil
 }
 
 func (s *StorageDB) SaveVersion(data []byte) error {
+	err := s.saveVersion(data)
+	if err != nil {
+		s.failures.Add(1)
+	}
+
+	return err
+}
+
+func (s *StorageDB) saveVersion(data []byte) error {
 	timestamp := time.Now().Unix()
 	_, err := s.Db.Exec(querySave, timestamp, data)
 	if err != nil {
@@ -56,6 +90,72 @@ func (s *StorageDB) SaveVersion(data []byte) error {
 		return err
 	}
 
-	_, err = s.Db.Exec(queryDeleteOld)
+	_, err = s.Db.Exec(queryDeleteOld, s.Retention)
 	return err
 }
+
+// Failures returns the number of versions that could not be saved.
+func (s *StorageDB) Failures() uint64 {
+	return s.failures.Load()
+}
+
+func (s *StorageDB) ListVersions() ([]Version, error) {
+	rows, err := s.Db.Query(queryList)
+	if err != nil {
+		log.Println("Ошибка получения версий:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []Version{}
+	for rows.Next() {
+		var v Version
+		if err = rows.Scan(&v.Version, &v.Timestamp, &v.Size); err != nil {
+			return nil, err
+		}
+
+		res = append(res, v)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *StorageDB) LoadVersion(version int64) ([]byte, error) {
+	return s.loadOne(queryLoad, version)
+}
+
+func (s *StorageDB) LatestVersion() ([]byte, error) {
+	return s.loadOne(queryLatest)
+}
+
+func (s *StorageDB) loadOne(query string, args ...any) ([]byte, error) {
+	var payload []byte
+	err := s.Db.QueryRow(query, args...).Scan(&payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoVersion
+	}
+
+	if err != nil {
+		log.Println("Ошибка загрузки версии:", err)
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+func (s *StorageDB) DeleteVersion(version int64) error {
+	res, err := s.Db.Exec(queryDelete, version)
+	if err != nil {
+		log.Println("Ошибка удаления версии:", err)
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNoVersion
+	}
+	return nil
+}
+
+func (s *StorageDB) Close() error {
+	return s.Db.Close()
+}
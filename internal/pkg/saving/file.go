@@ -0,0 +1,157 @@
+package saving
+
+import (
+	"cmp"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FilePersister keeps every version in a file of its own, Path.<version>.
+// A file at Path itself, as written before there were versions, is version
+// 0 and thus the latest one until another is saved.
+type FilePersister struct {
+	Path      string
+	Retention int
+
+	mu sync.Mutex
+}
+
+func NewFilePersister(path string, retention int) *FilePersister {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+
+	return &FilePersister{Path: path, Retention: retention}
+}
+
+func (f *FilePersister) name(version int64) string {
+	if version == 0 {
+		return f.Path
+	}
+
+	return f.Path + "." + strconv.FormatInt(version, 10)
+}
+
+func (f *FilePersister) ListVersions() ([]Version, error) {
+	entries, err := os.ReadDir(filepath.Dir(f.Path))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Version{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	base := filepath.Base(f.Path)
+	res := []Version{}
+	for _, e := range entries {
+		var version int64
+		if e.Name() != base {
+			suffix, ok := strings.CutPrefix(e.Name(), base+".")
+			if !ok {
+				continue
+			}
+			if version, err = strconv.ParseInt(suffix, 10, 64); err != nil || version <= 0 {
+				continue
+			}
+		}
+
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		res = append(res, Version{Version: version, Timestamp: info.ModTime().Unix(), Size: info.Size()})
+	}
+
+	slices.SortFunc(res, func(a, b Version) int {
+		return cmp.Compare(b.Version, a.Version)
+	})
+	return res, nil
+}
+
+func (f *FilePersister) SaveVersion(data []byte) error {
+	return f.WriteVersion(func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// WriteVersion writes the next version atomically and removes the ones
+// beyond the retention.
+func (f *FilePersister) WriteVersion(fn func(w io.Writer) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	versions, err := f.ListVersions()
+	if err != nil {
+		return err
+	}
+
+	next := int64(1)
+	if len(versions) > 0 {
+		next = versions[0].Version + 1
+	}
+
+	if err = WriteAtomicStream(f.name(next), fn); err != nil {
+		return err
+	}
+
+	for _, v := range versions[min(len(versions), f.Retention-1):] {
+		if err = os.Remove(f.name(v.Version)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *FilePersister) LatestVersion() ([]byte, error) {
+	versions, err := f.ListVersions()
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, ErrNoVersion
+	}
+
+	return f.LoadVersion(versions[0].Version)
+}
+
+func (f *FilePersister) LoadVersion(version int64) ([]byte, error) {
+	if version < 0 {
+		return nil, ErrNoVersion
+	}
+
+	data, err := os.ReadFile(f.name(version))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoVersion
+	}
+
+	return data, err
+}
+
+func (f *FilePersister) DeleteVersion(version int64) error {
+	if version < 0 {
+		return ErrNoVersion
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := os.Remove(f.name(version))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNoVersion
+	}
+
+	return err
+}
+
+func (f *FilePersister) Close() error {
+	return nil
+}
@@ -0,0 +1,162 @@
+package saving
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/lib/pq"
+)
+
+const (
+	queryCreateKeys = `CREATE TABLE IF NOT EXISTS core_keys (
+		key text PRIMARY KEY,
+		kind text NOT NULL,
+		expires_at bigint NOT NULL DEFAULT 0,
+		payload JSONB NOT NULL
+	)`
+
+	queryUpsertKeys = `INSERT INTO core_keys (key, kind, expires_at, payload)
+		SELECT * FROM unnest($1::text[], $2::text[], $3::bigint[], $4::jsonb[])
+		ON CONFLICT (key) DO UPDATE SET
+			kind = EXCLUDED.kind,
+			expires_at = EXCLUDED.expires_at,
+			payload = EXCLUDED.payload`
+	queryDeleteKeys   = `DELETE FROM core_keys WHERE key = ANY($1)`
+	queryTruncateKeys = `TRUNCATE core_keys`
+	queryScanKeys     = `SELECT key, kind, expires_at, payload FROM core_keys`
+)
+
+// keyBatch is the number of rows sent per statement.
+const keyBatch = 500
+
+// KeyRow is a single key as the key store keeps it; Payload is the JSON of
+// the value.
+type KeyRow struct {
+	Key       string
+	Kind      string
+	ExpiresAt int64
+	Payload   []byte
+}
+
+// KeyStore keeps every key on its own, so that a save only writes the keys
+// that changed since the last one.
+type KeyStore interface {
+	// WriteKeys upserts and deletes keys in one transaction.
+	WriteKeys(upserts []KeyRow, deletes []string) error
+	// ReplaceKeys makes rows the only keys of the store.
+	ReplaceKeys(rows []KeyRow) error
+	// ScanKeys calls fn for every key; an error of fn stops the scan.
+	ScanKeys(fn func(row KeyRow) error) error
+	Close() error
+}
+
+// PGKeyStore is a KeyStore in the core_keys table of PostgreSQL.
+type PGKeyStore struct {
+	Db *sql.DB
+}
+
+func NewPGKeyStore(url string) (*PGKeyStore, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = db.Exec(queryCreateKeys); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &PGKeyStore{Db: db}, nil
+}
+
+func (p *PGKeyStore) WriteKeys(upserts []KeyRow, deletes []string) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		if err := upsertKeys(tx, upserts); err != nil {
+			return err
+		}
+
+		for len(deletes) > 0 {
+			n := min(len(deletes), keyBatch)
+			if _, err := tx.Exec(queryDeleteKeys, pq.Array(deletes[:n])); err != nil {
+				return err
+			}
+			deletes = deletes[n:]
+		}
+
+		return nil
+	})
+}
+
+func (p *PGKeyStore) ReplaceKeys(rows []KeyRow) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(queryTruncateKeys); err != nil {
+			return err
+		}
+
+		return upsertKeys(tx, rows)
+	})
+}
+
+func upsertKeys(tx *sql.Tx, rows []KeyRow) error {
+	for len(rows) > 0 {
+		n := min(len(rows), keyBatch)
+		keys := make([]string, n)
+		kinds := make([]string, n)
+		expires := make([]int64, n)
+		payloads := make([]string, n)
+		for i, row := range rows[:n] {
+			keys[i], kinds[i], expires[i], payloads[i] = row.Key, row.Kind, row.ExpiresAt, string(row.Payload)
+		}
+
+		_, err := tx.Exec(queryUpsertKeys, pq.Array(keys), pq.Array(kinds), pq.Array(expires), pq.Array(payloads))
+		if err != nil {
+			return err
+		}
+		rows = rows[n:]
+	}
+
+	return nil
+}
+
+func (p *PGKeyStore) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := p.Db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		log.Println("Ошибка записи ключей:", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ScanKeys streams the rows, so that the whole table is never held in
+// memory at once.
+func (p *PGKeyStore) ScanKeys(fn func(row KeyRow) error) error {
+	rows, err := p.Db.Query(queryScanKeys)
+	if err != nil {
+		log.Println("Ошибка чтения ключей:", err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row KeyRow
+		if err = rows.Scan(&row.Key, &row.Kind, &row.ExpiresAt, &row.Payload); err != nil {
+			return err
+		}
+
+		if err = fn(row); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (p *PGKeyStore) Close() error {
+	return p.Db.Close()
+}
@@ -0,0 +1,68 @@
+package saving
+
+import (
+	"fmt"
+	"io"
+)
+
+// Persister keeps snapshots of the storage as numbered versions, the newest
+// of them up to a retention. LatestVersion, LoadVersion and DeleteVersion
+// return ErrNoVersion when there is nothing to act on.
+type Persister interface {
+	SaveVersion(data []byte) error
+	LatestVersion() ([]byte, error)
+	ListVersions() ([]Version, error)
+	LoadVersion(version int64) ([]byte, error)
+	DeleteVersion(version int64) error
+	Close() error
+}
+
+// VersionWriter is implemented by persisters that can save a version while
+// it is being encoded instead of keeping all of it in memory first.
+type VersionWriter interface {
+	WriteVersion(fn func(w io.Writer) error) error
+}
+
+type Backend string
+
+const (
+	BackendFile     Backend = "file"
+	BackendPostgres Backend = "postgres"
+	BackendBolt     Backend = "bolt"
+	// BackendPostgresKeys keeps every key in a row of its own, see
+	// PGKeyStore; versions are kept in files then.
+	BackendPostgresKeys Backend = "postgres-keys"
+)
+
+func ParseBackend(backend string) (Backend, error) {
+	switch Backend(backend) {
+	case BackendFile, BackendPostgres, BackendBolt, BackendPostgresKeys:
+		return Backend(backend), nil
+	case "":
+		return BackendFile, nil
+	}
+
+	return "", fmt.Errorf("unknown persistence backend %q, use file, postgres, bolt or postgres-keys", backend)
+}
+
+// PersisterConfig selects a backend; Path is the file of the file and bolt
+// backends, URL the connection string of postgres.
+type PersisterConfig struct {
+	Backend   Backend
+	Path      string
+	URL       string
+	Retention int
+}
+
+func OpenPersister(cfg PersisterConfig) (Persister, error) {
+	switch cfg.Backend {
+	case BackendFile, BackendPostgresKeys, "":
+		return NewFilePersister(cfg.Path, cfg.Retention), nil
+	case BackendPostgres:
+		return NewStorageDB(cfg.URL, cfg.Retention)
+	case BackendBolt:
+		return NewBoltPersister(cfg.Path, cfg.Retention)
+	}
+
+	return nil, fmt.Errorf("unknown persistence backend %q", cfg.Backend)
+}
@@ -0,0 +1,137 @@
+package saving
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func testPersister(t *testing.T, p Persister) {
+	t.Helper()
+	if _, err := p.LatestVersion(); !errors.Is(err, ErrNoVersion) {
+		t.Fatalf("latest of nothing: %v", err)
+	}
+
+	for i := 1; i <= 4; i++ {
+		if err := p.SaveVersion([]byte("v" + strconv.Itoa(i))); err != nil {
+			t.Fatalf("save %d: %v", i, err)
+		}
+	}
+
+	versions, err := p.ListVersions()
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("retention of 3 kept %v, %v", versions, err)
+	}
+	if versions[0].Version != 4 || versions[2].Version != 2 || versions[0].Size != 2 || versions[0].Timestamp == 0 {
+		t.Errorf("versions: %+v", versions)
+	}
+
+	if data, err := p.LatestVersion(); err != nil || string(data) != "v4" {
+		t.Errorf("latest: %q %v", data, err)
+	}
+	if data, err := p.LoadVersion(3); err != nil || string(data) != "v3" {
+		t.Errorf("load 3: %q %v", data, err)
+	}
+	if _, err = p.LoadVersion(1); !errors.Is(err, ErrNoVersion) {
+		t.Errorf("load dropped version: %v", err)
+	}
+
+	if err = p.DeleteVersion(4); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err = p.DeleteVersion(4); !errors.Is(err, ErrNoVersion) {
+		t.Errorf("delete twice: %v", err)
+	}
+	if data, _ := p.LatestVersion(); string(data) != "v3" {
+		t.Errorf("latest after delete: %q", data)
+	}
+
+	if err = p.SaveVersion([]byte("v5")); err != nil {
+		t.Fatalf("save after delete: %v", err)
+	}
+	if data, _ := p.LatestVersion(); string(data) != "v5" {
+		t.Errorf("latest after save: %q", data)
+	}
+}
+
+func TestFilePersister(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	others := []string{path + ".wal", path + ".9.tmp", path + "x.9"}
+	for _, name := range others {
+		os.WriteFile(name, []byte("other"), rights)
+	}
+
+	testPersister(t, NewFilePersister(path, 3))
+
+	// Files next to the versions that are not versions are left alone.
+	for _, name := range others {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestFilePersisterLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	os.WriteFile(path, []byte("old"), rights)
+	os.WriteFile(path+".wal", []byte("log"), rights)
+	p := NewFilePersister(path, 2)
+
+	if data, err := p.LatestVersion(); err != nil || string(data) != "old" {
+		t.Fatalf("legacy file: %q %v", data, err)
+	}
+
+	p.SaveVersion([]byte("new"))
+	if data, _ := p.LatestVersion(); string(data) != "new" {
+		t.Errorf("latest: %q", data)
+	}
+
+	p.SaveVersion([]byte("newer"))
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("legacy file beyond the retention kept: %v", err)
+	}
+	if _, err := os.Stat(path + ".wal"); err != nil {
+		t.Errorf("wal removed: %v", err)
+	}
+}
+
+func TestBoltPersister(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.bolt")
+	p, err := NewBoltPersister(path, 3)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	testPersister(t, p)
+	p.Close()
+
+	p, err = NewBoltPersister(path, 3)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer p.Close()
+	if data, _ := p.LatestVersion(); string(data) != "v5" {
+		t.Errorf("latest after reopen: %q", data)
+	}
+}
+
+func TestOpenPersister(t *testing.T) {
+	if _, err := ParseBackend("redis"); err == nil {
+		t.Error("unknown backend accepted")
+	}
+
+	dir := t.TempDir()
+	p, err := OpenPersister(PersisterConfig{Backend: BackendBolt, Path: filepath.Join(dir, "db")})
+	if err != nil {
+		t.Fatalf("bolt: %v", err)
+	}
+	p.Close()
+
+	if p, _ = OpenPersister(PersisterConfig{Path: filepath.Join(dir, "file")}); p == nil {
+		t.Fatal("default backend")
+	}
+	if _, ok := p.(*FilePersister); !ok {
+		t.Errorf("default backend is %T", p)
+	}
+}
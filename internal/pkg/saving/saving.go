@@ -1,6 +1,8 @@
 package saving
 
 import (
+	"bufio"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -24,3 +26,29 @@ func WriteAtomic(path string, b []byte) error {
 	}()
 	return os.Rename(tmpPathName, path)
 }
+
+// WriteAtomicStream is WriteAtomic for contents written by fn.
+func WriteAtomicStream(path string, fn func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, rights)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	bw := bufio.NewWriter(f)
+	if err = fn(bw); err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
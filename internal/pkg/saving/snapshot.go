@@ -0,0 +1,268 @@
+package saving
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Binary snapshots start with a header of 12 bytes that is never
+// compressed: the magic, the format version (uint16), the compression
+// (uint8), a reserved byte and the CRC of these 8 bytes. The rest is a
+// stream, compressed as a whole, of sections: the length of the payload
+// (uint32), the payload and its CRC. A section of length 0 ends the
+// snapshot, so that a truncated file is detected. Payloads are records
+// prefixed with their length as a uvarint. Integers are big endian and
+// CRCs use the Castagnoli polynomial.
+const (
+	SnapshotVersion = 1
+
+	headerSize  = 12
+	sectionSize = 64 << 10
+)
+
+var (
+	snapshotMagic = []byte("SGSN")
+	crcTable      = crc32.MakeTable(crc32.Castagnoli)
+
+	ErrCorruptSnapshot = errors.New("snapshot is corrupt")
+)
+
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionZstd
+)
+
+func ParseCompression(c string) (Compression, error) {
+	switch c {
+	case "", "none":
+		return CompressionNone, nil
+	case "gzip":
+		return CompressionGzip, nil
+	case "zstd":
+		return CompressionZstd, nil
+	}
+
+	return 0, fmt.Errorf("unknown compression %q, use none, gzip or zstd", c)
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	}
+
+	return fmt.Sprintf("compression(%d)", uint8(c))
+}
+
+// IsBinarySnapshot reports whether data starts like a binary snapshot.
+func IsBinarySnapshot(data []byte) bool {
+	return bytes.HasPrefix(data, snapshotMagic)
+}
+
+// SnapshotWriter encodes records into a binary snapshot. Only one section
+// is kept in memory.
+type SnapshotWriter struct {
+	w       io.Writer
+	zw      io.WriteCloser
+	section []byte
+	closed  bool
+}
+
+func NewSnapshotWriter(w io.Writer, c Compression) (*SnapshotWriter, error) {
+	header := make([]byte, headerSize)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint16(header[4:], SnapshotVersion)
+	header[6] = byte(c)
+	binary.BigEndian.PutUint32(header[8:], crc32.Checksum(header[:8], crcTable))
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	sw := &SnapshotWriter{w: w, section: make([]byte, 0, sectionSize)}
+	switch c {
+	case CompressionNone:
+	case CompressionGzip:
+		sw.zw = gzip.NewWriter(w)
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		sw.zw = zw
+	default:
+		return nil, fmt.Errorf("unknown compression %d", c)
+	}
+
+	if sw.zw != nil {
+		sw.w = sw.zw
+	}
+	return sw, nil
+}
+
+func (sw *SnapshotWriter) WriteRecord(rec []byte) error {
+	sw.section = binary.AppendUvarint(sw.section, uint64(len(rec)))
+	sw.section = append(sw.section, rec...)
+	if len(sw.section) >= sectionSize {
+		return sw.flush()
+	}
+
+	return nil
+}
+
+func (sw *SnapshotWriter) flush() error {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(len(sw.section)))
+	if _, err := sw.w.Write(buf[:]); err != nil {
+		return err
+	}
+
+	if _, err := sw.w.Write(sw.section); err != nil {
+		return err
+	}
+
+	binary.BigEndian.PutUint32(buf[:], crc32.Checksum(sw.section, crcTable))
+	_, err := sw.w.Write(buf[:])
+	sw.section = sw.section[:0]
+	return err
+}
+
+// Close writes the last section and the end of the snapshot. It does not
+// close the underlying writer.
+func (sw *SnapshotWriter) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+
+	if len(sw.section) > 0 {
+		if err := sw.flush(); err != nil {
+			return err
+		}
+	}
+
+	if err := sw.flush(); err != nil {
+		return err
+	}
+
+	if sw.zw != nil {
+		return sw.zw.Close()
+	}
+	return nil
+}
+
+// SnapshotReader decodes the records of a binary snapshot, verifying every
+// section before its records are returned.
+type SnapshotReader struct {
+	r       io.Reader
+	close   func()
+	section []byte
+	done    bool
+}
+
+func NewSnapshotReader(r io.Reader) (*SnapshotReader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+
+	if !IsBinarySnapshot(header) {
+		return nil, fmt.Errorf("%w: not a binary snapshot", ErrCorruptSnapshot)
+	}
+
+	if crc32.Checksum(header[:8], crcTable) != binary.BigEndian.Uint32(header[8:]) {
+		return nil, fmt.Errorf("%w: header checksum mismatch", ErrCorruptSnapshot)
+	}
+
+	if v := binary.BigEndian.Uint16(header[4:]); v != SnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", v)
+	}
+
+	sr := &SnapshotReader{r: bufio.NewReader(r), close: func() {}}
+	switch Compression(header[6]) {
+	case CompressionNone:
+	case CompressionGzip:
+		zr, err := gzip.NewReader(sr.r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+		}
+		sr.r = zr
+	case CompressionZstd:
+		zr, err := zstd.NewReader(sr.r)
+		if err != nil {
+			return nil, err
+		}
+		sr.r, sr.close = zr, zr.Close
+	default:
+		return nil, fmt.Errorf("unknown compression %d", header[6])
+	}
+
+	return sr, nil
+}
+
+// Next returns the next record, which is only valid until the following
+// call, or io.EOF after the last one.
+func (sr *SnapshotReader) Next() ([]byte, error) {
+	for len(sr.section) == 0 {
+		if sr.done {
+			return nil, io.EOF
+		}
+
+		if err := sr.readSection(); err != nil {
+			return nil, err
+		}
+	}
+
+	n, size := binary.Uvarint(sr.section)
+	if size <= 0 || n > uint64(len(sr.section)-size) {
+		return nil, fmt.Errorf("%w: broken record", ErrCorruptSnapshot)
+	}
+
+	rec := sr.section[size : size+int(n)]
+	sr.section = sr.section[size+int(n):]
+	return rec, nil
+}
+
+func (sr *SnapshotReader) readSection() error {
+	var buf [4]byte
+	if _, err := io.ReadFull(sr.r, buf[:]); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+
+	n := binary.BigEndian.Uint32(buf[:])
+	if n > 1<<30 {
+		return fmt.Errorf("%w: section of %d bytes", ErrCorruptSnapshot, n)
+	}
+
+	section := make([]byte, n+4)
+	if _, err := io.ReadFull(sr.r, section); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+
+	if crc32.Checksum(section[:n], crcTable) != binary.BigEndian.Uint32(section[n:]) {
+		return fmt.Errorf("%w: section checksum mismatch", ErrCorruptSnapshot)
+	}
+
+	sr.section = section[:n]
+	sr.done = n == 0
+	return nil
+}
+
+// Close releases the decompressor.
+func (sr *SnapshotReader) Close() {
+	sr.close()
+}
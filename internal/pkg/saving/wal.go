@@ -0,0 +1,343 @@
+package saving
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type SyncPolicy string
+
+const (
+	SyncAlways   SyncPolicy = "always"
+	SyncEverySec SyncPolicy = "everysec"
+	SyncNever    SyncPolicy = "never"
+)
+
+func ParseSyncPolicy(policy string) (SyncPolicy, error) {
+	switch SyncPolicy(policy) {
+	case SyncAlways, SyncEverySec, SyncNever:
+		return SyncPolicy(policy), nil
+	case "":
+		return SyncEverySec, nil
+	}
+
+	return "", errors.New("unknown fsync policy")
+}
+
+type WAL struct {
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	policy    SyncPolicy
+	size      int64
+	gen       int // rewrites so far, see WALMark
+	dirty     bool
+	logger    *zap.Logger
+	closeChan chan struct{}
+	wg        sync.WaitGroup
+}
+
+func OpenWAL(path string, policy SyncPolicy) (*WAL, error) {
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, rights)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	w := &WAL{path: path, file: file, policy: policy, size: info.Size(),
+		logger: logger, closeChan: make(chan struct{})}
+	if policy == SyncEverySec {
+		w.wg.Add(1)
+		go w.syncEverySecond()
+	}
+
+	return w, nil
+}
+
+func (w *WAL) Append(rec []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return errors.New("wal is closed")
+	}
+
+	n, err := w.file.Write(append(rec, '\n'))
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if w.policy == SyncAlways {
+		return w.file.Sync()
+	}
+
+	w.dirty = true
+	return nil
+}
+
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// Rewrite replaces the log with records.
+func (w *WAL) Rewrite(records [][]byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return errors.New("wal is closed")
+	}
+
+	tmp, buf, err := w.createTemp()
+	if err != nil {
+		return w.compacted(err)
+	}
+	writeRecords(buf, records)
+	return w.compacted(w.install(tmp, buf, nil))
+}
+
+// RewriteFrom replaces the records before m with records and keeps the ones
+// appended since. records are written while appends go on; only those are
+// copied with appends held up. A log rewritten since m is kept as it is.
+func (w *WAL) RewriteFrom(m WALMark, records [][]byte) error {
+	tmp, buf, err := w.createTemp()
+	if err != nil {
+		return w.compacted(err)
+	}
+	writeRecords(buf, records)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil || m.gen != w.gen {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		if w.file == nil {
+			return errors.New("wal is closed")
+		}
+		return nil
+	}
+
+	return w.compacted(w.install(tmp, buf, w.copyFrom(buf, m.size)))
+}
+
+func writeRecords(buf *bufio.Writer, records [][]byte) {
+	for _, rec := range records {
+		buf.Write(rec)
+		buf.WriteByte('\n')
+	}
+}
+
+// compacted logs the outcome of a rewrite; one that succeeded is counted
+// with mu held.
+func (w *WAL) compacted(err error) error {
+	if err != nil {
+		w.logger.Error("Failed to write compacted wal", zap.Error(err))
+		return err
+	}
+
+	w.gen++
+	w.logger.Info("wal compacted", zap.String("path", w.path), zap.Int64("size", w.size))
+	return nil
+}
+
+// WALMark is a position in the log, see Discard.
+type WALMark struct {
+	gen  int
+	size int64
+}
+
+// Mark returns the position the next record is appended at.
+func (w *WAL) Mark() WALMark {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return WALMark{gen: w.gen, size: w.size}
+}
+
+// Discard drops the records before m, once they are saved elsewhere. A log
+// that was rewritten since m holds the whole contents and is kept.
+func (w *WAL) Discard(m WALMark) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return errors.New("wal is closed")
+	}
+	if m.gen != w.gen || m.size == 0 {
+		return nil
+	}
+
+	tmp, buf, err := w.createTemp()
+	if err == nil {
+		err = w.install(tmp, buf, w.copyFrom(buf, m.size))
+	}
+	if err != nil {
+		w.logger.Error("Failed to truncate wal", zap.Error(err))
+		return err
+	}
+
+	// Earlier marks point into the old file.
+	w.gen++
+	return nil
+}
+
+// copyFrom copies the records from offset on. The caller holds mu.
+func (w *WAL) copyFrom(buf *bufio.Writer, offset int64) error {
+	file, err := os.Open(w.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(buf, file)
+	return err
+}
+
+// createTemp creates the file that replaces the log, next to it.
+func (w *WAL) createTemp() (*os.File, *bufio.Writer, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".*.tmp")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = tmp.Chmod(rights); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, nil, err
+	}
+	return tmp, bufio.NewWriter(tmp), nil
+}
+
+// install swaps the log for tmp, unless writing it failed with err. The
+// caller holds mu.
+func (w *WAL) install(tmp *os.File, buf *bufio.Writer, err error) error {
+	defer os.Remove(tmp.Name())
+
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), w.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, rights)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file.Close()
+	w.file = file
+	w.size = info.Size()
+	w.dirty = false
+	return nil
+}
+
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	if w.file == nil {
+		w.mu.Unlock()
+		return nil
+	}
+
+	close(w.closeChan)
+	err := w.file.Sync()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file = nil
+	w.mu.Unlock()
+
+	w.wg.Wait()
+	return err
+}
+
+func (w *WAL) syncEverySecond() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.closeChan:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.dirty && w.file != nil {
+				if err := w.file.Sync(); err != nil {
+					w.logger.Error("Failed to fsync wal", zap.Error(err))
+				}
+				w.dirty = false
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// ReadWAL calls fn for every complete record in the log. A trailing record
+// without a newline is the result of a torn write and is skipped.
+func ReadWAL(path string, fn func([]byte) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line = bytes.TrimSuffix(line, []byte{'\n'})
+		if len(line) == 0 {
+			continue
+		}
+
+		if err = fn(line); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net/http"
+	"proj1/internal/pkg/auth"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const identityKey = "auth.identity"
+
+// adminGroups are the route groups that only admins may use, whatever the
+// method.
+var adminGroups = map[string]bool{"admin": true, "cluster": true, "replication": true, "ring": true}
+
+// popRoutes are reads that change the list they read from.
+var popRoutes = map[string]bool{
+	"/slice/lpop/:key":  true,
+	"/slice/rpop/:key":  true,
+	"/slice/blpop/:key": true,
+	"/slice/brpop/:key": true,
+}
+
+// SetACL makes every route but /health require credentials of acl and a
+// grant for what the request does.
+func (r *Server) SetACL(acl *auth.ACL) {
+	r.acl = acl
+}
+
+// routeAccess returns the route group of the request and the permission it
+// needs.
+func routeAccess(ctx *gin.Context) (string, auth.Permission) {
+	full := ctx.FullPath()
+	group, _, _ := strings.Cut(strings.TrimPrefix(full, "/"), "/")
+	switch {
+	case adminGroups[group]:
+		return group, auth.Admin
+	case ctx.Request.Method == http.MethodGet && !popRoutes[full]:
+		return group, auth.Read
+	}
+
+	return group, auth.Write
+}
+
+// requestKeys returns the keys a request names in its path or query.
+// Channels of pubsub count as keys, so grants can restrict them by prefix.
+func requestKeys(ctx *gin.Context) []string {
+	var keys []string
+	for _, name := range []string{"key", "dest", "channel"} {
+		if key := ctx.Param(name); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	keys = append(keys, ctx.QueryArray("key")...)
+	return append(keys, ctx.QueryArray("channel")...)
+}
+
+// identity returns who sent the request, nil without access control.
+func identity(ctx *gin.Context) *auth.Identity {
+	if v, ok := ctx.Get(identityKey); ok {
+		return v.(*auth.Identity)
+	}
+
+	return nil
+}
+
+func (r *Server) authenticate(ctx *gin.Context) {
+	if r.acl == nil || ctx.FullPath() == "/health" {
+		return
+	}
+
+	id, err := r.acl.Authenticate(ctx.Request)
+	if err != nil {
+		ctx.Header("WWW-Authenticate", `Bearer realm="storage"`)
+		r.deny(ctx, "", http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	ctx.Set(identityKey, id)
+	if ctx.FullPath() == "" {
+		// Unknown routes are answered with 404.
+		return
+	}
+
+	group, perm := routeAccess(ctx)
+	// Listing keys is filtered by handlerRegExpKeys instead.
+	allowed := group == "keys" && id.Reaches(group, perm) || id.Allowed(group, perm, requestKeys(ctx)...)
+	if !allowed {
+		r.deny(ctx, id.ID, http.StatusForbidden, perm.String()+" access to "+group+" denied")
+	}
+}
+
+func (r *Server) deny(ctx *gin.Context, id string, status int, reason string) {
+	r.acl.Deny(auth.Denial{
+		Time:   time.Now().UnixMilli(),
+		ID:     id,
+		Remote: ctx.ClientIP(),
+		Method: ctx.Request.Method,
+		Path:   ctx.Request.URL.Path,
+		Status: status,
+		Reason: reason,
+	})
+	ctx.AbortWithStatusJSON(status, gin.H{"error": reason})
+}
+
+// visibleKeys drops the keys the identity of the request may not read.
+func visibleKeys(ctx *gin.Context, keys []string) []string {
+	id := identity(ctx)
+	if id == nil {
+		return keys
+	}
+
+	res := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if id.Allowed("keys", auth.Read, key) {
+			res = append(res, key)
+		}
+	}
+
+	return res
+}
+
+func (r *Server) handlerAuthStats(ctx *gin.Context) {
+	if r.acl == nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "authentication is not enabled"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, r.acl.Stats())
+}
+
+func (r *Server) handlerAuthReload(ctx *gin.Context) {
+	if r.acl == nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "authentication is not enabled"})
+		return
+	}
+
+	if err := r.acl.Reload(); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, r.acl.Stats())
+}
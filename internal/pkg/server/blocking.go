@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"proj1/internal/pkg/storage"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// waitContext bounds a blocking request by the timeout query parameter in
+// seconds; 0 or none waits until the client goes away.
+func waitContext(ctx *gin.Context) (context.Context, context.CancelFunc, bool) {
+	timeout := ctx.Query("timeout")
+	if timeout == "" {
+		timeout = "0"
+	}
+
+	seconds, err := strconv.ParseFloat(timeout, 64)
+	if err != nil || seconds < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid timeout"})
+		return nil, nil, false
+	}
+
+	if seconds == 0 {
+		wait, cancel := context.WithCancel(ctx.Request.Context())
+		return wait, cancel, true
+	}
+
+	wait, cancel := context.WithTimeout(ctx.Request.Context(), time.Duration(seconds*float64(time.Second)))
+	return wait, cancel, true
+}
+
+// waitFailed responds to a blocking request that got nothing; a client that
+// has gone away gets no response.
+func waitFailed(ctx *gin.Context, err error) {
+	switch {
+	case ctx.Request.Context().Err() != nil:
+		ctx.Abort()
+	case errors.Is(err, context.DeadlineExceeded):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "timeout"})
+	default:
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+	}
+}
+
+// handlerBlockingPop pops from :key and any further key query parameters,
+// whichever gets an element first.
+func (r *Server) handlerBlockingPop(pop func(context.Context, ...string) (string, string, error)) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		wait, cancel, ok := waitContext(ctx)
+		if !ok {
+			return
+		}
+		defer cancel()
+
+		keys := append([]string{ctx.Param("key")}, ctx.QueryArray("key")...)
+		key, elem, err := pop(wait, keys...)
+		if err != nil {
+			waitFailed(ctx, err)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, gin.H{"key": key, "value": elem})
+	}
+}
+
+func moveEnds(ctx *gin.Context) (storage.End, storage.End, bool) {
+	from, err := storage.ParseEnd(ctx.DefaultQuery("from", string(storage.Right)))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", "", false
+	}
+
+	to, err := storage.ParseEnd(ctx.DefaultQuery("to", string(storage.Left)))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", "", false
+	}
+
+	return from, to, true
+}
+
+func (r *Server) handlerLMove(ctx *gin.Context) {
+	from, to, ok := moveEnds(ctx)
+	if !ok {
+		return
+	}
+
+	elem, ok, err := r.storage.LMove(ctx.Param("key"), ctx.Param("dest"), from, to)
+	if err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	if !ok {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "no elements found"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, Entry{Value: elem})
+}
+
+func (r *Server) handlerBLMove(ctx *gin.Context) {
+	from, to, ok := moveEnds(ctx)
+	if !ok {
+		return
+	}
+
+	wait, cancel, ok := waitContext(ctx)
+	if !ok {
+		return
+	}
+	defer cancel()
+
+	elem, err := r.storage.BLMove(wait, ctx.Param("key"), ctx.Param("dest"), from, to)
+	if err != nil {
+		waitFailed(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, Entry{Value: elem})
+}
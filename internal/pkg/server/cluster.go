@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"proj1/internal/pkg/consensus"
+
+	"github.com/gin-gonic/gin"
+)
+
+// forwardedHeader marks requests forwarded to the leader, so that nodes
+// which disagree about the leader do not pass a request around forever.
+// nodeKeyHeader proves that another node forwarded them, not a client.
+const (
+	forwardedHeader = "X-Storage-Forwarded"
+	nodeKeyHeader   = "X-Storage-Node-Key"
+)
+
+// SetConsensus makes the server a node of a raft cluster: writes are served
+// by the leader and forwarded to it by the other nodes.
+func (r *Server) SetConsensus(n *consensus.Node) {
+	r.node = n
+}
+
+func (r *Server) forwardToLeader(ctx *gin.Context) {
+	if r.node.IsLeader() {
+		return
+	}
+
+	leader := r.node.Leader()
+	if leader == "" || ctx.GetHeader(forwardedHeader) != "" {
+		ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "no raft leader"})
+		return
+	}
+
+	r.proxy(ctx, leader, r.node.ID())
+}
+
+// proxy serves the request by forwarding it to the node at target.
+func (r *Server) proxy(ctx *gin.Context, target, from string) {
+	u, err := url.Parse(target)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "bad node address"})
+		return
+	}
+
+	ctx.Request.Header.Set(forwardedHeader, from)
+	ctx.Request.Header.Del(nodeKeyHeader)
+	if r.nodeKey != "" {
+		ctx.Request.Header.Set(nodeKeyHeader, r.nodeKey)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.Transport = r.peer
+	proxy.ServeHTTP(ctx.Writer, ctx.Request)
+	ctx.Abort()
+}
+
+// SetPeerTransport sets how requests are forwarded to other nodes, the
+// default transport if nil.
+func (r *Server) SetPeerTransport(rt http.RoundTripper) {
+	r.peer = rt
+}
+
+// SetNodeKey sets the key the nodes of a cluster share, see fromPeer.
+func (r *Server) SetNodeKey(key string) {
+	r.nodeKey = key
+}
+
+// fromPeer reports whether another node forwarded the request, as shown by
+// the node key it sent along.
+func (r *Server) fromPeer(ctx *gin.Context) bool {
+	key := ctx.GetHeader(nodeKeyHeader)
+	return ctx.GetHeader(forwardedHeader) != "" && r.nodeKey != "" &&
+		subtle.ConstantTimeCompare([]byte(key), []byte(r.nodeKey)) == 1
+}
+
+func (r *Server) handlerClusterStatus(ctx *gin.Context) {
+	if r.node == nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "raft is not enabled"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, r.node.Status())
+}
+
+func (r *Server) handlerClusterJoin(ctx *gin.Context) {
+	if r.node == nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "raft is not enabled"})
+		return
+	}
+
+	var req consensus.JoinRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.ID == "" || req.Addr == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "id and addr are required"})
+		return
+	}
+
+	if err := r.node.Join(req.ID, req.Addr); err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+}
+
+// handlerClusterLeave takes the id as a query parameter, since ids are URLs.
+func (r *Server) handlerClusterLeave(ctx *gin.Context) {
+	if r.node == nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "raft is not enabled"})
+		return
+	}
+
+	id := ctx.Query("id")
+	if id == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "id is required"})
+		return
+	}
+
+	if err := r.node.Leave(id); err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+}
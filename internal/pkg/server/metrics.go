@@ -0,0 +1,38 @@
+package server
+
+import (
+	"proj1/internal/pkg/metrics"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics returns the registry served at /metrics, e.g. to add the metrics
+// of a persister.
+func (r *Server) Metrics() *metrics.Registry {
+	return r.metrics
+}
+
+func (r *Server) registerMetrics() {
+	r.requests = r.metrics.NewCounterVec("http_requests_total",
+		"Number of requests per route and response code.", "method", "route", "code")
+	r.latency = r.metrics.NewHistogramVec("http_request_duration_seconds",
+		"Time taken to answer requests per route.", metrics.DefBuckets, "method", "route")
+	r.storage.RegisterMetrics(r.metrics)
+}
+
+// measure counts the requests per route. Requests of unknown routes are
+// counted under an empty route, so that paths do not pile up as labels.
+func (r *Server) measure(ctx *gin.Context) {
+	start := time.Now()
+	ctx.Next()
+
+	method, route := ctx.Request.Method, ctx.FullPath()
+	r.requests.With(method, route, strconv.Itoa(ctx.Writer.Status())).Inc()
+	r.latency.With(method, route).Observe(time.Since(start).Seconds())
+}
+
+func (r *Server) handlerMetrics(ctx *gin.Context) {
+	r.metrics.Handler().ServeHTTP(ctx.Writer, ctx.Request)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (r *Server) handlerIncrBy(sign int64, fixed bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		key := ctx.Param("key")
+		r.storage.CheckIfExpired(key)
+
+		delta := int64(1)
+		if !fixed {
+			var err error
+			delta, err = strconv.ParseInt(ctx.Param("delta"), 10, 64)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "increment must be integer"})
+				return
+			}
+		}
+
+		res, err := r.storage.IncrBy(key, sign*delta)
+		if err != nil {
+			ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, Entry{Value: strconv.FormatInt(res, 10)})
+	}
+}
+
+func (r *Server) handlerIncrByFloat(ctx *gin.Context) {
+	key := ctx.Param("key")
+	r.storage.CheckIfExpired(key)
+
+	delta, err := strconv.ParseFloat(ctx.Param("delta"), 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "increment must be a float"})
+		return
+	}
+
+	res, err := r.storage.IncrByFloat(key, delta)
+	if err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, Entry{Value: strconv.FormatFloat(res, 'f', -1, 64)})
+}
+
+func (r *Server) handlerHIncrBy(ctx *gin.Context) {
+	key := ctx.Param("key")
+	r.storage.CheckIfExpired(key)
+
+	delta, err := strconv.ParseInt(ctx.Param("delta"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "increment must be integer"})
+		return
+	}
+
+	res, err := r.storage.HIncrBy(key, ctx.Param("field"), delta)
+	if err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, Entry{Value: strconv.FormatInt(res, 10)})
+}
+
+func (r *Server) handlerHIncrByFloat(ctx *gin.Context) {
+	key := ctx.Param("key")
+	r.storage.CheckIfExpired(key)
+
+	delta, err := strconv.ParseFloat(ctx.Param("delta"), 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "increment must be a float"})
+		return
+	}
+
+	res, err := r.storage.HIncrByFloat(key, ctx.Param("field"), delta)
+	if err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, Entry{Value: strconv.FormatFloat(res, 'f', -1, 64)})
+}
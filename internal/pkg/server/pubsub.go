@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"proj1/internal/pkg/auth"
+	"proj1/internal/pkg/pubsub"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	pingInterval = 15 * time.Second
+	writeTimeout = 5 * time.Second
+)
+
+// PubSub returns the hub keyspace events and published messages go through.
+func (r *Server) PubSub() *pubsub.Hub {
+	return r.pubsub
+}
+
+// SetAllowedOrigins lets web pages of origins, e.g. "https://app.example.com",
+// open websockets; "*" allows every origin. Without it only pages of the
+// server's own origin and clients that send no Origin, i.e. no browsers, may.
+// Credentials a browser sends by itself, like client certificates, would
+// otherwise be usable by any page.
+func (r *Server) SetAllowedOrigins(origins []string) {
+	r.upgrader.CheckOrigin = func(req *http.Request) bool {
+		origin := req.Header.Get("Origin")
+		if origin == "" || slices.Contains(origins, "*") || slices.Contains(origins, origin) {
+			return true
+		}
+
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, req.Host)
+	}
+}
+
+// subscribe subscribes to the key and channel query parameters, which may be
+// repeated.
+func (r *Server) subscribe(ctx *gin.Context) (*pubsub.Subscriber, bool) {
+	sub, err := r.pubsub.Subscribe(ctx.QueryArray("key"), ctx.QueryArray("channel"))
+	if errors.Is(err, pubsub.ErrClosed) {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	return sub, true
+}
+
+type publishRequest struct {
+	Data string `json:"data"`
+}
+
+func (r *Server) handlerPublish(ctx *gin.Context) {
+	var req publishRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid message"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"receivers": r.pubsub.Publish(ctx.Param("channel"), req.Data)})
+}
+
+// handlerSSE streams messages as server-sent events named after their type;
+// a comment line is sent as a heartbeat.
+func (r *Server) handlerSSE(ctx *gin.Context) {
+	sub, ok := r.subscribe(ctx)
+	if !ok {
+		return
+	}
+	defer sub.Close()
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	ctx.Status(http.StatusOK)
+	ctx.Writer.Flush()
+
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case msg := <-sub.C():
+			ctx.SSEvent(msg.Type, msg)
+		case <-ping.C:
+			ctx.Writer.WriteString(": ping\n\n")
+		case <-sub.Done():
+			ctx.SSEvent("error", sub.Err().Error())
+			ctx.Writer.Flush()
+			return
+		case <-ctx.Request.Context().Done():
+			return
+		}
+		ctx.Writer.Flush()
+	}
+}
+
+// wsCommand changes the subscriptions of a websocket or publishes a message.
+type wsCommand struct {
+	Action   string   `json:"action"`
+	Keys     []string `json:"keys"`
+	Channels []string `json:"channels"`
+	Channel  string   `json:"channel"`
+	Data     string   `json:"data"`
+}
+
+type wsReply struct {
+	Type      string   `json:"type"`
+	Keys      []string `json:"keys,omitempty"`
+	Channels  []string `json:"channels,omitempty"`
+	Receivers *int     `json:"receivers,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+func (r *Server) handlerWebSocket(ctx *gin.Context) {
+	sub, ok := r.subscribe(ctx)
+	if !ok {
+		return
+	}
+	defer sub.Close()
+
+	conn, err := r.upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// The upgrader has responded already.
+		return
+	}
+	defer conn.Close()
+
+	replies := make(chan wsReply, 1)
+	go r.readCommands(conn, sub, identity(ctx), ctx.ClientIP(), replies)
+
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		select {
+		case msg := <-sub.C():
+			err = conn.WriteJSON(msg)
+		case reply, ok := <-replies:
+			if !ok {
+				return
+			}
+			err = conn.WriteJSON(reply)
+		case <-ping.C:
+			err = conn.WriteMessage(websocket.PingMessage, nil)
+		case <-sub.Done():
+			code := websocket.CloseGoingAway
+			if errors.Is(sub.Err(), pubsub.ErrSlowConsumer) {
+				code = websocket.ClosePolicyViolation
+			}
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, sub.Err().Error()))
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readCommands handles the messages of the client until the connection is
+// closed; replies are written by the caller, which owns writing. Commands
+// need the same grants as the routes: read for the keys and channels
+// subscribed to, write for the channel published to.
+func (r *Server) readCommands(conn *websocket.Conn, sub *pubsub.Subscriber, id *auth.Identity, remote string, replies chan<- wsReply) {
+	defer close(replies)
+
+	conn.SetReadLimit(1 << 20)
+	conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var cmd wsCommand
+		reply := wsReply{Type: "subscriptions"}
+		switch err = json.Unmarshal(data, &cmd); {
+		case err != nil:
+			reply = wsReply{Type: "error", Error: "invalid command"}
+		case cmd.Action == "subscribe":
+			if !r.wsAllowed(id, remote, auth.Read, slices.Concat(cmd.Keys, cmd.Channels)) {
+				reply = wsReply{Type: "error", Error: "read access to pubsub denied"}
+			} else if err = sub.Subscribe(cmd.Keys, cmd.Channels); err != nil {
+				reply = wsReply{Type: "error", Error: err.Error()}
+			}
+		case cmd.Action == "unsubscribe":
+			sub.Unsubscribe(cmd.Keys, cmd.Channels)
+		case cmd.Action == "publish":
+			if !r.wsAllowed(id, remote, auth.Write, []string{cmd.Channel}) {
+				reply = wsReply{Type: "error", Error: "write access to pubsub denied"}
+				break
+			}
+			n := r.pubsub.Publish(cmd.Channel, cmd.Data)
+			reply = wsReply{Type: "published", Receivers: &n}
+		default:
+			reply = wsReply{Type: "error", Error: "unknown action " + cmd.Action}
+		}
+
+		if reply.Type == "subscriptions" {
+			reply.Keys, reply.Channels = sub.Subscriptions()
+		}
+
+		select {
+		case replies <- reply:
+		case <-sub.Done():
+			return
+		}
+	}
+}
+
+// wsAllowed checks a websocket command like authenticate checks a request,
+// recording denials in the audit log.
+func (r *Server) wsAllowed(id *auth.Identity, remote string, perm auth.Permission, names []string) bool {
+	if r.acl == nil || id.Allowed("pubsub", perm, names...) {
+		return true
+	}
+
+	r.acl.Deny(auth.Denial{
+		Time:   time.Now().UnixMilli(),
+		ID:     id.ID,
+		Remote: remote,
+		Method: "WS",
+		Path:   "/pubsub/ws",
+		Status: http.StatusForbidden,
+		Reason: perm.String() + " access to pubsub denied",
+	})
+	return false
+}
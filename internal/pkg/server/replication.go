@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/http"
+	"proj1/internal/pkg/replication"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetReplicaOf turns the server into a read-only follower; writes are
+// redirected to the leader of f.
+func (r *Server) SetReplicaOf(f *replication.Follower) {
+	r.follower = f
+}
+
+// leaderOnly guards routes that have to be served by the leader: followers
+// redirect them, raft nodes forward them.
+func (r *Server) leaderOnly(ctx *gin.Context) {
+	switch {
+	case r.node != nil:
+		r.forwardToLeader(ctx)
+	case r.follower != nil:
+		// 307 keeps the method and the body of the request.
+		ctx.Redirect(http.StatusTemporaryRedirect, r.follower.Leader()+ctx.Request.URL.RequestURI())
+		ctx.Abort()
+	}
+}
+
+func (r *Server) handlerReplicationStatus(ctx *gin.Context) {
+	if r.follower != nil {
+		ctx.JSON(http.StatusOK, r.follower.Status())
+		return
+	}
+
+	id, offset := r.storage.ReplicationOffset()
+	ctx.JSON(http.StatusOK, replication.Status{Role: "leader", ID: id, Offset: offset})
+}
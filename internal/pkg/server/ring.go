@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"proj1/internal/pkg/ring"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetRing makes the server a node of a sharded cluster: requests for keys
+// of other nodes are forwarded to their owner, or redirected to it if
+// redirect is set.
+func (r *Server) SetRing(c *ring.Cluster, redirect bool) {
+	r.ring = c
+	r.redirect = redirect
+}
+
+// routeKey sends requests for keys this node does not own to their owner.
+func (r *Server) routeKey(ctx *gin.Context) {
+	r.route(ctx, requestKeys(ctx))
+}
+
+// routeTx routes a transaction by the keys it watches and changes.
+func (r *Server) routeTx(ctx *gin.Context) {
+	if r.ring == nil {
+		return
+	}
+
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	var req TxRequest
+	if err = json.Unmarshal(body, &req); err != nil {
+		// The handler answers invalid transactions.
+		return
+	}
+
+	keys := make([]string, 0, len(req.Watch)+len(req.Ops))
+	for key := range req.Watch {
+		keys = append(keys, key)
+	}
+	for _, op := range req.Ops {
+		keys = append(keys, op.Key)
+	}
+	r.route(ctx, keys)
+}
+
+// route sends a request to the owner of its keys, which must all have the
+// same one. A request forwarded by another node is served anyway, since the
+// nodes may briefly disagree about the topology; one forwarded by a client
+// is refused, so that it can not write keys where their owner misses them.
+func (r *Server) route(ctx *gin.Context, keys []string) {
+	if r.ring == nil || len(keys) == 0 {
+		return
+	}
+
+	owner := r.ring.Owner(keys[0])
+	for _, key := range keys[1:] {
+		if r.ring.Owner(key) != owner {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "keys belong to different nodes"})
+			return
+		}
+	}
+
+	switch {
+	case owner == "" || owner == r.ring.Self() || r.fromPeer(ctx):
+	case ctx.GetHeader(forwardedHeader) != "":
+		ctx.AbortWithStatusJSON(http.StatusMisdirectedRequest, gin.H{"error": "keys belong to " + owner})
+	case r.redirect:
+		ctx.Redirect(http.StatusTemporaryRedirect, owner+ctx.Request.URL.RequestURI())
+		ctx.Abort()
+	default:
+		r.proxy(ctx, owner, r.ring.Self())
+	}
+}
+
+func (r *Server) ringEnabled(ctx *gin.Context) bool {
+	if r.ring == nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "cluster mode is not enabled"})
+		return false
+	}
+
+	return true
+}
+
+func (r *Server) handlerRingStatus(ctx *gin.Context) {
+	if !r.ringEnabled(ctx) {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, r.ring.Status())
+}
+
+// handlerRingTopology receives the topology from the node it was changed on.
+func (r *Server) handlerRingTopology(ctx *gin.Context) {
+	if !r.ringEnabled(ctx) {
+		return
+	}
+
+	var t ring.Topology
+	if err := ctx.ShouldBindJSON(&t); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid topology"})
+		return
+	}
+
+	r.ring.SetTopology(t)
+	ctx.JSON(http.StatusOK, r.ring.Topology())
+}
+
+type ringNodeRequest struct {
+	URL string `json:"url"`
+}
+
+func (r *Server) handlerRingAddNode(ctx *gin.Context) {
+	if !r.ringEnabled(ctx) {
+		return
+	}
+
+	var req ringNodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.URL == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "url is required"})
+		return
+	}
+
+	if err := r.ring.AddNode(ctx.Request.Context(), req.URL); err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, r.ring.Topology())
+}
+
+// handlerRingRemoveNode takes the url as a query parameter, like
+// handlerClusterLeave.
+func (r *Server) handlerRingRemoveNode(ctx *gin.Context) {
+	if !r.ringEnabled(ctx) {
+		return
+	}
+
+	node := ctx.Query("url")
+	if node == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "url is required"})
+		return
+	}
+
+	err := r.ring.RemoveNode(ctx.Request.Context(), node)
+	if errors.Is(err, ring.ErrUnknownNode) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, r.ring.Topology())
+}
+
+func (r *Server) handlerRingImport(ctx *gin.Context) {
+	if !r.ringEnabled(ctx) {
+		return
+	}
+
+	var req ring.ImportRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid keys"})
+		return
+	}
+
+	imported, err := r.ring.Import(req.Keys)
+	if err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, ring.ImportResponse{Imported: imported})
+}
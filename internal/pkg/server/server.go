@@ -2,19 +2,49 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"proj1/internal/pkg/auth"
+	"proj1/internal/pkg/certs"
+	"proj1/internal/pkg/consensus"
+	"proj1/internal/pkg/metrics"
+	"proj1/internal/pkg/pubsub"
+	"proj1/internal/pkg/replication"
+	"proj1/internal/pkg/ring"
+	"proj1/internal/pkg/saving"
 	"proj1/internal/pkg/storage"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 )
 
 type Server struct {
-	host    string
-	storage *storage.SliceStorage
-	engine  *gin.Engine
-	server  *http.Server
+	host     string
+	storage  *storage.SliceStorage
+	engine   *gin.Engine
+	server   *http.Server
+	versions VersionStore
+	leader   *replication.Leader
+	follower *replication.Follower
+	node     *consensus.Node
+	ring     *ring.Cluster
+	redirect bool
+	nodeKey  string
+	peer     http.RoundTripper
+	pubsub   *pubsub.Hub
+	acl      *auth.ACL
+	metrics  *metrics.Registry
+	requests *metrics.CounterVec
+	latency  *metrics.HistogramVec
+	upgrader websocket.Upgrader
+}
+
+type VersionStore interface {
+	SaveVersion(data []byte) error
+	ListVersions() ([]saving.Version, error)
+	LoadVersion(version int64) ([]byte, error)
 }
 
 type Entry struct {
@@ -31,46 +61,163 @@ func New(host string, st *storage.SliceStorage) *Server {
 			Addr:    host,
 			Handler: engine,
 		},
-	}
+		leader:  replication.NewLeader(st),
+		pubsub:  pubsub.NewHub(),
+		metrics: metrics.NewRegistry(),
+	}
+	st.SetNotifier(s.pubsub.Notify)
+	// Replication streams and subscriptions never finish by themselves.
+	s.server.RegisterOnShutdown(s.leader.Close)
+	s.server.RegisterOnShutdown(s.pubsub.Close)
+	s.registerMetrics()
 	s.registerRoutes()
 	return s
 }
 
 func (r *Server) registerRoutes() {
+	r.engine.Use(r.trace, r.measure, r.authenticate)
 	r.engine.GET("/health", func(ctx *gin.Context) {
 		ctx.Status(http.StatusOK)
 	})
+	r.engine.GET("/metrics", r.handlerMetrics)
 
-	scalar := r.engine.Group("/scalar")
+	scalar := r.engine.Group("/scalar", r.routeKey)
 	{
-		scalar.POST("set/:key/:value", r.handlerSet)
+		scalar.POST("set/:key/:value", r.leaderOnly, r.handlerSet)
 		scalar.GET("get/:key", r.handlerGet)
+		scalar.POST("incr/:key", r.leaderOnly, r.handlerIncrBy(1, true))
+		scalar.POST("decr/:key", r.leaderOnly, r.handlerIncrBy(-1, true))
+		scalar.POST("incrby/:key/:delta", r.leaderOnly, r.handlerIncrBy(1, false))
+		scalar.POST("incrbyfloat/:key/:delta", r.leaderOnly, r.handlerIncrByFloat)
 	}
 
-	mapg := r.engine.Group("/map")
+	mapg := r.engine.Group("/map", r.routeKey)
 	{
-		mapg.POST("hset/:key", r.handlerHSet)
+		mapg.POST("hset/:key", r.leaderOnly, r.handlerHSet)
 		mapg.GET("hget/:key/:field", r.handlerHGet)
+		mapg.POST("hincrby/:key/:field/:delta", r.leaderOnly, r.handlerHIncrBy)
+		mapg.POST("hincrbyfloat/:key/:field/:delta", r.leaderOnly, r.handlerHIncrByFloat)
 	}
 
-	slice := r.engine.Group("/slice")
+	slice := r.engine.Group("/slice", r.routeKey)
 	{
-		slice.POST("lpush/:key", r.handlerLPush)
-		slice.POST("rpush/:key", r.handlerRPush)
-		slice.POST("raddtoset/:key", r.handlerRAddToSet)
-		slice.POST("/slice/lset/:key/:index/:elem", r.handlerLSet)
-		slice.GET("lpop/:key", r.handlerLPop)
-		slice.GET("rpop/:key", r.handlerRPop)
+		slice.POST("lpush/:key", r.leaderOnly, r.handlerLPush)
+		slice.POST("rpush/:key", r.leaderOnly, r.handlerRPush)
+		slice.POST("raddtoset/:key", r.leaderOnly, r.handlerRAddToSet)
+		slice.POST("/slice/lset/:key/:index/:elem", r.leaderOnly, r.handlerLSet)
+		slice.GET("lpop/:key", r.leaderOnly, r.handlerLPop)
+		slice.GET("rpop/:key", r.leaderOnly, r.handlerRPop)
+		slice.GET("blpop/:key", r.leaderOnly, r.handlerBlockingPop(r.storage.BLPop))
+		slice.GET("brpop/:key", r.leaderOnly, r.handlerBlockingPop(r.storage.BRPop))
+		slice.POST("lmove/:key/:dest", r.leaderOnly, r.handlerLMove)
+		slice.POST("blmove/:key/:dest", r.leaderOnly, r.handlerBLMove)
 		slice.GET("/slice/lget/:key/:index", r.handlerLGet)
 	}
-	r.engine.POST("/any/expire/:key/:seconds", r.handlerExpire)
+	set := r.engine.Group("/set", r.routeKey)
+	{
+		set.POST("sadd/:key", r.leaderOnly, r.handlerSAdd)
+		set.POST("srem/:key", r.leaderOnly, r.handlerSRem)
+		set.POST("spop/:key", r.leaderOnly, r.handlerSPop)
+		set.POST("sinterstore/:dest", r.leaderOnly, r.handlerSCombineStore(r.storage.SInterStore))
+		set.POST("sunionstore/:dest", r.leaderOnly, r.handlerSCombineStore(r.storage.SUnionStore))
+		set.POST("sdiffstore/:dest", r.leaderOnly, r.handlerSCombineStore(r.storage.SDiffStore))
+		set.GET("sismember/:key/:member", r.handlerSIsMember)
+		set.GET("scard/:key", r.handlerSCard)
+		set.GET("smembers/:key", r.handlerSMembers)
+		set.GET("srandmember/:key", r.handlerSRandMember)
+		set.GET("sinter", r.handlerSCombine(r.storage.SInter))
+		set.GET("sunion", r.handlerSCombine(r.storage.SUnion))
+		set.GET("sdiff", r.handlerSCombine(r.storage.SDiff))
+	}
+	zset := r.engine.Group("/zset", r.routeKey)
+	{
+		zset.POST("zadd/:key", r.leaderOnly, r.handlerZAdd)
+		zset.POST("zincrby/:key/:member/:delta", r.leaderOnly, r.handlerZIncrBy)
+		zset.POST("zrem/:key", r.leaderOnly, r.handlerZRem)
+		zset.POST("zremrangebyscore/:key", r.leaderOnly, r.handlerZRemRangeByScore)
+		zset.GET("zscore/:key/:member", r.handlerZScore)
+		zset.GET("zcard/:key", r.handlerZCard)
+		zset.GET("zrank/:key/:member", r.handlerZRank(false))
+		zset.GET("zrevrank/:key/:member", r.handlerZRank(true))
+		zset.GET("zrange/:key", r.handlerZRange)
+		zset.GET("zrangebyscore/:key", r.handlerZRangeByScore)
+	}
+	stream := r.engine.Group("/stream", r.routeKey)
+	{
+		stream.POST("xadd/:key", r.leaderOnly, r.handlerXAdd)
+		stream.POST("xtrim/:key", r.leaderOnly, r.handlerXTrim)
+		stream.POST("xgroup/:key/:group", r.leaderOnly, r.handlerXGroupCreate)
+		stream.POST("xreadgroup/:key/:group/:consumer", r.leaderOnly, r.handlerXReadGroup)
+		stream.POST("xack/:key/:group", r.leaderOnly, r.handlerXAck)
+		stream.POST("xautoclaim/:key/:group/:consumer", r.leaderOnly, r.handlerXAutoClaim)
+		stream.GET("xlen/:key", r.handlerXLen)
+		stream.GET("xrange/:key", r.handlerXRange(false))
+		stream.GET("xrevrange/:key", r.handlerXRange(true))
+		stream.GET("xgroups/:key", r.handlerXGroups)
+		stream.GET("xpending/:key/:group", r.handlerXPending)
+	}
+	r.engine.POST("/tx", r.routeTx, r.leaderOnly, r.handlerTx)
+	r.engine.GET("/tx/watch", r.routeKey, r.leaderOnly, r.handlerTxWatch)
+	r.engine.POST("/any/expire/:key/:seconds", r.routeKey, r.leaderOnly, r.handlerExpire)
 	r.engine.GET("/keys/:exp", r.handlerRegExpKeys)
+
+	admin := r.engine.Group("/admin")
+	{
+		admin.GET("versions", r.handlerListVersions)
+		admin.POST("versions", r.handlerSaveVersion)
+		admin.POST("restore/:version", r.leaderOnly, r.handlerRestoreVersion)
+		admin.GET("eviction", r.handlerEvictionStats)
+		admin.GET("snapshot", r.handlerSnapshotStats)
+		admin.POST("bgsave", r.handlerBackgroundSave)
+		admin.GET("auth", r.handlerAuthStats)
+		admin.POST("auth/reload", r.handlerAuthReload)
+	}
+
+	ps := r.engine.Group("/pubsub")
+	{
+		ps.GET("ws", r.handlerWebSocket)
+		ps.GET("sse", r.handlerSSE)
+		ps.POST("publish/:channel", r.handlerPublish)
+	}
+
+	r.engine.GET(replication.StreamPath, gin.WrapH(r.leader))
+	r.engine.GET("/replication/status", r.handlerReplicationStatus)
+
+	cluster := r.engine.Group("/cluster")
+	{
+		cluster.GET("status", r.handlerClusterStatus)
+		cluster.POST("join", r.leaderOnly, r.handlerClusterJoin)
+		cluster.DELETE("nodes", r.leaderOnly, r.handlerClusterLeave)
+	}
+
+	ringg := r.engine.Group(ring.TopologyPath)
+	{
+		ringg.GET("", r.handlerRingStatus)
+		ringg.PUT("", r.handlerRingTopology)
+		ringg.POST("nodes", r.handlerRingAddNode)
+		ringg.DELETE("nodes", r.handlerRingRemoveNode)
+		ringg.POST("import", r.handlerRingImport)
+	}
+}
+
+// Handler returns the http handler of the API, e.g. to serve it from a test
+// server.
+func (r *Server) Handler() http.Handler {
+	return r.engine
+}
+
+func (r *Server) SetVersionStore(versions VersionStore) {
+	r.versions = versions
 }
 
 func (r *Server) handlerSet(ctx *gin.Context) {
 	key := ctx.Param("key")
 	value := ctx.Param("value")
 	err := r.storage.Set(key, value)
+	if errors.Is(err, storage.ErrOOM) {
+		ctx.JSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set key"})
 		return
@@ -137,6 +284,10 @@ func (r *Server) handlerHSet(ctx *gin.Context) {
 	}
 
 	c, err := r.storage.HSet(key, maps)
+	if errors.Is(err, storage.ErrOOM) {
+		ctx.JSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
@@ -158,7 +309,11 @@ func (r *Server) handlerLPush(ctx *gin.Context) {
 		return
 	}
 
-	r.storage.LPush(key, vals)
+	if err := r.storage.LPush(key, vals); err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
 	ctx.Status(http.StatusOK)
 }
 
@@ -174,7 +329,12 @@ func (r *Server) handlerRPush(ctx *gin.Context) {
 		ctx.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-	r.storage.RPush(key, vals)
+
+	if err := r.storage.RPush(key, vals); err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
 	ctx.Status(http.StatusOK)
 }
 
@@ -191,7 +351,11 @@ func (r *Server) handlerRAddToSet(ctx *gin.Context) {
 		return
 	}
 
-	r.storage.RAddToSet(key, vals)
+	if err := r.storage.RAddToSet(key, vals); err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
 	ctx.Status(http.StatusOK)
 }
 
@@ -269,7 +433,7 @@ func (r *Server) handlerRPop(ctx *gin.Context) {
 		indexes = append(indexes, end)
 	}
 
-	result := r.storage.LPop(key, indexes...)
+	result := r.storage.RPop(key, indexes...)
 
 	if len(result) == 0 {
 		ctx.JSON(http.StatusNotFound, gin.H{"error": "no elements found or uncorrect indexes"})
@@ -293,6 +457,10 @@ func (r *Server) handlerLSet(ctx *gin.Context) {
 
 	elem := ctx.Param("elem")
 	_, err = r.storage.LSet(key, ind, elem)
+	if errors.Is(err, storage.ErrOOM) {
+		ctx.JSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid index"})
 		return
@@ -347,12 +515,123 @@ func (r *Server) handlerRegExpKeys(ctx *gin.Context) {
 		return
 	}
 
+	ctx.JSON(http.StatusOK, visibleKeys(ctx, res))
+}
+
+func (r *Server) handlerListVersions(ctx *gin.Context) {
+	if r.versions == nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "version storage is not configured"})
+		return
+	}
+
+	var res []saving.Version
+	err := persist(ctx, "ListVersions", func() error {
+		var err error
+		res, err = r.versions.ListVersions()
+		return err
+	})
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list versions"})
+		return
+	}
+
 	ctx.JSON(http.StatusOK, res)
 }
 
+func (r *Server) handlerSaveVersion(ctx *gin.Context) {
+	if r.versions == nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "version storage is not configured"})
+		return
+	}
+
+	if err := r.storage.SaveVersionContext(ctx.Request.Context(), r.versions); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save version"})
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+}
+
+func (r *Server) handlerRestoreVersion(ctx *gin.Context) {
+	if r.versions == nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "version storage is not configured"})
+		return
+	}
+
+	version, err := strconv.ParseInt(ctx.Param("version"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		return
+	}
+
+	var data []byte
+	err = persist(ctx, "LoadVersion", func() error {
+		data, err = r.versions.LoadVersion(version)
+		return err
+	})
+	if errors.Is(err, saving.ErrNoVersion) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "no such version"})
+		return
+	}
+
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load version"})
+		return
+	}
+
+	if err = r.storage.RestoreContext(ctx.Request.Context(), data); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to restore version"})
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+}
+
+func (r *Server) handlerEvictionStats(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, r.storage.EvictionStats())
+}
+
+func (r *Server) handlerSnapshotStats(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, r.storage.SnapshotStats())
+}
+
+func (r *Server) handlerBackgroundSave(ctx *gin.Context) {
+	if err := r.storage.BackgroundSave(); err != nil {
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusAccepted, gin.H{"result": "Background saving started"})
+}
+
+// storageStatus maps a storage error to the response code: running out of
+// the memory budget is not the client's fault.
+func storageStatus(err error) int {
+	if errors.Is(err, storage.ErrOOM) {
+		return http.StatusInsufficientStorage
+	}
+
+	if errors.Is(err, consensus.ErrNotLeader) || errors.Is(err, consensus.ErrUnavailable) {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusBadRequest
+}
+
+// SetTLS makes Start serve HTTPS with the certificates of c, which may be
+// reloaded while the server runs.
+func (r *Server) SetTLS(c *certs.Reloader) {
+	r.server.TLSConfig = c.TLSConfig()
+}
+
 func (r *Server) Start() error {
 	fmt.Println("Starting server at", r.host)
-	if err := r.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	serve := r.server.ListenAndServe
+	if r.server.TLSConfig != nil {
+		serve = func() error { return r.server.ListenAndServeTLS("", "") }
+	}
+
+	if err := serve(); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("listen: %w", err)
 	}
 	return nil
@@ -361,7 +640,7 @@ func (r *Server) Start() error {
 func (r *Server) Shutdown(ctx context.Context) error {
 	fmt.Println("Shutting down server...")
 
-	if err := r.storage.SaveToFile(r.storage.Path); err != nil {
+	if err := r.storage.Save(); err != nil {
 		fmt.Println("Error saving storage:", err)
 		return err
 	}
@@ -1,13 +1,24 @@
 package server
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"proj1/internal/pkg/auth"
+	"proj1/internal/pkg/replication"
+	"proj1/internal/pkg/saving"
 	"proj1/internal/pkg/storage"
+	"proj1/internal/pkg/tracing"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 const (
@@ -75,3 +86,495 @@ func TestHandlerGetNotFound(t *testing.T) {
 	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusNotFound, w.Code)
 }
+
+type fakeVersions struct {
+	saved [][]byte
+}
+
+func (f *fakeVersions) SaveVersion(data []byte) error {
+	f.saved = append(f.saved, data)
+	return nil
+}
+
+func (f *fakeVersions) ListVersions() ([]saving.Version, error) {
+	res := []saving.Version{}
+	for i := len(f.saved) - 1; i >= 0; i-- {
+		res = append(res, saving.Version{Version: int64(i + 1), Size: int64(len(f.saved[i]))})
+	}
+	return res, nil
+}
+
+func (f *fakeVersions) LoadVersion(version int64) ([]byte, error) {
+	if version < 1 || int(version) > len(f.saved) {
+		return nil, saving.ErrNoVersion
+	}
+	return f.saved[version-1], nil
+}
+
+func TestHandlerVersionsRestore(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor2, _ := storage.NewSliceStorage(file)
+	stor2.Set("testkey", "42")
+	s := New("localhost:8090", &stor2)
+	versions := &fakeVersions{}
+	s.SetVersionStore(versions)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/admin/versions", nil)
+	s.engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	stor2.Set("testkey", "43")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/admin/versions", nil)
+	s.engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"version":1`)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/admin/restore/1", nil)
+	s.engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	res, _ := stor2.Get("testkey")
+	assert.Equal(t, "42", res)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/admin/restore/7", nil)
+	s.engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestHandlerVersionsNotConfigured(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor2, _ := storage.NewSliceStorage(file)
+	router := setupTestServer(&stor2)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/admin/versions", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestHandlerSetGroup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor2, _ := storage.NewSliceStorage(file)
+	router := setupTestServer(&stor2)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/set/sadd/a", strings.NewReader(`["x","y"]`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Body.String())
+
+	stor2.SAdd("b", []string{"y", "z"})
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/set/sinter?key=a&key=b", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"result":["y"]}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/set/sunionstore/c?key=a&key=b", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "3", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/set/sismember/c/z", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "true", w.Body.String())
+}
+
+func TestHandlerZSetGroup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor2, _ := storage.NewSliceStorage(file)
+	router := setupTestServer(&stor2)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/zset/zadd/board",
+		strings.NewReader(`[{"member":"a","score":1},{"member":"b","score":5},{"member":"c","score":3}]`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "3", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/zset/zrangebyscore/board?min=(1&max=%2Binf&rev=true", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"result":[{"member":"b","score":5},{"member":"c","score":3}]}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/zset/zrevrank/board/a", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "2", w.Body.String())
+}
+
+func TestHandlerIncr(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor2, _ := storage.NewSliceStorage(file)
+	router := setupTestServer(&stor2)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/scalar/incrby/counter/10", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/scalar/decr/counter", nil)
+	router.ServeHTTP(w, req)
+	assert.JSONEq(t, `{"value":"9"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/map/hincrbyfloat/h/f/1.5", nil)
+	router.ServeHTTP(w, req)
+	assert.JSONEq(t, `{"value":"1.5"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/scalar/incr/h", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHandlerTx(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor2, _ := storage.NewSliceStorage(file)
+	router := setupTestServer(&stor2)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/tx/watch?key=n", nil)
+	router.ServeHTTP(w, req)
+	assert.JSONEq(t, `{"n":0}`, w.Body.String())
+
+	body := `{"watch":{"n":0},"ops":[{"op":"incrby","key":"n","args":["2"]},{"op":"get","key":"n"}]}`
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/tx", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"result":[{"result":2},{"result":"2"}]}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/tx", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestHandlerEviction(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor2, _ := storage.NewSliceStorage(file)
+	stor2.SetEviction(storage.EvictionConfig{Policy: storage.NoEviction, MaxKeys: 1})
+	router := setupTestServer(&stor2)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/scalar/set/a/1", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/slice/rpush/b", strings.NewReader(`["x"]`))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+
+	stor2.SetEviction(storage.EvictionConfig{Policy: storage.AllKeysLRU, MaxKeys: 1})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/set/sadd/b", strings.NewReader(`["x"]`))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/admin/eviction", nil)
+	router.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), `"policy":"allkeys-lru"`)
+	assert.Contains(t, w.Body.String(), `"evicted":1`)
+}
+
+func TestHandlerBackgroundSave(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	stor2, _ := storage.NewSliceStorage(path)
+	stor2.Set("a", "1")
+	router := setupTestServer(&stor2)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/admin/bgsave", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	// Snapshot waits for the background save.
+	stor2.Snapshot()
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/admin/snapshot", nil)
+	router.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), `"saves":1`)
+	assert.Contains(t, w.Body.String(), `"last_keys":1`)
+	assert.FileExists(t, path+".1")
+}
+
+func TestHandlerReplicaRedirect(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor2, _ := storage.NewSliceStorage(file)
+	stor2.Set("testkey", "42")
+	s := New("localhost:8090", &stor2)
+	follower, err := replication.NewFollower("http://leader:8090", &stor2)
+	assert.NoError(t, err)
+	s.SetReplicaOf(follower)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/scalar/set/testkey/43?exp=10", nil)
+	s.engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, "http://leader:8090/scalar/set/testkey/43?exp=10", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/scalar/get/testkey", nil)
+	s.engine.ServeHTTP(w, req)
+	assert.JSONEq(t, `{"value":"42"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/replication/status", nil)
+	s.engine.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), `"role":"follower"`)
+	assert.Contains(t, w.Body.String(), `"leader":"http://leader:8090"`)
+}
+
+func TestHandlerBlockingPop(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	stor2, _ := storage.NewSliceStorage(file)
+	router := setupTestServer(&stor2)
+
+	serve := func(req *http.Request) <-chan *httptest.ResponseRecorder {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			done <- w
+		}()
+		return done
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "/slice/blpop/jobs?key=other&timeout=5", nil)
+	waiting := serve(req)
+	time.Sleep(50 * time.Millisecond)
+	stor2.RPush("other", []string{"7"})
+	w := <-waiting
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"key":"other","value":"7"}`, w.Body.String())
+
+	req, _ = http.NewRequest(http.MethodGet, "/slice/brpop/jobs?timeout=0.05", nil)
+	w = <-serve(req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// A client that goes away stops waiting without taking anything.
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, "/slice/blpop/jobs", nil)
+	waiting = serve(req)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-waiting
+	stor2.RPush("jobs", []string{"1", "2"})
+	assert.Equal(t, 2, stor2.LLen("jobs"))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/slice/lmove/jobs/done?from=left&to=right", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"value":"1"}`, w.Body.String())
+
+	req, _ = http.NewRequest(http.MethodPost, "/slice/blmove/empty/done?timeout=5", nil)
+	waiting = serve(req)
+	time.Sleep(50 * time.Millisecond)
+	stor2.LPush("empty", []string{"3"})
+	w = <-waiting
+	assert.Equal(t, http.StatusOK, w.Code)
+	v, _ := stor2.LGet("done", 0)
+	assert.Equal(t, "3", v)
+}
+
+func TestHandlerStreamGroup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	stor2, _ := storage.NewSliceStorage(file)
+	router := setupTestServer(&stor2)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodPost, "/stream/xadd/events?id=5-1", `{"n":"1"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"5-1"}`, w.Body.String())
+	w = do(http.MethodPost, "/stream/xadd/events?id=5-1", `{"n":"x"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	do(http.MethodPost, "/stream/xadd/events?id=7", `{"n":"2"}`)
+
+	w = do(http.MethodGet, "/stream/xrange/events?start=5&end=5", "")
+	assert.JSONEq(t, `[{"id":"5-1","fields":{"n":"1"}}]`, w.Body.String())
+	w = do(http.MethodGet, "/stream/xrevrange/events?count=1", "")
+	assert.JSONEq(t, `[{"id":"7-0","fields":{"n":"2"}}]`, w.Body.String())
+
+	w = do(http.MethodPost, "/stream/xgroup/events/workers?start=0", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = do(http.MethodPost, "/stream/xreadgroup/events/workers/alice?count=1", "")
+	assert.JSONEq(t, `[{"id":"5-1","fields":{"n":"1"}}]`, w.Body.String())
+	w = do(http.MethodPost, "/stream/xack/events/workers", `["5-1","7-0"]`)
+	assert.Equal(t, "1", w.Body.String())
+
+	do(http.MethodPost, "/stream/xreadgroup/events/workers/alice", "")
+	w = do(http.MethodPost, "/stream/xautoclaim/events/workers/bob?min_idle=0", "")
+	assert.JSONEq(t, `[{"id":"7-0","fields":{"n":"2"}}]`, w.Body.String())
+	w = do(http.MethodGet, "/stream/xgroups/events", "")
+	assert.JSONEq(t, `[{"name":"workers","last_delivered":"7-0","pending":1,"consumers":{"bob":1}}]`, w.Body.String())
+
+	w = do(http.MethodPost, "/stream/xtrim/events?maxlen=0", "")
+	assert.Equal(t, "2", w.Body.String())
+	w = do(http.MethodGet, "/stream/xlen/events", "")
+	assert.Equal(t, "0", w.Body.String())
+	w = do(http.MethodPost, "/stream/xtrim/events", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHandlerAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	acl := filepath.Join(t.TempDir(), "acl.json")
+	os.WriteFile(acl, []byte(`{"keys": [
+		{"id": "app", "key": "app-key", "grants": [
+			{"groups": ["scalar", "keys"], "prefix": "user:", "permission": "write"}
+		]},
+		{"id": "ops", "secret": "ops-secret", "grants": [{"permission": "admin"}]}
+	]}`), 0o600)
+	a, err := auth.Load(acl)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	stor2, _ := storage.NewSliceStorage(filepath.Join(t.TempDir(), "snapshot.json"))
+	stor2.Set("user:1", "1")
+	stor2.Set("order:1", "2")
+	s := New("localhost:8090", &stor2)
+	s.SetACL(a)
+
+	send := func(method, target, key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, target, nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		s.engine.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/health", "").Code)
+	w := send(http.MethodGet, "/scalar/get/user:1", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/scalar/get/user:1", "wrong").Code)
+
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/scalar/get/user:1", "app-key").Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/scalar/set/user:2/3", "app-key").Code)
+	assert.Equal(t, http.StatusForbidden, send(http.MethodGet, "/scalar/get/order:1", "app-key").Code)
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPost, "/slice/rpush/user:1", "app-key").Code)
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPost, "/admin/bgsave", "app-key").Code)
+
+	// Listing keys only shows the permitted ones.
+	w = send(http.MethodGet, "/keys/.*", "app-key")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "user:1")
+	assert.NotContains(t, w.Body.String(), "order:1")
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/admin/auth", nil)
+	auth.Sign(req, "ops", "ops-secret", nil)
+	s.engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"denials":5`)
+	assert.Contains(t, w.Body.String(), `"reason":"admin access to admin denied"`)
+
+	// The file is read again on reload.
+	os.WriteFile(acl, []byte(`{"keys": [{"id": "app", "key": "app-key", "grants": [{"permission": "read"}]}]}`), 0o600)
+	a.Reload()
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/scalar/get/order:1", "app-key").Code)
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPost, "/scalar/set/user:2/3", "app-key").Code)
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor2, _ := storage.NewSliceStorage(filepath.Join(t.TempDir(), file))
+	router := setupTestServer(&stor2)
+
+	for _, path := range []string{"/scalar/set/a/1", "/scalar/set/b/2"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path, nil))
+	}
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/scalar/get/c", nil))
+	stor2.Save()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "version=0.0.4")
+	body := w.Body.String()
+	assert.Contains(t, body, `http_requests_total{method="POST",route="/scalar/set/:key/:value",code="200"} 2`)
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/scalar/get/:key",code="404"} 1`)
+	assert.Contains(t, body, `http_request_duration_seconds_count{method="POST",route="/scalar/set/:key/:value"} 2`)
+	assert.Contains(t, body, `storage_keys{kind="D"} 2`)
+	assert.Contains(t, body, "storage_snapshot_duration_seconds_count 1")
+	assert.Contains(t, body, `storage_lock_wait_seconds_bucket{mode="write",le="+Inf"}`)
+	assert.Equal(t, 1, strings.Count(body, "# TYPE storage_lock_wait_seconds histogram"))
+}
+
+func TestHandlerTracing(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	exporter := tracing.Record()
+
+	stor2, _ := storage.NewSliceStorage(filepath.Join(t.TempDir(), file))
+	stor2.Set("testkey", "42")
+	s := New("localhost:8090", &stor2)
+	s.SetVersionStore(&fakeVersions{})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/admin/versions", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929b0e0e4736-00f067aa0ba902b7-01")
+	s.engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/admin/restore/1", nil)
+	s.engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	byName := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		byName[span.Name] = span
+	}
+
+	handler := byName["POST /admin/versions"]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929b0e0e4736", handler.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", handler.Parent.SpanID().String())
+	assert.Contains(t, handler.Attributes, semconv.HTTPResponseStatusCode(http.StatusOK))
+	assert.Equal(t, handler.SpanContext.SpanID(), byName["storage.save_version"].Parent.SpanID())
+	assert.Equal(t, byName["storage.save_version"].SpanContext.SpanID(), byName["saving.SaveVersion"].Parent.SpanID())
+
+	restore := byName["POST /admin/restore/:version"]
+	assert.Equal(t, restore.SpanContext.SpanID(), byName["saving.LoadVersion"].Parent.SpanID())
+	assert.Equal(t, restore.SpanContext.SpanID(), byName["storage.restore"].Parent.SpanID())
+	assert.Equal(t, "shards locked", byName["storage.restore"].Events[0].Name)
+}
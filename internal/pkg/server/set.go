@@ -0,0 +1,203 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (r *Server) handlerSAdd(ctx *gin.Context) {
+	key := ctx.Param("key")
+	r.storage.CheckIfExpired(key)
+
+	var vals []string
+	if err := ctx.Bind(&vals); err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	c, err := r.storage.SAdd(key, vals)
+	if err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, c)
+}
+
+func (r *Server) handlerSRem(ctx *gin.Context) {
+	key := ctx.Param("key")
+	if r.storage.CheckIfExpired(key) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "element has expired"})
+		return
+	}
+
+	var vals []string
+	if err := ctx.Bind(&vals); err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	c, err := r.storage.SRem(key, vals)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, c)
+}
+
+func (r *Server) handlerSIsMember(ctx *gin.Context) {
+	key := ctx.Param("key")
+	if r.storage.CheckIfExpired(key) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "element has expired"})
+		return
+	}
+
+	ok, err := r.storage.SIsMember(key, ctx.Param("member"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, ok)
+}
+
+func (r *Server) handlerSCard(ctx *gin.Context) {
+	key := ctx.Param("key")
+	if r.storage.CheckIfExpired(key) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "element has expired"})
+		return
+	}
+
+	c, err := r.storage.SCard(key)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, c)
+}
+
+func (r *Server) handlerSMembers(ctx *gin.Context) {
+	key := ctx.Param("key")
+	if r.storage.CheckIfExpired(key) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "element has expired"})
+		return
+	}
+
+	res, err := r.storage.SMembers(key)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"result": res})
+}
+
+func queryCount(ctx *gin.Context) (int, bool) {
+	countstr := ctx.DefaultQuery("count", "1")
+	count, err := strconv.Atoi(countstr)
+	if err != nil || count < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid count"})
+		return 0, false
+	}
+
+	return count, true
+}
+
+func (r *Server) handlerSRandMember(ctx *gin.Context) {
+	key := ctx.Param("key")
+	if r.storage.CheckIfExpired(key) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "element has expired"})
+		return
+	}
+
+	count, ok := queryCount(ctx)
+	if !ok {
+		return
+	}
+
+	res, err := r.storage.SRandMember(key, count)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"result": res})
+}
+
+func (r *Server) handlerSPop(ctx *gin.Context) {
+	key := ctx.Param("key")
+	if r.storage.CheckIfExpired(key) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "element has expired"})
+		return
+	}
+
+	count, ok := queryCount(ctx)
+	if !ok {
+		return
+	}
+
+	res, err := r.storage.SPop(key, count)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(res) == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "no elements found"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"result": res})
+}
+
+func (r *Server) queryKeys(ctx *gin.Context) ([]string, bool) {
+	keys := ctx.QueryArray("key")
+	if len(keys) == 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "at least one key is required"})
+		return nil, false
+	}
+
+	for _, key := range keys {
+		r.storage.CheckIfExpired(key)
+	}
+
+	return keys, true
+}
+
+func (r *Server) handlerSCombine(combine func(keys ...string) ([]string, error)) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		keys, ok := r.queryKeys(ctx)
+		if !ok {
+			return
+		}
+
+		res, err := combine(keys...)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, gin.H{"result": res})
+	}
+}
+
+func (r *Server) handlerSCombineStore(store func(dst string, keys ...string) (int, error)) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		keys, ok := r.queryKeys(ctx)
+		if !ok {
+			return
+		}
+
+		c, err := store(ctx.Param("dest"), keys...)
+		if err != nil {
+			ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, c)
+	}
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"net/http"
+	"proj1/internal/pkg/storage"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// queryInt reads an optional integer query parameter.
+func queryInt(ctx *gin.Context, name string, def int) (int, bool) {
+	v := ctx.Query(name)
+	if v == "" {
+		return def, true
+	}
+
+	res, err := strconv.Atoi(v)
+	if err != nil || res < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name})
+		return 0, false
+	}
+
+	return res, true
+}
+
+func (r *Server) handlerXAdd(ctx *gin.Context) {
+	key := ctx.Param("key")
+	r.storage.CheckIfExpired(key)
+
+	var fields map[string]string
+	if err := ctx.Bind(&fields); err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	id, err := r.storage.XAdd(key, ctx.DefaultQuery("id", "*"), fields)
+	if err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"id": id})
+}
+
+func (r *Server) handlerXLen(ctx *gin.Context) {
+	key := ctx.Param("key")
+	r.storage.CheckIfExpired(key)
+
+	n, err := r.storage.XLen(key)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, n)
+}
+
+// handlerXRange serves the entries between the start and end query
+// parameters, "-" and "+" by default.
+func (r *Server) handlerXRange(rev bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		key := ctx.Param("key")
+		r.storage.CheckIfExpired(key)
+
+		start, err := storage.ParseStreamBound(ctx.DefaultQuery("start", "-"), false)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		end, err := storage.ParseStreamBound(ctx.DefaultQuery("end", "+"), true)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		count, ok := queryInt(ctx, "count", 0)
+		if !ok {
+			return
+		}
+
+		var res []storage.StreamEntry
+		if rev {
+			res, err = r.storage.XRevRange(key, end, start, count)
+		} else {
+			res, err = r.storage.XRange(key, start, end, count)
+		}
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, res)
+	}
+}
+
+// handlerXTrim trims by the maxlen, minid or maxage (in seconds) query
+// parameters.
+func (r *Server) handlerXTrim(ctx *gin.Context) {
+	key := ctx.Param("key")
+	r.storage.CheckIfExpired(key)
+
+	var n int
+	var err error
+	if age := ctx.Query("maxage"); age != "" {
+		seconds, perr := strconv.ParseFloat(age, 64)
+		if perr != nil || seconds < 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid maxage"})
+			return
+		}
+
+		n, err = r.storage.XTrimAge(key, time.Duration(seconds*float64(time.Second)))
+	} else {
+		maxLen, ok := queryInt(ctx, "maxlen", -1)
+		if !ok {
+			return
+		}
+
+		var minID storage.StreamID
+		if id := ctx.Query("minid"); id != "" {
+			if minID, err = storage.ParseStreamID(id); err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		if maxLen < 0 && minID == (storage.StreamID{}) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "maxlen, minid or maxage is required"})
+			return
+		}
+
+		n, err = r.storage.XTrim(key, maxLen, minID)
+	}
+	if err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, n)
+}
+
+func (r *Server) handlerXGroupCreate(ctx *gin.Context) {
+	key := ctx.Param("key")
+	r.storage.CheckIfExpired(key)
+
+	mkStream := ctx.Query("mkstream") == "true"
+	err := r.storage.XGroupCreate(key, ctx.Param("group"), ctx.DefaultQuery("start", "$"), mkStream)
+	if err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, "OK")
+}
+
+func (r *Server) handlerXGroups(ctx *gin.Context) {
+	key := ctx.Param("key")
+	r.storage.CheckIfExpired(key)
+
+	res, err := r.storage.XGroups(key)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (r *Server) handlerXReadGroup(ctx *gin.Context) {
+	key := ctx.Param("key")
+	r.storage.CheckIfExpired(key)
+
+	count, ok := queryInt(ctx, "count", 0)
+	if !ok {
+		return
+	}
+
+	res, err := r.storage.XReadGroup(key, ctx.Param("group"), ctx.Param("consumer"), count)
+	if err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (r *Server) handlerXAck(ctx *gin.Context) {
+	key := ctx.Param("key")
+	r.storage.CheckIfExpired(key)
+
+	var ids []storage.StreamID
+	if err := ctx.Bind(&ids); err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	n, err := r.storage.XAck(key, ctx.Param("group"), ids)
+	if err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, n)
+}
+
+// handlerXAutoClaim claims entries pending for at least min_idle
+// milliseconds.
+func (r *Server) handlerXAutoClaim(ctx *gin.Context) {
+	key := ctx.Param("key")
+	r.storage.CheckIfExpired(key)
+
+	minIdle, ok := queryInt(ctx, "min_idle", 0)
+	if !ok {
+		return
+	}
+
+	count, ok := queryInt(ctx, "count", 0)
+	if !ok {
+		return
+	}
+
+	res, err := r.storage.XAutoClaim(key, ctx.Param("group"), ctx.Param("consumer"),
+		time.Duration(minIdle)*time.Millisecond, count)
+	if err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (r *Server) handlerXPending(ctx *gin.Context) {
+	key := ctx.Param("key")
+	r.storage.CheckIfExpired(key)
+
+	res, err := r.storage.XPending(key, ctx.Param("group"), ctx.Query("consumer"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"proj1/internal/pkg/tracing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = tracing.Tracer("server")
+
+// trace starts a span per request, continuing the trace of the caller if
+// it sent one. Handlers find the span in the context of the request.
+func (r *Server) trace(ctx *gin.Context) {
+	route := ctx.FullPath()
+	name := ctx.Request.Method + " " + route
+	if route == "" {
+		// Unknown paths would make a span name each.
+		name = ctx.Request.Method
+	}
+
+	spanCtx, span := tracer.Start(tracing.Extract(ctx.Request.Context(), ctx.Request.Header), name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(ctx.Request.Method),
+			semconv.HTTPRoute(route),
+			semconv.URLPath(ctx.Request.URL.Path),
+		))
+	defer span.End()
+
+	ctx.Request = ctx.Request.WithContext(spanCtx)
+	ctx.Next()
+
+	status := ctx.Writer.Status()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, fmt.Sprint(status))
+	}
+	if id := identity(ctx); id != nil {
+		span.SetAttributes(semconv.EnduserID(id.ID))
+	}
+}
+
+// persist runs fn, a call to the version store, in a span of the request.
+func persist(ctx *gin.Context, op string, fn func() error) error {
+	_, span := tracer.Start(ctx.Request.Context(), "saving."+op, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	err := fn()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"proj1/internal/pkg/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+type TxRequest struct {
+	Watch map[string]uint64 `json:"watch"`
+	Ops   []storage.TxOp    `json:"ops"`
+}
+
+func (r *Server) handlerTxWatch(ctx *gin.Context) {
+	keys := ctx.QueryArray("key")
+	if len(keys) == 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "at least one key is required"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, r.storage.Versions(keys...))
+}
+
+func (r *Server) handlerTx(ctx *gin.Context) {
+	var req TxRequest
+	if err := ctx.Bind(&req); err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Ops) == 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "no operations"})
+		return
+	}
+
+	tx := r.storage.Multi()
+	tx.WatchVersions(req.Watch)
+	tx.Queue(req.Ops...)
+	res, err := tx.Exec()
+	if errors.Is(err, storage.ErrTxAborted) {
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to execute transaction"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"result": res})
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"net/http"
+	"proj1/internal/pkg/storage"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (r *Server) handlerZAdd(ctx *gin.Context) {
+	key := ctx.Param("key")
+	r.storage.CheckIfExpired(key)
+
+	var members []storage.ZMember
+	if err := ctx.Bind(&members); err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	c, err := r.storage.ZAdd(key, members)
+	if err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, c)
+}
+
+func (r *Server) handlerZIncrBy(ctx *gin.Context) {
+	key := ctx.Param("key")
+	r.storage.CheckIfExpired(key)
+
+	delta, err := strconv.ParseFloat(ctx.Param("delta"), 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "increment must be a float"})
+		return
+	}
+
+	res, err := r.storage.ZIncrBy(key, ctx.Param("member"), delta)
+	if err != nil {
+		ctx.JSON(storageStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (r *Server) handlerZRem(ctx *gin.Context) {
+	key := ctx.Param("key")
+	if r.storage.CheckIfExpired(key) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "element has expired"})
+		return
+	}
+
+	var vals []string
+	if err := ctx.Bind(&vals); err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	c, err := r.storage.ZRem(key, vals)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, c)
+}
+
+func (r *Server) handlerZScore(ctx *gin.Context) {
+	key := ctx.Param("key")
+	if r.storage.CheckIfExpired(key) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "element has expired"})
+		return
+	}
+
+	res, ok, err := r.storage.ZScore(key, ctx.Param("member"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (r *Server) handlerZCard(ctx *gin.Context) {
+	key := ctx.Param("key")
+	if r.storage.CheckIfExpired(key) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "element has expired"})
+		return
+	}
+
+	c, err := r.storage.ZCard(key)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, c)
+}
+
+func (r *Server) handlerZRank(rev bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		key := ctx.Param("key")
+		if r.storage.CheckIfExpired(key) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "element has expired"})
+			return
+		}
+
+		res, err := r.storage.ZRank(key, ctx.Param("member"), rev)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if res < 0 {
+			ctx.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, res)
+	}
+}
+
+func (r *Server) handlerZRange(ctx *gin.Context) {
+	key := ctx.Param("key")
+	if r.storage.CheckIfExpired(key) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "element has expired"})
+		return
+	}
+
+	start, err := strconv.Atoi(ctx.DefaultQuery("start", "0"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid start index"})
+		return
+	}
+
+	stop, err := strconv.Atoi(ctx.DefaultQuery("stop", "-1"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid stop index"})
+		return
+	}
+
+	res, err := r.storage.ZRange(key, start, stop, ctx.Query("rev") == "true")
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"result": res})
+}
+
+func queryScoreRange(ctx *gin.Context) (storage.ScoreBound, storage.ScoreBound, bool) {
+	min, err := storage.ParseScoreBound(ctx.DefaultQuery("min", "-inf"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return min, min, false
+	}
+
+	max, err := storage.ParseScoreBound(ctx.DefaultQuery("max", "+inf"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return min, max, false
+	}
+
+	return min, max, true
+}
+
+func (r *Server) handlerZRangeByScore(ctx *gin.Context) {
+	key := ctx.Param("key")
+	if r.storage.CheckIfExpired(key) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "element has expired"})
+		return
+	}
+
+	min, max, ok := queryScoreRange(ctx)
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.Atoi(ctx.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid offset"})
+		return
+	}
+
+	count, err := strconv.Atoi(ctx.DefaultQuery("count", "-1"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid count"})
+		return
+	}
+
+	res, err := r.storage.ZRangeByScore(key, min, max, offset, count, ctx.Query("rev") == "true")
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"result": res})
+}
+
+func (r *Server) handlerZRemRangeByScore(ctx *gin.Context) {
+	key := ctx.Param("key")
+	if r.storage.CheckIfExpired(key) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "element has expired"})
+		return
+	}
+
+	min, max, ok := queryScoreRange(ctx)
+	if !ok {
+		return
+	}
+
+	c, err := r.storage.ZRemRangeByScore(key, min, max)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, c)
+}
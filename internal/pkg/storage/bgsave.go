@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"proj1/internal/pkg/saving"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+var ErrSaveInProgress = errors.New("a snapshot is already being saved")
+
+// captureBatch is the number of keys read per read lock of a shard while a
+// snapshot is taken, which bounds how long a writer can wait for it.
+const captureBatch = 256
+
+type SnapshotStats struct {
+	InProgress     bool   `json:"in_progress"`
+	Saves          uint64 `json:"saves"`
+	Failures       uint64 `json:"failures"`
+	Skipped        uint64 `json:"skipped"`
+	LastStartedAt  int64  `json:"last_started_at"`
+	LastDurationMs int64  `json:"last_duration_ms"`
+	LastPauseUs    int64  `json:"last_pause_us"`
+	LastKeys       int    `json:"last_keys"`
+	LastBytes      int64  `json:"last_bytes"`
+	LastChanged    int    `json:"last_changed"`
+	LastError      string `json:"last_error,omitempty"`
+}
+
+// shardSnapshot keeps, for a shard that a running snapshot has not read
+// yet, the values keys had when the snapshot started; nil stands for a key
+// that did not exist.
+type shardSnapshot struct {
+	saved map[string]*SliceValue
+	all   bool
+}
+
+// preserve is called by writers with the shard locked, before key is
+// changed.
+func (sh *shard) preserve(key string) {
+	if sh.snap == nil || sh.snap.all {
+		return
+	}
+	if _, ok := sh.snap.saved[key]; ok {
+		return
+	}
+
+	var old *SliceValue
+	if val, ok := sh.inner[key]; ok {
+		val = cloneValue(val)
+		old = &val
+	}
+	sh.snap.saved[key] = old
+}
+
+// preserveAll is preserve for operations that may change any key of the
+// shard. Afterwards capture only takes saved values from the shard.
+func (sh *shard) preserveAll() {
+	if sh.snap == nil || sh.snap.all {
+		return
+	}
+
+	for key := range sh.inner {
+		sh.preserve(key)
+	}
+	sh.snap.all = true
+}
+
+// preserve expects the shards of keys to be write-locked.
+func (s *SliceStorage) preserve(keys ...string) {
+	for _, key := range keys {
+		s.shardFor(key).preserve(key)
+	}
+}
+
+// cloneValue copies everything of val that writers change in place.
+func cloneValue(val SliceValue) SliceValue {
+	val.StSl = slices.Clone(val.StSl)
+	val.Mint = maps.Clone(val.Mint)
+	val.Mstr = maps.Clone(val.Mstr)
+	val.Set = maps.Clone(val.Set)
+	if val.ZSet != nil {
+		z := newSortedSet()
+		for x := val.ZSet.head.level[0].forward; x != nil; x = x.level[0].forward {
+			z.add(x.member, x.score)
+		}
+		val.ZSet = z
+	}
+	if val.Stream != nil {
+		st := &Stream{Entries: slices.Clone(val.Stream.Entries), LastID: val.Stream.LastID}
+		if val.Stream.Groups != nil {
+			st.Groups = make(map[string]*ConsumerGroup, len(val.Stream.Groups))
+			for name, g := range val.Stream.Groups {
+				pending := make(map[StreamID]*PendingEntry, len(g.Pending))
+				for id, p := range g.Pending {
+					p := *p
+					pending[id] = &p
+				}
+				st.Groups[name] = &ConsumerGroup{LastDelivered: g.LastDelivered, Pending: pending}
+			}
+		}
+		val.Stream = st
+	}
+
+	return val
+}
+
+type captureInfo struct {
+	keys    int
+	changed int
+	pause   time.Duration
+	// wal holds the changes since the capture from walMark on.
+	wal     *saving.WAL
+	walMark saving.WALMark
+}
+
+// capture calls fn for every key with the value it had when capture
+// started. Writers are only stopped to mark the shards; afterwards every
+// shard is read in batches, and writers keep a copy of what they change
+// until it has been read. fn runs with the shard read-locked, flush after
+// every batch without any lock. marked, unless nil, runs while the shards
+// are marked, so nothing changes between them. The caller holds saveMu.
+func (s *SliceStorage) capture(marked func(), fn func(key string, val SliceValue), flush func() error) (captureInfo, error) {
+	var info captureInfo
+	start := time.Now()
+	lockShards(s.shards, true)
+	for _, sh := range s.shards {
+		sh.snap = &shardSnapshot{saved: make(map[string]*SliceValue)}
+	}
+	info.wal, info.walMark = s.walMark()
+	if marked != nil {
+		marked()
+	}
+	unlockShards(s.shards, true)
+	info.pause = time.Since(start)
+
+	done := func(sh *shard) {
+		sh.mu.Lock()
+		if sh.snap != nil {
+			info.changed += len(sh.snap.saved)
+			sh.snap = nil
+		}
+		sh.mu.Unlock()
+	}
+	defer func() {
+		for _, sh := range s.shards {
+			done(sh)
+		}
+	}()
+
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		keys := make([]string, 0, len(sh.inner)+len(sh.snap.saved))
+		for key := range sh.inner {
+			if _, ok := sh.snap.saved[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		for key := range sh.snap.saved {
+			keys = append(keys, key)
+		}
+		sh.mu.RUnlock()
+
+		for len(keys) > 0 {
+			n := min(len(keys), captureBatch)
+			sh.mu.RLock()
+			for _, key := range keys[:n] {
+				val, ok := sh.inner[key]
+				if old, saved := sh.snap.saved[key]; saved {
+					if ok = old != nil; ok {
+						val = *old
+					}
+				} else if sh.snap.all {
+					ok = false
+				}
+				if ok {
+					fn(key, val)
+					info.keys++
+				}
+			}
+			sh.mu.RUnlock()
+			keys = keys[n:]
+
+			if err := flush(); err != nil {
+				return info, err
+			}
+		}
+
+		done(sh)
+	}
+
+	return info, nil
+}
+
+// SetPersister makes saves and Load use p.
+func (s *SliceStorage) SetPersister(p saving.Persister) {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.persister = p
+}
+
+// Save writes a snapshot to the persister while writes go on. A save that
+// is already running is waited for.
+func (s *SliceStorage) Save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	return s.save()
+}
+
+// BackgroundSave is Save without waiting for the save. It returns
+// ErrSaveInProgress instead of starting a second one.
+func (s *SliceStorage) BackgroundSave() error {
+	if !s.saveMu.TryLock() {
+		s.skippedSaves.Add(1)
+		s.logger.Info("Snapshot skipped, the previous one is still being saved")
+		return ErrSaveInProgress
+	}
+
+	go func() {
+		defer s.saveMu.Unlock()
+		s.save()
+	}()
+	return nil
+}
+
+func (s *SliceStorage) save() error {
+	s.saving.Store(true)
+	defer s.saving.Store(false)
+
+	ctx, span := tracer.Start(context.Background(), "storage.save")
+	start := time.Now()
+	var info captureInfo
+	var size int64
+	write := func(w io.Writer) error {
+		cw := &countingWriter{w: w}
+		var err error
+		info, err = s.writeSnapshot(cw, s.snapshotConfig())
+		size = cw.n
+		return err
+	}
+
+	var err error
+	if vw, ok := s.persister.(saving.VersionWriter); ok {
+		err = persist(ctx, "WriteVersion", s.persister, func() error {
+			return vw.WriteVersion(write)
+		})
+	} else {
+		var buf bytes.Buffer
+		if err = write(&buf); err == nil {
+			err = persist(ctx, "SaveVersion", s.persister, func() error {
+				return s.persister.SaveVersion(buf.Bytes())
+			})
+		}
+	}
+	elapsed := time.Since(start)
+	s.saveDuration.Observe(elapsed.Seconds())
+	span.SetAttributes(
+		attribute.Int("storage.keys", info.keys),
+		attribute.Int("storage.changed", info.changed),
+		attribute.Int64("storage.bytes", size),
+		attribute.Int64("storage.pause_us", info.pause.Microseconds()))
+	endSpan(span, err)
+
+	stats := s.SnapshotStats()
+	stats.LastStartedAt = start.UnixMilli()
+	stats.LastDurationMs = elapsed.Milliseconds()
+	stats.LastPauseUs = info.pause.Microseconds()
+	stats.LastKeys = info.keys
+	stats.LastBytes = size
+	stats.LastChanged = info.changed
+	stats.LastError = ""
+	if err != nil {
+		stats.Failures++
+		stats.LastError = err.Error()
+	} else {
+		stats.Saves++
+	}
+	s.snapshotStats.Store(&stats)
+
+	if err != nil {
+		s.logger.Error("Failed to save SliceStorage", zap.Error(err))
+		return err
+	}
+
+	s.logger.Info("SliceStorage successfully saved", zap.Int("keys", info.keys),
+		zap.Int("changed", info.changed), zap.Duration("duration", elapsed))
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (s *SliceStorage) SnapshotStats() SnapshotStats {
+	var stats SnapshotStats
+	if last := s.snapshotStats.Load(); last != nil {
+		stats = *last
+	}
+
+	stats.InProgress = s.saving.Load()
+	stats.Skipped = s.skippedSaves.Load()
+	return stats
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// End is the end of a list elements are popped from or pushed to.
+type End string
+
+const (
+	Left  End = "left"
+	Right End = "right"
+)
+
+func ParseEnd(end string) (End, error) {
+	switch End(end) {
+	case Left, Right:
+		return End(end), nil
+	}
+
+	return "", errors.New("end must be left or right")
+}
+
+// waiter is a client blocked on lists. ready receives the key it should try
+// to pop from next.
+type waiter struct {
+	keys  []string
+	ready chan string
+}
+
+// waitQueue keeps the waiters of every key in the order they arrived. A
+// push wakes as many waiters as the list has elements, so that they are
+// served first come first served; a waiter that leaves passes its turn on.
+type waitQueue struct {
+	mu     sync.Mutex
+	queues map[string][]*waiter
+}
+
+func newWaitQueue() *waitQueue {
+	return &waitQueue{queues: make(map[string][]*waiter)}
+}
+
+func (q *waitQueue) add(keys []string) *waiter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	w := &waiter{keys: keys, ready: make(chan string, 1)}
+	for _, key := range keys {
+		q.queues[key] = append(q.queues[key], w)
+	}
+	return w
+}
+
+func (q *waitQueue) remove(w *waiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, key := range w.keys {
+		queue := slices.DeleteFunc(q.queues[key], func(other *waiter) bool {
+			return other == w
+		})
+		if len(queue) == 0 {
+			delete(q.queues, key)
+		} else {
+			q.queues[key] = queue
+		}
+	}
+}
+
+// first reports whether no one has been waiting for key longer than w.
+func (q *waitQueue) first(w *waiter, key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue := q.queues[key]
+	return len(queue) > 0 && queue[0] == w
+}
+
+// wake tells the first n waiters of key that there is an element for them.
+func (q *waitQueue) wake(key string, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue := q.queues[key]
+	for _, w := range queue[:min(n, len(queue))] {
+		select {
+		case w.ready <- key:
+		default:
+		}
+	}
+}
+
+// wakeRecord wakes the waiters of the lists rec added elements to. The keys
+// of rec must be locked.
+func (s *SliceStorage) wakeRecord(rec Record) {
+	if s.waiters == nil {
+		return
+	}
+
+	key := rec.Key
+	switch rec.Op {
+	case OpMulti:
+		for _, sub := range rec.Batch {
+			s.wakeRecord(sub)
+		}
+		return
+	case OpLMove:
+		if len(rec.Vals) == 0 {
+			return
+		}
+		key = rec.Vals[0]
+	case OpLPush, OpRPush, OpRAddToSet, OpRestore:
+	default:
+		return
+	}
+
+	if n := s.listLen(key); n > 0 {
+		s.waiters.wake(key, n)
+	}
+}
+
+// listLen returns the number of elements of the list at key, 0 if key holds
+// something else. The key must be locked.
+func (s *SliceStorage) listLen(key string) int {
+	val := s.value(key)
+	if val.Kind != KindSliceInt && val.Kind != KindSliceStr {
+		return 0
+	}
+
+	return len(val.StSl)
+}
+
+// block calls pop for keys until it succeeds or ctx is done. Keys are only
+// tried by the waiter that has been waiting for them longest, or by the one
+// that was woken for them.
+func (s *SliceStorage) block(ctx context.Context, keys []string, pop func(key string) (bool, error)) (string, error) {
+	w := s.waiters.add(keys)
+	defer func() {
+		s.waiters.remove(w)
+		for _, key := range keys {
+			sh := s.rlockShard(key)
+			n := s.listLen(key)
+			sh.mu.RUnlock()
+			if n > 0 {
+				s.waiters.wake(key, n)
+			}
+		}
+	}()
+
+	try := func(key string) (bool, error) {
+		if s.CheckIfExpired(key) {
+			return false, nil
+		}
+		return pop(key)
+	}
+
+	woken := ""
+	for {
+		if woken != "" {
+			if ok, err := try(woken); ok || err != nil {
+				return woken, err
+			}
+		}
+
+		for _, key := range keys {
+			if key == woken || !s.waiters.first(w, key) {
+				continue
+			}
+			if ok, err := try(key); ok || err != nil {
+				return key, err
+			}
+		}
+
+		select {
+		case woken = <-w.ready:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// BLPop pops the first element of the first of keys that has one, waiting
+// for a push until ctx is done.
+func (s *SliceStorage) BLPop(ctx context.Context, keys ...string) (string, string, error) {
+	return s.blockingPop(ctx, keys, s.LPop)
+}
+
+// BRPop is BLPop for the last element.
+func (s *SliceStorage) BRPop(ctx context.Context, keys ...string) (string, string, error) {
+	return s.blockingPop(ctx, keys, s.RPop)
+}
+
+func (s *SliceStorage) blockingPop(ctx context.Context, keys []string, pop func(string, ...int) []string) (string, string, error) {
+	var elem string
+	key, err := s.block(ctx, keys, func(key string) (bool, error) {
+		res := pop(key, 1)
+		if len(res) == 0 {
+			return false, nil
+		}
+
+		elem = res[0]
+		return true, nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, elem, nil
+}
+
+// LMove atomically pops an element from one end of src and pushes it to one
+// end of dst, which may be src itself. It reports false if src is empty.
+func (s *SliceStorage) LMove(src, dst string, from, to End) (string, bool, error) {
+	rec := Record{Op: OpLMove, Key: src, Vals: []string{dst, string(from), string(to)}}
+	if s.proposer != nil {
+		res, err := proposed[[]string](s, rec)
+		if err != nil || len(res) == 0 {
+			return "", false, err
+		}
+		return res[0], true, nil
+	}
+
+	shards := s.shardsOf([]string{src, dst})
+	lockShards(shards, true)
+	defer unlockShards(shards, true)
+	s.preserve(src, dst)
+
+	res, err := s.lmove(src, dst, from, to)
+	if err != nil || len(res) == 0 {
+		return "", false, err
+	}
+
+	s.appendRecord(rec)
+	return res[0], true, nil
+}
+
+// BLMove is LMove waiting for an element in src until ctx is done.
+func (s *SliceStorage) BLMove(ctx context.Context, src, dst string, from, to End) (string, error) {
+	var elem string
+	_, err := s.block(ctx, []string{src}, func(string) (bool, error) {
+		var ok bool
+		var err error
+		elem, ok, err = s.LMove(src, dst, from, to)
+		return ok, err
+	})
+
+	return elem, err
+}
+
+// lmove returns the moved element as a slice, like the pops, so that
+// appliers can tell whether anything was moved.
+func (s *SliceStorage) lmove(src, dst string, from, to End) ([]string, error) {
+	if s.listLen(src) == 0 {
+		if _, ok := s.lookup(src); ok && s.value(src).Kind != KindSliceInt && s.value(src).Kind != KindSliceStr {
+			return nil, ErrWrongKind
+		}
+		return []string{}, nil
+	}
+
+	head := s.value(src).StSl[0]
+	if from == Right {
+		head = s.value(src).StSl[len(s.value(src).StSl)-1]
+	}
+
+	if val, ok := s.lookup(dst); ok {
+		switch val.Kind {
+		case KindSliceStr:
+		case KindSliceInt:
+			if _, err := strconv.Atoi(head); err != nil {
+				return nil, ErrWrongKind
+			}
+		default:
+			return nil, ErrWrongKind
+		}
+	}
+
+	var res []string
+	if from == Right {
+		res = s.rpop(src, 1)
+	} else {
+		res = s.lpop(src, 1)
+	}
+
+	if to == Right {
+		s.rpush(dst, res)
+	} else {
+		s.lpush(dst, res)
+	}
+	return res, nil
+}
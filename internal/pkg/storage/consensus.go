@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var errNothingToPop = errors.New("nothing to pop")
+
+// Proposer puts records into a replicated log, such as raft, whose entries
+// are applied on every node with ApplyReplicated. Propose returns once rec is
+// committed and applied locally, with what applying it returned.
+type Proposer interface {
+	Propose(rec Record) (any, error)
+	// ProposeIf proposes the record build returns unless it fails. While
+	// build runs every earlier proposal has been applied and no other one is
+	// in flight.
+	ProposeIf(build func() (Record, error)) (any, error)
+}
+
+// SetProposer makes every mutation go through p instead of being applied
+// directly. It has to be called before the storage is used.
+//
+// Eviction is not applied then: which keys are evicted depends on sampling
+// and would differ between nodes.
+func (s *SliceStorage) SetProposer(p Proposer) {
+	s.lockAll()
+	defer s.unlockAll()
+
+	s.proposer = p
+}
+
+func proposed[T any](s *SliceStorage, rec Record) (T, error) {
+	var zero T
+	res, err := s.proposer.Propose(rec)
+	if err != nil {
+		return zero, err
+	}
+
+	v, _ := res.(T)
+	return v, nil
+}
+
+// proposeExpired deletes key through the log if it has expired. Only the
+// leader succeeds; other nodes just report the key as gone.
+func (s *SliceStorage) proposeExpired(key string) bool {
+	sh := s.rlockShard(key)
+	at := s.value(key).Expires_at
+	sh.mu.RUnlock()
+
+	if at == 0 || time.Now().UnixMilli() < at {
+		return false
+	}
+
+	if _, err := s.proposer.Propose(Record{Op: OpDel, Key: key, Reason: ReasonExpired}); err != nil {
+		s.logger.Debug("Expired key not deleted", zap.String("key", key), zap.Error(err))
+	}
+	return true
+}
+
+func (s *SliceStorage) proposeClean() {
+	var expired []string
+	now := time.Now().UnixMilli()
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for key, val := range sh.inner {
+			if val.Expires_at != 0 && now >= val.Expires_at {
+				expired = append(expired, key)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+
+	for _, key := range expired {
+		if _, err := s.proposer.Propose(Record{Op: OpDel, Key: key, Reason: ReasonExpired}); err != nil {
+			s.logger.Debug("Expired keys not deleted", zap.Error(err))
+			return
+		}
+	}
+}
+
+// proposeTx checks the watched keys on the node that proposes, so that the
+// decision does not depend on versions, which are local to every node.
+func (s *SliceStorage) proposeTx(tx *Tx) ([]TxResult, error) {
+	for _, op := range tx.ops {
+		s.proposeExpired(op.Key)
+	}
+
+	// Relative expirations are resolved here for the same reason.
+	ops := make([]TxOp, len(tx.ops))
+	for i, op := range tx.ops {
+		ops[i] = op
+		if op.Op != "expire" || len(op.Args) != 1 {
+			continue
+		}
+
+		if seconds, err := strconv.ParseInt(op.Args[0], 10, 64); err == nil {
+			at := strconv.FormatInt(time.Now().UnixMilli()+seconds*1000, 10)
+			ops[i] = TxOp{Op: string(OpExpireAt), Key: op.Key, Args: []string{at}}
+		}
+	}
+
+	res, err := s.proposer.ProposeIf(func() (Record, error) {
+		for key, v := range tx.watched {
+			if tx.storage.Versions(key)[key] != v {
+				return Record{}, ErrTxAborted
+			}
+		}
+
+		return Record{Op: OpExec, Ops: ops}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results, _ := res.([]TxResult)
+	return results, nil
+}
+
+func (s *SliceStorage) proposePop(rec Record) []string {
+	res, err := proposed[[]string](s, rec)
+	if err != nil {
+		s.logger.Error("Failed to pop", zap.String("key", rec.Key), zap.Error(err))
+	}
+	if res == nil {
+		return []string{}
+	}
+
+	return res
+}
+
+// proposeSPop picks the members while no other proposal is in flight and
+// removes them through the log, like SPop writes them to the wal.
+func (s *SliceStorage) proposeSPop(key string, count int) ([]string, error) {
+	var res []string
+	_, err := s.proposer.ProposeIf(func() (Record, error) {
+		sh := s.rlockShard(key)
+		defer sh.mu.RUnlock()
+
+		set, err := s.getSet(key)
+		if err != nil {
+			return Record{}, err
+		}
+
+		if res = randomMembers(set, count); len(res) == 0 {
+			return Record{}, errNothingToPop
+		}
+		return Record{Op: OpSRem, Key: key, Vals: res}, nil
+	})
+	if errors.Is(err, errNothingToPop) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// proposeRestore replaces the contents on every node the way a compacted
+// wal does it.
+func (s *SliceStorage) proposeRestore(data []byte) error {
+	inner, err := readSnapshotData(data)
+	if err != nil {
+		s.logger.Error("Failed to decode snapshot", zap.Error(err))
+		return err
+	}
+
+	batch := []Record{{Op: OpFlush}}
+	for key, val := range inner {
+		batch = append(batch, Record{Op: OpRestore, Key: key, Value: &val})
+	}
+
+	_, err = s.proposer.Propose(Record{Op: OpMulti, Batch: batch})
+	return err
+}
@@ -0,0 +1,394 @@
+package storage
+
+import (
+	"errors"
+	"math/rand/v2"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var ErrOOM = errors.New("command not allowed when used memory > 'maxmemory'")
+
+type EvictionPolicy string
+
+const (
+	NoEviction     EvictionPolicy = "noeviction"
+	AllKeysLRU     EvictionPolicy = "allkeys-lru"
+	AllKeysLFU     EvictionPolicy = "allkeys-lfu"
+	VolatileLRU    EvictionPolicy = "volatile-lru"
+	VolatileTTL    EvictionPolicy = "volatile-ttl"
+	defaultSamples                = 5
+)
+
+func ParseEvictionPolicy(policy string) (EvictionPolicy, error) {
+	switch EvictionPolicy(policy) {
+	case NoEviction, AllKeysLRU, AllKeysLFU, VolatileLRU, VolatileTTL:
+		return EvictionPolicy(policy), nil
+	case "":
+		return NoEviction, nil
+	}
+
+	return "", errors.New("unknown eviction policy")
+}
+
+// EvictionConfig limits the storage by number of keys and/or estimated
+// memory in bytes; zero means no limit.
+type EvictionConfig struct {
+	Policy    EvictionPolicy
+	MaxKeys   int
+	MaxMemory int64
+	Samples   int
+}
+
+type EvictionStats struct {
+	Policy     EvictionPolicy `json:"policy"`
+	Keys       int            `json:"keys"`
+	MaxKeys    int            `json:"max_keys"`
+	UsedMemory int64          `json:"used_memory"`
+	MaxMemory  int64          `json:"max_memory"`
+	Evicted    uint64         `json:"evicted"`
+}
+
+const (
+	lfuInitVal    = 5
+	lfuLogFactor  = 10
+	lfuDecayMilli = 60 * 1000
+	sizeSamples   = 16
+	entryOverhead = 64
+)
+
+// keyMeta is updated with atomics by readers holding only the read lock of
+// its shard; size is owned by writers.
+type keyMeta struct {
+	lastAccess atomic.Int64
+	counter    atomic.Uint32
+	size       int64
+	kind       Kind
+}
+
+func (m *keyMeta) access(now int64) {
+	last := m.lastAccess.Swap(now)
+	counter := m.counter.Load()
+	if periods := (now - last) / lfuDecayMilli; periods > 0 {
+		counter = uint32(max(int64(counter)-periods, 0))
+	}
+
+	if counter < 255 {
+		base := max(float64(counter)-lfuInitVal, 0)
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			counter++
+		}
+	}
+	m.counter.Store(counter)
+}
+
+func (m *keyMeta) frequency(now int64) uint32 {
+	counter := int64(m.counter.Load())
+	periods := (now - m.lastAccess.Load()) / lfuDecayMilli
+	return uint32(max(counter-periods, 0))
+}
+
+func (s *SliceStorage) SetEviction(cfg EvictionConfig) {
+	if cfg.Samples <= 0 {
+		cfg.Samples = defaultSamples
+	}
+	if cfg.Policy == "" {
+		cfg.Policy = NoEviction
+	}
+
+	s.eviction.Store(&cfg)
+	s.logger.Info("eviction configured", zap.String("policy", string(cfg.Policy)),
+		zap.Int("max_keys", cfg.MaxKeys), zap.Int64("max_memory", cfg.MaxMemory))
+}
+
+func (s *SliceStorage) evictionConfig() *EvictionConfig {
+	if cfg := s.eviction.Load(); cfg != nil {
+		return cfg
+	}
+
+	return &EvictionConfig{Policy: NoEviction, Samples: defaultSamples}
+}
+
+func (s *SliceStorage) EvictionStats() EvictionStats {
+	cfg := s.evictionConfig()
+	return EvictionStats{
+		Policy:     cfg.Policy,
+		Keys:       int(s.keys.Load()),
+		MaxKeys:    cfg.MaxKeys,
+		UsedMemory: s.usedMemory.Load(),
+		MaxMemory:  cfg.MaxMemory,
+		Evicted:    s.evicted.Load(),
+	}
+}
+
+// tracksAccess reports whether access times are needed at all; reading the
+// clock on every hit is not free.
+func (s *SliceStorage) tracksAccess() bool {
+	cfg := s.eviction.Load()
+	return cfg != nil && cfg.Policy != NoEviction
+}
+
+// accessed records a read of key; it is safe under the read lock.
+func (s *SliceStorage) accessed(key string) {
+	if !s.tracksAccess() {
+		return
+	}
+
+	if m, ok := s.shardFor(key).meta[key]; ok {
+		m.access(time.Now().UnixMilli())
+	}
+}
+
+// trackWrite refreshes the metadata of key after it was modified or removed.
+func (s *SliceStorage) trackWrite(key string) {
+	sh := s.shardFor(key)
+	val, ok := sh.inner[key]
+	m := sh.meta[key]
+	if !ok {
+		if m != nil {
+			s.usedMemory.Add(-m.size)
+			s.keys.Add(-1)
+			s.countKind(m.kind, -1)
+			delete(sh.meta, key)
+		}
+		delete(sh.volatile, key)
+		return
+	}
+
+	if m == nil {
+		m = &keyMeta{}
+		m.counter.Store(lfuInitVal)
+		sh.meta[key] = m
+		s.keys.Add(1)
+	}
+	if m.kind != val.Kind {
+		s.countKind(m.kind, -1)
+		s.countKind(val.Kind, 1)
+		m.kind = val.Kind
+	}
+
+	size := sizeOf(key, val)
+	s.usedMemory.Add(size - m.size)
+	m.size = size
+	if s.tracksAccess() {
+		m.access(time.Now().UnixMilli())
+	}
+
+	if val.Expires_at != 0 {
+		sh.volatile[key] = struct{}{}
+	} else {
+		delete(sh.volatile, key)
+	}
+}
+
+// rebuildMeta recounts everything after the contents were replaced; all
+// shards must be locked.
+func (s *SliceStorage) rebuildMeta() {
+	s.usedMemory.Store(0)
+	s.keys.Store(0)
+	for _, n := range s.kinds {
+		n.Store(0)
+	}
+	for _, sh := range s.shards {
+		sh.meta = make(map[string]*keyMeta, len(sh.inner))
+		sh.volatile = make(map[string]struct{})
+		for key := range sh.inner {
+			s.trackWrite(key)
+		}
+	}
+}
+
+// overBudget reports whether a write to key does not fit. With locked unset
+// the shard of key is read-locked for the check.
+func (s *SliceStorage) overBudget(cfg *EvictionConfig, key string, locked bool) bool {
+	if cfg.MaxMemory > 0 && s.usedMemory.Load() > cfg.MaxMemory {
+		return true
+	}
+
+	keys := int(s.keys.Load())
+	if cfg.MaxKeys == 0 || keys < cfg.MaxKeys {
+		return false
+	}
+
+	sh := s.shardFor(key)
+	if !locked {
+		sh.mu.RLock()
+		defer sh.mu.RUnlock()
+	}
+
+	_, exists := sh.inner[key]
+	return !exists || keys > cfg.MaxKeys
+}
+
+// reserve makes room before a write to key, evicting other keys according
+// to the policy. It returns ErrOOM when nothing can be evicted. The caller
+// either holds no shard at all or, with locked set, every shard.
+func (s *SliceStorage) reserve(key string, locked bool) error {
+	cfg := s.evictionConfig()
+	for s.overBudget(cfg, key, locked) {
+		if cfg.Policy == NoEviction {
+			return ErrOOM
+		}
+
+		victim, ok := s.pickVictim(cfg, key, locked)
+		if !ok {
+			return ErrOOM
+		}
+
+		sh := s.shardFor(victim)
+		if !locked {
+			sh.mu.Lock()
+			sh.preserve(victim)
+		}
+
+		// Another writer may have evicted the same key in between.
+		if s.remove(victim) {
+			s.appendRecord(Record{Op: OpDel, Key: victim, Reason: ReasonEvicted})
+			s.evicted.Add(1)
+			s.logger.Info("key evicted", zap.String("key", victim), zap.String("policy", string(cfg.Policy)))
+		}
+
+		if !locked {
+			sh.mu.Unlock()
+		}
+	}
+
+	return nil
+}
+
+// pickVictim samples a few keys, like redis does, starting from a random
+// shard, and returns the best candidate among them.
+func (s *SliceStorage) pickVictim(cfg *EvictionConfig, protected string, locked bool) (string, bool) {
+	now := time.Now().UnixMilli()
+	volatile := strings.HasPrefix(string(cfg.Policy), "volatile")
+	var victim string
+	var best int64
+	found := false
+	sampled := 0
+
+	consider := func(sh *shard, key string) {
+		if key == protected {
+			return
+		}
+
+		var score int64
+		switch cfg.Policy {
+		case AllKeysLFU:
+			score = int64(sh.meta[key].frequency(now))
+		case VolatileTTL:
+			score = sh.inner[key].Expires_at
+		default:
+			score = sh.meta[key].lastAccess.Load()
+		}
+
+		if !found || score < best {
+			victim, best, found = key, score, true
+		}
+		sampled++
+	}
+
+	first := rand.IntN(len(s.shards))
+	for i := 0; i < len(s.shards) && sampled < cfg.Samples; i++ {
+		sh := s.shards[(first+i)%len(s.shards)]
+		if !locked {
+			sh.mu.RLock()
+		}
+
+		if volatile {
+			for key := range sh.volatile {
+				if consider(sh, key); sampled >= cfg.Samples {
+					break
+				}
+			}
+		} else {
+			for key := range sh.meta {
+				if consider(sh, key); sampled >= cfg.Samples {
+					break
+				}
+			}
+		}
+
+		if !locked {
+			sh.mu.RUnlock()
+		}
+	}
+
+	return victim, found
+}
+
+func sampledSize(n int, each func(yield func(string) bool)) int64 {
+	if n == 0 {
+		return 0
+	}
+
+	var total, seen int64
+	each(func(x string) bool {
+		total += int64(len(x))
+		seen++
+		return seen < sizeSamples
+	})
+
+	return total * int64(n) / seen
+}
+
+// sizeOf estimates the memory used by a key. Big collections are sampled so
+// that the estimate stays cheap on every write.
+func sizeOf(key string, val SliceValue) int64 {
+	size := int64(len(key)+len(val.St)) + entryOverhead
+	size += sampledSize(len(val.StSl), func(yield func(string) bool) {
+		for _, x := range val.StSl {
+			if !yield(x) {
+				return
+			}
+		}
+	}) + int64(len(val.StSl))*16
+	size += sampledSize(len(val.Mint), func(yield func(string) bool) {
+		for k := range val.Mint {
+			if !yield(k) {
+				return
+			}
+		}
+	}) + int64(len(val.Mint))*32
+	size += sampledSize(len(val.Mstr), func(yield func(string) bool) {
+		for k, v := range val.Mstr {
+			if !yield(k + v) {
+				return
+			}
+		}
+	}) + int64(len(val.Mstr))*48
+	size += sampledSize(len(val.Set), func(yield func(string) bool) {
+		for k := range val.Set {
+			if !yield(k) {
+				return
+			}
+		}
+	}) + int64(len(val.Set))*24
+	if val.ZSet != nil {
+		size += sampledSize(val.ZSet.Len(), func(yield func(string) bool) {
+			for k := range val.ZSet.scores {
+				if !yield(k) {
+					return
+				}
+			}
+		}) + int64(val.ZSet.Len())*96
+	}
+	if val.Stream != nil {
+		size += sampledSize(len(val.Stream.Entries), func(yield func(string) bool) {
+			for _, e := range val.Stream.Entries {
+				for k, v := range e.Fields {
+					if !yield(k + v) {
+						return
+					}
+				}
+			}
+		}) + int64(len(val.Stream.Entries))*64
+		for _, g := range val.Stream.Groups {
+			size += int64(len(g.Pending)) * 96
+		}
+	}
+
+	return size
+}
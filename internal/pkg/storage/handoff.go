@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Keys are handed over between the nodes of a sharded cluster in three
+// steps: the old owner exports a key, the new owner imports it unless it has
+// the key already, and the old owner drops it if it has not changed since.
+
+var errKeyExists = errors.New("key exists")
+
+// Keys returns every key that has not expired.
+func (s *SliceStorage) Keys() []string {
+	var res []string
+	now := time.Now().UnixMilli()
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for key, val := range sh.inner {
+			if val.Expires_at == 0 || now < val.Expires_at {
+				res = append(res, key)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+
+	return res
+}
+
+// Export returns key encoded the way the storage file keeps it, together
+// with its version.
+func (s *SliceStorage) Export(key string) (json.RawMessage, uint64, bool) {
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
+
+	val, ok := s.lookup(key)
+	if !ok {
+		return nil, 0, false
+	}
+
+	data, err := json.Marshal(val)
+	if err != nil {
+		s.logger.Error("Failed to marshal key", zap.String("key", key), zap.Error(err))
+		return nil, 0, false
+	}
+
+	return data, sh.versions[key], true
+}
+
+// Import stores a key exported by another node. A key that exists already
+// was written after the handover had started and is kept.
+func (s *SliceStorage) Import(key string, data json.RawMessage) (bool, error) {
+	var val SliceValue
+	if err := json.Unmarshal(data, &val); err != nil {
+		return false, err
+	}
+
+	if s.proposer != nil {
+		_, err := s.proposer.ProposeIf(func() (Record, error) {
+			sh := s.rlockShard(key)
+			defer sh.mu.RUnlock()
+
+			if _, ok := s.lookup(key); ok {
+				return Record{}, errKeyExists
+			}
+			return Record{Op: OpRestore, Key: key, Value: &val}, nil
+		})
+		if errors.Is(err, errKeyExists) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return false, err
+	}
+	defer sh.mu.Unlock()
+
+	if _, ok := s.lookup(key); ok {
+		return false, nil
+	}
+
+	s.store(key, val)
+	s.appendRecord(Record{Op: OpRestore, Key: key, Value: &val})
+	return true, nil
+}
+
+// DropIfUnchanged removes key if its version is still version.
+func (s *SliceStorage) DropIfUnchanged(key string, version uint64) bool {
+	if s.proposer != nil {
+		_, err := s.proposer.ProposeIf(func() (Record, error) {
+			if s.Versions(key)[key] != version {
+				return Record{}, ErrTxAborted
+			}
+			return Record{Op: OpDel, Key: key}, nil
+		})
+		return err == nil
+	}
+
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+
+	if sh.versions[key] != version || !s.remove(key) {
+		return false
+	}
+
+	s.appendRecord(Record{Op: OpDel, Key: key})
+	return true
+}
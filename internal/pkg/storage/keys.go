@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"proj1/internal/pkg/saving"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+var ErrNoKeyStore = errors.New("no key store is set")
+
+// SetKeyStore makes the storage track which keys change, so that FlushKeys
+// only writes those to ks. The first flush writes every key. A wal keeps
+// the changes that are not flushed yet: every flush drops the records it
+// wrote from it.
+func (s *SliceStorage) SetKeyStore(ks saving.KeyStore) {
+	s.lockAll()
+	defer s.unlockAll()
+
+	s.keyStore = ks
+	s.resync = true
+	for _, sh := range s.shards {
+		sh.dirty = make(map[string]struct{})
+	}
+}
+
+// LoadKeys replaces the contents with the keys of the key store, reading
+// them one by one. Keys that expired in the meantime are not loaded and get
+// deleted from the store by the next flush.
+func (s *SliceStorage) LoadKeys() error {
+	ctx, span := tracer.Start(context.Background(), "storage.load_keys")
+	err := s.loadKeys(ctx)
+	endSpan(span, err)
+	return err
+}
+
+func (s *SliceStorage) loadKeys(ctx context.Context) error {
+	s.lockAll()
+	defer s.unlockAll()
+
+	if s.keyStore == nil {
+		return ErrNoKeyStore
+	}
+
+	s.replace(nil)
+	var loaded int
+	var expired []string
+	now := time.Now().UnixMilli()
+	err := persist(ctx, "ScanKeys", s.keyStore, func() error {
+		return s.keyStore.ScanKeys(func(row saving.KeyRow) error {
+			if row.ExpiresAt != 0 && now >= row.ExpiresAt {
+				expired = append(expired, row.Key)
+				return nil
+			}
+
+			var val SliceValue
+			if err := json.Unmarshal(row.Payload, &val); err != nil {
+				return fmt.Errorf("key %q: %w", row.Key, err)
+			}
+
+			s.store(row.Key, val)
+			loaded++
+			return nil
+		})
+	})
+	if err != nil {
+		s.logger.Error("Failed to load keys", zap.Error(err))
+		return err
+	}
+
+	s.touchAll()
+	s.rebuildMeta()
+	s.resetFeed()
+
+	// What was just read is in the store already.
+	s.resync = false
+	for _, sh := range s.shards {
+		clear(sh.dirty)
+	}
+	for _, key := range expired {
+		s.shardFor(key).dirty[key] = struct{}{}
+	}
+
+	s.logger.Info("Keys loaded", zap.Int("keys", loaded), zap.Int("expired", len(expired)))
+	return nil
+}
+
+func keyRow(key string, val SliceValue) (saving.KeyRow, error) {
+	payload, err := json.Marshal(val)
+	return saving.KeyRow{Key: key, Kind: string(val.Kind), ExpiresAt: val.Expires_at, Payload: payload}, err
+}
+
+// FlushKeys writes the keys changed since the last flush to the key store,
+// and deletes the ones that are gone, in one batch. It returns the number
+// of keys written or deleted. Keys of a failed flush are kept for the next
+// one.
+func (s *SliceStorage) FlushKeys() (int, error) {
+	ctx, span := tracer.Start(context.Background(), "storage.flush_keys")
+	n, err := s.flushKeys(ctx)
+	span.SetAttributes(attribute.Int("storage.keys", n))
+	endSpan(span, err)
+	return n, err
+}
+
+func (s *SliceStorage) flushKeys(ctx context.Context) (int, error) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	sh := s.shards[0]
+	sh.mu.RLock()
+	ks, resync := s.keyStore, s.resync
+	sh.mu.RUnlock()
+	if ks == nil {
+		return 0, ErrNoKeyStore
+	}
+
+	if resync {
+		return s.flushAllKeys(ctx, ks)
+	}
+
+	// The values are copied with every shard locked, so that they are what
+	// the wal holds up to the mark.
+	values := make(map[string]SliceValue)
+	var deletes []string
+	lockShards(s.shards, true)
+	wal, mark := s.walMark()
+	for _, sh := range s.shards {
+		if len(sh.dirty) == 0 {
+			continue
+		}
+
+		for key := range sh.dirty {
+			if val, ok := sh.inner[key]; ok {
+				values[key] = cloneValue(val)
+			} else {
+				deletes = append(deletes, key)
+			}
+		}
+		sh.dirty = make(map[string]struct{})
+	}
+	unlockShards(s.shards, true)
+
+	if len(values)+len(deletes) == 0 {
+		return 0, nil
+	}
+
+	upserts := make([]saving.KeyRow, 0, len(values))
+	var err error
+	for key, val := range values {
+		row, rowErr := keyRow(key, val)
+		upserts = append(upserts, row)
+		err = cmp.Or(err, rowErr)
+	}
+
+	if err == nil {
+		err = persist(ctx, "WriteKeys", ks, func() error {
+			return ks.WriteKeys(upserts, deletes)
+		})
+	}
+	if err != nil {
+		s.redirty(upserts, deletes)
+		return 0, err
+	}
+
+	s.discardWAL(wal, mark)
+	return len(upserts) + len(deletes), nil
+}
+
+// flushAllKeys replaces the contents of the key store after the storage
+// was replaced as a whole. The caller holds flushMu.
+func (s *SliceStorage) flushAllKeys(ctx context.Context, ks saving.KeyStore) (int, error) {
+	// Whatever changes from here on is flushed again by the next flush.
+	lockShards(s.shards, true)
+	s.resync = false
+	for _, sh := range s.shards {
+		clear(sh.dirty)
+	}
+	unlockShards(s.shards, true)
+
+	s.saveMu.Lock()
+	inner, info, err := s.captureContents(nil)
+	s.saveMu.Unlock()
+
+	rows := make([]saving.KeyRow, 0, len(inner))
+	for key, val := range inner {
+		row, rowErr := keyRow(key, val)
+		rows = append(rows, row)
+		err = cmp.Or(err, rowErr)
+	}
+
+	if err == nil {
+		err = persist(ctx, "ReplaceKeys", ks, func() error {
+			return ks.ReplaceKeys(rows)
+		})
+	}
+	if err != nil {
+		lockShards(s.shards, true)
+		s.resync = true
+		unlockShards(s.shards, true)
+		return 0, err
+	}
+
+	s.discardWAL(info.wal, info.walMark)
+	s.logger.Info("Keys rewritten", zap.Int("keys", len(rows)))
+	return len(rows), nil
+}
+
+func (s *SliceStorage) redirty(upserts []saving.KeyRow, deletes []string) {
+	for _, row := range upserts {
+		deletes = append(deletes, row.Key)
+	}
+
+	for _, key := range deletes {
+		sh := s.shardFor(key)
+		sh.mu.Lock()
+		sh.dirty[key] = struct{}{}
+		sh.mu.Unlock()
+	}
+}
+
+// walMark returns the wal and the position of its next record, with every
+// shard locked so that no record is being appended.
+func (s *SliceStorage) walMark() (*saving.WAL, saving.WALMark) {
+	if s.wal == nil {
+		return nil, saving.WALMark{}
+	}
+
+	return s.wal, s.wal.Mark()
+}
+
+// discardWAL drops the records before mark, which the key store holds now.
+// Replaying them on top of it would repeat increments and pushes, so if
+// that fails the wal is compacted, as its contents can be replayed anywhere.
+func (s *SliceStorage) discardWAL(wal *saving.WAL, mark saving.WALMark) {
+	if wal == nil || wal.Discard(mark) == nil {
+		return
+	}
+
+	if err := s.CompactWAL(); err != nil {
+		s.logger.Error("Failed to compact wal", zap.Error(err))
+	}
+}
+
+// trackReplayed marks the keys a record replayed from the wal changed, so
+// that the next flush writes them to the key store.
+func (s *SliceStorage) trackReplayed(rec Record) {
+	switch rec.Op {
+	case OpFlush:
+		s.resync = true
+	case OpMulti:
+		for _, sub := range rec.Batch {
+			s.trackReplayed(sub)
+		}
+	case OpLMove:
+		if len(rec.Vals) > 0 {
+			s.touch(rec.Vals[0])
+		}
+	}
+	s.touch(rec.Key)
+}
+
+// PeriodicFlushKeys flushes the keys every interval, and once more when
+// closeChan is closed so that a clean stop loses nothing. Keys of a failed
+// flush are retried by the next one.
+func (s *SliceStorage) PeriodicFlushKeys(closeChan chan struct{}, interval time.Duration) {
+	for {
+		select {
+		case <-closeChan:
+			s.flushKeysLogged()
+			return
+		case <-time.After(interval):
+			s.flushKeysLogged()
+		}
+	}
+}
+
+func (s *SliceStorage) flushKeysLogged() {
+	if _, err := s.FlushKeys(); err != nil {
+		s.logger.Error("Failed to flush keys", zap.Error(err))
+	}
+}
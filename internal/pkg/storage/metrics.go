@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"proj1/internal/pkg/metrics"
+)
+
+var (
+	// lockBuckets are upper bounds in seconds of waiting for a shard lock.
+	lockBuckets = []float64{1e-6, 1e-5, 1e-4, .001, .01, .1, 1}
+	saveBuckets = []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60}
+)
+
+// KeysByKind counts the keys per kind of value, including expired ones that
+// are not deleted yet. The counts are kept up to date by writes.
+func (s *SliceStorage) KeysByKind() map[Kind]int {
+	res := make(map[Kind]int)
+	for kind, n := range s.kinds {
+		if v := n.Load(); v > 0 {
+			res[kind] = int(v)
+		}
+	}
+
+	return res
+}
+
+// countKind adds delta to the number of keys of kind.
+func (s *SliceStorage) countKind(kind Kind, delta int64) {
+	if n, ok := s.kinds[kind]; ok {
+		n.Add(delta)
+	}
+}
+
+// RegisterMetrics adds the metrics of the storage to reg.
+func (s *SliceStorage) RegisterMetrics(reg *metrics.Registry) {
+	reg.GaugeVecFunc("storage_keys", "Number of keys per kind of value.", "kind", func() map[string]float64 {
+		res := make(map[string]float64)
+		for kind, n := range s.KeysByKind() {
+			res[string(kind)] = float64(n)
+		}
+		return res
+	})
+	reg.CounterFunc("storage_expired_keys_total", "Number of keys deleted because they expired.", func() float64 {
+		return float64(s.expired.Load())
+	})
+	reg.CounterFunc("storage_evicted_keys_total", "Number of keys evicted by the eviction policy.", func() float64 {
+		return float64(s.evicted.Load())
+	})
+	reg.CounterFunc("storage_snapshot_failures_total", "Number of snapshots that could not be saved.", func() float64 {
+		return float64(s.SnapshotStats().Failures)
+	})
+	reg.Histogram("storage_snapshot_duration_seconds", "Time taken to save a snapshot.", s.saveDuration)
+	reg.GaugeFunc("storage_snapshot_size_bytes", "Size of the last snapshot.", func() float64 {
+		return float64(s.SnapshotStats().LastBytes)
+	})
+	reg.Histogram("storage_lock_wait_seconds", "Time waited for shard locks.", s.readWait, "mode", "read")
+	reg.Histogram("storage_lock_wait_seconds", "Time waited for shard locks.", s.writeWait, "mode", "write")
+}
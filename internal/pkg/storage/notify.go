@@ -0,0 +1,56 @@
+package storage
+
+// Reasons why a key was deleted other than by a client.
+const (
+	ReasonExpired = "expired"
+	ReasonEvicted = "evicted"
+)
+
+// Event describes a change of a key. Op is the operation of the record, or
+// the reason for deletions such as expiry; Kind is the kind of the key after
+// the change and empty if the key is gone. Replacing the whole contents
+// produces a flush event without a key.
+type Event struct {
+	Key  string `json:"key"`
+	Op   string `json:"op"`
+	Kind Kind   `json:"kind,omitempty"`
+}
+
+// SetNotifier makes fn receive an event for every change, including the
+// ones applied from a leader. fn is called with the key locked, so it must
+// not block or use the storage.
+func (s *SliceStorage) SetNotifier(fn func(Event)) {
+	s.lockAll()
+	defer s.unlockAll()
+
+	s.notify = fn
+}
+
+// notifyRecord reports rec once it is complete, i.e. a transaction when it
+// is committed. The keys of rec must be locked.
+func (s *SliceStorage) notifyRecord(rec Record) {
+	if s.notify == nil {
+		return
+	}
+
+	switch rec.Op {
+	case OpMulti:
+		for _, sub := range rec.Batch {
+			s.notifyRecord(sub)
+		}
+		return
+	case OpFlush:
+		s.notify(Event{Op: string(OpFlush)})
+		return
+	}
+
+	op := string(rec.Op)
+	if rec.Reason != "" {
+		op = rec.Reason
+	}
+
+	s.notify(Event{Key: rec.Key, Op: op, Kind: s.value(rec.Key).Kind})
+	if rec.Op == OpLMove && len(rec.Vals) > 0 && rec.Vals[0] != rec.Key {
+		s.notify(Event{Key: rec.Vals[0], Op: op, Kind: s.value(rec.Vals[0]).Kind})
+	}
+}
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+var (
+	ErrNotInteger = errors.New("value is not an integer or out of range")
+	ErrNotFloat   = errors.New("value is not a valid float")
+	ErrOverflow   = errors.New("increment or decrement would overflow")
+	ErrNaN        = errors.New("increment would produce NaN or Infinity")
+)
+
+func addInt64(a, b int64) (int64, error) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, ErrOverflow
+	}
+
+	return a + b, nil
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// scalarValue returns the scalar stored at key; a missing key reads as zero.
+func (s *SliceStorage) scalarValue(key string) (SliceValue, string, error) {
+	val, ok := s.lookup(key)
+	if !ok {
+		return SliceValue{}, "0", nil
+	}
+
+	if val.Kind != KindInt && val.Kind != KindString {
+		return val, "", ErrWrongKind
+	}
+
+	return val, val.St, nil
+}
+
+// storeNumber keeps the expiration of val and picks the kind by the value.
+func (s *SliceStorage) storeNumber(key string, val SliceValue, num string) {
+	val.Kind = KindString
+	if _, err := strconv.Atoi(num); err == nil {
+		val.Kind = KindInt
+	}
+
+	val.St = num
+	s.store(key, val)
+}
+
+func (s *SliceStorage) IncrBy(key string, delta int64) (int64, error) {
+	if s.proposer != nil {
+		return proposed[int64](s, Record{Op: OpIncrBy, Key: key, Ints: []int64{delta}})
+	}
+
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	defer sh.mu.Unlock()
+
+	res, err := s.incrBy(key, delta)
+	if err != nil {
+		return 0, err
+	}
+
+	s.appendRecord(Record{Op: OpIncrBy, Key: key, Ints: []int64{delta}})
+	return res, nil
+}
+
+func (s *SliceStorage) incrBy(key string, delta int64) (int64, error) {
+	val, cur, err := s.scalarValue(key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.ParseInt(cur, 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+
+	res, err := addInt64(n, delta)
+	if err != nil {
+		return 0, err
+	}
+
+	s.storeNumber(key, val, strconv.FormatInt(res, 10))
+	return res, nil
+}
+
+func (s *SliceStorage) IncrByFloat(key string, delta float64) (float64, error) {
+	if s.proposer != nil {
+		return proposed[float64](s, Record{Op: OpIncrByFloat, Key: key, Floats: []float64{delta}})
+	}
+
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	defer sh.mu.Unlock()
+
+	res, err := s.incrByFloat(key, delta)
+	if err != nil {
+		return 0, err
+	}
+
+	s.appendRecord(Record{Op: OpIncrByFloat, Key: key, Floats: []float64{delta}})
+	return res, nil
+}
+
+func (s *SliceStorage) incrByFloat(key string, delta float64) (float64, error) {
+	val, cur, err := s.scalarValue(key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.ParseFloat(cur, 64)
+	if err != nil {
+		return 0, ErrNotFloat
+	}
+
+	res := n + delta
+	if !validScore(res) {
+		return 0, ErrNaN
+	}
+
+	s.storeNumber(key, val, formatFloat(res))
+	return res, nil
+}
+
+func (s *SliceStorage) mapValue(key string) (SliceValue, error) {
+	val, ok := s.lookup(key)
+	if !ok {
+		return SliceValue{Kind: KindMapInt, Mint: make(map[string]int)}, nil
+	}
+
+	if val.Kind != KindMapInt && val.Kind != KindMapStr {
+		return val, ErrWrongKind
+	}
+
+	if val.Mint == nil {
+		val.Mint = make(map[string]int)
+	}
+	if val.Mstr == nil {
+		val.Mstr = make(map[string]string)
+	}
+
+	return val, nil
+}
+
+func (s *SliceStorage) HIncrBy(key, field string, delta int64) (int64, error) {
+	if s.proposer != nil {
+		return proposed[int64](s, Record{Op: OpHIncrBy, Key: key, Vals: []string{field}, Ints: []int64{delta}})
+	}
+
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	defer sh.mu.Unlock()
+
+	res, err := s.hincrBy(key, field, delta)
+	if err != nil {
+		return 0, err
+	}
+
+	s.appendRecord(Record{Op: OpHIncrBy, Key: key, Vals: []string{field}, Ints: []int64{delta}})
+	return res, nil
+}
+
+func (s *SliceStorage) hincrBy(key, field string, delta int64) (int64, error) {
+	val, err := s.mapValue(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if val.Kind == KindMapInt {
+		res, err := addInt64(int64(val.Mint[field]), delta)
+		if err != nil {
+			return 0, err
+		}
+
+		val.Mint[field] = int(res)
+		s.store(key, val)
+		return res, nil
+	}
+
+	cur, ok := val.Mstr[field]
+	if !ok {
+		cur = "0"
+	}
+
+	n, err := strconv.ParseInt(cur, 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+
+	res, err := addInt64(n, delta)
+	if err != nil {
+		return 0, err
+	}
+
+	val.Mstr[field] = strconv.FormatInt(res, 10)
+	s.store(key, val)
+	return res, nil
+}
+
+func (s *SliceStorage) HIncrByFloat(key, field string, delta float64) (float64, error) {
+	if s.proposer != nil {
+		return proposed[float64](s, Record{Op: OpHIncrByFloat, Key: key, Vals: []string{field}, Floats: []float64{delta}})
+	}
+
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	defer sh.mu.Unlock()
+
+	res, err := s.hincrByFloat(key, field, delta)
+	if err != nil {
+		return 0, err
+	}
+
+	s.appendRecord(Record{Op: OpHIncrByFloat, Key: key, Vals: []string{field}, Floats: []float64{delta}})
+	return res, nil
+}
+
+func (s *SliceStorage) hincrByFloat(key, field string, delta float64) (float64, error) {
+	val, err := s.mapValue(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var n float64
+	if val.Kind == KindMapInt {
+		n = float64(val.Mint[field])
+	} else if cur, ok := val.Mstr[field]; ok {
+		if n, err = strconv.ParseFloat(cur, 64); err != nil {
+			return 0, ErrNotFloat
+		}
+	}
+
+	res := n + delta
+	if !validScore(res) {
+		return 0, ErrNaN
+	}
+
+	if val.Kind == KindMapInt {
+		if res == math.Trunc(res) && math.Abs(res) < 1<<53 {
+			val.Mint[field] = int(res)
+			s.store(key, val)
+			return res, nil
+		}
+
+		// A fractional value can not live in an int map, so the whole map
+		// becomes a string map.
+		mstr := make(map[string]string, len(val.Mint)+1)
+		for k, v := range val.Mint {
+			mstr[k] = strconv.Itoa(v)
+		}
+		val = SliceValue{Kind: KindMapStr, Expires_at: val.Expires_at, Mstr: mstr}
+	}
+
+	val.Mstr[field] = formatFloat(res)
+	s.store(key, val)
+	return res, nil
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrReplicationDisabled = errors.New("replication is not enabled")
+	ErrSubscriptionLagged  = errors.New("subscriber fell behind the replication stream")
+)
+
+const (
+	DefaultBacklog = 10000
+	subscriberBuf  = 1024
+)
+
+// Entry is a record together with its position in the replication stream.
+type Entry struct {
+	Offset uint64 `json:"o"`
+	Record Record `json:"r"`
+}
+
+// feed keeps the last records in a ring so that followers which lost the
+// connection for a moment can continue from their offset instead of taking
+// a whole new snapshot.
+type feed struct {
+	mu   sync.Mutex
+	id   string
+	next uint64
+	ring []Entry
+	n    int
+	subs map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	// Snapshot is set when the subscriber has to start from scratch; the
+	// entries then continue right after it.
+	Snapshot []byte
+	ID       string
+	Offset   uint64
+
+	pending []Entry
+	c       chan Entry
+	feed    *feed
+}
+
+func newReplicationID() string {
+	buf := make([]byte, 20)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// EnableReplication makes every mutation available to Subscribe, keeping
+// the last backlog of them for partial resynchronization.
+func (s *SliceStorage) EnableReplication(backlog int) {
+	if backlog <= 0 {
+		backlog = DefaultBacklog
+	}
+
+	s.lockAll()
+	defer s.unlockAll()
+
+	s.feed = &feed{
+		id:   newReplicationID(),
+		next: 1,
+		ring: make([]Entry, backlog),
+		subs: make(map[*Subscription]struct{}),
+	}
+	s.logger.Info("replication enabled", zap.String("id", s.feed.id), zap.Int("backlog", backlog))
+}
+
+// ReplicationOffset returns the id of the stream and the offset the next
+// record will get.
+func (s *SliceStorage) ReplicationOffset() (string, uint64) {
+	f := s.replicationFeed()
+	if f == nil {
+		return "", 0
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.id, f.next
+}
+
+func (s *SliceStorage) replicationFeed() *feed {
+	sh := s.shards[0]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return s.feed
+}
+
+func (f *feed) publish(rec Record) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	e := Entry{Offset: f.next, Record: rec}
+	f.ring[f.next%uint64(len(f.ring))] = e
+	f.next++
+	f.n = min(f.n+1, len(f.ring))
+
+	for sub := range f.subs {
+		select {
+		case sub.c <- e:
+		default:
+			// A slow subscriber is dropped rather than allowed to hold up
+			// writers; it resumes from the backlog when it comes back.
+			close(sub.c)
+			delete(f.subs, sub)
+		}
+	}
+}
+
+// Subscribe starts a stream of mutations. If id is the current stream and
+// offset is still in the backlog the stream continues from offset, otherwise
+// the subscription starts with a full snapshot.
+func (s *SliceStorage) Subscribe(id string, offset uint64) (*Subscription, error) {
+	f := s.replicationFeed()
+	if f == nil {
+		return nil, ErrReplicationDisabled
+	}
+
+	sub := &Subscription{ID: f.id, c: make(chan Entry, subscriberBuf), feed: f}
+	f.mu.Lock()
+	if id == f.id && offset >= f.next-uint64(f.n) && offset <= f.next {
+		sub.Offset = offset
+		for o := offset; o < f.next; o++ {
+			sub.pending = append(sub.pending, f.ring[o%uint64(len(f.ring))])
+		}
+		f.subs[sub] = struct{}{}
+		f.mu.Unlock()
+		return sub, nil
+	}
+	f.mu.Unlock()
+
+	// The snapshot is taken like a background save and encoded without
+	// locks; the entries from its capture on are queued meanwhile.
+	s.saveMu.Lock()
+	inner, _, err := s.captureContents(func() {
+		f.mu.Lock()
+		sub.Offset = f.next
+		f.subs[sub] = struct{}{}
+		f.mu.Unlock()
+	})
+	s.saveMu.Unlock()
+	if err == nil {
+		sub.Snapshot, err = json.Marshal(inner)
+	}
+	if err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+// Next returns the following entry, waiting for it if needed.
+func (sub *Subscription) Next(ctx context.Context) (Entry, error) {
+	if len(sub.pending) > 0 {
+		e := sub.pending[0]
+		sub.pending = sub.pending[1:]
+		return e, nil
+	}
+
+	select {
+	case e, ok := <-sub.c:
+		if !ok {
+			return Entry{}, ErrSubscriptionLagged
+		}
+		return e, nil
+	case <-ctx.Done():
+		return Entry{}, ctx.Err()
+	}
+}
+
+func (sub *Subscription) Close() {
+	sub.feed.mu.Lock()
+	defer sub.feed.mu.Unlock()
+
+	if _, ok := sub.feed.subs[sub]; ok {
+		delete(sub.feed.subs, sub)
+		close(sub.c)
+	}
+}
+
+// ApplyReplicated applies a record received from the leader and writes it to
+// the local wal like any other mutation. It returns what applying it returned.
+func (s *SliceStorage) ApplyReplicated(rec Record) (any, error) {
+	switch rec.Op {
+	case OpMulti, OpExec, OpFlush, OpSInterStore, OpSUnionStore, OpSDiffStore, OpLMove:
+		s.lockAll()
+		defer s.unlockAll()
+	default:
+		sh := s.lockShard(rec.Key)
+		defer sh.mu.Unlock()
+	}
+
+	if rec.Op == OpExec {
+		return s.execOps(rec.Ops), nil
+	}
+
+	res, err := s.apply(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	flushed := rec.Op == OpFlush
+	for _, sub := range rec.Batch {
+		flushed = flushed || sub.Op == OpFlush
+		s.touch(sub.Key)
+		s.trackWrite(sub.Key)
+	}
+
+	if flushed {
+		s.touchAll()
+		s.rebuildMeta()
+		s.resetFeed()
+	}
+	s.appendRecord(rec)
+	return res, nil
+}
+
+// LoadReplica replaces the contents with a snapshot sent by the leader.
+func (s *SliceStorage) LoadReplica(snapshot []byte) error {
+	return s.restore(context.Background(), snapshot)
+}
+
+// resetFeed starts a new stream after the contents were replaced other than
+// through mutations, so that followers take a full snapshot. All shards must
+// be locked.
+func (s *SliceStorage) resetFeed() {
+	if s.feed == nil {
+		return
+	}
+
+	f := s.feed
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.id = newReplicationID()
+	f.n = 0
+	for sub := range f.subs {
+		close(sub.c)
+		delete(f.subs, sub)
+	}
+}
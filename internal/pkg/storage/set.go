@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"errors"
+	"math/rand/v2"
+)
+
+var ErrWrongKind = errors.New("wrong kind of value")
+
+// getSet returns the set stored at key, nil if there is no such key.
+func (s *SliceStorage) getSet(key string) (map[string]struct{}, error) {
+	val, ok := s.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+
+	if val.Kind != KindSet {
+		return nil, ErrWrongKind
+	}
+
+	return val.Set, nil
+}
+
+func (s *SliceStorage) SAdd(key string, members []string) (int, error) {
+	if s.proposer != nil {
+		return proposed[int](s, Record{Op: OpSAdd, Key: key, Vals: members})
+	}
+
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	defer sh.mu.Unlock()
+
+	c, err := s.sadd(key, members)
+	if err != nil {
+		return 0, err
+	}
+
+	s.appendRecord(Record{Op: OpSAdd, Key: key, Vals: members})
+	return c, nil
+}
+
+func (s *SliceStorage) sadd(key string, members []string) (int, error) {
+	set, err := s.getSet(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if set == nil {
+		set = make(map[string]struct{}, len(members))
+		s.store(key, SliceValue{Kind: KindSet, Set: set})
+	}
+
+	var added int
+	for _, x := range members {
+		if _, ok := set[x]; !ok {
+			set[x] = struct{}{}
+			added++
+		}
+	}
+
+	return added, nil
+}
+
+func (s *SliceStorage) SRem(key string, members []string) (int, error) {
+	if s.proposer != nil {
+		return proposed[int](s, Record{Op: OpSRem, Key: key, Vals: members})
+	}
+
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+
+	c, err := s.srem(key, members)
+	if err != nil {
+		return 0, err
+	}
+
+	if c > 0 {
+		s.appendRecord(Record{Op: OpSRem, Key: key, Vals: members})
+	}
+	return c, nil
+}
+
+func (s *SliceStorage) srem(key string, members []string) (int, error) {
+	set, err := s.getSet(key)
+	if err != nil || set == nil {
+		return 0, err
+	}
+
+	var removed int
+	for _, x := range members {
+		if _, ok := set[x]; ok {
+			delete(set, x)
+			removed++
+		}
+	}
+
+	if len(set) == 0 {
+		s.remove(key)
+	}
+
+	return removed, nil
+}
+
+func (s *SliceStorage) SIsMember(key, member string) (bool, error) {
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
+
+	s.accessed(key)
+	set, err := s.getSet(key)
+	if err != nil {
+		return false, err
+	}
+
+	_, ok := set[member]
+	return ok, nil
+}
+
+func (s *SliceStorage) SCard(key string) (int, error) {
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
+
+	s.accessed(key)
+	set, err := s.getSet(key)
+	return len(set), err
+}
+
+func (s *SliceStorage) SMembers(key string) ([]string, error) {
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
+
+	s.accessed(key)
+	set, err := s.getSet(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return setToSlice(set), nil
+}
+
+func setToSlice(set map[string]struct{}) []string {
+	res := make([]string, 0, len(set))
+	for x := range set {
+		res = append(res, x)
+	}
+
+	return res
+}
+
+func randomMembers(set map[string]struct{}, count int) []string {
+	res := setToSlice(set)
+	rand.Shuffle(len(res), func(i, j int) {
+		res[i], res[j] = res[j], res[i]
+	})
+
+	return res[:min(count, len(res))]
+}
+
+func (s *SliceStorage) SRandMember(key string, count int) ([]string, error) {
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
+
+	s.accessed(key)
+	set, err := s.getSet(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return randomMembers(set, count), nil
+}
+
+// SPop removes and returns up to count random members. The popped members are
+// written to the wal as a plain removal so that replay stays deterministic.
+func (s *SliceStorage) SPop(key string, count int) ([]string, error) {
+	if s.proposer != nil {
+		return s.proposeSPop(key, count)
+	}
+
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+
+	set, err := s.getSet(key)
+	if err != nil {
+		return nil, err
+	}
+
+	res := randomMembers(set, count)
+	if len(res) > 0 {
+		s.srem(key, res)
+		s.appendRecord(Record{Op: OpSRem, Key: key, Vals: res})
+	}
+
+	return res, nil
+}
+
+func (s *SliceStorage) collectSets(keys []string) ([]map[string]struct{}, error) {
+	sets := make([]map[string]struct{}, 0, len(keys))
+	for _, key := range keys {
+		set, err := s.getSet(key)
+		if err != nil {
+			return nil, err
+		}
+
+		sets = append(sets, set)
+	}
+
+	return sets, nil
+}
+
+func (s *SliceStorage) combine(op Op, keys []string) (map[string]struct{}, error) {
+	sets, err := s.collectSets(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]struct{})
+	if len(sets) == 0 {
+		return res, nil
+	}
+
+	switch op {
+	case OpSInterStore:
+		for x := range sets[0] {
+			inAll := true
+			for _, set := range sets[1:] {
+				if _, ok := set[x]; !ok {
+					inAll = false
+					break
+				}
+			}
+			if inAll {
+				res[x] = struct{}{}
+			}
+		}
+	case OpSUnionStore:
+		for _, set := range sets {
+			for x := range set {
+				res[x] = struct{}{}
+			}
+		}
+	case OpSDiffStore:
+		for x := range sets[0] {
+			res[x] = struct{}{}
+		}
+		for _, set := range sets[1:] {
+			for x := range set {
+				delete(res, x)
+			}
+		}
+	default:
+		return nil, errors.New("unknown operation")
+	}
+
+	return res, nil
+}
+
+func (s *SliceStorage) readCombined(op Op, keys []string) ([]string, error) {
+	shards := s.shardsOf(keys)
+	lockShards(shards, false)
+	defer unlockShards(shards, false)
+
+	res, err := s.combine(op, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return setToSlice(res), nil
+}
+
+func (s *SliceStorage) SInter(keys ...string) ([]string, error) {
+	return s.readCombined(OpSInterStore, keys)
+}
+
+func (s *SliceStorage) SUnion(keys ...string) ([]string, error) {
+	return s.readCombined(OpSUnionStore, keys)
+}
+
+func (s *SliceStorage) SDiff(keys ...string) ([]string, error) {
+	return s.readCombined(OpSDiffStore, keys)
+}
+
+func (s *SliceStorage) storeCombined(op Op, dst string, keys []string) (int, error) {
+	if s.proposer != nil {
+		return proposed[int](s, Record{Op: op, Key: dst, Vals: keys})
+	}
+
+	if err := s.reserve(dst, false); err != nil {
+		return 0, err
+	}
+
+	shards := s.shardsOf(append([]string{dst}, keys...))
+	lockShards(shards, true)
+	defer unlockShards(shards, true)
+	s.preserve(dst)
+
+	c, err := s.combineStore(op, dst, keys)
+	if err != nil {
+		return 0, err
+	}
+
+	s.appendRecord(Record{Op: op, Key: dst, Vals: keys})
+	return c, nil
+}
+
+func (s *SliceStorage) combineStore(op Op, dst string, keys []string) (int, error) {
+	res, err := s.combine(op, keys)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(res) == 0 {
+		s.remove(dst)
+		return 0, nil
+	}
+
+	s.store(dst, SliceValue{Kind: KindSet, Set: res})
+	return len(res), nil
+}
+
+func (s *SliceStorage) SInterStore(dst string, keys ...string) (int, error) {
+	return s.storeCombined(OpSInterStore, dst, keys)
+}
+
+func (s *SliceStorage) SUnionStore(dst string, keys ...string) (int, error) {
+	return s.storeCombined(OpSUnionStore, dst, keys)
+}
+
+func (s *SliceStorage) SDiffStore(dst string, keys ...string) (int, error) {
+	return s.storeCombined(OpSDiffStore, dst, keys)
+}
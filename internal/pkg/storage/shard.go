@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+const DefaultShards = 64
+
+// shard is an independently locked part of the keyspace. Everything that is
+// kept per key lives next to the key, so that single-key operations only
+// ever touch one shard.
+type shard struct {
+	mu       sync.RWMutex
+	inner    map[string]SliceValue
+	versions map[string]uint64
+	meta     map[string]*keyMeta
+	volatile map[string]struct{}
+	snap     *shardSnapshot
+	// dirty holds the keys changed since the last flush to the key store;
+	// it is nil without one.
+	dirty map[string]struct{}
+}
+
+func newShard() *shard {
+	return &shard{
+		inner:    make(map[string]SliceValue),
+		versions: make(map[string]uint64),
+		meta:     make(map[string]*keyMeta),
+		volatile: make(map[string]struct{}),
+	}
+}
+
+// shardIndex is an inlined 32-bit FNV-1a, so that picking a shard does not
+// allocate.
+func shardIndex(key string, n int) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+
+	return int(h % uint32(n))
+}
+
+func (s *SliceStorage) shardFor(key string) *shard {
+	return s.shards[shardIndex(key, len(s.shards))]
+}
+
+// lockShard write-locks the shard of key for a change of key.
+func (s *SliceStorage) lockShard(key string) *shard {
+	sh := s.shardFor(key)
+	start := time.Now()
+	sh.mu.Lock()
+	s.writeWait.Observe(time.Since(start).Seconds())
+	sh.preserve(key)
+	return sh
+}
+
+func (s *SliceStorage) rlockShard(key string) *shard {
+	sh := s.shardFor(key)
+	start := time.Now()
+	sh.mu.RLock()
+	s.readWait.Observe(time.Since(start).Seconds())
+	return sh
+}
+
+// lockWrite makes room for key according to the eviction policy and locks
+// its shard. Eviction happens before, so that no two shards are held at once.
+func (s *SliceStorage) lockWrite(key string) (*shard, error) {
+	if err := s.reserve(key, false); err != nil {
+		return nil, err
+	}
+
+	return s.lockShard(key), nil
+}
+
+// shardsOf returns the distinct shards of keys in index order. Shards are
+// always locked in this order, so multi-key operations can not deadlock.
+func (s *SliceStorage) shardsOf(keys []string) []*shard {
+	idx := make([]int, 0, len(keys))
+	for _, key := range keys {
+		idx = append(idx, shardIndex(key, len(s.shards)))
+	}
+	slices.Sort(idx)
+
+	res := make([]*shard, 0, len(idx))
+	for _, i := range slices.Compact(idx) {
+		res = append(res, s.shards[i])
+	}
+
+	return res
+}
+
+func lockShards(shards []*shard, write bool) {
+	for _, sh := range shards {
+		if write {
+			sh.mu.Lock()
+		} else {
+			sh.mu.RLock()
+		}
+	}
+}
+
+func unlockShards(shards []*shard, write bool) {
+	for i := len(shards) - 1; i >= 0; i-- {
+		if write {
+			shards[i].mu.Unlock()
+		} else {
+			shards[i].mu.RUnlock()
+		}
+	}
+}
+
+// lockAll locks every shard. It is used for transactions and whenever the
+// whole contents are replaced; fields of SliceStorage outside the shards are
+// only changed under it. A running snapshot gets a copy of the shards it has
+// not read yet.
+func (s *SliceStorage) lockAll() {
+	start := time.Now()
+	lockShards(s.shards, true)
+	s.writeWait.Observe(time.Since(start).Seconds())
+	for _, sh := range s.shards {
+		sh.preserveAll()
+	}
+}
+
+func (s *SliceStorage) unlockAll() {
+	unlockShards(s.shards, true)
+}
+
+// rlockAll gives a consistent view of the whole keyspace, e.g. to a full
+// resync of a replica.
+func (s *SliceStorage) rlockAll() {
+	start := time.Now()
+	lockShards(s.shards, false)
+	s.readWait.Observe(time.Since(start).Seconds())
+}
+
+func (s *SliceStorage) runlockAll() {
+	unlockShards(s.shards, false)
+}
+
+// The helpers below expect the shard of key to be locked by the caller.
+
+func (s *SliceStorage) lookup(key string) (SliceValue, bool) {
+	val, ok := s.shardFor(key).inner[key]
+	return val, ok
+}
+
+func (s *SliceStorage) value(key string) SliceValue {
+	return s.shardFor(key).inner[key]
+}
+
+func (s *SliceStorage) store(key string, val SliceValue) {
+	s.shardFor(key).inner[key] = val
+}
+
+func (s *SliceStorage) remove(key string) bool {
+	sh := s.shardFor(key)
+	_, ok := sh.inner[key]
+	delete(sh.inner, key)
+	return ok
+}
+
+// replace distributes inner over the shards; all of them must be locked.
+func (s *SliceStorage) replace(inner map[string]SliceValue) {
+	for _, sh := range s.shards {
+		sh.inner = make(map[string]SliceValue)
+	}
+
+	for key, val := range inner {
+		s.store(key, val)
+	}
+}
+
+// contents merges the shards back into one map; all of them must be locked.
+func (s *SliceStorage) contents() map[string]SliceValue {
+	res := make(map[string]SliceValue, s.keys.Load())
+	for _, sh := range s.shards {
+		for key, val := range sh.inner {
+			res[key] = val
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+)
+
+const (
+	zsetMaxLevel = 32
+	zsetP        = 0.25
+)
+
+type zsetLevel struct {
+	forward *zsetNode
+	span    int
+}
+
+type zsetNode struct {
+	member   string
+	score    float64
+	backward *zsetNode
+	level    []zsetLevel
+}
+
+// SortedSet is a skip list ordered by (score, member) with span counters for
+// rank queries, plus a member index for O(1) score lookups.
+type SortedSet struct {
+	head   *zsetNode
+	tail   *zsetNode
+	length int
+	level  int
+	scores map[string]float64
+}
+
+type ZMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+func newSortedSet() *SortedSet {
+	return &SortedSet{
+		head:   &zsetNode{level: make([]zsetLevel, zsetMaxLevel)},
+		level:  1,
+		scores: make(map[string]float64),
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < zsetMaxLevel && rand.Float64() < zsetP {
+		level++
+	}
+
+	return level
+}
+
+// before reports whether n sorts strictly before (score, member).
+func (n *zsetNode) before(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+func (z *SortedSet) Len() int {
+	return z.length
+}
+
+func (z *SortedSet) insert(score float64, member string) {
+	var update [zsetMaxLevel]*zsetNode
+	var rank [zsetMaxLevel]int
+
+	x := z.head
+	for i := z.level - 1; i >= 0; i-- {
+		if i < z.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > z.level {
+		for i := z.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = z.head
+			update[i].level[i].span = z.length
+		}
+		z.level = level
+	}
+
+	x = &zsetNode{member: member, score: score, level: make([]zsetLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+
+	for i := level; i < z.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != z.head {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		z.tail = x
+	}
+	z.length++
+}
+
+func (z *SortedSet) delete(score float64, member string) bool {
+	var update [zsetMaxLevel]*zsetNode
+
+	x := z.head
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	for i := 0; i < z.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		z.tail = x.backward
+	}
+
+	for z.level > 1 && z.head.level[z.level-1].forward == nil {
+		z.level--
+	}
+	z.length--
+	return true
+}
+
+// add inserts member or moves it to a new score, reporting whether it is new.
+func (z *SortedSet) add(member string, score float64) bool {
+	old, ok := z.scores[member]
+	if ok {
+		if old == score {
+			return false
+		}
+		z.delete(old, member)
+	}
+
+	z.insert(score, member)
+	z.scores[member] = score
+	return !ok
+}
+
+func (z *SortedSet) remove(member string) bool {
+	score, ok := z.scores[member]
+	if !ok {
+		return false
+	}
+
+	z.delete(score, member)
+	delete(z.scores, member)
+	return true
+}
+
+// rank returns the 0-based position of member, -1 if it is absent.
+func (z *SortedSet) rank(member string) int {
+	score, ok := z.scores[member]
+	if !ok {
+		return -1
+	}
+
+	rank := 0
+	x := z.head
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.before(score, member) || x.level[i].forward.member == member) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != z.head && x.member == member {
+			return rank - 1
+		}
+	}
+
+	return -1
+}
+
+func (z *SortedSet) byRank(rank int) *zsetNode {
+	traversed := 0
+	target := rank + 1
+	x := z.head
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= target {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == target {
+			return x
+		}
+	}
+
+	return nil
+}
+
+func (z *SortedSet) firstInRange(min, max ScoreBound) *zsetNode {
+	if !validRange(min, max) {
+		return nil
+	}
+
+	x := z.head
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !min.below(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+
+	x = x.level[0].forward
+	if x == nil || !max.above(x.score) {
+		return nil
+	}
+
+	return x
+}
+
+func (z *SortedSet) lastInRange(min, max ScoreBound) *zsetNode {
+	if !validRange(min, max) {
+		return nil
+	}
+
+	x := z.head
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && max.above(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+
+	if x == z.head || !min.below(x.score) {
+		return nil
+	}
+
+	return x
+}
+
+func (z *SortedSet) MarshalJSON() ([]byte, error) {
+	res := make([]ZMember, 0, z.length)
+	for x := z.head.level[0].forward; x != nil; x = x.level[0].forward {
+		res = append(res, ZMember{Member: x.member, Score: x.score})
+	}
+
+	return json.Marshal(res)
+}
+
+func (z *SortedSet) UnmarshalJSON(data []byte) error {
+	var members []ZMember
+	if err := json.Unmarshal(data, &members); err != nil {
+		return err
+	}
+
+	*z = *newSortedSet()
+	for _, m := range members {
+		z.add(m.Member, m.Score)
+	}
+
+	return nil
+}
@@ -0,0 +1,445 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"proj1/internal/pkg/saving"
+)
+
+type SnapshotFormat string
+
+const (
+	SnapshotJSON   SnapshotFormat = "json"
+	SnapshotBinary SnapshotFormat = "binary"
+)
+
+func ParseSnapshotFormat(format string) (SnapshotFormat, error) {
+	switch SnapshotFormat(format) {
+	case SnapshotJSON, SnapshotBinary:
+		return SnapshotFormat(format), nil
+	}
+
+	return "", fmt.Errorf("unknown snapshot format %q, use json or binary", format)
+}
+
+// SnapshotConfig selects how Save and WriteSnapshot encode the
+// contents. Compression only applies to the binary format.
+type SnapshotConfig struct {
+	Format      SnapshotFormat
+	Compression saving.Compression
+}
+
+func (s *SliceStorage) SetSnapshotConfig(cfg SnapshotConfig) {
+	if cfg.Format == "" {
+		cfg.Format = SnapshotJSON
+	}
+
+	s.snapshotCfg.Store(&cfg)
+}
+
+func (s *SliceStorage) snapshotConfig() SnapshotConfig {
+	if cfg := s.snapshotCfg.Load(); cfg != nil {
+		return *cfg
+	}
+
+	return SnapshotConfig{Format: SnapshotJSON}
+}
+
+// WriteSnapshot encodes the contents, as they are when it is called, into
+// w. Writes go on meanwhile.
+func (s *SliceStorage) WriteSnapshot(w io.Writer) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	_, err := s.writeSnapshot(w, s.snapshotConfig())
+	return err
+}
+
+// writeSnapshot expects saveMu to be held.
+func (s *SliceStorage) writeSnapshot(w io.Writer, cfg SnapshotConfig) (captureInfo, error) {
+	if cfg.Format != SnapshotBinary {
+		inner, info, err := s.captureContents(nil)
+		if err != nil {
+			return info, err
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return info, enc.Encode(inner)
+	}
+
+	sw, err := saving.NewSnapshotWriter(w, cfg.Compression)
+	if err != nil {
+		return captureInfo{}, err
+	}
+
+	// Records are encoded with the shard locked and written out after.
+	var buf []byte
+	var ends []int
+	info, err := s.capture(nil, func(key string, val SliceValue) {
+		buf = appendValue(buf, key, val)
+		ends = append(ends, len(buf))
+	}, func() error {
+		start := 0
+		for _, end := range ends {
+			if err := sw.WriteRecord(buf[start:end]); err != nil {
+				return err
+			}
+			start = end
+		}
+
+		buf, ends = buf[:0], ends[:0]
+		return nil
+	})
+	if err != nil {
+		return info, err
+	}
+
+	return info, sw.Close()
+}
+
+// captureContents copies the contents as they are when it is called.
+func (s *SliceStorage) captureContents(marked func()) (map[string]SliceValue, captureInfo, error) {
+	res := make(map[string]SliceValue, s.keys.Load())
+	info, err := s.capture(marked, func(key string, val SliceValue) {
+		res[key] = cloneValue(val)
+	}, func() error { return nil })
+
+	return res, info, err
+}
+
+// ReadSnapshot decodes a snapshot in either format.
+func ReadSnapshot(r io.Reader) (map[string]SliceValue, error) {
+	br := bufio.NewReader(r)
+	prefix, _ := br.Peek(4)
+	res := make(map[string]SliceValue)
+	if !saving.IsBinarySnapshot(prefix) {
+		var inner map[string]SliceValue
+		if err := json.NewDecoder(br).Decode(&inner); err != nil {
+			return nil, err
+		}
+
+		if inner != nil {
+			res = inner
+		}
+		return res, nil
+	}
+
+	sr, err := saving.NewSnapshotReader(br)
+	if err != nil {
+		return nil, err
+	}
+	defer sr.Close()
+
+	for {
+		rec, err := sr.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		key, val, err := decodeValue(rec)
+		if err != nil {
+			return nil, err
+		}
+		res[key] = val
+	}
+}
+
+// Fields of a SliceValue in the binary format; a record is the key, the
+// kind, the expiry and the tagged fields that are set, ending with
+// tagEnd.
+const (
+	tagEnd byte = iota
+	tagSt
+	tagStSl
+	tagMint
+	tagMstr
+	tagSet
+	tagZSet
+	tagStream
+)
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendID(buf []byte, id StreamID) []byte {
+	buf = binary.AppendUvarint(buf, id.Ms)
+	return binary.AppendUvarint(buf, id.Seq)
+}
+
+func appendValue(buf []byte, key string, val SliceValue) []byte {
+	buf = appendString(buf, key)
+	buf = appendString(buf, string(val.Kind))
+	buf = binary.AppendVarint(buf, val.Expires_at)
+
+	if val.St != "" {
+		buf = append(buf, tagSt)
+		buf = appendString(buf, val.St)
+	}
+	if val.StSl != nil {
+		buf = append(buf, tagStSl)
+		buf = binary.AppendUvarint(buf, uint64(len(val.StSl)))
+		for _, x := range val.StSl {
+			buf = appendString(buf, x)
+		}
+	}
+	if val.Mint != nil {
+		buf = append(buf, tagMint)
+		buf = binary.AppendUvarint(buf, uint64(len(val.Mint)))
+		for k, v := range val.Mint {
+			buf = appendString(buf, k)
+			buf = binary.AppendVarint(buf, int64(v))
+		}
+	}
+	if val.Mstr != nil {
+		buf = append(buf, tagMstr)
+		buf = binary.AppendUvarint(buf, uint64(len(val.Mstr)))
+		for k, v := range val.Mstr {
+			buf = appendString(buf, k)
+			buf = appendString(buf, v)
+		}
+	}
+	if val.Set != nil {
+		buf = append(buf, tagSet)
+		buf = binary.AppendUvarint(buf, uint64(len(val.Set)))
+		for k := range val.Set {
+			buf = appendString(buf, k)
+		}
+	}
+	if val.ZSet != nil {
+		buf = append(buf, tagZSet)
+		buf = binary.AppendUvarint(buf, uint64(val.ZSet.Len()))
+		for x := val.ZSet.head.level[0].forward; x != nil; x = x.level[0].forward {
+			buf = appendString(buf, x.member)
+			buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(x.score))
+		}
+	}
+	if val.Stream != nil {
+		buf = append(buf, tagStream)
+		buf = appendStream(buf, val.Stream)
+	}
+
+	return append(buf, tagEnd)
+}
+
+func appendStream(buf []byte, st *Stream) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(st.Entries)))
+	for _, e := range st.Entries {
+		buf = appendID(buf, e.ID)
+		buf = binary.AppendUvarint(buf, uint64(len(e.Fields)))
+		for k, v := range e.Fields {
+			buf = appendString(buf, k)
+			buf = appendString(buf, v)
+		}
+	}
+
+	buf = appendID(buf, st.LastID)
+	buf = binary.AppendUvarint(buf, uint64(len(st.Groups)))
+	for name, g := range st.Groups {
+		buf = appendString(buf, name)
+		buf = appendID(buf, g.LastDelivered)
+		buf = binary.AppendUvarint(buf, uint64(len(g.Pending)))
+		for id, p := range g.Pending {
+			buf = appendID(buf, id)
+			buf = appendString(buf, p.Consumer)
+			buf = binary.AppendVarint(buf, p.DeliveredAt)
+			buf = binary.AppendUvarint(buf, uint64(p.Deliveries))
+		}
+	}
+
+	return buf
+}
+
+var errBrokenValue = fmt.Errorf("%w: broken value", saving.ErrCorruptSnapshot)
+
+// decoder reads a record; after the first error every read returns zero
+// values and err keeps the error.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errBrokenValue
+		return 0
+	}
+
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errBrokenValue
+		return 0
+	}
+
+	d.data = d.data[n:]
+	return v
+}
+
+// count reads a number of items, each taking at least one byte.
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.err = errBrokenValue
+		return 0
+	}
+
+	return int(n)
+}
+
+func (d *decoder) str() string {
+	n := d.count()
+	if d.err != nil {
+		return ""
+	}
+
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.data) == 0 {
+		d.err = errBrokenValue
+		return 0
+	}
+
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) float() float64 {
+	if d.err != nil || len(d.data) < 8 {
+		d.err = errBrokenValue
+		return 0
+	}
+
+	v := math.Float64frombits(binary.BigEndian.Uint64(d.data))
+	d.data = d.data[8:]
+	return v
+}
+
+func (d *decoder) id() StreamID {
+	return StreamID{Ms: d.uvarint(), Seq: d.uvarint()}
+}
+
+func decodeValue(data []byte) (string, SliceValue, error) {
+	d := &decoder{data: data}
+	key := d.str()
+	val := SliceValue{Kind: Kind(d.str()), Expires_at: d.varint()}
+	for d.err == nil {
+		switch tag := d.byte(); tag {
+		case tagEnd:
+			if d.err == nil && len(d.data) > 0 {
+				d.err = errBrokenValue
+			}
+			return key, val, d.err
+		case tagSt:
+			val.St = d.str()
+		case tagStSl:
+			val.StSl = make([]string, d.count())
+			for i := range val.StSl {
+				val.StSl[i] = d.str()
+			}
+		case tagMint:
+			n := d.count()
+			val.Mint = make(map[string]int, n)
+			for range n {
+				k := d.str()
+				val.Mint[k] = int(d.varint())
+			}
+		case tagMstr:
+			n := d.count()
+			val.Mstr = make(map[string]string, n)
+			for range n {
+				k := d.str()
+				val.Mstr[k] = d.str()
+			}
+		case tagSet:
+			n := d.count()
+			val.Set = make(map[string]struct{}, n)
+			for range n {
+				val.Set[d.str()] = struct{}{}
+			}
+		case tagZSet:
+			val.ZSet = newSortedSet()
+			for range d.count() {
+				member := d.str()
+				val.ZSet.add(member, d.float())
+			}
+		case tagStream:
+			val.Stream = d.stream()
+		default:
+			if d.err == nil {
+				d.err = fmt.Errorf("%w: unknown field %d", saving.ErrCorruptSnapshot, tag)
+			}
+		}
+	}
+
+	return "", SliceValue{}, d.err
+}
+
+func (d *decoder) stream() *Stream {
+	st := &Stream{Entries: make([]StreamEntry, d.count())}
+	for i := range st.Entries {
+		st.Entries[i].ID = d.id()
+		n := d.count()
+		st.Entries[i].Fields = make(map[string]string, n)
+		for range n {
+			k := d.str()
+			st.Entries[i].Fields[k] = d.str()
+		}
+	}
+
+	st.LastID = d.id()
+	if n := d.count(); n > 0 {
+		st.Groups = make(map[string]*ConsumerGroup, n)
+		for range n {
+			name := d.str()
+			g := &ConsumerGroup{LastDelivered: d.id()}
+			pending := d.count()
+			g.Pending = make(map[StreamID]*PendingEntry, pending)
+			for range pending {
+				id := d.id()
+				g.Pending[id] = &PendingEntry{Consumer: d.str(), DeliveredAt: d.varint(), Deliveries: int(d.uvarint())}
+			}
+			st.Groups[name] = g
+		}
+	}
+
+	return st
+}
+
+// readSnapshotData is ReadSnapshot for a snapshot in memory.
+func readSnapshotData(data []byte) (map[string]SliceValue, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, errors.New("empty snapshot")
+	}
+
+	return ReadSnapshot(bytes.NewReader(data))
+}
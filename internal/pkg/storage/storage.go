@@ -1,18 +1,22 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"math"
-	"os"
+	"proj1/internal/pkg/metrics"
 	"proj1/internal/pkg/saving"
 	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -23,41 +27,143 @@ type SliceValue struct {
 	St         string
 	Mint       map[string]int
 	Mstr       map[string]string
+	Set        map[string]struct{}
+	ZSet       *SortedSet
+	Stream     *Stream
 }
 
+// SliceStorage keeps the keyspace in independently locked shards. Fields
+// outside the shards are either atomic or only changed with every shard
+// locked, so holding any shard is enough to read them.
 type SliceStorage struct {
-	inner  map[string]SliceValue
+	shards []*shard
 	logger *zap.Logger
-	mu     sync.RWMutex
-	Path   string
+	wal    *saving.WAL
+
+	epoch    uint64
+	version  atomic.Uint64
+	batch    *[]Record
+	feed     *feed
+	proposer Proposer
+	notify   func(Event)
+	waiters  *waitQueue
+
+	eviction    atomic.Pointer[EvictionConfig]
+	snapshotCfg atomic.Pointer[SnapshotConfig]
+	keys        atomic.Int64
+	kinds       map[Kind]*atomic.Int64
+	usedMemory  atomic.Int64
+	evicted     atomic.Uint64
+	expired     atomic.Uint64
+	readWait    *metrics.Histogram
+	writeWait   *metrics.Histogram
+
+	saveMu        sync.Mutex
+	persister     saving.Persister
+	saving        atomic.Bool
+	skippedSaves  atomic.Uint64
+	snapshotStats atomic.Pointer[SnapshotStats]
+	saveDuration  *metrics.Histogram
+
+	flushMu  sync.Mutex
+	keyStore saving.KeyStore
+	resync   bool
 }
 
 type Kind string
 
 const (
-	KindString   Kind = "S"
-	KindInt      Kind = "D"
-	KindSliceInt Kind = "SD"
-	KindSliceStr Kind = "SS"
-	KindMapInt   Kind = "MI"
-	KindMapStr   Kind = "MS"
+	KindString    Kind = "S"
+	KindInt       Kind = "D"
+	KindSliceInt  Kind = "SD"
+	KindSliceStr  Kind = "SS"
+	KindMapInt    Kind = "MI"
+	KindMapStr    Kind = "MS"
+	KindSet       Kind = "ST"
+	KindSortedSet Kind = "ZS"
+	KindStream    Kind = "XS"
 )
 
+// NewSliceStorage keeps snapshots in versions of file until SetPersister
+// picks another backend.
 func NewSliceStorage(file string) (SliceStorage, error) {
+	return NewShardedStorage(file, DefaultShards)
+}
+
+func NewShardedStorage(file string, n int) (SliceStorage, error) {
+	if n <= 0 {
+		return SliceStorage{}, errors.New("number of shards must be positive")
+	}
+
 	logger, err := zap.NewProduction()
 	if err != nil {
 		return SliceStorage{}, err
 	}
 
+	shards := make([]*shard, n)
+	for i := range shards {
+		shards[i] = newShard()
+	}
+
+	kinds := make(map[Kind]*atomic.Int64)
+	for _, kind := range []Kind{KindString, KindInt, KindSliceInt, KindSliceStr, KindMapInt, KindMapStr, KindSet, KindSortedSet, KindStream} {
+		kinds[kind] = &atomic.Int64{}
+	}
+
 	defer logger.Sync()
-	logger.Info("Created new storage")
-	return SliceStorage{inner: make(map[string]SliceValue),
-		logger: logger, Path: file}, nil
+	logger.Info("Created new storage", zap.Int("shards", n))
+	return SliceStorage{shards: shards, logger: logger, persister: saving.NewFilePersister(file, 0),
+		epoch: uint64(time.Now().UnixNano()), waiters: newWaitQueue(), kinds: kinds,
+		readWait: metrics.NewHistogram(lockBuckets), writeWait: metrics.NewHistogram(lockBuckets),
+		saveDuration: metrics.NewHistogram(saveBuckets)}, nil
 }
 
 func (s *SliceStorage) Set(key, val string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.proposer != nil {
+		_, err := s.proposer.Propose(Record{Op: OpSet, Key: key, Vals: []string{val}})
+		return err
+	}
+
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return err
+	}
+	defer sh.mu.Unlock()
+	if err := s.set(key, val); err != nil {
+		return err
+	}
+
+	s.logger.Info("key has been set")
+	s.appendRecord(Record{Op: OpSet, Key: key, Vals: []string{val}})
+	return nil
+}
+
+// SetScalar stores val as it is, an integer if it is one and a string
+// otherwise; unlike Set it takes strings without quotes.
+func (s *SliceStorage) SetScalar(key, val string) error {
+	v := SliceValue{Kind: KindString, St: val}
+	if _, err := strconv.Atoi(val); err == nil {
+		v.Kind = KindInt
+	}
+
+	rec := Record{Op: OpSet, Key: key, Value: &v}
+	if s.proposer != nil {
+		_, err := s.proposer.Propose(rec)
+		return err
+	}
+
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return err
+	}
+	defer sh.mu.Unlock()
+
+	s.store(key, v)
+	s.appendRecord(rec)
+	return nil
+}
+
+func (s *SliceStorage) set(key, val string) error {
 	var val1 SliceValue
 	if strings.HasPrefix(val, `"`) && strings.HasSuffix(val, `"`) {
 		val1 = SliceValue{Kind: KindString, St: strings.Trim(val, `"`)}
@@ -68,20 +174,20 @@ func (s *SliceStorage) Set(key, val string) error {
 		val1 = SliceValue{Kind: KindInt, St: val}
 	}
 
-	s.inner[key] = val1
-	s.logger.Info("key has been set")
+	s.store(key, val1)
 	return nil
 }
 
 func (s *SliceStorage) Get(key string) (string, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
 
-	res, ok := s.inner[key]
+	res, ok := s.lookup(key)
 	if !ok {
 		return "", false
 	}
 
+	s.accessed(key)
 	s.logger.Info("val got")
 	if res.Kind == KindString {
 		return res.St, true
@@ -91,19 +197,36 @@ func (s *SliceStorage) Get(key string) (string, bool) {
 }
 
 func (s *SliceStorage) GetKind(key string) string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
 
-	res := s.inner[key]
+	res := s.value(key)
 	return string(res.Kind)
 }
 
 func (s *SliceStorage) HSet(key string, maps []map[string]string) (int, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.proposer != nil {
+		return proposed[int](s, Record{Op: OpHSet, Key: key, Maps: maps})
+	}
+
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	defer sh.mu.Unlock()
+
+	c, err := s.hset(key, maps)
+	if err != nil {
+		return 0, err
+	}
+
+	s.appendRecord(Record{Op: OpHSet, Key: key, Maps: maps})
+	return c, nil
+}
 
-	other_types := []Kind{KindInt, KindSliceInt, KindSliceStr, KindString}
-	if slices.Contains(other_types, s.inner[key].Kind) {
+func (s *SliceStorage) hset(key string, maps []map[string]string) (int, error) {
+	other_types := []Kind{KindInt, KindSliceInt, KindSliceStr, KindString, KindSet, KindSortedSet, KindStream}
+	if slices.Contains(other_types, s.value(key).Kind) {
 		s.logger.Info("uncorrect indexes")
 		return 0, errors.New("no such key")
 	}
@@ -123,19 +246,19 @@ func (s *SliceStorage) HSet(key string, maps []map[string]string) (int, error) {
 	}
 
 	if len(final1) > 0 {
-		s.inner[key] = SliceValue{Kind: KindMapStr, Mstr: final1}
+		s.store(key, SliceValue{Kind: KindMapStr, Mstr: final1})
 		return len(final1), nil
 	}
 
-	s.inner[key] = SliceValue{Kind: KindMapInt, Mint: final2}
+	s.store(key, SliceValue{Kind: KindMapInt, Mint: final2})
 	return len(final2), nil
 }
 
 func (s *SliceStorage) HGet(key string, field string) (*string, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
 
-	res := s.inner[key]
+	res := s.value(key)
 	res1, ok1 := res.Mint[field]
 	res2, ok2 := res.Mstr[field]
 	if res.Kind == "" || (!ok1 && !ok2) {
@@ -143,11 +266,12 @@ func (s *SliceStorage) HGet(key string, field string) (*string, error) {
 		return nil, nil
 	}
 
-	other_types := []Kind{KindInt, KindSliceInt, KindSliceStr, KindString}
-	if slices.Contains(other_types, s.inner[key].Kind) {
+	other_types := []Kind{KindInt, KindSliceInt, KindSliceStr, KindString, KindSet, KindSortedSet, KindStream}
+	if slices.Contains(other_types, s.value(key).Kind) {
 		s.logger.Info("uncorrect indexes")
 		return nil, errors.New("no such key")
 	}
+	s.accessed(key)
 	if ok1 {
 		fin := strconv.Itoa(res1)
 		return &fin, nil
@@ -165,69 +289,111 @@ func (s *SliceStorage) createIfEmpty(values []string) SliceValue {
 }
 
 func (s *SliceStorage) defineKind(key string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	if s.inner[key].Kind == KindSliceInt {
-		return s.inner[key].StSl
+	if s.value(key).Kind == KindSliceInt {
+		return s.value(key).StSl
 	}
 
-	return s.inner[key].StSl
+	return s.value(key).StSl
 }
 
-func (s *SliceStorage) addToAppropriate(key string, values []string, cur SliceValue) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
+// addToAppropriate stores values as the list at key, unless cur is a list
+// of integers and one of them is not.
+func (s *SliceStorage) addToAppropriate(key string, values []string, cur SliceValue) error {
 	if cur.Kind == KindSliceInt {
 		for _, x := range values {
 			if _, err := strconv.Atoi(x); err != nil {
 				s.logger.Info("uncorrect values")
-				return
+				return ErrWrongKind
 			}
 		}
 
-		s.inner[key] = SliceValue{Kind: KindSliceInt, StSl: values}
+		s.store(key, SliceValue{Kind: KindSliceInt, StSl: values})
 	} else {
-		s.inner[key] = SliceValue{Kind: KindSliceStr, StSl: values}
+		s.store(key, SliceValue{Kind: KindSliceStr, StSl: values})
 	}
+	return nil
 }
 
-func (s *SliceStorage) LPush(key string, values []string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *SliceStorage) LPush(key string, values []string) error {
+	if s.proposer != nil {
+		_, err := s.proposer.Propose(Record{Op: OpLPush, Key: key, Vals: values})
+		return err
+	}
 
-	val, ok := s.inner[key]
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return err
+	}
+	defer sh.mu.Unlock()
+
+	if err := s.lpush(key, values); err != nil {
+		return err
+	}
+	s.appendRecord(Record{Op: OpLPush, Key: key, Vals: values})
+	return nil
+}
+
+func (s *SliceStorage) lpush(key string, values []string) error {
+	val, ok := s.lookup(key)
 	var tmp []string
 	tmp = append(tmp, values...)
 	slices.Reverse(tmp)
 	if !ok {
-		s.addToAppropriate(key, tmp, s.createIfEmpty(values))
-	} else {
-		s.addToAppropriate(key, append(tmp, s.defineKind(key)...), val)
+		return s.addToAppropriate(key, tmp, s.createIfEmpty(values))
 	}
+
+	return s.addToAppropriate(key, append(tmp, s.defineKind(key)...), val)
 }
 
-func (s *SliceStorage) RPush(key string, values []string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *SliceStorage) RPush(key string, values []string) error {
+	if s.proposer != nil {
+		_, err := s.proposer.Propose(Record{Op: OpRPush, Key: key, Vals: values})
+		return err
+	}
+
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return err
+	}
+	defer sh.mu.Unlock()
+
+	if err := s.rpush(key, values); err != nil {
+		return err
+	}
+	s.appendRecord(Record{Op: OpRPush, Key: key, Vals: values})
+	return nil
+}
 
-	val, ok := s.inner[key]
+func (s *SliceStorage) rpush(key string, values []string) error {
+	val, ok := s.lookup(key)
 	var tmp []string
 	tmp = append(tmp, values...)
 	if !ok {
-		s.addToAppropriate(key, tmp, s.createIfEmpty(values))
-
-	} else {
-		s.addToAppropriate(key, append(s.defineKind(key), tmp...), val)
+		return s.addToAppropriate(key, tmp, s.createIfEmpty(values))
 	}
+
+	return s.addToAppropriate(key, append(s.defineKind(key), tmp...), val)
 }
 
-func (s *SliceStorage) RAddToSet(key string, values []string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *SliceStorage) RAddToSet(key string, values []string) error {
+	if s.proposer != nil {
+		_, err := s.proposer.Propose(Record{Op: OpRAddToSet, Key: key, Vals: values})
+		return err
+	}
+
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return err
+	}
+	defer sh.mu.Unlock()
+
+	s.raddToSet(key, values)
+	s.appendRecord(Record{Op: OpRAddToSet, Key: key, Vals: values})
+	return nil
+}
 
-	val, ok := s.inner[key]
+func (s *SliceStorage) raddToSet(key string, values []string) {
+	val, ok := s.lookup(key)
 	var tmp []string
 	if !ok {
 		tmp = append(tmp, values...)
@@ -244,9 +410,22 @@ func (s *SliceStorage) RAddToSet(key string, values []string) {
 }
 
 func (s *SliceStorage) LPop(key string, indexes ...int) []string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.proposer != nil {
+		return s.proposePop(Record{Op: OpLPop, Key: key, Ints: toInt64s(indexes)})
+	}
+
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+
+	res := s.lpop(key, indexes...)
+	if len(res) > 0 {
+		s.appendRecord(Record{Op: OpLPop, Key: key, Ints: toInt64s(indexes)})
+	}
+
+	return res
+}
 
+func (s *SliceStorage) lpop(key string, indexes ...int) []string {
 	var start int
 	end := indexes[0]
 	if len(indexes) == 2 {
@@ -254,7 +433,7 @@ func (s *SliceStorage) LPop(key string, indexes ...int) []string {
 		end = indexes[1] + 1
 	}
 
-	val, ok := s.inner[key]
+	val, ok := s.lookup(key)
 	if !ok {
 		return []string{}
 	}
@@ -283,12 +462,25 @@ func (s *SliceStorage) LPop(key string, indexes ...int) []string {
 }
 
 func (s *SliceStorage) RPop(key string, indexes ...int) []string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.proposer != nil {
+		return s.proposePop(Record{Op: OpRPop, Key: key, Ints: toInt64s(indexes)})
+	}
+
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
 
+	res := s.rpop(key, indexes...)
+	if len(res) > 0 {
+		s.appendRecord(Record{Op: OpRPop, Key: key, Ints: toInt64s(indexes)})
+	}
+
+	return res
+}
+
+func (s *SliceStorage) rpop(key string, indexes ...int) []string {
 	var start int
 	end := indexes[0]
-	val, ok := s.inner[key]
+	val, ok := s.lookup(key)
 	if !ok {
 		return []string{}
 	}
@@ -327,17 +519,38 @@ func (s *SliceStorage) RPop(key string, indexes ...int) []string {
 }
 
 func (s *SliceStorage) LSet(key string, index int, elem string) (string, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.proposer != nil {
+		return proposed[string](s, Record{Op: OpLSet, Key: key, Vals: []string{elem}, Ints: []int64{int64(index)}})
+	}
+
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return "", err
+	}
+	defer sh.mu.Unlock()
+
+	res, err := s.lset(key, index, elem)
+	if err != nil {
+		return "", err
+	}
+
+	s.appendRecord(Record{Op: OpLSet, Key: key, Vals: []string{elem}, Ints: []int64{int64(index)}})
+	return res, nil
+}
 
-	_, ok := s.inner[key]
+func (s *SliceStorage) lset(key string, index int, elem string) (string, error) {
+	_, ok := s.lookup(key)
 	if !ok {
 		s.logger.Info("no such key")
 		return "", errors.New("no such key")
 	}
 
 	res := s.defineKind(key)
-	if index > len(res)-1 {
+	if index < 0 {
+		index += len(res)
+	}
+
+	if index < 0 || index > len(res)-1 {
 		s.logger.Info("out of range")
 		return "", errors.New("slice bounds ot of range")
 	}
@@ -347,28 +560,38 @@ func (s *SliceStorage) LSet(key string, index int, elem string) (string, error)
 }
 
 func (s *SliceStorage) LGet(key string, index int) (string, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
 
-	_, ok := s.inner[key]
+	_, ok := s.lookup(key)
 	if !ok {
 		s.logger.Info("no such key")
 		return "", errors.New("no such key")
 	}
 
 	res := s.defineKind(key)
-	if index > len(res)-1 {
+	if index < 0 {
+		index += len(res)
+	}
+
+	if index < 0 || index > len(res)-1 {
 		s.logger.Info("out of range")
 		return "", errors.New("slice bounds ot of range")
 	}
 
+	s.accessed(key)
 	return res[index], nil
 }
 
-func (s *SliceStorage) RegExKeys(ex string) ([]string, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *SliceStorage) LLen(key string) int {
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
 
+	s.accessed(key)
+	return len(s.value(key).StSl)
+}
+
+func (s *SliceStorage) RegExKeys(ex string) ([]string, error) {
 	re, err := regexp.Compile(ex)
 	if err != nil {
 		s.logger.Info("not correct expression")
@@ -376,8 +599,12 @@ func (s *SliceStorage) RegExKeys(ex string) ([]string, error) {
 	}
 
 	var keys []string
-	for key := range s.inner {
-		keys = append(keys, key)
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for key := range sh.inner {
+			keys = append(keys, key)
+		}
+		sh.mu.RUnlock()
 	}
 
 	var res []string
@@ -389,52 +616,117 @@ func (s *SliceStorage) RegExKeys(ex string) ([]string, error) {
 	return res, nil
 }
 
-func (s *SliceStorage) SaveToFile(filename string) error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	data, err := json.MarshalIndent(s.inner, "", "  ")
+// Load replaces the contents with the latest version of the persister, in
+// either format. It returns saving.ErrNoVersion when there is none.
+func (s *SliceStorage) Load() error {
+	ctx, span := tracer.Start(context.Background(), "storage.load")
+	err := s.load(ctx)
+	endSpan(span, err)
+	return err
+}
+
+func (s *SliceStorage) load(ctx context.Context) error {
+	var data []byte
+	s.saveMu.Lock()
+	err := persist(ctx, "LatestVersion", s.persister, func() error {
+		var err error
+		data, err = s.persister.LatestVersion()
+		return err
+	})
+	s.saveMu.Unlock()
 	if err != nil {
-		s.logger.Error("Failed to marshal SliceStorage to JSON", zap.Error(err))
+		if !errors.Is(err, saving.ErrNoVersion) {
+			s.logger.Error("Failed to load latest version", zap.Error(err))
+		}
 		return err
 	}
 
-	err = saving.WriteAtomic(filename, data)
+	inner, err := readSnapshotData(data)
 	if err != nil {
-		s.logger.Error("Failed to write JSON to file", zap.Error(err))
+		s.logger.Error("Failed to decode snapshot", zap.Error(err))
 		return err
 	}
 
-	s.logger.Info("SliceStorage successfully saved to file", zap.String("filename", filename))
+	s.lockAll()
+	defer s.unlockAll()
+	trace.SpanFromContext(ctx).AddEvent("shards locked")
+
+	s.replace(inner)
+	s.touchAll()
+	s.rebuildMeta()
+	s.resetFeed()
+	s.logger.Info("SliceStorage successfully loaded", zap.Int("keys", len(inner)))
 	return nil
 }
 
-func (s *SliceStorage) LoadFromFile(filename string) error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	data, err := os.ReadFile(filename)
+// Snapshot returns the contents as JSON, which is what versions are kept
+// in. Restore accepts both formats.
+func (s *SliceStorage) Snapshot() ([]byte, error) {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	inner, _, err := s.captureContents(nil)
 	if err != nil {
-		s.logger.Error("Failed to read file", zap.Error(err))
-		return err
+		return nil, err
+	}
+
+	return json.Marshal(inner)
+}
+
+func (s *SliceStorage) Restore(data []byte) error {
+	return s.RestoreContext(context.Background(), data)
+}
+
+// RestoreContext is Restore with its span in the trace of ctx.
+func (s *SliceStorage) RestoreContext(ctx context.Context, data []byte) error {
+	ctx, span := tracer.Start(ctx, "storage.restore", trace.WithAttributes(attribute.Int("storage.bytes", len(data))))
+	var err error
+	if s.proposer != nil {
+		err = s.proposeRestore(data)
+	} else {
+		err = s.restore(ctx, data)
 	}
 
-	var inner map[string]SliceValue
-	if err = json.Unmarshal(data, &inner); err != nil {
-		s.logger.Error("Failed to unmarshal JSON", zap.Error(err))
+	endSpan(span, err)
+	return err
+}
+
+func (s *SliceStorage) restore(ctx context.Context, data []byte) error {
+	inner, err := readSnapshotData(data)
+	if err != nil {
+		s.logger.Error("Failed to decode snapshot", zap.Error(err))
 		return err
 	}
 
-	s.inner = inner
-	s.logger.Info("SliceStorage successfully loaded from file", zap.String("filename", filename))
+	s.lockAll()
+	defer s.unlockAll()
+	trace.SpanFromContext(ctx).AddEvent("shards locked")
+
+	s.replace(inner)
+	s.touchAll()
+	s.rebuildMeta()
+	s.resetFeed()
+	s.notifyRecord(Record{Op: OpFlush})
+	s.logger.Info("SliceStorage restored from snapshot", zap.Int("keys", len(inner)))
+	if s.wal != nil {
+		return s.compactWAL()
+	}
+
 	return nil
 }
 
 func (s *SliceStorage) CheckIfExpired(key string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	if s.proposer != nil {
+		return s.proposeExpired(key)
+	}
 
-	if time.Now().UnixMilli() >= s.inner[key].Expires_at && s.inner[key].Expires_at != 0 {
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+
+	if at := s.value(key).Expires_at; at != 0 && time.Now().UnixMilli() >= at {
 		s.logger.Info("expired")
-		delete(s.inner, key)
+		s.remove(key)
+		s.appendRecord(Record{Op: OpDel, Key: key, Reason: ReasonExpired})
 		return true
 	}
 
@@ -442,44 +734,109 @@ func (s *SliceStorage) CheckIfExpired(key string) bool {
 }
 
 func (s *SliceStorage) Expire(key string, seconds int64) int {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.proposer != nil {
+		at := time.Now().UnixMilli() + seconds*1000
+		res, _ := proposed[int](s, Record{Op: OpExpireAt, Key: key, Ints: []int64{at}})
+		return res
+	}
+
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+
+	at := time.Now().UnixMilli() + seconds*1000
+	if s.expireAt(key, at) == 0 {
+		return 0
+	}
 
-	if res, ok := s.inner[key]; ok {
-		res.Expires_at = time.Now().UnixMilli() + seconds
-		s.inner[key] = res
+	s.appendRecord(Record{Op: OpExpireAt, Key: key, Ints: []int64{at}})
+	return 1
+}
+
+func (s *SliceStorage) expireAt(key string, at int64) int {
+	if res, ok := s.lookup(key); ok {
+		res.Expires_at = at
+		s.store(key, res)
 		return 1
 	}
 
 	return 0
 }
 
-func (s *SliceStorage) Clean(file string) {
-	var expiredKeys []string
-	s.mu.RLock()
-
-	for key, val := range s.inner {
-		if time.Now().UnixMilli() >= val.Expires_at && s.inner[key].Expires_at != 0 {
-			expiredKeys = append(expiredKeys, key)
+func (s *SliceStorage) Clean() {
+	if s.proposer != nil {
+		s.proposeClean()
+		s.BackgroundSave()
+		return
+	}
+
+	_, span := tracer.Start(context.Background(), "storage.clean")
+	expired := s.expired.Load()
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		now := time.Now().UnixMilli()
+		for key, val := range sh.inner {
+			if val.Expires_at != 0 && now >= val.Expires_at {
+				s.logger.Info("Deleting expired key: " + key)
+				sh.preserve(key)
+				delete(sh.inner, key)
+				s.appendRecord(Record{Op: OpDel, Key: key, Reason: ReasonExpired})
+			}
 		}
+		for key := range sh.versions {
+			if _, ok := sh.inner[key]; !ok {
+				delete(sh.versions, key)
+			}
+		}
+		sh.mu.Unlock()
 	}
-	s.mu.RUnlock()
-	s.mu.Lock()
-	for _, key := range expiredKeys {
-		s.logger.Info("Deleting expired key: " + key)
-		delete(s.inner, key)
-	}
-	s.mu.Unlock()
-	s.SaveToFile(file)
+	span.SetAttributes(attribute.Int64("storage.expired", int64(s.expired.Load()-expired)))
+	span.End()
+
+	s.BackgroundSave()
 }
 
-func (s *SliceStorage) PeriodicClean(closeChan chan struct{}, interval time.Duration, file string) {
+func (s *SliceStorage) PeriodicClean(closeChan chan struct{}, interval time.Duration) {
 	for {
 		select {
 		case <-closeChan:
 			return
 		case <-time.After(interval):
-			s.Clean(file)
+			s.Clean()
 		}
 	}
 }
+
+type VersionSaver interface {
+	SaveVersion(data []byte) error
+}
+
+func (s *SliceStorage) SaveVersion(db VersionSaver) error {
+	return s.SaveVersionContext(context.Background(), db)
+}
+
+// SaveVersionContext is SaveVersion with its span in the trace of ctx.
+func (s *SliceStorage) SaveVersionContext(ctx context.Context, db VersionSaver) error {
+	ctx, span := tracer.Start(ctx, "storage.save_version")
+	err := s.saveVersion(ctx, db)
+	endSpan(span, err)
+	return err
+}
+
+func (s *SliceStorage) saveVersion(ctx context.Context, db VersionSaver) error {
+	data, err := s.Snapshot()
+	if err != nil {
+		s.logger.Error("Failed to marshal SliceStorage to JSON", zap.Error(err))
+		return err
+	}
+
+	err = persist(ctx, "SaveVersion", db, func() error {
+		return db.SaveVersion(data)
+	})
+	if err != nil {
+		s.logger.Error("Failed to save version", zap.Error(err))
+		return err
+	}
+
+	s.logger.Info("SliceStorage version saved", zap.Int("size", len(data)))
+	return nil
+}
@@ -1,6 +1,29 @@
 package storage
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"proj1/internal/pkg/saving"
+	"proj1/internal/pkg/tracing"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
 
 type pieceOfTest struct {
 	key   string
@@ -54,6 +77,24 @@ func TestKind(t *testing.T) {
 	}
 }
 
+// Expire takes seconds like /any/expire and EXPIRE; it used to add them as
+// milliseconds, so keys expired almost at once.
+func TestExpireSeconds(t *testing.T) {
+	stor, err := NewSliceStorage(filepath.Join(t.TempDir(), "slice_storage.json"))
+	if err != nil {
+		t.Fatalf("new storage: %v", err)
+	}
+
+	stor.Set("a", "1")
+	if stor.Expire("a", 1) != 1 {
+		t.Fatal("expire of an existing key failed")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if stor.CheckIfExpired("a") {
+		t.Error("key with a ttl of one second expired after 50ms")
+	}
+}
+
 func BenchmarkGet(b *testing.B) {
 	stor, err := NewSliceStorage("slice_storage.json")
 	if err != nil {
@@ -112,3 +153,1277 @@ func BenchmarkGetKind(b *testing.B) {
 		_ = stor.GetKind("go")
 	}
 }
+
+// The single shard case stands for the former design with one global lock.
+func benchmarkParallel(b *testing.B, op func(stor *SliceStorage, key string)) {
+	for _, n := range []int{1, DefaultShards} {
+		b.Run("shards="+strconv.Itoa(n), func(b *testing.B) {
+			stor, err := NewShardedStorage("slice_storage.json", n)
+			if err != nil {
+				b.Fatalf("not able to create storage: %v", err)
+			}
+			keys := make([]string, 1024)
+			for i := range keys {
+				keys[i] = "key" + strconv.Itoa(i)
+				stor.Set(keys[i], strconv.Itoa(i))
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.IntN(len(keys))
+				for pb.Next() {
+					op(&stor, keys[i%len(keys)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkParallelSet(b *testing.B) {
+	benchmarkParallel(b, func(stor *SliceStorage, key string) {
+		stor.Set(key, "45678")
+	})
+}
+
+func BenchmarkParallelGet(b *testing.B) {
+	benchmarkParallel(b, func(stor *SliceStorage, key string) {
+		stor.Get(key)
+	})
+}
+
+func BenchmarkParallelSetGet(b *testing.B) {
+	var n atomic.Int64
+	benchmarkParallel(b, func(stor *SliceStorage, key string) {
+		if n.Add(1)%4 == 0 {
+			stor.Set(key, "45678")
+		} else {
+			stor.Get(key)
+		}
+	})
+}
+
+func TestWALReplay(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "storage.wal")
+	stor, err := NewSliceStorage("slice_storage.json")
+	if err != nil {
+		t.Fatalf("new storage: %v", err)
+	}
+	if err = stor.OpenWAL(walPath, saving.SyncAlways); err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+
+	stor.Set("vsem", `"privet"`)
+	stor.Set("go", "45678")
+	stor.HSet("map", []map[string]string{{"a": "b"}})
+	stor.RPush("list", []string{"a", "b", "c"})
+	stor.LPush("list", []string{"z"})
+	stor.LPop("list", 1)
+	stor.LSet("list", 0, "x")
+	if err = stor.CloseWAL(); err != nil {
+		t.Fatalf("close wal: %v", err)
+	}
+
+	restored, _ := NewSliceStorage("slice_storage.json")
+	if err = restored.OpenWAL(walPath, saving.SyncNever); err != nil {
+		t.Fatalf("replay wal: %v", err)
+	}
+	defer restored.CloseWAL()
+
+	if res, _ := restored.Get("vsem"); res != "privet" {
+		t.Errorf("wrong scalar after replay: %q", res)
+	}
+	if res, _ := restored.Get("go"); res != "45678" {
+		t.Errorf("wrong int after replay: %q", res)
+	}
+	if res, err := restored.HGet("map", "a"); err != nil || res == nil || *res != "b" {
+		t.Errorf("wrong map field after replay")
+	}
+	for i, want := range []string{"x", "b", "c"} {
+		if res, _ := restored.LGet("list", i); res != want {
+			t.Errorf("wrong list element %d after replay: %q", i, res)
+		}
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "storage.wal")
+	stor, _ := NewSliceStorage("slice_storage.json")
+	if err := stor.OpenWAL(walPath, saving.SyncNever); err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		stor.Set("counter", strconv.Itoa(i))
+	}
+	before := stor.wal.Size()
+	if err := stor.CompactWAL(); err != nil {
+		t.Fatalf("compact wal: %v", err)
+	}
+	if stor.wal.Size() >= before {
+		t.Errorf("wal was not compacted: %d >= %d", stor.wal.Size(), before)
+	}
+	stor.Set("other", "1")
+	stor.CloseWAL()
+
+	restored, _ := NewSliceStorage("slice_storage.json")
+	restored.Set("stale", "1")
+	if err := restored.OpenWAL(walPath, saving.SyncNever); err != nil {
+		t.Fatalf("replay wal: %v", err)
+	}
+	defer restored.CloseWAL()
+
+	if res, _ := restored.Get("counter"); res != "99" {
+		t.Errorf("wrong value after compaction: %q", res)
+	}
+	if res, _ := restored.Get("other"); res != "1" {
+		t.Errorf("record after compaction lost: %q", res)
+	}
+	if _, ok := restored.Get("stale"); ok {
+		t.Errorf("wal should take precedence over snapshot data")
+	}
+}
+
+func TestWALCompactionDuringWrites(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "storage.wal")
+	stor, _ := NewSliceStorage("slice_storage.json")
+	if err := stor.OpenWAL(walPath, saving.SyncNever); err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+
+	// Increments made while the log is compacted are neither lost nor
+	// replayed twice.
+	const n = 5000
+	var written atomic.Int64
+	go func() {
+		for i := 0; i < n; i++ {
+			stor.IncrBy("n", 1)
+			written.Add(1)
+		}
+	}()
+	for written.Load() < n {
+		if err := stor.CompactWAL(); err != nil {
+			t.Fatalf("compact wal: %v", err)
+		}
+	}
+	stor.CloseWAL()
+
+	restored, _ := NewSliceStorage("slice_storage.json")
+	if err := restored.OpenWAL(walPath, saving.SyncNever); err != nil {
+		t.Fatalf("replay wal: %v", err)
+	}
+	defer restored.CloseWAL()
+	if res, _ := restored.Get("n"); res != strconv.Itoa(n) {
+		t.Errorf("counter after replay: %q", res)
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	stor, _ := NewSliceStorage("slice_storage.json")
+
+	if c, err := stor.SAdd("a", []string{"1", "2", "3", "3"}); err != nil || c != 3 {
+		t.Fatalf("sadd: %d, %v", c, err)
+	}
+	stor.SAdd("b", []string{"2", "3", "4"})
+	stor.Set("scalar", "1")
+
+	if ok, _ := stor.SIsMember("a", "2"); !ok {
+		t.Errorf("2 should be a member")
+	}
+	if c, _ := stor.SRem("a", []string{"1", "9"}); c != 1 {
+		t.Errorf("srem removed %d members", c)
+	}
+	if c, _ := stor.SCard("a"); c != 2 {
+		t.Errorf("scard: %d", c)
+	}
+	if _, err := stor.SAdd("scalar", []string{"x"}); err != ErrWrongKind {
+		t.Errorf("expected wrong kind error, got %v", err)
+	}
+
+	union, _ := stor.SUnion("a", "b")
+	slices.Sort(union)
+	if !slices.Equal(union, []string{"2", "3", "4"}) {
+		t.Errorf("sunion: %v", union)
+	}
+	diff, _ := stor.SDiff("b", "a")
+	if !slices.Equal(diff, []string{"4"}) {
+		t.Errorf("sdiff: %v", diff)
+	}
+	if c, _ := stor.SInterStore("dst", "a", "b", "missing"); c != 0 {
+		t.Errorf("intersection with a missing key should be empty")
+	}
+	if c, _ := stor.SInterStore("dst", "a", "b"); c != 2 {
+		t.Errorf("sinterstore: %d", c)
+	}
+
+	popped, _ := stor.SPop("dst", 5)
+	if len(popped) != 2 {
+		t.Errorf("spop: %v", popped)
+	}
+	if kind := stor.GetKind("dst"); kind != "" {
+		t.Errorf("empty set should be removed, kind %q", kind)
+	}
+}
+
+func TestSetPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slice_storage.json")
+	stor, _ := NewSliceStorage(path)
+	stor.SAdd("tags", []string{"go", "redis"})
+	if err := stor.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	restored, _ := NewSliceStorage(path)
+	if err := restored.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if ok, _ := restored.SIsMember("tags", "redis"); !ok {
+		t.Errorf("set was not persisted")
+	}
+}
+
+func TestSortedSetRanks(t *testing.T) {
+	stor, _ := NewSliceStorage("slice_storage.json")
+
+	var members []ZMember
+	for i := 0; i < 200; i++ {
+		members = append(members, ZMember{Member: "m" + strconv.Itoa(i), Score: float64((i * 37) % 101)})
+	}
+	if c, err := stor.ZAdd("board", members); err != nil || c != 200 {
+		t.Fatalf("zadd: %d, %v", c, err)
+	}
+
+	sorted := slices.Clone(members)
+	slices.SortFunc(sorted, func(a, b ZMember) int {
+		if a.Score != b.Score {
+			if a.Score < b.Score {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Member, b.Member)
+	})
+
+	all, _ := stor.ZRange("board", 0, -1, false)
+	if !slices.Equal(all, sorted) {
+		t.Fatalf("zrange does not match sorted members")
+	}
+	for i, m := range sorted {
+		if rank, _ := stor.ZRank("board", m.Member, false); rank != i {
+			t.Fatalf("rank of %s: %d, want %d", m.Member, rank, i)
+		}
+		if rank, _ := stor.ZRank("board", m.Member, true); rank != len(sorted)-1-i {
+			t.Fatalf("reverse rank of %s: %d", m.Member, rank)
+		}
+	}
+
+	top, _ := stor.ZRange("board", 0, 2, true)
+	if !slices.Equal(top, []ZMember{sorted[199], sorted[198], sorted[197]}) {
+		t.Errorf("reverse zrange: %v", top)
+	}
+}
+
+func TestSortedSetScores(t *testing.T) {
+	stor, _ := NewSliceStorage("slice_storage.json")
+	stor.ZAdd("q", []ZMember{{"a", 1}, {"b", 2}, {"c", 3}, {"d", 4}})
+
+	if res, _ := stor.ZIncrBy("q", "a", 10); res != 11 {
+		t.Errorf("zincrby: %v", res)
+	}
+
+	min, _ := ParseScoreBound("(2")
+	max, _ := ParseScoreBound("+inf")
+	res, _ := stor.ZRangeByScore("q", min, max, 1, 1, false)
+	if !slices.Equal(res, []ZMember{{"d", 4}}) {
+		t.Errorf("zrangebyscore with limit: %v", res)
+	}
+	res, _ = stor.ZRangeByScore("q", min, max, 0, -1, true)
+	if !slices.Equal(res, []ZMember{{"a", 11}, {"d", 4}, {"c", 3}}) {
+		t.Errorf("reverse zrangebyscore: %v", res)
+	}
+
+	min, _ = ParseScoreBound("-inf")
+	max, _ = ParseScoreBound("3")
+	if c, _ := stor.ZRemRangeByScore("q", min, max); c != 2 {
+		t.Errorf("zremrangebyscore removed %d", c)
+	}
+	if c, _ := stor.ZRem("q", []string{"a", "x"}); c != 1 {
+		t.Errorf("zrem removed %d", c)
+	}
+
+	path := filepath.Join(t.TempDir(), "slice_storage.json")
+	stor.SetPersister(saving.NewFilePersister(path, 0))
+	stor.Save()
+	restored, _ := NewSliceStorage(path)
+	if err := restored.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if score, ok, _ := restored.ZScore("q", "d"); !ok || score != 4 {
+		t.Errorf("sorted set was not persisted")
+	}
+}
+
+func TestNumericOperations(t *testing.T) {
+	stor, _ := NewSliceStorage("slice_storage.json")
+
+	if res, err := stor.IncrBy("counter", 5); err != nil || res != 5 {
+		t.Errorf("incrby on a missing key: %d, %v", res, err)
+	}
+	if res, _ := stor.IncrBy("counter", -7); res != -2 {
+		t.Errorf("decrby: %d", res)
+	}
+	if res, _ := stor.Get("counter"); res != "-2" || stor.GetKind("counter") != string(KindInt) {
+		t.Errorf("counter stored as %q of kind %q", res, stor.GetKind("counter"))
+	}
+	if res, _ := stor.IncrByFloat("counter", 0.5); res != -1.5 {
+		t.Errorf("incrbyfloat: %v", res)
+	}
+	if _, err := stor.IncrBy("counter", 1); err != ErrNotInteger {
+		t.Errorf("incr on a float should fail, got %v", err)
+	}
+
+	stor.Set("big", strconv.Itoa(math.MaxInt64))
+	if _, err := stor.IncrBy("big", 1); err != ErrOverflow {
+		t.Errorf("expected overflow, got %v", err)
+	}
+	stor.Set("name", `"bob"`)
+	if _, err := stor.IncrBy("name", 1); err != ErrNotInteger {
+		t.Errorf("incr on a string should fail, got %v", err)
+	}
+	stor.RPush("list", []string{"1"})
+	if _, err := stor.IncrBy("list", 1); err != ErrWrongKind {
+		t.Errorf("incr on a list should fail, got %v", err)
+	}
+
+	if res, _ := stor.HIncrBy("h", "visits", 3); res != 3 {
+		t.Errorf("hincrby on a missing key: %d", res)
+	}
+	if res, _ := stor.HIncrByFloat("h", "visits", 0.25); res != 3.25 {
+		t.Errorf("hincrbyfloat: %v", res)
+	}
+	if res, _ := stor.HGet("h", "visits"); res == nil || *res != "3.25" {
+		t.Errorf("hash field after hincrbyfloat: %v", res)
+	}
+	if _, err := stor.HIncrBy("h", "visits", 1); err != ErrNotInteger {
+		t.Errorf("hincrby on a float field should fail, got %v", err)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "storage.wal")
+	stor, _ := NewSliceStorage("slice_storage.json")
+	stor.OpenWAL(walPath, saving.SyncNever)
+	stor.RPush("jobs", []string{"a", "b"})
+
+	tx := stor.Multi()
+	tx.Watch("jobs")
+	tx.Queue(
+		TxOp{Op: "rpop", Key: "jobs"},
+		TxOp{Op: "lpush", Key: "done", Args: []string{"b"}},
+		TxOp{Op: "incrby", Key: "processed", Args: []string{"1"}},
+		TxOp{Op: "incrby", Key: "jobs", Args: []string{"1"}},
+		TxOp{Op: "get", Key: "processed"},
+	)
+	res, err := tx.Exec()
+	if err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+	if !slices.Equal(res[0].Result.([]string), []string{"b"}) {
+		t.Errorf("rpop result: %v", res[0].Result)
+	}
+	if res[2].Result != int64(1) || res[4].Result != "1" {
+		t.Errorf("counter results: %v, %v", res[2].Result, res[4].Result)
+	}
+	if res[3].Error != ErrWrongKind.Error() {
+		t.Errorf("failed operation should report its error: %+v", res[3])
+	}
+
+	tx = stor.Multi()
+	tx.Watch("jobs")
+	stor.RPush("jobs", []string{"c"})
+	tx.Queue(TxOp{Op: "del", Key: "jobs"})
+	if _, err = tx.Exec(); err != ErrTxAborted {
+		t.Errorf("expected abort, got %v", err)
+	}
+	if stor.LLen("jobs") != 2 {
+		t.Errorf("aborted transaction must not apply")
+	}
+	stor.CloseWAL()
+
+	restored, _ := NewSliceStorage("slice_storage.json")
+	restored.OpenWAL(walPath, saving.SyncNever)
+	defer restored.CloseWAL()
+	if res, _ := restored.LGet("done", 0); res != "b" {
+		t.Errorf("transaction was not replayed from the wal")
+	}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	stor, _ := NewSliceStorage("slice_storage.json")
+	stor.SetEviction(EvictionConfig{Policy: NoEviction, MaxKeys: 2})
+	stor.Set("a", "1")
+	stor.Set("b", "2")
+	if err := stor.Set("c", "3"); err != ErrOOM {
+		t.Errorf("noeviction should refuse new keys, got %v", err)
+	}
+	if err := stor.Set("a", "10"); err != nil {
+		t.Errorf("overwriting a key should fit: %v", err)
+	}
+
+	stor.SetEviction(EvictionConfig{Policy: AllKeysLRU, MaxKeys: 2, Samples: 10})
+	stor.shardFor("a").meta["a"].lastAccess.Store(1)
+	stor.Get("b")
+	if err := stor.Set("c", "3"); err != nil {
+		t.Fatalf("allkeys-lru set: %v", err)
+	}
+	if _, ok := stor.Get("a"); ok {
+		t.Errorf("least recently used key should be evicted")
+	}
+
+	stor.SetEviction(EvictionConfig{Policy: AllKeysLFU, MaxKeys: 2, Samples: 10})
+	stor.shardFor("b").meta["b"].counter.Store(100)
+	stor.shardFor("c").meta["c"].counter.Store(1)
+	stor.RPush("d", []string{"x"})
+	if _, ok := stor.Get("c"); ok {
+		t.Errorf("least frequently used key should be evicted")
+	}
+
+	stor.SetEviction(EvictionConfig{Policy: VolatileLRU, MaxKeys: 2, Samples: 10})
+	if _, err := stor.SAdd("e", []string{"x"}); err != ErrOOM {
+		t.Errorf("volatile-lru without expiring keys should fail, got %v", err)
+	}
+	stor.Expire("d", 100)
+	if _, err := stor.SAdd("e", []string{"x"}); err != nil {
+		t.Fatalf("volatile-lru sadd: %v", err)
+	}
+	if stor.LLen("d") != 0 {
+		t.Errorf("only the key with expiration could be evicted")
+	}
+
+	stor.SetEviction(EvictionConfig{Policy: VolatileTTL, MaxKeys: 3, Samples: 10})
+	stor.Set("f", "1")
+	stor.Expire("b", 10)
+	stor.Expire("f", 1000)
+	stor.Set("g", "1")
+	if _, ok := stor.Get("b"); ok {
+		t.Errorf("key closest to expiration should be evicted")
+	}
+	if stats := stor.EvictionStats(); stats.Evicted != 4 || stats.Keys != 3 {
+		t.Errorf("eviction stats: %+v", stats)
+	}
+}
+
+func TestEvictionMemory(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "storage.wal")
+	stor, _ := NewSliceStorage("slice_storage.json")
+	stor.OpenWAL(walPath, saving.SyncNever)
+	stor.SetEviction(EvictionConfig{Policy: AllKeysLRU, MaxMemory: 4096})
+	for i := 0; i < 100; i++ {
+		if err := stor.RPush("list"+strconv.Itoa(i), []string{strings.Repeat("x", 100)}); err != nil {
+			t.Fatalf("rpush: %v", err)
+		}
+	}
+
+	stats := stor.EvictionStats()
+	if stats.Evicted == 0 || stats.UsedMemory > 4096+512 {
+		t.Errorf("memory budget was not enforced: %+v", stats)
+	}
+	if stor.LLen("list99") != 1 {
+		t.Errorf("the key being written must not be evicted")
+	}
+	stor.CloseWAL()
+
+	restored, _ := NewSliceStorage("slice_storage.json")
+	restored.OpenWAL(walPath, saving.SyncNever)
+	defer restored.CloseWAL()
+	if got := restored.EvictionStats(); got.Keys != stats.Keys || got.UsedMemory != stats.UsedMemory {
+		t.Errorf("evictions were not replayed: %+v, want %+v", got, stats)
+	}
+}
+
+func TestKeysByKind(t *testing.T) {
+	stor, _ := NewSliceStorage("slice_storage.json")
+	stor.Set("a", "1")
+	stor.Set("b", "2")
+	stor.Set("c", `"x"`)
+	stor.RPush("list", []string{"x"})
+	if got := stor.KeysByKind(); !reflect.DeepEqual(got, map[Kind]int{KindInt: 2, KindString: 1, KindSliceStr: 1}) {
+		t.Errorf("after writes: %v", got)
+	}
+
+	// A key changing its kind moves between the counts.
+	stor.Set("a", `"y"`)
+	stor.Expire("b", 0)
+	stor.CheckIfExpired("b")
+	if got := stor.KeysByKind(); !reflect.DeepEqual(got, map[Kind]int{KindString: 2, KindSliceStr: 1}) {
+		t.Errorf("after changes: %v", got)
+	}
+
+	data, _ := stor.Snapshot()
+	stor.Set("d", "4")
+	stor.Restore(data)
+	if got := stor.KeysByKind(); !reflect.DeepEqual(got, map[Kind]int{KindString: 2, KindSliceStr: 1}) {
+		t.Errorf("after a restore: %v", got)
+	}
+}
+
+func TestShardedConcurrency(t *testing.T) {
+	stor, _ := NewShardedStorage("slice_storage.json", 8)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := "k" + strconv.Itoa(i%16)
+				stor.IncrBy(key, 1)
+				stor.SAdd("s"+strconv.Itoa(i%4), []string{key})
+				stor.SUnionStore("all", "s0", "s1", "s2", "s3")
+				if i%50 == 0 {
+					stor.Snapshot()
+					stor.RegExKeys("^k")
+				}
+
+				tx := stor.Multi()
+				tx.Queue(TxOp{Op: "incrby", Key: "total", Args: []string{"1"}})
+				tx.Exec()
+			}
+		}()
+	}
+	wg.Wait()
+
+	var sum int
+	for i := 0; i < 16; i++ {
+		v, _ := stor.Get("k" + strconv.Itoa(i))
+		n, _ := strconv.Atoi(v)
+		sum += n
+	}
+	if total, _ := stor.Get("total"); sum != 1600 || total != "1600" {
+		t.Errorf("lost updates: keys sum to %d, total is %s", sum, total)
+	}
+	if c, _ := stor.SCard("all"); c != 16 {
+		t.Errorf("union of all sets: %d", c)
+	}
+	if keys, _ := stor.RegExKeys("^k"); len(keys) != 16 {
+		t.Errorf("keys across shards: %v", keys)
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	from, _ := NewSliceStorage("slice_storage.json")
+	to, _ := NewSliceStorage("slice_storage.json")
+	from.ZAdd("z", []ZMember{{Member: "m", Score: 1.5}})
+	from.Set("a", "1")
+	to.Set("a", "2")
+
+	data, version, ok := from.Export("z")
+	if !ok {
+		t.Fatal("z not exported")
+	}
+	if imported, err := to.Import("z", data); err != nil || !imported {
+		t.Fatalf("import z: %v %v", imported, err)
+	}
+	if score, ok, _ := to.ZScore("z", "m"); !ok || score != 1.5 {
+		t.Errorf("imported score: %v %v", score, ok)
+	}
+	if !from.DropIfUnchanged("z", version) || len(from.Keys()) != 1 {
+		t.Errorf("z not dropped: %v", from.Keys())
+	}
+
+	// The new owner keeps what was written to it in the meantime, and the
+	// old one keeps keys that changed after they were exported.
+	data, version, _ = from.Export("a")
+	if imported, _ := to.Import("a", data); imported {
+		t.Error("existing key overwritten")
+	}
+	from.IncrBy("a", 1)
+	if from.DropIfUnchanged("a", version) {
+		t.Error("changed key dropped")
+	}
+	if v, _ := to.Get("a"); v != "2" {
+		t.Errorf("a = %s", v)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	stor, _ := NewSliceStorage("slice_storage.json")
+	var events []Event
+	stor.SetNotifier(func(e Event) {
+		events = append(events, e)
+	})
+
+	stor.RPush("l", []string{"1"})
+	tx := stor.Multi()
+	tx.Queue(TxOp{Op: "set", Key: "a", Args: []string{"1"}}, TxOp{Op: "del", Key: "l"})
+	tx.Exec()
+	stor.SetEviction(EvictionConfig{Policy: AllKeysLRU, MaxKeys: 1})
+	stor.Set("b", "2")
+
+	want := []Event{
+		{Key: "l", Op: "rpush", Kind: KindSliceInt},
+		{Key: "a", Op: "set", Kind: KindInt},
+		{Key: "l", Op: "del"},
+		{Key: "a", Op: ReasonEvicted},
+		{Key: "b", Op: "set", Kind: KindInt},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events: %v", events)
+	}
+}
+
+func waiting(s *SliceStorage, key string) int {
+	s.waiters.mu.Lock()
+	defer s.waiters.mu.Unlock()
+
+	return len(s.waiters.queues[key])
+}
+
+func TestBlockingPops(t *testing.T) {
+	stor, _ := NewSliceStorage("slice_storage.json")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	if _, _, err := stor.BLPop(ctx, "q"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("empty list: %v", err)
+	}
+	cancel()
+
+	// Waiters are served in the order they arrived.
+	const n = 5
+	got := make(chan string, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, elem, err := stor.BLPop(context.Background(), "q")
+			if err != nil {
+				t.Error(err)
+			}
+			got <- strconv.Itoa(i) + "=" + elem
+		}()
+		for waiting(&stor, "q") != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		stor.RPush("q", []string{strconv.Itoa(10 + i)})
+		if res := <-got; res != strconv.Itoa(i)+"="+strconv.Itoa(10+i) {
+			t.Errorf("waiter %d got %s", i, res)
+		}
+	}
+
+	stor.RPush("b", []string{"1", "2"})
+	if key, elem, err := stor.BRPop(context.Background(), "a", "b"); key != "b" || elem != "2" || err != nil {
+		t.Errorf("brpop: %s %s %v", key, elem, err)
+	}
+}
+
+func TestLMove(t *testing.T) {
+	stor, _ := NewSliceStorage("slice_storage.json")
+	stor.RPush("src", []string{"1", "2", "3"})
+
+	if elem, ok, err := stor.LMove("src", "dst", Right, Left); elem != "3" || !ok || err != nil {
+		t.Errorf("lmove: %s %v %v", elem, ok, err)
+	}
+	if elem, _, _ := stor.LMove("src", "src", Left, Right); elem != "1" {
+		t.Errorf("rotate: %s", elem)
+	}
+	if v, _ := stor.LGet("src", 0); v != "2" || stor.LLen("src") != 2 {
+		t.Errorf("src after rotate: %s", v)
+	}
+
+	stor.Set("str", `"x"`)
+	if _, _, err := stor.LMove("src", "str", Left, Left); !errors.Is(err, ErrWrongKind) {
+		t.Errorf("move into a string: %v", err)
+	}
+	if stor.LLen("src") != 2 {
+		t.Error("element lost on failed move")
+	}
+	if _, ok, _ := stor.LMove("none", "dst", Left, Left); ok {
+		t.Error("moved from a missing list")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go stor.LPush("later", []string{"9"})
+	if elem, err := stor.BLMove(ctx, "later", "dst", Left, Right); elem != "9" || err != nil {
+		t.Errorf("blmove: %s %v", elem, err)
+	}
+	if v, _ := stor.LGet("dst", -1); v != "9" {
+		t.Errorf("dst tail: %s", v)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	stor, _ := NewSliceStorage("slice_storage.json")
+
+	first, err := stor.XAdd("events", "*", map[string]string{"n": "1"})
+	if err != nil {
+		t.Fatalf("xadd: %v", err)
+	}
+	second, _ := stor.XAdd("events", "*", map[string]string{"n": "2"})
+	if !first.Less(second) {
+		t.Errorf("ids are not monotonic: %s %s", first, second)
+	}
+	if _, err = stor.XAdd("events", "1-0", map[string]string{"n": "x"}); !errors.Is(err, ErrStreamIDTooSmall) {
+		t.Errorf("explicit smaller id: %v", err)
+	}
+	stor.XAdd("events", "*", map[string]string{"n": "3"})
+
+	all, _ := stor.XRange("events", StreamID{}, maxStreamID, 0)
+	if len(all) != 3 || all[2].Fields["n"] != "3" {
+		t.Errorf("xrange: %v", all)
+	}
+	if rev, _ := stor.XRevRange("events", maxStreamID, StreamID{}, 1); len(rev) != 1 || rev[0].Fields["n"] != "3" {
+		t.Errorf("xrevrange: %v", rev)
+	}
+
+	if err = stor.XGroupCreate("events", "workers", "0", false); err != nil {
+		t.Fatalf("xgroup: %v", err)
+	}
+	if err = stor.XGroupCreate("events", "workers", "0", false); !errors.Is(err, ErrGroupExists) {
+		t.Errorf("duplicate group: %v", err)
+	}
+
+	got, _ := stor.XReadGroup("events", "workers", "alice", 2)
+	if len(got) != 2 || got[0].ID != first {
+		t.Errorf("alice: %v", got)
+	}
+	got, _ = stor.XReadGroup("events", "workers", "bob", 0)
+	if len(got) != 1 || got[0].Fields["n"] != "3" {
+		t.Errorf("bob: %v", got)
+	}
+	if n, _ := stor.XAck("events", "workers", []StreamID{first, first}); n != 1 {
+		t.Errorf("xack: %d", n)
+	}
+
+	pending, _ := stor.XPending("events", "workers", "alice")
+	if len(pending) != 1 || pending[0].ID != second {
+		t.Errorf("pending of alice: %v", pending)
+	}
+	if claimed, _ := stor.XAutoClaim("events", "workers", "bob", time.Hour, 0); len(claimed) != 0 {
+		t.Errorf("claimed entries that are not idle: %v", claimed)
+	}
+	claimed, _ := stor.XAutoClaim("events", "workers", "bob", 0, 0)
+	if len(claimed) != 2 {
+		t.Errorf("xautoclaim: %v", claimed)
+	}
+	if pending, _ = stor.XPending("events", "workers", "bob"); len(pending) != 2 || pending[0].Deliveries != 2 {
+		t.Errorf("pending of bob: %v", pending)
+	}
+
+	if n, _ := stor.XTrim("events", 1, StreamID{}); n != 2 {
+		t.Errorf("xtrim: %d", n)
+	}
+	if n, _ := stor.XLen("events"); n != 1 {
+		t.Errorf("xlen after trim: %d", n)
+	}
+	stor.XAutoClaim("events", "workers", "bob", 0, 0)
+	if pending, _ = stor.XPending("events", "workers", ""); len(pending) != 1 {
+		t.Errorf("trimmed entries are still pending: %v", pending)
+	}
+
+	if _, err = stor.XReadGroup("events", "nobody", "alice", 0); !errors.Is(err, ErrNoGroup) {
+		t.Errorf("missing group: %v", err)
+	}
+	stor.Set("str", `"x"`)
+	if _, err = stor.XAdd("str", "*", map[string]string{"a": "b"}); !errors.Is(err, ErrWrongKind) {
+		t.Errorf("xadd to a string: %v", err)
+	}
+}
+
+func TestStreamPersistence(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "storage.wal")
+	stor, _ := NewSliceStorage(filepath.Join(dir, "slice_storage.json"))
+	if err := stor.OpenWAL(walPath, saving.SyncNever); err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+
+	stor.XAdd("events", "*", map[string]string{"n": "1"})
+	stor.XAdd("events", "*", map[string]string{"n": "2"})
+	stor.XGroupCreate("events", "workers", "0", false)
+	stor.XReadGroup("events", "workers", "alice", 1)
+	if err := stor.CloseWAL(); err != nil {
+		t.Fatalf("close wal: %v", err)
+	}
+
+	path := filepath.Join(dir, "snapshot.json")
+	stor.SetPersister(saving.NewFilePersister(path, 0))
+	if err := stor.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	replayed, _ := NewSliceStorage(path)
+	if err := replayed.OpenWAL(walPath, saving.SyncNever); err != nil {
+		t.Fatalf("replay wal: %v", err)
+	}
+	defer replayed.CloseWAL()
+	loaded, _ := NewSliceStorage(path)
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	for name, restored := range map[string]*SliceStorage{"wal": &replayed, "snapshot": &loaded} {
+		want, _ := stor.XRange("events", StreamID{}, maxStreamID, 0)
+		if got, _ := restored.XRange("events", StreamID{}, maxStreamID, 0); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: entries %v, want %v", name, got, want)
+		}
+		if pending, _ := restored.XPending("events", "workers", "alice"); len(pending) != 1 || pending[0].ID != want[0].ID {
+			t.Errorf("%s: pending %v", name, pending)
+		}
+		if got, _ := restored.XReadGroup("events", "workers", "bob", 0); len(got) != 1 || got[0].ID != want[1].ID {
+			t.Errorf("%s: next delivery %v", name, got)
+		}
+	}
+}
+
+func TestBinarySnapshot(t *testing.T) {
+	stor, _ := NewSliceStorage("slice_storage.json")
+	stor.Set("str", `"privet"`)
+	stor.Set("int", "42")
+	stor.Expire("int", 3600)
+	stor.RPush("list", []string{"a", "", "c"})
+	stor.RPush("nums", []string{"1", "2"})
+	stor.HSet("mstr", []map[string]string{{"a": "b", "c": ""}})
+	stor.HSet("mint", []map[string]string{{"x": "-7"}})
+	stor.SAdd("set", []string{"go", "redis"})
+	stor.ZAdd("zset", []ZMember{{Member: "a", Score: 1.5}, {Member: "b", Score: -2}})
+	stor.XAdd("stream", "*", map[string]string{"n": "1"})
+	stor.XGroupCreate("stream", "g", "0", false)
+	stor.XReadGroup("stream", "g", "c", 0)
+	for i := 0; i < 5000; i++ {
+		stor.Set("k"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	want, _ := stor.Snapshot()
+
+	dir := t.TempDir()
+	for _, c := range []saving.Compression{saving.CompressionNone, saving.CompressionGzip, saving.CompressionZstd} {
+		path := filepath.Join(dir, c.String()+".snap")
+		stor.SetSnapshotConfig(SnapshotConfig{Format: SnapshotBinary, Compression: c})
+		stor.SetPersister(saving.NewFilePersister(path, 0))
+		if err := stor.Save(); err != nil {
+			t.Fatalf("%s: save: %v", c, err)
+		}
+
+		data, _ := saving.NewFilePersister(path, 0).LatestVersion()
+		if !saving.IsBinarySnapshot(data) {
+			t.Fatalf("%s: not a binary snapshot", c)
+		}
+
+		restored, _ := NewSliceStorage(path)
+		if err := restored.Load(); err != nil {
+			t.Fatalf("%s: load: %v", c, err)
+		}
+		if got, _ := restored.Snapshot(); !bytes.Equal(got, want) {
+			t.Errorf("%s: contents differ after a round trip", c)
+		}
+		if n, _ := restored.ZRank("zset", "a", false); n != 1 {
+			t.Errorf("%s: sorted set order lost: %d", c, n)
+		}
+
+		if c != saving.CompressionNone {
+			continue
+		}
+
+		// A flipped bit or a missing tail is detected.
+		if err := restored.Restore(data[:len(data)-3]); !errors.Is(err, saving.ErrCorruptSnapshot) {
+			t.Errorf("truncated snapshot: %v", err)
+		}
+		corrupt := bytes.Clone(data)
+		corrupt[len(corrupt)/2] ^= 1
+		if err := restored.Restore(corrupt); !errors.Is(err, saving.ErrCorruptSnapshot) {
+			t.Errorf("flipped bit: %v", err)
+		}
+		if got, _ := restored.Snapshot(); !bytes.Equal(got, want) {
+			t.Error("failed restore changed the contents")
+		}
+	}
+
+	// A JSON file written before there were versions still loads.
+	path := filepath.Join(dir, "old.json")
+	stor.SetSnapshotConfig(SnapshotConfig{Format: SnapshotJSON})
+	var buf bytes.Buffer
+	stor.WriteSnapshot(&buf)
+	if !bytes.HasPrefix(buf.Bytes(), []byte("{")) {
+		t.Fatalf("not json: %q", buf.Bytes()[:10])
+	}
+	os.WriteFile(path, buf.Bytes(), 0644)
+	restored, _ := NewSliceStorage(path)
+	if err := restored.Load(); err != nil {
+		t.Fatalf("load json: %v", err)
+	}
+	if got, _ := restored.Snapshot(); !bytes.Equal(got, want) {
+		t.Error("contents differ after loading json")
+	}
+}
+
+func TestSnapshotCopyOnWrite(t *testing.T) {
+	stor, _ := NewSliceStorage("slice_storage.json")
+	for i := 0; i < 2000; i++ {
+		stor.Set("k"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	stor.RPush("list", []string{"a", "b"})
+	stor.HSet("map", []map[string]string{{"f": "v"}})
+	stor.SAdd("set", []string{"x"})
+	stor.ZAdd("zset", []ZMember{{Member: "a", Score: 1}})
+	stor.XAdd("stream", "1-1", map[string]string{"n": "1"})
+	stor.XGroupCreate("stream", "g", "0", false)
+	stor.XReadGroup("stream", "g", "c", 0)
+	want, _ := stor.Snapshot()
+
+	// Writes during the capture, between two batches, are not seen by it.
+	stor.saveMu.Lock()
+	written := false
+	inner := make(map[string]SliceValue)
+	_, err := stor.capture(nil, func(key string, val SliceValue) {
+		inner[key] = cloneValue(val)
+	}, func() error {
+		if written {
+			return nil
+		}
+		written = true
+
+		for i := 0; i < 2000; i += 3 {
+			stor.Set("k"+strconv.Itoa(i), `"changed"`)
+			stor.CheckIfExpired("k" + strconv.Itoa(i+1))
+		}
+		stor.Expire("k2", -1)
+		stor.CheckIfExpired("k2")
+		stor.Set("new", "1")
+		stor.RPush("list", []string{"c"})
+		stor.LSet("list", 0, "z")
+		stor.HSet("map", []map[string]string{{"f": "w", "g": "x"}})
+		stor.SAdd("set", []string{"y"})
+		stor.ZIncrBy("zset", "a", 5)
+		stor.XAdd("stream", "2-1", map[string]string{"n": "2"})
+		stor.XAck("stream", "g", []StreamID{{Ms: 1, Seq: 1}})
+		stor.LMove("list", "moved", Left, Right)
+		stor.SUnionStore("set", "set", "other")
+
+		tx := stor.Multi()
+		tx.Queue(TxOp{Op: "set", Key: "k5", Args: []string{`"tx"`}}, TxOp{Op: "set", Key: "txnew", Args: []string{"1"}})
+		if _, err := tx.Exec(); err != nil {
+			t.Errorf("exec: %v", err)
+		}
+		return nil
+	})
+	stor.saveMu.Unlock()
+	if err != nil {
+		t.Fatalf("capture: %v", err)
+	}
+
+	if got, _ := json.Marshal(inner); !bytes.Equal(got, want) {
+		t.Error("capture saw writes made after it started")
+	}
+	if !written {
+		t.Fatal("no writes during the capture")
+	}
+	if res, _ := stor.Get("new"); res != "1" {
+		t.Error("write during the capture lost")
+	}
+	for _, sh := range stor.shards {
+		if sh.snap != nil {
+			t.Fatal("shard still keeps copies after the capture")
+		}
+	}
+}
+
+func TestBackgroundSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	stor, _ := NewSliceStorage(path)
+	stor.SetSnapshotConfig(SnapshotConfig{Format: SnapshotBinary})
+	for i := 0; i < 1000; i++ {
+		stor.Set("k"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	started := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				stor.RPush("list", []string{strconv.Itoa(i)})
+				stor.HSet("map", []map[string]string{{strconv.Itoa(i % 100): "v"}})
+				stor.Set("k"+strconv.Itoa(i%1000), strconv.Itoa(i))
+			}
+			if i == 0 {
+				close(started)
+			}
+		}
+	}()
+	<-started
+
+	for i := 0; i < 5; i++ {
+		if err := stor.Save(); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	stor.saveMu.Lock()
+	if err := stor.BackgroundSave(); err != ErrSaveInProgress {
+		t.Errorf("overlapping save: %v", err)
+	}
+	stor.saveMu.Unlock()
+
+	if err := stor.BackgroundSave(); err != nil {
+		t.Fatalf("background save: %v", err)
+	}
+	for stor.SnapshotStats().Saves < 6 {
+		time.Sleep(time.Millisecond)
+	}
+
+	stats := stor.SnapshotStats()
+	if stats.Skipped != 1 || stats.Failures != 0 || stats.LastKeys != 1002 || stats.LastStartedAt == 0 {
+		t.Errorf("stats: %+v", stats)
+	}
+
+	want, _ := stor.Snapshot()
+	restored, _ := NewSliceStorage(path)
+	if err := restored.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got, _ := restored.Snapshot(); !bytes.Equal(got, want) {
+		t.Error("background save differs from the contents")
+	}
+}
+
+// memKeyStore stands in for PostgreSQL in tests.
+type memKeyStore struct {
+	mu       sync.Mutex
+	rows     map[string]saving.KeyRow
+	upserted []string
+	deleted  []string
+	replaced int
+	fail     error
+}
+
+func newMemKeyStore() *memKeyStore {
+	return &memKeyStore{rows: make(map[string]saving.KeyRow)}
+}
+
+func (m *memKeyStore) WriteKeys(upserts []saving.KeyRow, deletes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return m.fail
+	}
+
+	m.upserted, m.deleted = nil, deletes
+	for _, row := range upserts {
+		m.rows[row.Key] = row
+		m.upserted = append(m.upserted, row.Key)
+	}
+	for _, key := range deletes {
+		delete(m.rows, key)
+	}
+	return nil
+}
+
+func (m *memKeyStore) ReplaceKeys(rows []saving.KeyRow) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return m.fail
+	}
+
+	m.replaced++
+	m.rows = make(map[string]saving.KeyRow)
+	for _, row := range rows {
+		m.rows[row.Key] = row
+	}
+	return nil
+}
+
+func (m *memKeyStore) ScanKeys(fn func(row saving.KeyRow) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, row := range m.rows {
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memKeyStore) Close() error {
+	return nil
+}
+
+func TestKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	stor, _ := NewSliceStorage(path)
+	if _, err := stor.FlushKeys(); err != ErrNoKeyStore {
+		t.Errorf("flush without a key store: %v", err)
+	}
+
+	ks := newMemKeyStore()
+	stor.Set("a", "1")
+	stor.SetKeyStore(ks)
+	stor.Set("b", `"two"`)
+	stor.Expire("b", 100)
+	stor.ZAdd("z", []ZMember{{Member: "m", Score: 1.5}})
+
+	// The first flush writes everything, later ones only what changed.
+	if n, err := stor.FlushKeys(); err != nil || n != 3 || ks.replaced != 1 || len(ks.rows) != 3 {
+		t.Fatalf("first flush: %d %v, %d rows", n, err, len(ks.rows))
+	}
+	if row := ks.rows["b"]; row.Kind != string(KindString) || row.ExpiresAt == 0 {
+		t.Errorf("row: %+v", row)
+	}
+
+	stor.Set("a", "2")
+	stor.Set("c", "3")
+	stor.Expire("b", -1)
+	stor.CheckIfExpired("b")
+	if n, err := stor.FlushKeys(); err != nil || n != 3 {
+		t.Fatalf("flush: %d %v", n, err)
+	}
+	slices.Sort(ks.upserted)
+	if !slices.Equal(ks.upserted, []string{"a", "c"}) || !slices.Equal(ks.deleted, []string{"b"}) {
+		t.Errorf("upserted %v, deleted %v", ks.upserted, ks.deleted)
+	}
+	if n, _ := stor.FlushKeys(); n != 0 {
+		t.Errorf("flush without changes wrote %d keys", n)
+	}
+
+	// A failed flush is retried by the next one.
+	ks.fail = errors.New("down")
+	stor.Set("a", "4")
+	if _, err := stor.FlushKeys(); err == nil {
+		t.Fatal("failure not reported")
+	}
+	ks.fail = nil
+	if n, _ := stor.FlushKeys(); n != 1 || !strings.Contains(string(ks.rows["a"].Payload), `"4"`) {
+		t.Errorf("retry: %d %s", n, ks.rows["a"].Payload)
+	}
+
+	// Warm start, with a key that expired while the storage was down.
+	ks.rows["gone"] = saving.KeyRow{Key: "gone", Kind: string(KindInt), ExpiresAt: 1, Payload: []byte(`{"Kind":"D","St":"1"}`)}
+	loaded, _ := NewSliceStorage(path)
+	loaded.SetKeyStore(ks)
+	if err := loaded.LoadKeys(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	want, _ := stor.Snapshot()
+	if got, _ := loaded.Snapshot(); !bytes.Equal(got, want) {
+		t.Errorf("loaded %s, want %s", got, want)
+	}
+	if n, _ := loaded.FlushKeys(); n != 1 || !slices.Equal(ks.deleted, []string{"gone"}) || ks.replaced != 1 {
+		t.Errorf("expired key: %d, deleted %v", n, ks.deleted)
+	}
+
+	// Replacing the contents rewrites the store.
+	if err := loaded.Restore([]byte(`{"x":{"Kind":"D","St":"5"}}`)); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if n, _ := loaded.FlushKeys(); n != 1 || ks.replaced != 2 || len(ks.rows) != 1 {
+		t.Errorf("after restore: %d, %d rows", n, len(ks.rows))
+	}
+}
+
+func TestPeriodicFlushKeysOnClose(t *testing.T) {
+	ks := newMemKeyStore()
+	stor, _ := NewSliceStorage(filepath.Join(t.TempDir(), "storage.json"))
+	stor.SetKeyStore(ks)
+	stor.Set("a", "1")
+
+	closeChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		stor.PeriodicFlushKeys(closeChan, time.Hour)
+		close(done)
+	}()
+	close(closeChan)
+	<-done
+
+	if _, ok := ks.rows["a"]; !ok {
+		t.Error("keys not flushed on close")
+	}
+}
+
+func TestKeyStoreWAL(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "storage.wal")
+	ks := newMemKeyStore()
+	stor, _ := NewSliceStorage(filepath.Join(dir, "storage.json"))
+	stor.SetKeyStore(ks)
+	if err := stor.OpenWAL(walPath, saving.SyncAlways); err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+
+	stor.Set("n", "1")
+	stor.RPush("list", []string{"a"})
+	if _, err := stor.FlushKeys(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if info, _ := os.Stat(walPath); info.Size() != 0 {
+		t.Errorf("wal keeps %d bytes of flushed changes", info.Size())
+	}
+
+	// Changes after the last flush survive a crash, and flushed ones are
+	// not applied twice.
+	stor.IncrBy("n", 2)
+	stor.RPush("list", []string{"b"})
+	stor.CloseWAL()
+
+	restored, _ := NewSliceStorage(filepath.Join(dir, "storage.json"))
+	restored.SetKeyStore(ks)
+	if err := restored.LoadKeys(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := restored.OpenWAL(walPath, saving.SyncAlways); err != nil {
+		t.Fatalf("replay wal: %v", err)
+	}
+	defer restored.CloseWAL()
+
+	want, _ := stor.Snapshot()
+	if got, _ := restored.Snapshot(); !bytes.Equal(got, want) {
+		t.Errorf("restored %s, want %s", got, want)
+	}
+	if n, err := restored.FlushKeys(); err != nil || n != 2 || !strings.Contains(string(ks.rows["n"].Payload), `"3"`) {
+		t.Errorf("flush of replayed keys: %d %v %s", n, err, ks.rows["n"].Payload)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracing.Record()
+	path := filepath.Join(t.TempDir(), "snapshot")
+	stor, _ := NewSliceStorage(path)
+	stor.Set("a", "1")
+	stor.Set("b", `"x"`)
+	if err := stor.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := stor.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	save, write := spans["storage.save"], spans["saving.WriteVersion"]
+	if write.Parent.SpanID() != save.SpanContext.SpanID() {
+		t.Fatalf("persister span is not a child of the save: %v", slices.Collect(maps.Keys(spans)))
+	}
+	if !slices.Contains(write.Attributes, attribute.String("saving.backend", "*saving.FilePersister")) {
+		t.Errorf("backend: %v", write.Attributes)
+	}
+	if !slices.Contains(save.Attributes, attribute.Int("storage.keys", 2)) ||
+		!slices.Contains(save.Attributes, attribute.Int64("storage.bytes", stor.SnapshotStats().LastBytes)) {
+		t.Errorf("save attributes: %v", save.Attributes)
+	}
+	if stor.SnapshotStats().LastBytes == 0 {
+		t.Error("snapshot size not counted")
+	}
+
+	if spans["saving.LatestVersion"].Parent.SpanID() != spans["storage.load"].SpanContext.SpanID() {
+		t.Error("persister span is not a child of the load")
+	}
+}
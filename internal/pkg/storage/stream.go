@@ -0,0 +1,676 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidStreamID  = errors.New("invalid stream id")
+	ErrStreamIDTooSmall = errors.New("id is equal or smaller than the last id of the stream")
+	ErrNoStream         = errors.New("no such stream")
+	ErrNoGroup          = errors.New("no such consumer group")
+	ErrGroupExists      = errors.New("consumer group already exists")
+)
+
+// StreamID orders the entries of a stream: milliseconds of the time the
+// entry was added and a sequence number within that millisecond.
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+var maxStreamID = StreamID{Ms: math.MaxUint64, Seq: math.MaxUint64}
+
+// ParseStreamID accepts "ms-seq" and "ms", which means "ms-0".
+func ParseStreamID(id string) (StreamID, error) {
+	ms, seq, found := strings.Cut(id, "-")
+	var res StreamID
+	var err error
+	if res.Ms, err = strconv.ParseUint(ms, 10, 64); err != nil {
+		return StreamID{}, ErrInvalidStreamID
+	}
+
+	if found {
+		if res.Seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+			return StreamID{}, ErrInvalidStreamID
+		}
+	}
+
+	return res, nil
+}
+
+// ParseStreamBound parses a bound of a range: "-" and "+" are the smallest
+// and the greatest id, and "ms" covers the whole millisecond.
+func ParseStreamBound(bound string, upper bool) (StreamID, error) {
+	switch bound {
+	case "-":
+		return StreamID{}, nil
+	case "+":
+		return maxStreamID, nil
+	}
+
+	id, err := ParseStreamID(bound)
+	if err == nil && upper && !strings.Contains(bound, "-") {
+		id.Seq = math.MaxUint64
+	}
+	return id, err
+}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+func (id StreamID) Less(other StreamID) bool {
+	return id.Ms < other.Ms || id.Ms == other.Ms && id.Seq < other.Seq
+}
+
+func (id StreamID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *StreamID) UnmarshalText(data []byte) error {
+	res, err := ParseStreamID(string(data))
+	if err != nil {
+		return err
+	}
+
+	*id = res
+	return nil
+}
+
+type StreamEntry struct {
+	ID     StreamID          `json:"id"`
+	Fields map[string]string `json:"fields"`
+}
+
+// Stream is an append-only log of entries in id order.
+type Stream struct {
+	Entries []StreamEntry             `json:"entries"`
+	LastID  StreamID                  `json:"last_id"`
+	Groups  map[string]*ConsumerGroup `json:"groups,omitempty"`
+}
+
+// ConsumerGroup delivers every entry to one of its consumers and keeps it
+// pending until the consumer acknowledges it.
+type ConsumerGroup struct {
+	LastDelivered StreamID                   `json:"last_delivered"`
+	Pending       map[StreamID]*PendingEntry `json:"pending"`
+}
+
+type PendingEntry struct {
+	Consumer    string `json:"consumer"`
+	DeliveredAt int64  `json:"delivered_at"`
+	Deliveries  int    `json:"deliveries"`
+}
+
+type PendingInfo struct {
+	ID         StreamID `json:"id"`
+	Consumer   string   `json:"consumer"`
+	Idle       int64    `json:"idle_ms"`
+	Deliveries int      `json:"deliveries"`
+}
+
+type GroupInfo struct {
+	Name          string         `json:"name"`
+	LastDelivered StreamID       `json:"last_delivered"`
+	Pending       int            `json:"pending"`
+	Consumers     map[string]int `json:"consumers"`
+}
+
+// search returns the index of the first entry not below id.
+func (st *Stream) search(id StreamID) int {
+	i, _ := slices.BinarySearchFunc(st.Entries, id, func(e StreamEntry, id StreamID) int {
+		switch {
+		case e.ID.Less(id):
+			return -1
+		case id.Less(e.ID):
+			return 1
+		}
+		return 0
+	})
+	return i
+}
+
+func (st *Stream) entry(id StreamID) (StreamEntry, bool) {
+	i := st.search(id)
+	if i < len(st.Entries) && st.Entries[i].ID == id {
+		return st.Entries[i], true
+	}
+
+	return StreamEntry{}, false
+}
+
+// sortedPending returns the pending ids of g in order.
+func (g *ConsumerGroup) sortedPending() []StreamID {
+	ids := make([]StreamID, 0, len(g.Pending))
+	for id := range g.Pending {
+		ids = append(ids, id)
+	}
+
+	slices.SortFunc(ids, func(a, b StreamID) int {
+		switch {
+		case a.Less(b):
+			return -1
+		case b.Less(a):
+			return 1
+		}
+		return 0
+	})
+	return ids
+}
+
+func (s *SliceStorage) getStream(key string) (*Stream, error) {
+	val, ok := s.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+
+	if val.Kind != KindStream {
+		return nil, ErrWrongKind
+	}
+
+	return val.Stream, nil
+}
+
+func (s *SliceStorage) getGroup(key, group string) (*Stream, *ConsumerGroup, error) {
+	st, err := s.getStream(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if st == nil {
+		return nil, nil, ErrNoStream
+	}
+
+	g, ok := st.Groups[group]
+	if !ok {
+		return nil, nil, ErrNoGroup
+	}
+
+	return st, g, nil
+}
+
+// XAdd appends an entry with the given fields. id is "*" to generate one
+// from the current time, or an explicit id greater than the last one.
+func (s *SliceStorage) XAdd(key, id string, fields map[string]string) (StreamID, error) {
+	if len(fields) == 0 {
+		return StreamID{}, errors.New("an entry needs at least one field")
+	}
+
+	rec := Record{Op: OpXAdd, Key: key, Vals: []string{id}, Maps: []map[string]string{fields},
+		Ints: []int64{time.Now().UnixMilli()}}
+	if s.proposer != nil {
+		return proposed[StreamID](s, rec)
+	}
+
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return StreamID{}, err
+	}
+	defer sh.mu.Unlock()
+
+	res, err := s.xadd(key, id, fields, rec.Ints[0])
+	if err != nil {
+		return StreamID{}, err
+	}
+
+	rec.Vals[0] = res.String()
+	s.appendRecord(rec)
+	return res, nil
+}
+
+func (s *SliceStorage) xadd(key, id string, fields map[string]string, now int64) (StreamID, error) {
+	st, err := s.getStream(key)
+	if err != nil {
+		return StreamID{}, err
+	}
+
+	var last StreamID
+	if st != nil {
+		last = st.LastID
+	}
+
+	var res StreamID
+	if id == "*" {
+		res = StreamID{Ms: max(uint64(max(now, 0)), last.Ms)}
+		if res.Ms == last.Ms {
+			if last.Seq == math.MaxUint64 {
+				return StreamID{}, ErrStreamIDTooSmall
+			}
+			res.Seq = last.Seq + 1
+		}
+	} else if res, err = ParseStreamID(id); err != nil {
+		return StreamID{}, err
+	}
+
+	if !last.Less(res) {
+		return StreamID{}, ErrStreamIDTooSmall
+	}
+
+	if st == nil {
+		st = &Stream{}
+		s.store(key, SliceValue{Kind: KindStream, Stream: st})
+	}
+
+	st.Entries = append(st.Entries, StreamEntry{ID: res, Fields: fields})
+	st.LastID = res
+	return res, nil
+}
+
+func (s *SliceStorage) XLen(key string) (int, error) {
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
+
+	st, err := s.getStream(key)
+	if err != nil || st == nil {
+		return 0, err
+	}
+
+	s.accessed(key)
+	return len(st.Entries), nil
+}
+
+// XRange returns up to count entries between start and end, both included;
+// count 0 returns all of them.
+func (s *SliceStorage) XRange(key string, start, end StreamID, count int) ([]StreamEntry, error) {
+	return s.xrange(key, start, end, count, false)
+}
+
+// XRevRange is XRange in reverse order.
+func (s *SliceStorage) XRevRange(key string, end, start StreamID, count int) ([]StreamEntry, error) {
+	return s.xrange(key, start, end, count, true)
+}
+
+func (s *SliceStorage) xrange(key string, start, end StreamID, count int, rev bool) ([]StreamEntry, error) {
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
+
+	res := []StreamEntry{}
+	st, err := s.getStream(key)
+	if err != nil || st == nil || end.Less(start) {
+		return res, err
+	}
+
+	s.accessed(key)
+	from := st.search(start)
+	to := from
+	for to < len(st.Entries) && !end.Less(st.Entries[to].ID) {
+		to++
+	}
+
+	entries := st.Entries[from:to]
+	if rev {
+		for i := len(entries) - 1; i >= 0 && (count <= 0 || len(res) < count); i-- {
+			res = append(res, entries[i])
+		}
+		return res, nil
+	}
+
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+	return append(res, entries...), nil
+}
+
+// XTrim removes the oldest entries, so that at most maxLen remain and none
+// is older than minID. A negative maxLen or a zero minID does not limit.
+func (s *SliceStorage) XTrim(key string, maxLen int, minID StreamID) (int, error) {
+	rec := Record{Op: OpXTrim, Key: key, Ints: []int64{int64(maxLen)}, Vals: []string{minID.String()}}
+	if s.proposer != nil {
+		return proposed[int](s, rec)
+	}
+
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+
+	res, err := s.xtrim(key, maxLen, minID)
+	if err != nil {
+		return 0, err
+	}
+
+	if res > 0 {
+		s.appendRecord(rec)
+	}
+	return res, nil
+}
+
+// XTrimAge is XTrim for entries added more than age ago.
+func (s *SliceStorage) XTrimAge(key string, age time.Duration) (int, error) {
+	minMs := time.Now().Add(-age).UnixMilli()
+	return s.XTrim(key, -1, StreamID{Ms: uint64(max(minMs, 0))})
+}
+
+func (s *SliceStorage) xtrim(key string, maxLen int, minID StreamID) (int, error) {
+	st, err := s.getStream(key)
+	if err != nil || st == nil {
+		return 0, err
+	}
+
+	n := st.search(minID)
+	if maxLen >= 0 && len(st.Entries)-n > maxLen {
+		n = len(st.Entries) - maxLen
+	}
+
+	if n > 0 {
+		// Copy, so that the trimmed entries can be collected.
+		st.Entries = slices.Clone(st.Entries[n:])
+	}
+	return n, nil
+}
+
+// XGroupCreate creates a consumer group that delivers entries after start:
+// "$" for entries added from now on, "0" for all of them, or an id. With
+// mkStream a missing stream is created empty.
+func (s *SliceStorage) XGroupCreate(key, group, start string, mkStream bool) error {
+	rec := Record{Op: OpXGroupCreate, Key: key, Vals: []string{group, start}}
+	if mkStream {
+		rec.Ints = []int64{1}
+	}
+
+	if s.proposer != nil {
+		_, err := s.proposer.Propose(rec)
+		return err
+	}
+
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+
+	if err := s.xgroupCreate(key, group, start, mkStream); err != nil {
+		return err
+	}
+
+	s.appendRecord(rec)
+	return nil
+}
+
+func (s *SliceStorage) xgroupCreate(key, group, start string, mkStream bool) error {
+	st, err := s.getStream(key)
+	if err != nil {
+		return err
+	}
+
+	if st == nil {
+		if !mkStream {
+			return ErrNoStream
+		}
+
+		st = &Stream{}
+		s.store(key, SliceValue{Kind: KindStream, Stream: st})
+	}
+
+	if _, ok := st.Groups[group]; ok {
+		return ErrGroupExists
+	}
+
+	last := st.LastID
+	if start != "$" {
+		if last, err = ParseStreamID(start); err != nil {
+			return err
+		}
+	}
+
+	if st.Groups == nil {
+		st.Groups = make(map[string]*ConsumerGroup)
+	}
+	st.Groups[group] = &ConsumerGroup{LastDelivered: last, Pending: make(map[StreamID]*PendingEntry)}
+	return nil
+}
+
+// XReadGroup delivers up to count entries the group has not delivered yet
+// to consumer; they stay pending until they are acknowledged.
+func (s *SliceStorage) XReadGroup(key, group, consumer string, count int) ([]StreamEntry, error) {
+	rec := Record{Op: OpXReadGroup, Key: key, Vals: []string{group, consumer},
+		Ints: []int64{int64(count), time.Now().UnixMilli()}}
+	if s.proposer != nil {
+		return proposed[[]StreamEntry](s, rec)
+	}
+
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+
+	res, err := s.xreadGroup(key, group, consumer, count, rec.Ints[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) > 0 {
+		s.appendRecord(rec)
+	}
+	return res, nil
+}
+
+func (s *SliceStorage) xreadGroup(key, group, consumer string, count int, now int64) ([]StreamEntry, error) {
+	st, g, err := s.getGroup(key, group)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []StreamEntry{}
+	for _, e := range st.Entries[st.search(g.LastDelivered):] {
+		if count > 0 && len(res) == count {
+			break
+		}
+		if e.ID == g.LastDelivered {
+			continue
+		}
+
+		g.Pending[e.ID] = &PendingEntry{Consumer: consumer, DeliveredAt: now, Deliveries: 1}
+		g.LastDelivered = e.ID
+		res = append(res, e)
+	}
+
+	return res, nil
+}
+
+// XAck acknowledges entries, so that they are not pending anymore, and
+// returns how many were pending.
+func (s *SliceStorage) XAck(key, group string, ids []StreamID) (int, error) {
+	rec := Record{Op: OpXAck, Key: key, Vals: []string{group}}
+	for _, id := range ids {
+		rec.Vals = append(rec.Vals, id.String())
+	}
+
+	if s.proposer != nil {
+		return proposed[int](s, rec)
+	}
+
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+
+	res, err := s.xack(key, group, ids)
+	if err != nil {
+		return 0, err
+	}
+
+	if res > 0 {
+		s.appendRecord(rec)
+	}
+	return res, nil
+}
+
+func (s *SliceStorage) xack(key, group string, ids []StreamID) (int, error) {
+	_, g, err := s.getGroup(key, group)
+	if err != nil {
+		return 0, err
+	}
+
+	var res int
+	for _, id := range ids {
+		if _, ok := g.Pending[id]; ok {
+			delete(g.Pending, id)
+			res++
+		}
+	}
+
+	return res, nil
+}
+
+// XAutoClaim hands up to count entries that have been pending for at least
+// minIdle over to consumer, e.g. because their consumer died, and returns
+// them. Pending entries that were trimmed away are dropped.
+func (s *SliceStorage) XAutoClaim(key, group, consumer string, minIdle time.Duration, count int) ([]StreamEntry, error) {
+	rec := Record{Op: OpXAutoClaim, Key: key, Vals: []string{group, consumer},
+		Ints: []int64{minIdle.Milliseconds(), int64(count), time.Now().UnixMilli()}}
+	if s.proposer != nil {
+		return proposed[[]StreamEntry](s, rec)
+	}
+
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+
+	res, changed, err := s.xautoClaim(key, group, consumer, rec.Ints[0], count, rec.Ints[2])
+	if err != nil {
+		return nil, err
+	}
+
+	if changed {
+		s.appendRecord(rec)
+	}
+	return res, nil
+}
+
+func (s *SliceStorage) xautoClaim(key, group, consumer string, minIdle int64, count int, now int64) ([]StreamEntry, bool, error) {
+	st, g, err := s.getGroup(key, group)
+	if err != nil {
+		return nil, false, err
+	}
+
+	res := []StreamEntry{}
+	var changed bool
+	for _, id := range g.sortedPending() {
+		if count > 0 && len(res) == count {
+			break
+		}
+
+		p := g.Pending[id]
+		if now-p.DeliveredAt < minIdle {
+			continue
+		}
+
+		changed = true
+		e, ok := st.entry(id)
+		if !ok {
+			delete(g.Pending, id)
+			continue
+		}
+
+		p.Consumer = consumer
+		p.DeliveredAt = now
+		p.Deliveries++
+		res = append(res, e)
+	}
+
+	return res, changed, nil
+}
+
+// XPending lists the pending entries of group in id order, only those of
+// consumer unless it is empty.
+func (s *SliceStorage) XPending(key, group, consumer string) ([]PendingInfo, error) {
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
+
+	_, g, err := s.getGroup(key, group)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	res := []PendingInfo{}
+	for _, id := range g.sortedPending() {
+		p := g.Pending[id]
+		if consumer != "" && p.Consumer != consumer {
+			continue
+		}
+
+		res = append(res, PendingInfo{ID: id, Consumer: p.Consumer, Idle: max(now-p.DeliveredAt, 0),
+			Deliveries: p.Deliveries})
+	}
+
+	return res, nil
+}
+
+func (s *SliceStorage) XGroups(key string) ([]GroupInfo, error) {
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
+
+	st, err := s.getStream(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if st == nil {
+		return nil, ErrNoStream
+	}
+
+	res := []GroupInfo{}
+	for name, g := range st.Groups {
+		info := GroupInfo{Name: name, LastDelivered: g.LastDelivered, Pending: len(g.Pending),
+			Consumers: make(map[string]int)}
+		for _, p := range g.Pending {
+			info.Consumers[p.Consumer]++
+		}
+		res = append(res, info)
+	}
+
+	slices.SortFunc(res, func(a, b GroupInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return res, nil
+}
+
+// applyStream performs the stream records for apply.
+func (s *SliceStorage) applyStream(rec Record) (any, error) {
+	switch rec.Op {
+	case OpXAdd:
+		if len(rec.Vals) != 1 || len(rec.Maps) != 1 || len(rec.Ints) != 1 {
+			return nil, errBrokenRecord
+		}
+		return s.xadd(rec.Key, rec.Vals[0], rec.Maps[0], rec.Ints[0])
+	case OpXTrim:
+		if len(rec.Vals) != 1 || len(rec.Ints) != 1 {
+			return nil, errBrokenRecord
+		}
+		minID, err := ParseStreamID(rec.Vals[0])
+		if err != nil {
+			return nil, err
+		}
+		return s.xtrim(rec.Key, int(rec.Ints[0]), minID)
+	case OpXGroupCreate:
+		if len(rec.Vals) != 2 {
+			return nil, errBrokenRecord
+		}
+		return nil, s.xgroupCreate(rec.Key, rec.Vals[0], rec.Vals[1], len(rec.Ints) == 1 && rec.Ints[0] == 1)
+	case OpXReadGroup:
+		if len(rec.Vals) != 2 || len(rec.Ints) != 2 {
+			return nil, errBrokenRecord
+		}
+		return s.xreadGroup(rec.Key, rec.Vals[0], rec.Vals[1], int(rec.Ints[0]), rec.Ints[1])
+	case OpXAck:
+		if len(rec.Vals) == 0 {
+			return nil, errBrokenRecord
+		}
+		ids := make([]StreamID, 0, len(rec.Vals)-1)
+		for _, v := range rec.Vals[1:] {
+			id, err := ParseStreamID(v)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		return s.xack(rec.Key, rec.Vals[0], ids)
+	case OpXAutoClaim:
+		if len(rec.Vals) != 2 || len(rec.Ints) != 3 {
+			return nil, errBrokenRecord
+		}
+		res, _, err := s.xautoClaim(rec.Key, rec.Vals[0], rec.Vals[1], rec.Ints[0], int(rec.Ints[1]), rec.Ints[2])
+		return res, err
+	}
+
+	return nil, fmt.Errorf("unknown stream operation %s", rec.Op)
+}
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"proj1/internal/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = tracing.Tracer("storage")
+
+// persist runs fn, a call to a persistence backend, in a span of its own,
+// so that a slow database shows apart from the work of the storage.
+func persist(ctx context.Context, op string, backend any, fn func() error) error {
+	_, span := tracer.Start(ctx, "saving."+op, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("saving.backend", fmt.Sprintf("%T", backend))))
+	err := fn()
+	endSpan(span, err)
+	return err
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,371 @@
+package storage
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+var ErrTxAborted = errors.New("transaction aborted: watched key has changed")
+
+type TxOp struct {
+	Op   string   `json:"op"`
+	Key  string   `json:"key"`
+	Args []string `json:"args,omitempty"`
+}
+
+type TxResult struct {
+	Result any    `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Tx queues operations that are executed atomically by Exec. Keys passed to
+// Watch make Exec fail with ErrTxAborted if they were modified in between.
+type Tx struct {
+	storage *SliceStorage
+	watched map[string]uint64
+	ops     []TxOp
+}
+
+func (s *SliceStorage) touch(key string) {
+	if key == "" {
+		return
+	}
+
+	sh := s.shardFor(key)
+	sh.versions[key] = s.epoch + s.version.Add(1)
+	if sh.dirty != nil {
+		sh.dirty[key] = struct{}{}
+	}
+}
+
+// touchAll is used when the whole contents are replaced, so that every
+// outstanding watch is invalidated.
+func (s *SliceStorage) touchAll() {
+	// Keys that are gone now are not known any more, so the key store is
+	// rewritten as a whole.
+	s.resync = s.keyStore != nil
+	for _, sh := range s.shards {
+		for key := range sh.versions {
+			s.touch(key)
+		}
+
+		for key := range sh.inner {
+			s.touch(key)
+		}
+	}
+}
+
+// Versions returns the current version of every key, 0 for missing keys.
+func (s *SliceStorage) Versions(keys ...string) map[string]uint64 {
+	res := make(map[string]uint64, len(keys))
+	for _, key := range keys {
+		sh := s.rlockShard(key)
+		res[key] = sh.versions[key]
+		sh.mu.RUnlock()
+	}
+
+	return res
+}
+
+func (s *SliceStorage) Multi() *Tx {
+	return &Tx{storage: s, watched: make(map[string]uint64)}
+}
+
+func (tx *Tx) Watch(keys ...string) {
+	for key, v := range tx.storage.Versions(keys...) {
+		tx.watched[key] = v
+	}
+}
+
+// WatchVersions watches keys at versions previously returned by Versions.
+func (tx *Tx) WatchVersions(versions map[string]uint64) {
+	for key, v := range versions {
+		tx.watched[key] = v
+	}
+}
+
+func (tx *Tx) Queue(ops ...TxOp) {
+	tx.ops = append(tx.ops, ops...)
+}
+
+// Exec runs the queued operations with every shard locked. A failed
+// operation does not stop the following ones; its error is reported in the
+// corresponding result. All changes reach the wal as one record.
+func (tx *Tx) Exec() ([]TxResult, error) {
+	s := tx.storage
+	if s.proposer != nil {
+		return s.proposeTx(tx)
+	}
+
+	s.lockAll()
+	defer s.unlockAll()
+
+	for key, v := range tx.watched {
+		if s.shardFor(key).versions[key] != v {
+			return nil, ErrTxAborted
+		}
+	}
+
+	return s.execOps(tx.ops), nil
+}
+
+// execOps runs ops with every shard locked by the caller.
+func (s *SliceStorage) execOps(ops []TxOp) []TxResult {
+	var batch []Record
+	s.batch = &batch
+	res := make([]TxResult, len(ops))
+	for i, op := range ops {
+		val, err := s.execTxOp(op)
+		if err != nil {
+			res[i] = TxResult{Error: err.Error()}
+			continue
+		}
+
+		res[i] = TxResult{Result: val}
+	}
+	s.batch = nil
+
+	if len(batch) > 0 {
+		s.appendRecord(Record{Op: OpMulti, Batch: batch})
+	}
+	return res
+}
+
+func (s *SliceStorage) execTxOp(op TxOp) (any, error) {
+	// With a proposer expired keys are deleted through the log beforehand;
+	// the clocks of the nodes must not matter here.
+	if val, ok := s.lookup(op.Key); ok && s.proposer == nil && val.Expires_at != 0 && time.Now().UnixMilli() >= val.Expires_at {
+		s.remove(op.Key)
+		s.appendRecord(Record{Op: OpDel, Key: op.Key, Reason: ReasonExpired})
+	}
+
+	switch op.Op {
+	case "get", "hget", "lget", "llen", "scard", "sismember", "smembers", "zscore", "zcard":
+		return s.readTxOp(op)
+	}
+
+	rec, err := txRecord(op)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case s.proposer != nil:
+	case rec.Op == OpDel, rec.Op == OpLPop, rec.Op == OpRPop, rec.Op == OpSRem, rec.Op == OpZRem, rec.Op == OpExpireAt:
+	default:
+		if err := s.reserve(rec.Key, true); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := s.apply(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	s.appendRecord(rec)
+	return res, nil
+}
+
+func txArgs(op TxOp, n int) error {
+	if len(op.Args) != n {
+		return errors.New("wrong number of arguments for " + op.Op)
+	}
+
+	return nil
+}
+
+// txRecord converts a queued mutating operation into the record that
+// performs it.
+func txRecord(op TxOp) (Record, error) {
+	rec := Record{Op: Op(op.Op), Key: op.Key}
+	switch rec.Op {
+	case OpSet:
+		if err := txArgs(op, 1); err != nil {
+			return rec, err
+		}
+		rec.Vals = op.Args
+	case OpLPush, OpRPush, OpSAdd, OpSRem, OpZRem:
+		if len(op.Args) == 0 {
+			return rec, errors.New("wrong number of arguments for " + op.Op)
+		}
+		rec.Vals = op.Args
+	case OpDel:
+		if err := txArgs(op, 0); err != nil {
+			return rec, err
+		}
+	case OpHSet:
+		if len(op.Args) == 0 || len(op.Args)%2 != 0 {
+			return rec, errors.New("wrong number of arguments for " + op.Op)
+		}
+		fields := make(map[string]string)
+		for i := 0; i < len(op.Args); i += 2 {
+			fields[op.Args[i]] = op.Args[i+1]
+		}
+		rec.Maps = []map[string]string{fields}
+	case OpLPop, OpRPop:
+		count := 1
+		if len(op.Args) > 0 {
+			n, err := strconv.Atoi(op.Args[0])
+			if err != nil || n < 0 {
+				return rec, ErrNotInteger
+			}
+			count = n
+		}
+		rec.Ints = []int64{int64(count)}
+	case OpLSet:
+		if err := txArgs(op, 2); err != nil {
+			return rec, err
+		}
+		index, err := strconv.ParseInt(op.Args[0], 10, 64)
+		if err != nil {
+			return rec, ErrNotInteger
+		}
+		rec.Ints = []int64{index}
+		rec.Vals = op.Args[1:]
+	case "expire":
+		if err := txArgs(op, 1); err != nil {
+			return rec, err
+		}
+		seconds, err := strconv.ParseInt(op.Args[0], 10, 64)
+		if err != nil {
+			return rec, ErrNotInteger
+		}
+		rec.Op = OpExpireAt
+		rec.Ints = []int64{time.Now().UnixMilli() + seconds*1000}
+	case OpExpireAt:
+		if err := txArgs(op, 1); err != nil {
+			return rec, err
+		}
+		at, err := strconv.ParseInt(op.Args[0], 10, 64)
+		if err != nil {
+			return rec, ErrNotInteger
+		}
+		rec.Ints = []int64{at}
+	case OpIncrBy, OpHIncrBy:
+		if len(op.Args) == 0 {
+			return rec, errors.New("wrong number of arguments for " + op.Op)
+		}
+		delta, err := strconv.ParseInt(op.Args[len(op.Args)-1], 10, 64)
+		if err != nil {
+			return rec, ErrNotInteger
+		}
+		rec.Ints = []int64{delta}
+		if rec.Op == OpHIncrBy {
+			if err := txArgs(op, 2); err != nil {
+				return rec, err
+			}
+			rec.Vals = op.Args[:1]
+		}
+	case OpIncrByFloat, OpHIncrByFloat, OpZIncrBy:
+		if len(op.Args) == 0 {
+			return rec, errors.New("wrong number of arguments for " + op.Op)
+		}
+		delta, err := strconv.ParseFloat(op.Args[len(op.Args)-1], 64)
+		if err != nil {
+			return rec, ErrNotFloat
+		}
+		rec.Floats = []float64{delta}
+		if rec.Op != OpIncrByFloat {
+			if err := txArgs(op, 2); err != nil {
+				return rec, err
+			}
+			rec.Vals = op.Args[:1]
+		}
+	case OpZAdd:
+		if len(op.Args) == 0 || len(op.Args)%2 != 0 {
+			return rec, errors.New("wrong number of arguments for " + op.Op)
+		}
+		for i := 0; i < len(op.Args); i += 2 {
+			score, err := strconv.ParseFloat(op.Args[i+1], 64)
+			if err != nil {
+				return rec, ErrInvalidScore
+			}
+			rec.Vals = append(rec.Vals, op.Args[i])
+			rec.Floats = append(rec.Floats, score)
+		}
+	default:
+		return rec, errors.New("unsupported operation " + op.Op)
+	}
+
+	return rec, nil
+}
+
+func (s *SliceStorage) readTxOp(op TxOp) (any, error) {
+	val, ok := s.lookup(op.Key)
+	switch op.Op {
+	case "get":
+		if !ok {
+			return nil, nil
+		}
+		if val.Kind != KindString && val.Kind != KindInt {
+			return nil, ErrWrongKind
+		}
+		return val.St, nil
+	case "hget":
+		if err := txArgs(op, 1); err != nil {
+			return nil, err
+		}
+		if ok && val.Kind != KindMapInt && val.Kind != KindMapStr {
+			return nil, ErrWrongKind
+		}
+		if v, ok := val.Mint[op.Args[0]]; ok {
+			return strconv.Itoa(v), nil
+		}
+		if v, ok := val.Mstr[op.Args[0]]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "lget":
+		if err := txArgs(op, 1); err != nil {
+			return nil, err
+		}
+		index, err := strconv.Atoi(op.Args[0])
+		if err != nil {
+			return nil, ErrNotInteger
+		}
+		if index < 0 {
+			index += len(val.StSl)
+		}
+		if index < 0 || index >= len(val.StSl) {
+			return nil, nil
+		}
+		return val.StSl[index], nil
+	case "llen":
+		return len(val.StSl), nil
+	case "scard", "sismember", "smembers":
+		set, err := s.getSet(op.Key)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "scard" {
+			return len(set), nil
+		}
+		if op.Op == "smembers" {
+			return setToSlice(set), nil
+		}
+		if err := txArgs(op, 1); err != nil {
+			return nil, err
+		}
+		_, ok := set[op.Args[0]]
+		return ok, nil
+	case "zscore", "zcard":
+		zset, err := s.getZSet(op.Key)
+		if err != nil || zset == nil {
+			return nil, err
+		}
+		if op.Op == "zcard" {
+			return zset.Len(), nil
+		}
+		if err := txArgs(op, 1); err != nil {
+			return nil, err
+		}
+		if score, ok := zset.scores[op.Args[0]]; ok {
+			return score, nil
+		}
+		return nil, nil
+	}
+
+	return nil, errors.New("unsupported operation " + op.Op)
+}
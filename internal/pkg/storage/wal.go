@@ -0,0 +1,386 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"proj1/internal/pkg/saving"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type Op string
+
+const (
+	OpSet              Op = "set"
+	OpHSet             Op = "hset"
+	OpLPush            Op = "lpush"
+	OpRPush            Op = "rpush"
+	OpRAddToSet        Op = "raddtoset"
+	OpLPop             Op = "lpop"
+	OpRPop             Op = "rpop"
+	OpLSet             Op = "lset"
+	OpLMove            Op = "lmove"
+	OpExpireAt         Op = "expireat"
+	OpDel              Op = "del"
+	OpSAdd             Op = "sadd"
+	OpSRem             Op = "srem"
+	OpSInterStore      Op = "sinterstore"
+	OpSUnionStore      Op = "sunionstore"
+	OpSDiffStore       Op = "sdiffstore"
+	OpZAdd             Op = "zadd"
+	OpZIncrBy          Op = "zincrby"
+	OpZRem             Op = "zrem"
+	OpZRemRangeByScore Op = "zremrangebyscore"
+	OpIncrBy           Op = "incrby"
+	OpIncrByFloat      Op = "incrbyfloat"
+	OpHIncrBy          Op = "hincrby"
+	OpHIncrByFloat     Op = "hincrbyfloat"
+	OpXAdd             Op = "xadd"
+	OpXTrim            Op = "xtrim"
+	OpXGroupCreate     Op = "xgroupcreate"
+	OpXReadGroup       Op = "xreadgroup"
+	OpXAck             Op = "xack"
+	OpXAutoClaim       Op = "xautoclaim"
+	OpRestore          Op = "restore"
+	OpFlush            Op = "flush"
+	OpMulti            Op = "multi"
+	// OpExec carries queued transaction operations through a Proposer; it
+	// is never written to the wal.
+	OpExec Op = "exec"
+)
+
+type Record struct {
+	Op     Op                  `json:"op"`
+	Key    string              `json:"k,omitempty"`
+	Vals   []string            `json:"v,omitempty"`
+	Maps   []map[string]string `json:"m,omitempty"`
+	Ints   []int64             `json:"i,omitempty"`
+	Floats []float64           `json:"f,omitempty"`
+	Value  *SliceValue         `json:"sv,omitempty"`
+	Batch  []Record            `json:"b,omitempty"`
+	Ops    []TxOp              `json:"ops,omitempty"`
+	// Reason tells why a key was deleted, e.g. ReasonExpired.
+	Reason string `json:"r,omitempty"`
+}
+
+func toInt64s(indexes []int) []int64 {
+	res := make([]int64, len(indexes))
+	for i, x := range indexes {
+		res[i] = int64(x)
+	}
+
+	return res
+}
+
+func toInts(indexes []int64) []int {
+	res := make([]int, len(indexes))
+	for i, x := range indexes {
+		res[i] = int(x)
+	}
+
+	return res
+}
+
+func (s *SliceStorage) appendRecord(rec Record) {
+	if rec.Reason == ReasonExpired {
+		s.expired.Add(1)
+	}
+	s.touch(rec.Key)
+	if rec.Key != "" {
+		s.trackWrite(rec.Key)
+	}
+	if rec.Op == OpLMove && len(rec.Vals) > 0 {
+		// The destination changes as well.
+		s.touch(rec.Vals[0])
+		s.trackWrite(rec.Vals[0])
+	}
+	if s.batch != nil {
+		*s.batch = append(*s.batch, rec)
+		return
+	}
+
+	s.notifyRecord(rec)
+	s.wakeRecord(rec)
+	if s.feed != nil {
+		s.feed.publish(rec)
+	}
+
+	if s.wal == nil {
+		return
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		s.logger.Error("Failed to marshal wal record", zap.Error(err))
+		return
+	}
+
+	if err = s.wal.Append(data); err != nil {
+		s.logger.Error("Failed to append wal record", zap.Error(err))
+	}
+}
+
+var errBrokenRecord = errors.New("broken record")
+
+// apply performs rec without taking the lock or writing to the wal and
+// returns the result the corresponding storage method would return.
+func (s *SliceStorage) apply(rec Record) (any, error) {
+	switch rec.Op {
+	case OpSet:
+		// SetScalar sends the value as it is stored.
+		if rec.Value != nil {
+			s.store(rec.Key, *rec.Value)
+			return "OK", nil
+		}
+		if len(rec.Vals) != 1 {
+			return nil, errBrokenRecord
+		}
+		return "OK", s.set(rec.Key, rec.Vals[0])
+	case OpHSet:
+		return s.hset(rec.Key, rec.Maps)
+	case OpLPush:
+		if err := s.lpush(rec.Key, rec.Vals); err != nil {
+			return nil, err
+		}
+		return len(s.value(rec.Key).StSl), nil
+	case OpRPush:
+		if err := s.rpush(rec.Key, rec.Vals); err != nil {
+			return nil, err
+		}
+		return len(s.value(rec.Key).StSl), nil
+	case OpRAddToSet:
+		s.raddToSet(rec.Key, rec.Vals)
+		return len(s.value(rec.Key).StSl), nil
+	case OpLPop, OpRPop:
+		if len(rec.Ints) == 0 {
+			return nil, errBrokenRecord
+		}
+		if rec.Op == OpLPop {
+			return s.lpop(rec.Key, toInts(rec.Ints)...), nil
+		}
+		return s.rpop(rec.Key, toInts(rec.Ints)...), nil
+	case OpLSet:
+		if len(rec.Vals) != 1 || len(rec.Ints) != 1 {
+			return nil, errBrokenRecord
+		}
+		return s.lset(rec.Key, int(rec.Ints[0]), rec.Vals[0])
+	case OpLMove:
+		if len(rec.Vals) != 3 {
+			return nil, errBrokenRecord
+		}
+		return s.lmove(rec.Key, rec.Vals[0], End(rec.Vals[1]), End(rec.Vals[2]))
+	case OpExpireAt:
+		if len(rec.Ints) != 1 {
+			return nil, errBrokenRecord
+		}
+		return s.expireAt(rec.Key, rec.Ints[0]), nil
+	case OpSAdd:
+		return s.sadd(rec.Key, rec.Vals)
+	case OpSRem:
+		return s.srem(rec.Key, rec.Vals)
+	case OpSInterStore, OpSUnionStore, OpSDiffStore:
+		return s.combineStore(rec.Op, rec.Key, rec.Vals)
+	case OpZAdd:
+		if len(rec.Vals) != len(rec.Floats) {
+			return nil, errBrokenRecord
+		}
+		members := make([]ZMember, len(rec.Vals))
+		for i := range rec.Vals {
+			members[i] = ZMember{Member: rec.Vals[i], Score: rec.Floats[i]}
+		}
+		return s.zadd(rec.Key, members)
+	case OpZIncrBy:
+		if len(rec.Vals) != 1 || len(rec.Floats) != 1 {
+			return nil, errBrokenRecord
+		}
+		return s.zincrBy(rec.Key, rec.Vals[0], rec.Floats[0])
+	case OpZRem:
+		return s.zrem(rec.Key, rec.Vals)
+	case OpZRemRangeByScore:
+		if len(rec.Vals) != 2 {
+			return nil, errBrokenRecord
+		}
+		min, err := ParseScoreBound(rec.Vals[0])
+		if err != nil {
+			return nil, err
+		}
+		max, err := ParseScoreBound(rec.Vals[1])
+		if err != nil {
+			return nil, err
+		}
+		return s.zremRangeByScore(rec.Key, min, max)
+	case OpIncrBy:
+		if len(rec.Ints) != 1 {
+			return nil, errBrokenRecord
+		}
+		return s.incrBy(rec.Key, rec.Ints[0])
+	case OpIncrByFloat:
+		if len(rec.Floats) != 1 {
+			return nil, errBrokenRecord
+		}
+		return s.incrByFloat(rec.Key, rec.Floats[0])
+	case OpHIncrBy:
+		if len(rec.Vals) != 1 || len(rec.Ints) != 1 {
+			return nil, errBrokenRecord
+		}
+		return s.hincrBy(rec.Key, rec.Vals[0], rec.Ints[0])
+	case OpHIncrByFloat:
+		if len(rec.Vals) != 1 || len(rec.Floats) != 1 {
+			return nil, errBrokenRecord
+		}
+		return s.hincrByFloat(rec.Key, rec.Vals[0], rec.Floats[0])
+	case OpXAdd, OpXTrim, OpXGroupCreate, OpXReadGroup, OpXAck, OpXAutoClaim:
+		return s.applyStream(rec)
+	case OpDel:
+		_, ok := s.lookup(rec.Key)
+		s.remove(rec.Key)
+		if ok {
+			return 1, nil
+		}
+		return 0, nil
+	case OpRestore:
+		if rec.Value == nil {
+			return nil, errBrokenRecord
+		}
+		s.store(rec.Key, *rec.Value)
+	case OpFlush:
+		s.replace(nil)
+	case OpMulti:
+		for _, sub := range rec.Batch {
+			s.apply(sub)
+		}
+	default:
+		return nil, errors.New("unknown operation")
+	}
+
+	return nil, nil
+}
+
+// OpenWAL replays the log at path on top of the current contents, then
+// compacts it so that the log alone describes the whole storage.
+func (s *SliceStorage) OpenWAL(path string, policy saving.SyncPolicy) error {
+	s.lockAll()
+	defer s.unlockAll()
+
+	if s.wal != nil {
+		return errors.New("wal is already open")
+	}
+
+	var replayed int
+	err := saving.ReadWAL(path, func(line []byte) error {
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return err
+		}
+
+		if _, err := s.apply(rec); err != nil {
+			s.logger.Info("skipping wal record", zap.String("op", string(rec.Op)), zap.Error(err))
+		}
+		if s.keyStore != nil {
+			s.trackReplayed(rec)
+		}
+		replayed++
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.logger.Error("Failed to replay wal", zap.Error(err))
+		return err
+	}
+
+	wal, err := saving.OpenWAL(path, policy)
+	if err != nil {
+		s.logger.Error("Failed to open wal", zap.Error(err))
+		return err
+	}
+
+	s.wal = wal
+	s.rebuildMeta()
+	s.logger.Info("wal replayed", zap.String("path", path), zap.Int("records", replayed))
+	return s.compactWAL()
+}
+
+// CompactWAL rewrites the log as the contents it describes. They are
+// captured like a background save and written out while writes go on; the
+// records of those writes are kept after them.
+func (s *SliceStorage) CompactWAL() error {
+	s.saveMu.Lock()
+	inner, info, err := s.captureContents(nil)
+	s.saveMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if info.wal == nil {
+		return errors.New("wal is not open")
+	}
+
+	records, err := walRecords(inner)
+	if err != nil {
+		return err
+	}
+
+	return info.wal.RewriteFrom(info.walMark, records)
+}
+
+// compactWAL is CompactWAL for callers that hold every shard lock anyway,
+// because they replace the contents.
+func (s *SliceStorage) compactWAL() error {
+	records, err := walRecords(s.contents())
+	if err != nil {
+		return err
+	}
+
+	return s.wal.Rewrite(records)
+}
+
+func walRecords(inner map[string]SliceValue) ([][]byte, error) {
+	flush, err := json.Marshal(Record{Op: OpFlush})
+	if err != nil {
+		return nil, err
+	}
+
+	records := [][]byte{flush}
+	for key, val := range inner {
+		data, err := json.Marshal(Record{Op: OpRestore, Key: key, Value: &val})
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, data)
+	}
+
+	return records, nil
+}
+
+func (s *SliceStorage) CloseWAL() error {
+	s.lockAll()
+	defer s.unlockAll()
+
+	if s.wal == nil {
+		return nil
+	}
+
+	err := s.wal.Close()
+	s.wal = nil
+	return err
+}
+
+func (s *SliceStorage) PeriodicCompact(closeChan chan struct{}, interval time.Duration, minSize int64) {
+	for {
+		select {
+		case <-closeChan:
+			return
+		case <-time.After(interval):
+			sh := s.shards[0]
+			sh.mu.RLock()
+			wal := s.wal
+			sh.mu.RUnlock()
+			if wal != nil && wal.Size() >= minSize {
+				if err := s.CompactWAL(); err != nil {
+					s.logger.Error("Failed to compact wal", zap.Error(err))
+				}
+			}
+		}
+	}
+}
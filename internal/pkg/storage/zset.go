@@ -0,0 +1,385 @@
+package storage
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidScore = errors.New("score is not a valid float")
+
+type ScoreBound struct {
+	Value     float64
+	Exclusive bool
+}
+
+// ParseScoreBound accepts the redis notation: a float, "-inf", "+inf" and a
+// leading "(" for an exclusive bound.
+func ParseScoreBound(bound string) (ScoreBound, error) {
+	var res ScoreBound
+	if strings.HasPrefix(bound, "(") {
+		res.Exclusive = true
+		bound = bound[1:]
+	}
+
+	v, err := strconv.ParseFloat(bound, 64)
+	if err != nil || math.IsNaN(v) {
+		return ScoreBound{}, errors.New("min or max is not a float")
+	}
+
+	res.Value = v
+	return res, nil
+}
+
+func (b ScoreBound) String() string {
+	res := strconv.FormatFloat(b.Value, 'g', -1, 64)
+	if b.Exclusive {
+		return "(" + res
+	}
+
+	return res
+}
+
+// below reports whether score satisfies b as a lower bound.
+func (b ScoreBound) below(score float64) bool {
+	if b.Exclusive {
+		return score > b.Value
+	}
+
+	return score >= b.Value
+}
+
+// above reports whether score satisfies b as an upper bound.
+func (b ScoreBound) above(score float64) bool {
+	if b.Exclusive {
+		return score < b.Value
+	}
+
+	return score <= b.Value
+}
+
+func validRange(min, max ScoreBound) bool {
+	if min.Value > max.Value {
+		return false
+	}
+
+	return min.Value != max.Value || (!min.Exclusive && !max.Exclusive)
+}
+
+func validScore(score float64) bool {
+	return !math.IsNaN(score) && !math.IsInf(score, 0)
+}
+
+func (s *SliceStorage) getZSet(key string) (*SortedSet, error) {
+	val, ok := s.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+
+	if val.Kind != KindSortedSet {
+		return nil, ErrWrongKind
+	}
+
+	return val.ZSet, nil
+}
+
+func (s *SliceStorage) ZAdd(key string, members []ZMember) (int, error) {
+	rec := Record{Op: OpZAdd, Key: key}
+	for _, m := range members {
+		rec.Vals = append(rec.Vals, m.Member)
+		rec.Floats = append(rec.Floats, m.Score)
+	}
+
+	if s.proposer != nil {
+		return proposed[int](s, rec)
+	}
+
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	defer sh.mu.Unlock()
+
+	c, err := s.zadd(key, members)
+	if err != nil {
+		return 0, err
+	}
+
+	s.appendRecord(rec)
+	return c, nil
+}
+
+func (s *SliceStorage) zadd(key string, members []ZMember) (int, error) {
+	for _, m := range members {
+		if !validScore(m.Score) {
+			return 0, ErrInvalidScore
+		}
+	}
+
+	zset, err := s.getZSet(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if zset == nil {
+		zset = newSortedSet()
+		s.store(key, SliceValue{Kind: KindSortedSet, ZSet: zset})
+	}
+
+	var added int
+	for _, m := range members {
+		if zset.add(m.Member, m.Score) {
+			added++
+		}
+	}
+
+	return added, nil
+}
+
+func (s *SliceStorage) ZIncrBy(key, member string, delta float64) (float64, error) {
+	if s.proposer != nil {
+		return proposed[float64](s, Record{Op: OpZIncrBy, Key: key, Vals: []string{member}, Floats: []float64{delta}})
+	}
+
+	sh, err := s.lockWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	defer sh.mu.Unlock()
+
+	res, err := s.zincrBy(key, member, delta)
+	if err != nil {
+		return 0, err
+	}
+
+	s.appendRecord(Record{Op: OpZIncrBy, Key: key, Vals: []string{member}, Floats: []float64{delta}})
+	return res, nil
+}
+
+func (s *SliceStorage) zincrBy(key, member string, delta float64) (float64, error) {
+	zset, err := s.getZSet(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var score float64
+	if zset != nil {
+		score = zset.scores[member]
+	}
+
+	score += delta
+	if !validScore(score) {
+		return 0, ErrInvalidScore
+	}
+
+	_, err = s.zadd(key, []ZMember{{Member: member, Score: score}})
+	return score, err
+}
+
+func (s *SliceStorage) ZRem(key string, members []string) (int, error) {
+	if s.proposer != nil {
+		return proposed[int](s, Record{Op: OpZRem, Key: key, Vals: members})
+	}
+
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+
+	c, err := s.zrem(key, members)
+	if err != nil {
+		return 0, err
+	}
+
+	if c > 0 {
+		s.appendRecord(Record{Op: OpZRem, Key: key, Vals: members})
+	}
+	return c, nil
+}
+
+func (s *SliceStorage) zrem(key string, members []string) (int, error) {
+	zset, err := s.getZSet(key)
+	if err != nil || zset == nil {
+		return 0, err
+	}
+
+	var removed int
+	for _, m := range members {
+		if zset.remove(m) {
+			removed++
+		}
+	}
+
+	if zset.Len() == 0 {
+		s.remove(key)
+	}
+
+	return removed, nil
+}
+
+func (s *SliceStorage) ZScore(key, member string) (float64, bool, error) {
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
+
+	s.accessed(key)
+	zset, err := s.getZSet(key)
+	if err != nil || zset == nil {
+		return 0, false, err
+	}
+
+	score, ok := zset.scores[member]
+	return score, ok, nil
+}
+
+func (s *SliceStorage) ZCard(key string) (int, error) {
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
+
+	s.accessed(key)
+	zset, err := s.getZSet(key)
+	if err != nil || zset == nil {
+		return 0, err
+	}
+
+	return zset.Len(), nil
+}
+
+// ZRank returns the 0-based rank of member, counted from the highest score
+// when rev is set, or -1 if there is no such member.
+func (s *SliceStorage) ZRank(key, member string, rev bool) (int, error) {
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
+
+	s.accessed(key)
+	zset, err := s.getZSet(key)
+	if err != nil || zset == nil {
+		return -1, err
+	}
+
+	rank := zset.rank(member)
+	if rank >= 0 && rev {
+		rank = zset.Len() - 1 - rank
+	}
+
+	return rank, nil
+}
+
+func (s *SliceStorage) ZRange(key string, start, stop int, rev bool) ([]ZMember, error) {
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
+
+	s.accessed(key)
+	res := []ZMember{}
+	zset, err := s.getZSet(key)
+	if err != nil || zset == nil {
+		return res, err
+	}
+
+	n := zset.Len()
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	start = max(start, 0)
+	stop = min(stop, n-1)
+	if start > stop || start >= n {
+		return res, nil
+	}
+
+	var x *zsetNode
+	if rev {
+		x = zset.byRank(n - 1 - start)
+	} else {
+		x = zset.byRank(start)
+	}
+
+	for i := start; i <= stop && x != nil; i++ {
+		res = append(res, ZMember{Member: x.member, Score: x.score})
+		if rev {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+
+	return res, nil
+}
+
+// ZRangeByScore returns members with scores between min and max, skipping
+// offset of them and returning at most count (all if count is negative).
+// With rev the members are walked from max down to min.
+func (s *SliceStorage) ZRangeByScore(key string, min, max ScoreBound, offset, count int, rev bool) ([]ZMember, error) {
+	sh := s.rlockShard(key)
+	defer sh.mu.RUnlock()
+
+	s.accessed(key)
+	res := []ZMember{}
+	zset, err := s.getZSet(key)
+	if err != nil || zset == nil {
+		return res, err
+	}
+
+	var x *zsetNode
+	if rev {
+		x = zset.lastInRange(min, max)
+	} else {
+		x = zset.firstInRange(min, max)
+	}
+
+	for x != nil {
+		if (rev && !min.below(x.score)) || (!rev && !max.above(x.score)) {
+			break
+		}
+
+		if offset > 0 {
+			offset--
+		} else {
+			if count >= 0 && len(res) == count {
+				break
+			}
+			res = append(res, ZMember{Member: x.member, Score: x.score})
+		}
+
+		if rev {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+
+	return res, nil
+}
+
+func (s *SliceStorage) ZRemRangeByScore(key string, min, max ScoreBound) (int, error) {
+	if s.proposer != nil {
+		return proposed[int](s, Record{Op: OpZRemRangeByScore, Key: key, Vals: []string{min.String(), max.String()}})
+	}
+
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+
+	c, err := s.zremRangeByScore(key, min, max)
+	if err != nil {
+		return 0, err
+	}
+
+	if c > 0 {
+		s.appendRecord(Record{Op: OpZRemRangeByScore, Key: key, Vals: []string{min.String(), max.String()}})
+	}
+	return c, nil
+}
+
+func (s *SliceStorage) zremRangeByScore(key string, min, max ScoreBound) (int, error) {
+	zset, err := s.getZSet(key)
+	if err != nil || zset == nil {
+		return 0, err
+	}
+
+	var members []string
+	for x := zset.firstInRange(min, max); x != nil && max.above(x.score); x = x.level[0].forward {
+		members = append(members, x.member)
+	}
+
+	return s.zrem(key, members)
+}
@@ -0,0 +1,156 @@
+// Package tracing sets up OpenTelemetry: spans of the HTTP handlers, the
+// storage and persistence are exported over OTLP, and W3C trace context is
+// taken from incoming and added to outgoing requests.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+const defaultService = "storage"
+
+// Config picks the exporter of spans. Endpoint is the OTLP/HTTP collector,
+// e.g. "http://localhost:4318"; empty means the OTEL_EXPORTER_OTLP_*
+// variables or their defaults. SampleRatio is the share of new traces that
+// are recorded, zero means all of them; traces started by a caller follow
+// its decision.
+type Config struct {
+	Exporter    string
+	Endpoint    string
+	ServiceName string
+	SampleRatio float64
+	// Writer receives the spans of the stdout exporter, os.Stdout if nil.
+	Writer io.Writer
+}
+
+func setPropagator() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// Setup installs the global tracer provider and the W3C propagators. The
+// returned function flushes the spans that are not exported yet and stops
+// the exporter.
+func Setup(cfg Config) (func(context.Context) error, error) {
+	setPropagator()
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			endpoint, err := tracesURL(cfg.Endpoint)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case ExporterStdout:
+		w := cfg.Writer
+		if w == nil {
+			w = os.Stdout
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, use otlp, stdout or none", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	service := cfg.ServiceName
+	if service == "" {
+		service = defaultService
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service)))
+	if err != nil {
+		return nil, err
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SampleRatio > 0 && cfg.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Record installs a provider that keeps every span in memory as soon as it
+// ends, for tests.
+func Record() *tracetest.InMemoryExporter {
+	setPropagator()
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	return exporter
+}
+
+// tracesURL adds the path of traces to the URL of a collector without one,
+// as OTEL_EXPORTER_OTLP_ENDPOINT does.
+func tracesURL(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("invalid OTLP endpoint %q, use e.g. http://localhost:4318", endpoint)
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return u.String(), nil
+}
+
+// Tracer returns the tracer of a package, e.g. "storage", from the global
+// provider, so that spans go wherever the latest Setup sends them.
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer("proj1/internal/pkg/" + name)
+}
+
+// Extract returns ctx with the trace context of the headers of an incoming
+// request.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Transport adds the trace context of a request's context to its headers,
+// so that calls to other nodes continue the trace.
+type Transport struct {
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if trace.SpanContextFromContext(req.Context()).IsValid() {
+		req = req.Clone(req.Context())
+		otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	}
+
+	return t.Base.RoundTrip(req)
+}
@@ -0,0 +1,77 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const traceparent = "00-4bf92f3577b34da6a3ce929b0e0e4736-00f067aa0ba902b7-01"
+
+func TestPropagation(t *testing.T) {
+	exporter := Record()
+
+	header := http.Header{"Traceparent": []string{traceparent}}
+	ctx, span := Tracer("test").Start(Extract(context.Background(), header), "incoming")
+
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Traceparent")
+	}))
+	defer ts.Close()
+
+	c := &http.Client{Transport: &Transport{Base: http.DefaultTransport}}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	if _, err := c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Fatalf("spans: %+v", spans)
+	}
+	sc := spans[0].SpanContext
+	if want := "00-" + sc.TraceID().String() + "-" + sc.SpanID().String() + "-01"; got != want || sc.TraceID().String() != "4bf92f3577b34da6a3ce929b0e0e4736" {
+		t.Errorf("outgoing traceparent %q, want %q", got, want)
+	}
+
+	// Requests outside of a trace are sent as they are.
+	got = ""
+	c.Get(ts.URL)
+	if got != "" {
+		t.Errorf("traceparent without a span: %q", got)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	if _, err := Setup(Config{Exporter: "jaeger"}); err == nil {
+		t.Error("unknown exporter accepted")
+	}
+	if _, err := Setup(Config{Exporter: ExporterOTLP, Endpoint: "localhost"}); err == nil {
+		t.Error("endpoint without a scheme accepted")
+	}
+	if u, _ := tracesURL("http://collector:4318"); u != "http://collector:4318/v1/traces" {
+		t.Errorf("traces url: %s", u)
+	}
+
+	var out bytes.Buffer
+	shutdown, err := Setup(Config{Exporter: ExporterStdout, ServiceName: "test-storage", Writer: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := Tracer("test").Start(context.Background(), "op", trace.WithSpanKind(trace.SpanKindInternal))
+	span.End()
+	if err = shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), `"Name":"op"`) || !strings.Contains(out.String(), "test-storage") {
+		t.Errorf("exported: %s", out.String())
+	}
+}
@@ -0,0 +1,325 @@
+// Package client is a Go client for the HTTP API of the storage server.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRetries    = 3
+	DefaultMinBackoff = 50 * time.Millisecond
+	DefaultMaxBackoff = 2 * time.Second
+)
+
+// Client calls a storage server. It is safe for concurrent use and keeps
+// connections to the server open between requests.
+type Client struct {
+	base       string
+	http       *http.Client
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	apiKey     string
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces the default http client, e.g. to configure TLS.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithAPIKey sends key as a bearer token with every request.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// WithRetries sets how many times an idempotent request failing with a
+// server error or a network error is repeated; 0 disables retries.
+func WithRetries(n int) Option {
+	return func(c *Client) {
+		c.retries = n
+	}
+}
+
+// WithBackoff sets the wait before the first retry, which doubles with
+// every further one up to max.
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Client) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// New returns a client of the server at baseURL, e.g. "http://localhost:8090".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid server url %q", baseURL)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 64
+	c := &Client{
+		base:       strings.TrimSuffix(baseURL, "/"),
+		http:       &http.Client{Transport: transport},
+		retries:    DefaultRetries,
+		minBackoff: DefaultMinBackoff,
+		maxBackoff: DefaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+// path joins escaped path segments.
+func path(segments ...string) string {
+	var b strings.Builder
+	for _, s := range segments {
+		b.WriteByte('/')
+		b.WriteString(url.PathEscape(s))
+	}
+
+	return b.String()
+}
+
+// Do sends a request to any route of the API, e.g. one without a method of
+// its own. p is the escaped path and body, unless nil, is sent as JSON. A
+// JSON response is decoded into out, if it is not nil; an empty one leaves
+// out unchanged. The request is sent once: after a lost response it can not
+// tell whether the server applied it.
+func (c *Client) Do(ctx context.Context, method, p string, query url.Values, body, out any) error {
+	return c.do(ctx, method, p, query, body, out, false)
+}
+
+// DoIdempotent is Do for requests that have the same effect when sent
+// twice, such as reads and sets but not pushes or pops. Server and network
+// errors are retried with exponential backoff until ctx is done.
+func (c *Client) DoIdempotent(ctx context.Context, method, p string, query url.Values, body, out any) error {
+	return c.do(ctx, method, p, query, body, out, true)
+}
+
+func (c *Client) do(ctx context.Context, method, p string, query url.Values, body, out any, idempotent bool) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	target := c.base + p
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	backoff := c.minBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, method, target, data, out)
+		var apiErr *Error
+		retry := errors.As(err, &apiErr) && apiErr.retryable() ||
+			err != nil && apiErr == nil && ctx.Err() == nil
+		if !retry || !idempotent || attempt >= c.retries {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, c.maxBackoff)
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, target string, data []byte, out any) error {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &Error{Status: resp.StatusCode}
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&msg) == nil {
+			apiErr.Message = msg.Error
+		}
+		return apiErr
+	}
+
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil && err != io.EOF {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+func ttlQuery(ttl time.Duration) url.Values {
+	if ttl <= 0 {
+		return nil
+	}
+
+	// The server counts whole seconds; round up, so that a key never lives
+	// shorter than asked.
+	seconds := (ttl + time.Second - 1) / time.Second
+	return url.Values{"exp": {strconv.FormatInt(int64(seconds), 10)}}
+}
+
+// Set stores a string value; a positive ttl makes it expire.
+func (c *Client) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return c.DoIdempotent(ctx, http.MethodPost, "/scalar/set"+path(key, `"`+value+`"`), ttlQuery(ttl), nil, nil)
+}
+
+// SetInt stores an integer value; a positive ttl makes it expire.
+func (c *Client) SetInt(ctx context.Context, key string, value int64, ttl time.Duration) error {
+	return c.DoIdempotent(ctx, http.MethodPost, "/scalar/set"+path(key, strconv.FormatInt(value, 10)), ttlQuery(ttl), nil, nil)
+}
+
+// Get returns the scalar at key, or ErrNotFound.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var res struct {
+		Value string `json:"value"`
+	}
+	if err := c.DoIdempotent(ctx, http.MethodGet, "/scalar/get"+path(key), nil, nil, &res); err != nil {
+		return "", err
+	}
+
+	return res.Value, nil
+}
+
+// HSet replaces the map at key with fields and returns their number.
+func (c *Client) HSet(ctx context.Context, key string, fields map[string]string) (int, error) {
+	var res int
+	err := c.DoIdempotent(ctx, http.MethodPost, "/map/hset"+path(key), nil, []map[string]string{fields}, &res)
+	return res, err
+}
+
+// HGet returns a field of the map at key, or ErrNotFound.
+func (c *Client) HGet(ctx context.Context, key, field string) (string, error) {
+	var res struct {
+		Value string `json:"value"`
+	}
+	if err := c.DoIdempotent(ctx, http.MethodGet, "/map/hget"+path(key, field), nil, nil, &res); err != nil {
+		return "", err
+	}
+
+	return res.Value, nil
+}
+
+// LPush prepends vals to the list at key. Pushes and pops are not retried.
+func (c *Client) LPush(ctx context.Context, key string, vals ...string) error {
+	return c.Do(ctx, http.MethodPost, "/slice/lpush"+path(key), nil, vals, nil)
+}
+
+// RPush appends vals to the list at key.
+func (c *Client) RPush(ctx context.Context, key string, vals ...string) error {
+	return c.Do(ctx, http.MethodPost, "/slice/rpush"+path(key), nil, vals, nil)
+}
+
+// LPop removes and returns the first count elements of the list at key, or
+// ErrNotFound if there are none.
+func (c *Client) LPop(ctx context.Context, key string, count int) ([]string, error) {
+	return c.pop(ctx, "lpop", key, url.Values{"start": {strconv.Itoa(count)}})
+}
+
+// LPopRange removes and returns the elements from start to end, both
+// included, counted from the head of the list.
+func (c *Client) LPopRange(ctx context.Context, key string, start, end int) ([]string, error) {
+	return c.pop(ctx, "lpop", key, url.Values{"start": {strconv.Itoa(start)}, "end": {strconv.Itoa(end)}})
+}
+
+// RPop removes and returns the last count elements of the list at key,
+// the last one first.
+func (c *Client) RPop(ctx context.Context, key string, count int) ([]string, error) {
+	return c.pop(ctx, "rpop", key, url.Values{"start": {strconv.Itoa(count)}})
+}
+
+// RPopRange is LPopRange counted from the tail of the list.
+func (c *Client) RPopRange(ctx context.Context, key string, start, end int) ([]string, error) {
+	return c.pop(ctx, "rpop", key, url.Values{"start": {strconv.Itoa(start)}, "end": {strconv.Itoa(end)}})
+}
+
+func (c *Client) pop(ctx context.Context, op, key string, query url.Values) ([]string, error) {
+	var res struct {
+		Result []string `json:"result"`
+	}
+	if err := c.Do(ctx, http.MethodGet, "/slice/"+op+path(key), query, nil, &res); err != nil {
+		return nil, err
+	}
+
+	return res.Result, nil
+}
+
+// LSet replaces the element at index of the list at key.
+func (c *Client) LSet(ctx context.Context, key string, index int, elem string) error {
+	return c.DoIdempotent(ctx, http.MethodPost, "/slice/slice/lset"+path(key, strconv.Itoa(index), elem), nil, nil, nil)
+}
+
+// LGet returns the element at index of the list at key; negative indexes
+// count from the tail.
+func (c *Client) LGet(ctx context.Context, key string, index int) (string, error) {
+	var res string
+	err := c.DoIdempotent(ctx, http.MethodGet, "/slice/slice/lget"+path(key, strconv.Itoa(index)), nil, nil, &res)
+	return res, err
+}
+
+// Expire makes key expire after ttl, rounded up to whole seconds.
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	seconds := ttlQuery(ttl).Get("exp")
+	if seconds == "" {
+		return errors.New("ttl must be positive")
+	}
+
+	return c.DoIdempotent(ctx, http.MethodPost, "/any/expire"+path(key, seconds), nil, nil, nil)
+}
+
+// Keys returns the keys matching the regular expression pattern.
+func (c *Client) Keys(ctx context.Context, pattern string) ([]string, error) {
+	var res []string
+	err := c.DoIdempotent(ctx, http.MethodGet, "/keys"+path(pattern), nil, nil, &res)
+	return res, err
+}
@@ -0,0 +1,185 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"proj1/internal/pkg/server"
+	"proj1/internal/pkg/storage"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestClient(t *testing.T, wrap func(http.Handler) http.Handler, opts ...Option) *Client {
+	gin.SetMode(gin.TestMode)
+	st, err := storage.NewSliceStorage("slice_storage.json")
+	if err != nil {
+		t.Fatalf("new storage: %v", err)
+	}
+
+	var handler http.Handler = server.New("", &st).Handler()
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	c, err := New(ts.URL, opts...)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	return c
+}
+
+func TestClientRoutes(t *testing.T) {
+	c := newTestClient(t, nil)
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "greeting", "hello world", 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if v, err := c.Get(ctx, "greeting"); v != "hello world" || err != nil {
+		t.Errorf("get: %q %v", v, err)
+	}
+	if err := c.SetInt(ctx, "n", 42, time.Minute); err != nil {
+		t.Fatalf("set int: %v", err)
+	}
+	if v, _ := c.Get(ctx, "n"); v != "42" {
+		t.Errorf("get int: %q", v)
+	}
+
+	if n, err := c.HSet(ctx, "user", map[string]string{"name": "ann", "city": "Riga"}); n != 2 || err != nil {
+		t.Errorf("hset: %d %v", n, err)
+	}
+	if v, err := c.HGet(ctx, "user", "city"); v != "Riga" || err != nil {
+		t.Errorf("hget: %q %v", v, err)
+	}
+
+	if err := c.RPush(ctx, "list", "a", "b", "c", "d", "e"); err != nil {
+		t.Fatalf("rpush: %v", err)
+	}
+	if err := c.LPush(ctx, "list", "z"); err != nil {
+		t.Fatalf("lpush: %v", err)
+	}
+	if err := c.LSet(ctx, "list", 1, "A"); err != nil {
+		t.Fatalf("lset: %v", err)
+	}
+	if v, err := c.LGet(ctx, "list", -1); v != "e" || err != nil {
+		t.Errorf("lget: %q %v", v, err)
+	}
+	if res, _ := c.LPop(ctx, "list", 2); !reflect.DeepEqual(res, []string{"z", "A"}) {
+		t.Errorf("lpop: %v", res)
+	}
+	if res, _ := c.RPop(ctx, "list", 1); !reflect.DeepEqual(res, []string{"e"}) {
+		t.Errorf("rpop: %v", res)
+	}
+	if res, _ := c.LPopRange(ctx, "list", 1, 2); !reflect.DeepEqual(res, []string{"c", "d"}) {
+		t.Errorf("lpop range: %v", res)
+	}
+
+	if err := c.Expire(ctx, "user", time.Hour); err != nil {
+		t.Errorf("expire: %v", err)
+	}
+	keys, err := c.Keys(ctx, "^gr")
+	if err != nil || !reflect.DeepEqual(keys, []string{"greeting"}) {
+		t.Errorf("keys: %v %v", keys, err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	c := newTestClient(t, nil)
+	ctx := context.Background()
+
+	_, err := c.Get(ctx, "missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("get missing: %v", err)
+	}
+
+	if _, err = c.LPop(ctx, "missing", 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("lpop missing: %v", err)
+	}
+
+	err = c.Expire(ctx, "missing", time.Second)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest || apiErr.Message != "invalid key" {
+		t.Errorf("expire missing: %v", err)
+	}
+	if !errors.Is(err, ErrBadRequest) || errors.Is(err, ErrNotFound) {
+		t.Errorf("expire missing matches wrong errors: %v", err)
+	}
+
+	c.Set(ctx, "short", "x", time.Second)
+	time.Sleep(1100 * time.Millisecond)
+	if _, err = c.Get(ctx, "short"); !errors.Is(err, ErrExpired) {
+		t.Errorf("get expired: %v", err)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var calls, failures atomic.Int32
+	failures.Store(2)
+	flaky := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			if failures.Add(-1) >= 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`{"error":"no leader"}`))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	c := newTestClient(t, flaky, WithBackoff(time.Millisecond, 5*time.Millisecond))
+	ctx := context.Background()
+	if err := c.Set(ctx, "job", "1", 0); err != nil {
+		t.Fatalf("set after retries: %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 calls, got %d", calls.Load())
+	}
+	if v, _ := c.Get(ctx, "job"); v != "1" {
+		t.Errorf("set %q", v)
+	}
+
+	// Pushes and pops are not idempotent, so they are sent once.
+	calls.Store(0)
+	failures.Store(1)
+	if err := c.RPush(ctx, "jobs", "1"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("rpush while unavailable: %v", err)
+	}
+	if _, err := c.LPop(ctx, "jobs", 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("lpop: %v", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("retried a push: %d calls", calls.Load())
+	}
+
+	// Client errors are not retried, and retries give up eventually.
+	calls.Store(0)
+	c.Get(ctx, "missing")
+	if calls.Load() != 1 {
+		t.Errorf("retried a 404: %d calls", calls.Load())
+	}
+
+	calls.Store(0)
+	failures.Store(100)
+	err := c.Set(ctx, "k", "v", 0)
+	if !errors.Is(err, ErrUnavailable) || err.Error() != "storage: 503 no leader" {
+		t.Errorf("set while unavailable: %v", err)
+	}
+	if calls.Load() != DefaultRetries+1 {
+		t.Errorf("expected %d calls, got %d", DefaultRetries+1, calls.Load())
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err = c.Set(ctx, "k", "v", 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled context: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrExpired     = errors.New("element has expired")
+	ErrBadRequest  = errors.New("bad request")
+	ErrOOM         = errors.New("out of memory")
+	ErrUnavailable = errors.New("service unavailable")
+)
+
+// Error is a response of the server with a status other than 2xx. Message
+// is the error of the JSON body, if there was one. It matches the sentinel
+// errors above with errors.Is.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("storage: %d %s", e.Status, http.StatusText(e.Status))
+	}
+
+	return fmt.Sprintf("storage: %d %s", e.Status, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Status == http.StatusNotFound
+	case ErrExpired:
+		return e.Status == http.StatusBadRequest && e.Message == ErrExpired.Error()
+	case ErrBadRequest:
+		return e.Status == http.StatusBadRequest
+	case ErrOOM:
+		return e.Status == http.StatusInsufficientStorage
+	case ErrUnavailable:
+		return e.Status == http.StatusServiceUnavailable
+	}
+
+	return false
+}
+
+// retryable reports whether the request may succeed when it is sent again:
+// server errors except the ones that will not go away by themselves.
+func (e *Error) retryable() bool {
+	return e.Status >= 500 && e.Status != http.StatusNotImplemented && e.Status != http.StatusInsufficientStorage
+}